@@ -0,0 +1,236 @@
+// Package adaptive provides a cache choosing its admission policy at run
+// time. Small shadow caches, one per policy, replay a sample of the key
+// traffic, and the main cache follows the policy whose shadow has recently
+// hit more often. This suits workloads whose access pattern is unknown in
+// advance or changes over time, such as recency-friendly bursts alternating
+// with scans over large key ranges.
+package adaptive
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/0xsoniclabs/cacheutils/simplewlru"
+	"github.com/0xsoniclabs/cacheutils/sketch"
+	"github.com/0xsoniclabs/cacheutils/wlru"
+)
+
+// Policy names an admission policy.
+type Policy int
+
+const (
+	// PolicyLRU admits every new entry, evicting the least recently used
+	// ones to make room.
+	PolicyLRU Policy = iota
+	// PolicyLFU admits a new entry only if its key has been requested at
+	// least as often as the key of the entry it would displace, as estimated
+	// by a frequency sketch.
+	PolicyLFU
+)
+
+// String returns the name of the policy.
+func (p Policy) String() string {
+	switch p {
+	case PolicyLRU:
+		return "lru"
+	case PolicyLFU:
+		return "lfu"
+	}
+	return fmt.Sprintf("Policy(%d)", int(p))
+}
+
+const (
+	defaultSampling = 8       // one in defaultSampling keys is replayed
+	minShadowSize   = 16      // lower bound of the shadow cache size
+	maxShadowSize   = 1 << 16 // upper bound of the shadow cache size
+)
+
+// Cache is a weighted cache switching between admission policies, see the
+// package documentation. It is safe for concurrent use.
+type Cache struct {
+	cache     *wlru.Cache
+	cacheOpts []wlru.Option
+	maxWeight uint
+	maxSize   int
+	freq      *sketch.CountMin
+	hasher    wlru.Hasher
+	sampling  int
+	policy    atomic.Int32
+
+	lock       sync.Mutex           // guards the fields below
+	shadows    [2]*simplewlru.Cache // indexed by policy, counting entries
+	shadowSize int
+	hits       [2]int
+	lookups    int
+	interval   int // sampled lookups between policy decisions
+}
+
+var _ cacheutils.WeightedCache = (*Cache)(nil)
+
+// Option configures an adaptive cache.
+type Option func(*Cache)
+
+// WithSampling replays one in n keys in the shadow caches. Defaults to 8;
+// more frequent sampling decides more accurately at a higher cost.
+func WithSampling(n int) Option {
+	return func(c *Cache) {
+		c.sampling = n
+	}
+}
+
+// WithCacheOptions passes options on to the main cache, see wlru.New.
+func WithCacheOptions(opts ...wlru.Option) Option {
+	return func(c *Cache) {
+		c.cacheOpts = append(c.cacheOpts, opts...)
+	}
+}
+
+// WithHasher sets the hasher used for sampling keys and estimating their
+// frequencies. Defaults to wlru.MapHasher.
+func WithHasher(h wlru.Hasher) Option {
+	return func(c *Cache) {
+		c.hasher = h
+	}
+}
+
+// New creates an adaptive cache of the given size, starting with PolicyLRU.
+func New(maxWeight uint, maxSize int, opts ...Option) (*Cache, error) {
+	c := &Cache{
+		maxWeight: maxWeight,
+		maxSize:   maxSize,
+		hasher:    wlru.MapHasher,
+		sampling:  defaultSampling,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.hasher == nil {
+		return nil, errors.New("must provide a hasher")
+	}
+	if c.sampling <= 0 {
+		return nil, fmt.Errorf("%w: must provide a positive sampling", cacheutils.ErrInvalidSize)
+	}
+	var err error
+	if c.cache, err = wlru.New(maxWeight, maxSize, c.cacheOpts...); err != nil {
+		return nil, err
+	}
+	c.shadowSize = min(max(maxSize/c.sampling, minShadowSize), maxShadowSize)
+	for i := range c.shadows {
+		c.shadows[i], _ = simplewlru.New(uint(c.shadowSize), c.shadowSize)
+	}
+	c.interval = 10 * c.shadowSize
+	// The sketch tracks more keys than the cache holds, so that keys passing
+	// through the cache once are told apart from the ones it retains.
+	keys := min(max(maxSize, minShadowSize), maxShadowSize*c.sampling) * 10
+	if c.freq, err = sketch.New(keys, sketch.WithHasher(c.hasher)); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Policy returns the admission policy currently followed.
+func (c *Cache) Policy() Policy {
+	return Policy(c.policy.Load())
+}
+
+// Unwrap returns the main cache.
+func (c *Cache) Unwrap() *wlru.Cache {
+	return c.cache
+}
+
+// Get looks up a key's value from the cache, updating its recency and
+// frequency.
+func (c *Cache) Get(key interface{}) (value interface{}, ok bool) {
+	c.freq.Increment(key)
+	c.replay(key)
+	return c.cache.Get(key)
+}
+
+// Peek looks up a key's value without updating its recency or frequency.
+func (c *Cache) Peek(key interface{}) (value interface{}, ok bool) {
+	return c.cache.Peek(key)
+}
+
+// Contains checks if a key is in the cache without updating its recency or
+// frequency.
+func (c *Cache) Contains(key interface{}) bool {
+	return c.cache.Contains(key)
+}
+
+// Add adds a value to the cache, unless the current policy rejects it.
+// Updates of keys already in the cache are always accepted. Returns the
+// number of evictions.
+func (c *Cache) Add(key, value interface{}, weight uint) (evicted int) {
+	if !c.cache.Contains(key) && c.Policy() == PolicyLFU && !c.admit(key, weight) {
+		return 0
+	}
+	return c.cache.Add(key, value, weight)
+}
+
+// admit reports whether PolicyLFU admits a new entry into the main cache.
+func (c *Cache) admit(key interface{}, weight uint) bool {
+	if c.cache.Len() < c.maxSize && c.cache.Weight()+weight <= c.maxWeight {
+		return true
+	}
+	victim, _, ok := c.cache.GetOldest()
+	return !ok || c.freq.Estimate(key) >= c.freq.Estimate(victim)
+}
+
+// Remove removes the provided key from the cache, returning if the key was
+// contained.
+func (c *Cache) Remove(key interface{}) (present bool) {
+	return c.cache.Remove(key)
+}
+
+// Purge removes all entries from the cache. Frequencies and the policy are
+// kept.
+func (c *Cache) Purge() {
+	c.cache.Purge()
+}
+
+// Len returns the number of entries in the cache.
+func (c *Cache) Len() int {
+	return c.cache.Len()
+}
+
+// Weight returns the total weight of the entries in the cache.
+func (c *Cache) Weight() uint {
+	return c.cache.Weight()
+}
+
+// replay looks up key in the shadow caches if it is sampled, adding it on a
+// miss as the respective policy would, and switches policy once enough
+// lookups have been replayed.
+func (c *Cache) replay(key interface{}) {
+	if c.hasher.Hash(key)%uint64(c.sampling) != 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for p, shadow := range c.shadows {
+		if _, ok := shadow.Get(key); ok {
+			c.hits[p]++
+			continue
+		}
+		if Policy(p) == PolicyLFU && shadow.Len() >= c.shadowSize {
+			if victim, _, ok := shadow.GetOldest(); ok && c.freq.Estimate(key) < c.freq.Estimate(victim) {
+				continue
+			}
+		}
+		shadow.Add(key, nil, 1)
+	}
+	c.lookups++
+	if c.lookups < c.interval {
+		return
+	}
+	if c.hits[PolicyLFU] > c.hits[PolicyLRU] {
+		c.policy.Store(int32(PolicyLFU))
+	} else if c.hits[PolicyLRU] > c.hits[PolicyLFU] {
+		c.policy.Store(int32(PolicyLRU))
+	}
+	c.hits = [2]int{}
+	c.lookups = 0
+}
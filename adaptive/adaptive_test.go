@@ -0,0 +1,75 @@
+package adaptive
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/0xsoniclabs/cacheutils/wlru"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// access looks up key, adding it on a miss, and returns if it was a hit.
+func access(c *Cache, key int) bool {
+	if _, ok := c.Get(key); ok {
+		return true
+	}
+	c.Add(key, key, 1)
+	return false
+}
+
+func TestNew_ValidatesArguments(t *testing.T) {
+	_, err := New(10, 10, WithSampling(0))
+	assert.True(t, errors.Is(err, cacheutils.ErrInvalidSize))
+	_, err = New(10, 10, WithHasher(nil))
+	assert.Error(t, err)
+	_, err = New(10, -1)
+	assert.True(t, errors.Is(err, cacheutils.ErrInvalidSize))
+}
+
+func TestPolicy_String(t *testing.T) {
+	assert.Equal(t, "lru", PolicyLRU.String())
+	assert.Equal(t, "lfu", PolicyLFU.String())
+	assert.Equal(t, "Policy(7)", Policy(7).String())
+}
+
+func TestCache_SwitchesToLFUUnderScans(t *testing.T) {
+	c, err := New(1000, 1000, WithSampling(1), WithHasher(wlru.XXHasher), WithCacheOptions(wlru.WithHasher(wlru.XXHasher)))
+	require.NoError(t, err)
+	assert.Equal(t, PolicyLRU, c.Policy())
+
+	scan := 1_000_000
+	hits := 0
+	for i := 0; i < 2000; i++ {
+		if access(c, i%100) && i >= 1000 {
+			hits++
+		}
+		for j := 0; j < 20; j++ {
+			access(c, scan)
+			scan++
+		}
+	}
+	assert.Equal(t, PolicyLFU, c.Policy())
+	assert.Greater(t, hits, 900)
+	assert.Equal(t, 1000, c.Len())
+}
+
+func TestCache_StaysLRUForRecency(t *testing.T) {
+	c, err := New(1000, 1000, WithSampling(1))
+	require.NoError(t, err)
+
+	for i := 0; i < 20000; i++ {
+		access(c, i/4)
+	}
+	assert.Equal(t, PolicyLRU, c.Policy())
+	value, ok := c.Peek(4999)
+	assert.True(t, ok)
+	assert.Equal(t, 4999, value)
+	assert.True(t, c.Contains(4999))
+	assert.True(t, c.Remove(4999))
+	assert.Same(t, c.Unwrap(), c.cache)
+	c.Purge()
+	assert.Zero(t, c.Len())
+	assert.Zero(t, c.Weight())
+}
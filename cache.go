@@ -0,0 +1,49 @@
+package cacheutils
+
+// Cache is the interface shared by all caches of this module, allowing
+// wrappers such as metrics, tiering or persistence to be written once.
+type Cache interface {
+	// Get looks up a key's value, marking the entry as used.
+	Get(key interface{}) (value interface{}, ok bool)
+	// Peek looks up a key's value without marking the entry as used.
+	Peek(key interface{}) (value interface{}, ok bool)
+	// Contains checks if a key is in the cache without marking it as used.
+	Contains(key interface{}) bool
+	// Remove removes a key from the cache, returning if it was contained.
+	Remove(key interface{}) (present bool)
+	// Purge removes all entries from the cache.
+	Purge()
+	// Len returns the number of entries in the cache.
+	Len() int
+}
+
+// WeightedCache is a Cache bounding the total weight of its entries.
+type WeightedCache interface {
+	Cache
+	// Add adds a value of the given weight to the cache, returning the
+	// number of evictions.
+	Add(key, value interface{}, weight uint) (evicted int)
+	// Weight returns the total weight of the entries in the cache.
+	Weight() uint
+}
+
+// ResizableCache is a WeightedCache whose limits can be changed.
+type ResizableCache interface {
+	WeightedCache
+	// Resize changes the weight and size limits of the cache, returning the
+	// number of evictions.
+	Resize(maxWeight uint, maxSize int) (evicted int)
+}
+
+// ReadOnlyCache is a view of a cache offering lookups only, for subsystems
+// which must never add, remove or evict entries.
+type ReadOnlyCache interface {
+	// Get looks up a key's value, marking the entry as used.
+	Get(key interface{}) (value interface{}, ok bool)
+	// Peek looks up a key's value without marking the entry as used.
+	Peek(key interface{}) (value interface{}, ok bool)
+	// Contains checks if a key is in the cache without marking it as used.
+	Contains(key interface{}) bool
+	// Keys returns the keys in the cache, from oldest to newest.
+	Keys() []interface{}
+}
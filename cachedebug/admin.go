@@ -0,0 +1,110 @@
+package cachedebug
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Admin serves operations changing registered caches, so operators can
+// intervene without restarting the process. Operations are requested by POST
+// with the form values cache, naming the cache, and op:
+//
+//	purge       removes all entries
+//	resize      sets the limits given by the weight and size values
+//	invalidate  removes the entries with keys starting with the prefix value
+//	snapshot    takes a snapshot of the cache using the Snapshot function
+//
+// Keys are matched against the prefix as rendered by fmt.
+type Admin struct {
+	// Authorize reports whether the request may perform operations. Requests
+	// are rejected if it is nil.
+	Authorize func(r *http.Request) bool
+	// Snapshot, if set, takes a snapshot of the named cache.
+	Snapshot func(name string) error
+}
+
+// BearerToken returns an authorization function accepting requests carrying
+// the token in a bearer Authorization header.
+func BearerToken(token string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		return ok && token != "" && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+	}
+}
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if a.Authorize == nil || !a.Authorize(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	name := r.FormValue("cache")
+	c, ok := Lookup(name)
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown cache %q", name), http.StatusNotFound)
+		return
+	}
+	switch op := r.FormValue("op"); op {
+	case "purge":
+		c.Purge()
+		writeJSON(w, info(name, c))
+	case "resize":
+		weight, err := strconv.ParseUint(r.FormValue("weight"), 10, 0)
+		if err != nil || weight == 0 {
+			http.Error(w, "invalid weight", http.StatusBadRequest)
+			return
+		}
+		size, err := strconv.Atoi(r.FormValue("size"))
+		if err != nil || size <= 0 {
+			http.Error(w, "invalid size", http.StatusBadRequest)
+			return
+		}
+		evicted := c.Resize(uint(weight), size)
+		writeJSON(w, struct {
+			CacheInfo
+			Evicted int `json:"evicted"`
+		}{info(name, c), evicted})
+	case "invalidate":
+		prefix := r.FormValue("prefix")
+		if prefix == "" {
+			http.Error(w, "missing prefix", http.StatusBadRequest)
+			return
+		}
+		removed := 0
+		for _, key := range c.Keys() {
+			if strings.HasPrefix(keyString(key), prefix) && c.Remove(key) {
+				removed++
+			}
+		}
+		writeJSON(w, struct {
+			CacheInfo
+			Removed int `json:"removed"`
+		}{info(name, c), removed})
+	case "snapshot":
+		if a.Snapshot == nil {
+			http.Error(w, "snapshots not configured", http.StatusNotImplemented)
+			return
+		}
+		if err := a.Snapshot(name); err != nil {
+			http.Error(w, fmt.Sprintf("snapshot failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, info(name, c))
+	default:
+		http.Error(w, fmt.Sprintf("unknown operation %q", op), http.StatusBadRequest)
+	}
+}
+
+func keyString(key interface{}) string {
+	if s, ok := key.(string); ok {
+		return s
+	}
+	return fmt.Sprint(key)
+}
@@ -0,0 +1,87 @@
+package cachedebug
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/0xsoniclabs/cacheutils/wlru"
+	"github.com/stretchr/testify/assert"
+)
+
+func post(a *Admin, token string, form url.Values) int {
+	req := httptest.NewRequest(http.MethodPost, "/debug/caches/admin", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestAdmin_RequiresAuthorization(t *testing.T) {
+	c, _ := wlru.New(100, 100)
+	c.Add("a", 1, 1)
+	Register("c", c)
+	defer Unregister("c")
+	purge := url.Values{"cache": {"c"}, "op": {"purge"}}
+
+	assert.Equal(t, http.StatusUnauthorized, post(&Admin{}, "secret", purge))
+	a := &Admin{Authorize: BearerToken("secret")}
+	assert.Equal(t, http.StatusUnauthorized, post(a, "", purge))
+	assert.Equal(t, http.StatusUnauthorized, post(a, "wrong", purge))
+	assert.Equal(t, 1, c.Len())
+	assert.Equal(t, http.StatusOK, post(a, "secret", purge))
+	assert.Equal(t, 0, c.Len())
+
+	assert.False(t, BearerToken("")(httptest.NewRequest(http.MethodPost, "/", nil)))
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func TestAdmin_Operations(t *testing.T) {
+	c, _ := wlru.New(100, 100)
+	for _, key := range []string{"user:1", "user:2", "block:1"} {
+		c.Add(key, key, 10)
+	}
+	Register("c", c)
+	defer Unregister("c")
+	var snapshots []string
+	a := &Admin{
+		Authorize: func(*http.Request) bool { return true },
+		Snapshot: func(name string) error {
+			snapshots = append(snapshots, name)
+			if len(snapshots) > 1 {
+				return errors.New("disk full")
+			}
+			return nil
+		},
+	}
+
+	assert.Equal(t, http.StatusOK, post(a, "", url.Values{"cache": {"c"}, "op": {"invalidate"}, "prefix": {"user:"}}))
+	assert.Equal(t, []interface{}{"block:1"}, c.Keys())
+
+	c.Add("user:3", "user:3", 10)
+	assert.Equal(t, http.StatusOK, post(a, "", url.Values{"cache": {"c"}, "op": {"resize"}, "weight": {"10"}, "size": {"10"}}))
+	assert.Equal(t, []interface{}{"user:3"}, c.Keys())
+
+	assert.Equal(t, http.StatusOK, post(a, "", url.Values{"cache": {"c"}, "op": {"snapshot"}}))
+	assert.Equal(t, http.StatusInternalServerError, post(a, "", url.Values{"cache": {"c"}, "op": {"snapshot"}}))
+	assert.Equal(t, []string{"c", "c"}, snapshots)
+	assert.Equal(t, http.StatusNotImplemented, post(&Admin{Authorize: a.Authorize}, "", url.Values{"cache": {"c"}, "op": {"snapshot"}}))
+
+	for _, form := range []url.Values{
+		{"cache": {"c"}, "op": {"resize"}, "weight": {"0"}, "size": {"10"}},
+		{"cache": {"c"}, "op": {"resize"}, "weight": {"10"}, "size": {"-1"}},
+		{"cache": {"c"}, "op": {"invalidate"}},
+		{"cache": {"c"}, "op": {"drop"}},
+	} {
+		assert.Equal(t, http.StatusBadRequest, post(a, "", form), form)
+	}
+	assert.Equal(t, http.StatusNotFound, post(a, "", url.Values{"cache": {"missing"}, "op": {"purge"}}))
+}
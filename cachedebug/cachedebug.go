@@ -0,0 +1,190 @@
+// Package cachedebug serves the contents of registered caches over HTTP for
+// live troubleshooting, in the spirit of net/http/pprof.
+//
+// Mount the handler on a debug mux:
+//
+//	cachedebug.Register("blocks", cache)
+//	mux.Handle("/debug/caches", cachedebug.Handler())
+//
+// A request without parameters lists the registered caches. The cache
+// parameter selects a cache and lists its entries from newest to oldest,
+// paginated by the offset and limit parameters. Operations changing caches
+// are served separately by an authenticated Admin handler.
+package cachedebug
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/0xsoniclabs/cacheutils/wlru"
+)
+
+// DefaultLimit is the number of entries listed per page if the request does
+// not specify a limit.
+const DefaultLimit = 100
+
+// MaxLimit bounds the number of entries listed per page.
+const MaxLimit = 10000
+
+var (
+	registryLock sync.RWMutex
+	registry     = map[string]*wlru.Cache{}
+)
+
+// Register makes the cache available to the handler under the given name.
+// It panics if the name is already registered.
+func Register(name string, c *wlru.Cache) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, exists := registry[name]; exists {
+		panic(fmt.Sprintf("cachedebug: cache %q already registered", name))
+	}
+	registry[name] = c
+}
+
+// Unregister removes the cache registered under the given name.
+func Unregister(name string) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	delete(registry, name)
+}
+
+// Lookup returns the cache registered under the given name.
+func Lookup(name string) (*wlru.Cache, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	c, ok := registry[name]
+	return c, ok
+}
+
+// CacheInfo summarizes a registered cache. Lookups are only reported for
+// caches tracking hits.
+type CacheInfo struct {
+	Name    string       `json:"name"`
+	Len     int          `json:"len"`
+	Weight  uint         `json:"weight"`
+	Lookups *LookupStats `json:"lookups,omitempty"`
+}
+
+// LookupStats counts the Get calls of a cache which hit and missed.
+type LookupStats struct {
+	Hits     uint64  `json:"hits"`
+	Misses   uint64  `json:"misses"`
+	HitRatio float64 `json:"hitRatio"`
+}
+
+// EntryInfo describes a cache entry. Keys are rendered with fmt.
+type EntryInfo struct {
+	Key    string        `json:"key"`
+	Weight uint          `json:"weight"`
+	Age    time.Duration `json:"age"`
+}
+
+// Page is a page of the entries of a cache, from newest to oldest.
+type Page struct {
+	CacheInfo
+	Offset  int         `json:"offset"`
+	Limit   int         `json:"limit"`
+	Entries []EntryInfo `json:"entries"`
+}
+
+// Handler returns a handler serving the registered caches as JSON.
+func Handler() http.Handler {
+	return http.HandlerFunc(serve)
+}
+
+func serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	name := query.Get("cache")
+	if name == "" {
+		writeJSON(w, caches())
+		return
+	}
+	c, ok := Lookup(name)
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown cache %q", name), http.StatusNotFound)
+		return
+	}
+	offset, err := intParam(query.Get("offset"), 0)
+	if err != nil {
+		http.Error(w, "invalid offset", http.StatusBadRequest)
+		return
+	}
+	limit, err := intParam(query.Get("limit"), DefaultLimit)
+	if err != nil || limit == 0 {
+		http.Error(w, "invalid limit", http.StatusBadRequest)
+		return
+	}
+	if limit > MaxLimit {
+		limit = MaxLimit
+	}
+	writeJSON(w, page(name, c, offset, limit))
+}
+
+func caches() []CacheInfo {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	infos := make([]CacheInfo, 0, len(registry))
+	for name, c := range registry {
+		infos = append(infos, info(name, c))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+func info(name string, c *wlru.Cache) CacheInfo {
+	weight, num := c.Total()
+	ci := CacheInfo{Name: name, Len: num, Weight: weight}
+	if c.TracksHits() {
+		var total wlru.ShardStats
+		for _, s := range c.ShardStats() {
+			total.Hits += s.Hits
+			total.Misses += s.Misses
+		}
+		ci.Lookups = &LookupStats{Hits: total.Hits, Misses: total.Misses, HitRatio: total.HitRatio()}
+	}
+	return ci
+}
+
+func page(name string, c *wlru.Cache, offset, limit int) Page {
+	if n := c.Len(); offset > n {
+		offset = n
+	}
+	// Snapshot lists entries from oldest to newest, so the newest entries up
+	// to the end of the page are taken and listed in reverse.
+	entries := c.Snapshot(wlru.SnapshotFilter{MaxEntries: offset + limit})
+	p := Page{CacheInfo: info(name, c), Offset: offset, Limit: limit, Entries: []EntryInfo{}}
+	for i := len(entries) - 1 - offset; i >= 0; i-- {
+		e := entries[i]
+		p.Entries = append(p.Entries, EntryInfo{Key: keyString(e.Key), Weight: e.Weight, Age: e.Age})
+	}
+	return p
+}
+
+func intParam(s string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid parameter %q", s)
+	}
+	return n, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
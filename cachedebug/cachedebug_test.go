@@ -0,0 +1,107 @@
+package cachedebug
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/0xsoniclabs/cacheutils/wlru"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func get(t *testing.T, url string, v interface{}) int {
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+	if rec.Code == http.StatusOK && v != nil {
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), v))
+	}
+	return rec.Code
+}
+
+func TestHandler_ListsCaches(t *testing.T) {
+	a, _ := wlru.New(100, 100)
+	b, _ := wlru.New(100, 100)
+	a.Add(1, "one", 3)
+	Register("b", b)
+	defer Unregister("b")
+	Register("a", a)
+	defer Unregister("a")
+	assert.Panics(t, func() { Register("a", a) })
+
+	var infos []CacheInfo
+	require.Equal(t, http.StatusOK, get(t, "/debug/caches", &infos))
+	assert.Equal(t, []CacheInfo{{Name: "a", Len: 1, Weight: 3}, {Name: "b"}}, infos)
+}
+
+func TestHandler_ReportsLookups(t *testing.T) {
+	c, _ := wlru.New(100, 100, wlru.WithHitTracking())
+	c.Add(1, "one", 1)
+	c.Get(1)
+	c.Get(1)
+	c.Get(1)
+	c.Get(2)
+	Register("c", c)
+	defer Unregister("c")
+
+	var infos []CacheInfo
+	require.Equal(t, http.StatusOK, get(t, "/debug/caches", &infos))
+	require.Len(t, infos, 1)
+	assert.Equal(t, &LookupStats{Hits: 3, Misses: 1, HitRatio: 0.75}, infos[0].Lookups)
+
+	var p Page
+	require.Equal(t, http.StatusOK, get(t, "/?cache=c", &p))
+	assert.Equal(t, infos[0], p.CacheInfo)
+}
+
+func TestHandler_PaginatesEntries(t *testing.T) {
+	c, _ := wlru.New(100, 100)
+	for i := 0; i < 5; i++ {
+		c.Add(i, i, uint(i+1))
+	}
+	Register("c", c)
+	defer Unregister("c")
+
+	keys := func(p Page) []string {
+		var keys []string
+		for _, e := range p.Entries {
+			keys = append(keys, e.Key)
+		}
+		return keys
+	}
+
+	var p Page
+	require.Equal(t, http.StatusOK, get(t, "/?cache=c", &p))
+	assert.Equal(t, []string{"4", "3", "2", "1", "0"}, keys(p))
+	assert.Equal(t, CacheInfo{Name: "c", Len: 5, Weight: 15}, p.CacheInfo)
+	assert.Equal(t, DefaultLimit, p.Limit)
+	assert.Equal(t, uint(5), p.Entries[0].Weight)
+
+	p = Page{}
+	require.Equal(t, http.StatusOK, get(t, "/?cache=c&offset=1&limit=2", &p))
+	assert.Equal(t, []string{"3", "2"}, keys(p))
+
+	p = Page{}
+	require.Equal(t, http.StatusOK, get(t, "/?cache=c&offset=4&limit=2", &p))
+	assert.Equal(t, []string{"0"}, keys(p))
+
+	p = Page{}
+	require.Equal(t, http.StatusOK, get(t, "/?cache=c&offset=10", &p))
+	assert.Empty(t, p.Entries)
+}
+
+func TestHandler_RejectsInvalidRequests(t *testing.T) {
+	c, _ := wlru.New(100, 100)
+	Register("c", c)
+	defer Unregister("c")
+
+	assert.Equal(t, http.StatusNotFound, get(t, "/?cache=missing", nil))
+	assert.Equal(t, http.StatusBadRequest, get(t, "/?cache=c&offset=-1", nil))
+	assert.Equal(t, http.StatusBadRequest, get(t, "/?cache=c&limit=x", nil))
+	assert.Equal(t, http.StatusBadRequest, get(t, "/?cache=c&limit=0", nil))
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
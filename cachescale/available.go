@@ -0,0 +1,70 @@
+package cachescale
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/0xsoniclabs/cacheutils"
+)
+
+// availableMemory returns the memory available to new allocations of the
+// system in bytes, replaced by tests.
+var availableMemory = readAvailableMemory
+
+// PercentOfAvailable returns a ratio scaling cache sizes configured for base
+// bytes of memory to the given percentage of the memory currently available
+// on the system. Unlike a share of the total memory, this accounts for the
+// memory taken by co-located processes, so that they are not over-committed.
+// The memory is sampled once; call it again to follow changes.
+func PercentOfAvailable(pct float64, base uint64) (Ratio, error) {
+	if !(pct > 0 && pct <= 100) {
+		return Identity, errors.New("percentage must be in the range (0, 100]")
+	}
+	if base == 0 {
+		return Identity, fmt.Errorf("%w: must provide a positive base", cacheutils.ErrInvalidSize)
+	}
+	available, err := availableMemory()
+	if err != nil {
+		return Identity, err
+	}
+	target := uint64(float64(available) * pct / 100)
+	if target == 0 {
+		return Identity, errors.New("no memory available")
+	}
+	return reduce(base, target), nil
+}
+
+// reduce returns the ratio of target to base in lowest terms. Scaling by a
+// Ratio does not overflow whatever its terms, so no precision is given up.
+func reduce(base, target uint64) Ratio {
+	a, b := base, target
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return Ratio{Base: base / a, Target: target / a}
+}
+
+// parseMemAvailable reads the available memory in bytes from the contents
+// of /proc/meminfo.
+func parseMemAvailable(r io.Reader) (uint64, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[0] != "MemAvailable:" || fields[2] != "kB" {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid available memory: %w", err)
+		}
+		return kb << 10, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, errors.New("available memory not reported")
+}
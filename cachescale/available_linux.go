@@ -0,0 +1,14 @@
+package cachescale
+
+import "os"
+
+// readAvailableMemory returns the memory the kernel estimates to be
+// available for starting new applications without swapping.
+func readAvailableMemory() (uint64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return parseMemAvailable(f)
+}
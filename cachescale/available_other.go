@@ -0,0 +1,11 @@
+//go:build !linux
+
+package cachescale
+
+import "errors"
+
+// readAvailableMemory reports that the available memory cannot be sampled
+// on this platform.
+func readAvailableMemory() (uint64, error) {
+	return 0, errors.New("available memory is only known on Linux")
+}
@@ -0,0 +1,71 @@
+package cachescale
+
+import (
+	"errors"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMemAvailable(t *testing.T) {
+	available, err := parseMemAvailable(strings.NewReader("MemTotal:       16000000 kB\nMemFree:         1000000 kB\nMemAvailable:    8000000 kB\n"))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(8000000<<10), available)
+
+	_, err = parseMemAvailable(strings.NewReader("MemTotal:       16000000 kB\n"))
+	assert.Error(t, err)
+	_, err = parseMemAvailable(strings.NewReader("MemAvailable:    lots kB\n"))
+	assert.Error(t, err)
+}
+
+func TestPercentOfAvailable(t *testing.T) {
+	previous := availableMemory
+	defer func() { availableMemory = previous }()
+	availableMemory = func() (uint64, error) { return 8 << 30, nil }
+
+	r, err := PercentOfAvailable(25, 1<<30)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2000), r.U64(1000))
+	assert.Equal(t, uint64(2<<40), r.U64(1<<40), "large values do not overflow")
+
+	// Ratios far from 1 keep their precision in both directions.
+	availableMemory = func() (uint64, error) { return 16 << 30, nil }
+	r, err = PercentOfAvailable(100, 1)
+	require.NoError(t, err)
+	assert.Equal(t, Ratio{Base: 1, Target: 16 << 30}, r)
+	assert.Equal(t, uint64(3<<34), r.U64(3))
+	r, err = PercentOfAvailable(100, 1<<50)
+	require.NoError(t, err)
+	assert.Equal(t, Ratio{Base: 1 << 16, Target: 1}, r)
+	assert.Equal(t, uint64(3), r.U64(3<<16))
+	availableMemory = func() (uint64, error) { return 2000000, nil }
+	r, err = PercentOfAvailable(100, 1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2000000), r.U64(1))
+
+	for _, pct := range []float64{0, -1, 101} {
+		_, err = PercentOfAvailable(pct, 1<<30)
+		assert.Error(t, err)
+	}
+	_, err = PercentOfAvailable(25, 0)
+	assert.ErrorIs(t, err, cacheutils.ErrInvalidSize)
+
+	availableMemory = func() (uint64, error) { return 0, errors.New("unknown") }
+	r, err = PercentOfAvailable(25, 1<<30)
+	assert.Error(t, err)
+	assert.Equal(t, Identity, r)
+}
+
+func TestReadAvailableMemory(t *testing.T) {
+	available, err := readAvailableMemory()
+	if runtime.GOOS != "linux" {
+		assert.Error(t, err)
+		return
+	}
+	require.NoError(t, err)
+	assert.NotZero(t, available)
+}
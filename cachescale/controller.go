@@ -0,0 +1,299 @@
+package cachescale
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/0xsoniclabs/cacheutils/cachedebug"
+	"github.com/0xsoniclabs/cacheutils/clock"
+	"github.com/0xsoniclabs/cacheutils/internal/heapmon"
+	"github.com/0xsoniclabs/cacheutils/wlru"
+)
+
+// Defaults of the controller options.
+const (
+	DefaultThreshold      = 0.9
+	DefaultTargetHitRatio = 0.9
+	DefaultStep           = 0.1
+	DefaultMinScale       = 0.1
+	DefaultMaxScale       = 2.0
+)
+
+// ratioBase is the base of the ratios set by a controller.
+const ratioBase = 1000
+
+// Controller sizes caches of the cachedebug registry by a common Ratio,
+// which it periodically recomputes from their hit ratio and the heap size of
+// the process. While the heap exceeds a threshold fraction of a limit, the
+// ratio shrinks by a step. While the caches hit less often than a target hit
+// ratio and the heap leaves room for growing them, it grows by a step.
+// Otherwise, it is kept. Every change is applied to all caches.
+//
+// Caches take part once registered with the controller by their name in the
+// registry, along with the unscaled limits the ratio applies to, and leave
+// when unregistered from either. Their hits are counted if they track hits,
+// see wlru.WithHitTracking.
+type Controller struct {
+	limit          uint64
+	threshold      float64
+	targetHitRatio float64
+	step           float64
+	minTarget      uint64
+	maxTarget      uint64
+	clock          clock.Clock
+	readHeap       func() uint64
+
+	lock   sync.Mutex
+	caches []*registered
+	target uint64 // of the current ratio, over ratioBase
+	closed bool
+	loop   heapmon.Loop
+}
+
+// registered is a cache registered with a controller.
+type registered struct {
+	name               string
+	maxWeight          uint
+	maxSize            int
+	lastHits, lastMiss uint64
+}
+
+// Option configures optional behaviour of a Controller.
+type Option func(*Controller) error
+
+// WithThreshold sets the fraction of the limit above which the caches are
+// shrunk. The default is DefaultThreshold.
+func WithThreshold(fraction float64) Option {
+	return func(c *Controller) error {
+		if !(fraction > 0 && fraction <= 1) {
+			return errors.New("threshold must be in the range (0, 1]")
+		}
+		c.threshold = fraction
+		return nil
+	}
+}
+
+// WithTargetHitRatio sets the hit ratio below which the caches are grown if
+// memory permits. The default is DefaultTargetHitRatio.
+func WithTargetHitRatio(ratio float64) Option {
+	return func(c *Controller) error {
+		if !(ratio > 0 && ratio <= 1) {
+			return errors.New("target hit ratio must be in the range (0, 1]")
+		}
+		c.targetHitRatio = ratio
+		return nil
+	}
+}
+
+// WithStep sets the fraction by which the ratio changes per update. The
+// default is DefaultStep.
+func WithStep(fraction float64) Option {
+	return func(c *Controller) error {
+		if !(fraction > 0 && fraction < 1) {
+			return errors.New("step must be in the range (0, 1)")
+		}
+		c.step = fraction
+		return nil
+	}
+}
+
+// WithBounds sets the range of the ratio, as multiples of the registered
+// sizes. The defaults are DefaultMinScale and DefaultMaxScale.
+func WithBounds(minScale, maxScale float64) Option {
+	return func(c *Controller) error {
+		if !(minScale > 0 && minScale <= 1 && maxScale >= 1 && maxScale <= 1000) {
+			return errors.New("bounds must satisfy 0 < min <= 1 <= max <= 1000")
+		}
+		c.minTarget = uint64(math.Ceil(minScale * ratioBase))
+		c.maxTarget = uint64(maxScale * ratioBase)
+		return nil
+	}
+}
+
+// WithClock sets the clock driving the controller. The default is
+// clock.Real.
+func WithClock(clk clock.Clock) Option {
+	return func(c *Controller) error {
+		if clk == nil {
+			return errors.New("must provide a clock")
+		}
+		c.clock = clk
+		return nil
+	}
+}
+
+// NewController creates a controller for the given heap limit in bytes,
+// starting with the Identity ratio. A limit of 0 uses the soft memory limit
+// of the runtime, as set by GOMEMLIMIT, which must then be configured.
+func NewController(limit uint64, opts ...Option) (*Controller, error) {
+	limit, err := heapmon.Limit(limit)
+	if err != nil {
+		return nil, err
+	}
+	c := &Controller{
+		limit:          limit,
+		threshold:      DefaultThreshold,
+		targetHitRatio: DefaultTargetHitRatio,
+		step:           DefaultStep,
+		minTarget:      uint64(DefaultMinScale * ratioBase),
+		maxTarget:      uint64(DefaultMaxScale * ratioBase),
+		clock:          clock.Real,
+		readHeap:       heapmon.Size,
+		target:         ratioBase,
+	}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Register makes the controller size the cache registered with cachedebug
+// under the given name, resizing it by the current ratio of the given
+// unscaled limits. Returns the number of evictions, or an error if no cache
+// is registered under the name or the controller already sizes it.
+func (c *Controller) Register(name string, maxWeight uint, maxSize int) (evicted int, err error) {
+	cache, ok := cachedebug.Lookup(name)
+	if !ok {
+		return 0, fmt.Errorf("no cache registered as %q", name)
+	}
+	r := &registered{name: name, maxWeight: maxWeight, maxSize: maxSize}
+	r.lastHits, r.lastMiss = lookups(cache)
+	c.lock.Lock()
+	for _, other := range c.caches {
+		if other.name == name {
+			c.lock.Unlock()
+			return 0, fmt.Errorf("cache %q already registered", name)
+		}
+	}
+	c.caches = append(c.caches, r)
+	c.lock.Unlock()
+	return c.apply([]*registered{r}), nil
+}
+
+// Unregister stops sizing the cache registered under the given name,
+// leaving its limits as they are.
+func (c *Controller) Unregister(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i, r := range c.caches {
+		if r.name == name {
+			c.caches = append(c.caches[:i], c.caches[i+1:]...)
+			return
+		}
+	}
+}
+
+// lookups returns the numbers of Get calls of a cache which hit and missed,
+// or zeros if it does not track hits.
+func lookups(cache *wlru.Cache) (hits, misses uint64) {
+	if !cache.TracksHits() {
+		return 0, 0
+	}
+	for _, s := range cache.ShardStats() {
+		hits += s.Hits
+		misses += s.Misses
+	}
+	return hits, misses
+}
+
+// Ratio returns the ratio currently applied to the registered caches.
+func (c *Controller) Ratio() Ratio {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return Ratio{Base: ratioBase, Target: c.target}
+}
+
+// Update recomputes the ratio from the hits and misses since the last update
+// and the current heap size, and resizes the caches if it changed. Returns
+// the number of evictions.
+func (c *Controller) Update() (evicted int) {
+	heap := float64(c.readHeap())
+	c.lock.Lock()
+	var hits, misses uint64
+	for _, r := range c.caches {
+		cache, ok := cachedebug.Lookup(r.name)
+		if !ok {
+			continue
+		}
+		h, m := lookups(cache)
+		// Counters going back belong to a cache registered anew.
+		if h >= r.lastHits && m >= r.lastMiss {
+			hits += h - r.lastHits
+			misses += m - r.lastMiss
+		}
+		r.lastHits, r.lastMiss = h, m
+	}
+
+	target := c.target
+	delta := max(uint64(float64(target)*c.step), 1)
+	threshold := c.threshold * float64(c.limit)
+	switch {
+	case heap > threshold:
+		target -= min(delta, target)
+	case hits+misses > 0 && float64(hits) < c.targetHitRatio*float64(hits+misses) && heap*(1+c.step) <= threshold:
+		target += delta
+	}
+	target = min(max(target, c.minTarget), c.maxTarget)
+	if target == c.target {
+		c.lock.Unlock()
+		return 0
+	}
+	c.target = target
+	caches := append([]*registered(nil), c.caches...)
+	c.lock.Unlock()
+	return c.apply(caches)
+}
+
+// apply resizes the given caches by the current ratio. It must be called
+// without holding the lock, as resizing runs eviction callbacks, which may
+// use the controller. The ratio is read per cache, so that concurrent
+// updates leave every cache sized by the latest one.
+func (c *Controller) apply(caches []*registered) (evicted int) {
+	for _, r := range caches {
+		cache, ok := cachedebug.Lookup(r.name)
+		if !ok {
+			continue
+		}
+		ratio := c.Ratio()
+		evicted += cache.Resize(ratio.U(r.maxWeight), ratio.I(r.maxSize))
+	}
+	return evicted
+}
+
+// Start updates the ratio every interval in the background until Stop or
+// Close is called. It fails with ErrClosed once the controller is closed.
+func (c *Controller) Start(interval time.Duration) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return cacheutils.ErrClosed
+	}
+	return c.loop.Start(c.clock, interval, func() { c.Update() })
+}
+
+// Stop stops background updates and waits for an update in progress to
+// finish. It does nothing if the controller is not running.
+func (c *Controller) Stop() {
+	c.loop.Stop()
+}
+
+// Close stops background updates like Stop. Afterwards, Start fails with
+// ErrClosed, as does closing the controller again. Updates may still be
+// requested explicitly.
+func (c *Controller) Close() error {
+	c.lock.Lock()
+	closed := c.closed
+	c.closed = true
+	c.lock.Unlock()
+	if closed {
+		return cacheutils.ErrClosed
+	}
+	c.Stop()
+	return nil
+}
@@ -0,0 +1,185 @@
+package cachescale
+
+import (
+	"math"
+	"runtime/debug"
+	"testing"
+	"time"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/0xsoniclabs/cacheutils/cachedebug"
+	"github.com/0xsoniclabs/cacheutils/clock"
+	"github.com/0xsoniclabs/cacheutils/wlru"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestController(t *testing.T, heap *uint64, opts ...Option) (*Controller, *clock.Fake) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	c, err := NewController(1000, append(opts, WithClock(fake))...)
+	require.NoError(t, err)
+	c.readHeap = func() uint64 { return *heap }
+	return c, fake
+}
+
+// newRegisteredCache creates a cache tracking hits and registers it with
+// cachedebug under the name of the test and the given suffix.
+func newRegisteredCache(t *testing.T, suffix string, maxWeight uint, maxSize int) (*wlru.Cache, string) {
+	c, err := wlru.New(maxWeight, maxSize, wlru.WithHitTracking())
+	require.NoError(t, err)
+	name := t.Name() + suffix
+	cachedebug.Register(name, c)
+	t.Cleanup(func() { cachedebug.Unregister(name) })
+	return c, name
+}
+
+func TestNewController_Validates(t *testing.T) {
+	for _, opt := range []Option{
+		WithThreshold(0), WithThreshold(1.5), WithTargetHitRatio(0),
+		WithTargetHitRatio(2), WithStep(0), WithStep(1), WithBounds(0, 2),
+		WithBounds(1.5, 2), WithBounds(0.5, 0.9), WithClock(nil),
+	} {
+		_, err := NewController(1000, opt)
+		assert.Error(t, err)
+	}
+
+	previous := debug.SetMemoryLimit(-1)
+	defer debug.SetMemoryLimit(previous)
+	debug.SetMemoryLimit(math.MaxInt64)
+	_, err := NewController(0)
+	assert.ErrorIs(t, err, cacheutils.ErrInvalidSize)
+	debug.SetMemoryLimit(1 << 30)
+	c, err := NewController(0)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1<<30), c.limit)
+}
+
+func TestController_FollowsHitRatioAndHeap(t *testing.T) {
+	heap := uint64(500)
+	c, _ := newTestController(t, &heap, WithStep(0.5), WithBounds(0.25, 2))
+	cache, name := newRegisteredCache(t, "", 100, 100)
+	for i := 0; i < 100; i++ {
+		cache.Add(i, i, 1)
+	}
+	evicted, err := c.Register(name, 100, 100)
+	require.NoError(t, err)
+	assert.Equal(t, 0, evicted)
+	assert.Equal(t, Identity.F64(1), c.Ratio().F64(1))
+
+	// Without lookups, there is nothing to improve.
+	assert.Equal(t, 0, c.Update())
+	assert.Equal(t, uint64(1000), c.Ratio().Target)
+
+	// Missing often, the cache grows while memory permits.
+	cache.Get(0)
+	cache.Get(-1)
+	assert.Equal(t, 0, c.Update())
+	assert.Equal(t, uint64(1500), c.Ratio().Target)
+	cache.Get(-1)
+	heap = 700
+	assert.Equal(t, 0, c.Update(), "growing would exceed the threshold")
+	assert.Equal(t, uint64(1500), c.Ratio().Target)
+
+	// Under pressure, it shrinks regardless of the hit ratio.
+	heap = 950
+	assert.Equal(t, 25, c.Update())
+	assert.Equal(t, uint64(750), c.Ratio().Target)
+	assert.Equal(t, 37, c.Update())
+	assert.Equal(t, uint64(375), c.Ratio().Target)
+	assert.Equal(t, 13, c.Update(), "the ratio is bounded")
+	assert.Equal(t, uint64(250), c.Ratio().Target)
+	assert.Equal(t, 25, cache.Len())
+	assert.Equal(t, 0, c.Update())
+
+	// Hitting often enough, the cache keeps its size.
+	heap = 100
+	cache.Get(99)
+	assert.Equal(t, 0, c.Update())
+	assert.Equal(t, uint64(250), c.Ratio().Target)
+}
+
+func TestController_RegisterAppliesRatio(t *testing.T) {
+	heap := uint64(950)
+	c, _ := newTestController(t, &heap, WithStep(0.5))
+	c.Update()
+	a, name := newRegisteredCache(t, "", 10, 10)
+	for i := 0; i < 10; i++ {
+		a.Add(i, i, 1)
+	}
+	evicted, err := c.Register(name, 10, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 5, evicted)
+	assert.Equal(t, 5, a.Len())
+	_, err = c.Register(name, 10, 10)
+	assert.Error(t, err, "already registered")
+	_, err = c.Register(name+"-missing", 10, 10)
+	assert.Error(t, err, "not in the registry")
+
+	c.Unregister(name)
+	c.Update()
+	assert.Equal(t, 5, a.Len())
+
+	// Caches unregistered from cachedebug are no longer sized either.
+	b, name := newRegisteredCache(t, "-b", 10, 10)
+	for i := 0; i < 10; i++ {
+		b.Add(i, i, 1)
+	}
+	_, err = c.Register(name, 40, 40)
+	require.NoError(t, err)
+	assert.Equal(t, 10, b.Len())
+	cachedebug.Unregister(name)
+	c.Update()
+	assert.Equal(t, 10, b.Len())
+}
+
+func TestController_ResizesOutsideTheLock(t *testing.T) {
+	heap := uint64(950)
+	c, _ := newTestController(t, &heap, WithStep(0.5))
+	var ratios []uint64
+	cache, err := wlru.NewWithEvict(10, 10, func(key, value interface{}) {
+		ratios = append(ratios, c.Ratio().Target)
+	})
+	require.NoError(t, err)
+	name := t.Name()
+	cachedebug.Register(name, cache)
+	defer cachedebug.Unregister(name)
+	for i := 0; i < 10; i++ {
+		cache.Add(i, i, 1)
+	}
+	_, err = c.Register(name, 10, 10)
+	require.NoError(t, err)
+
+	assert.Equal(t, 5, c.Update())
+	assert.Equal(t, []uint64{500, 500, 500, 500, 500}, ratios)
+}
+
+func TestController_StartStop(t *testing.T) {
+	heap := uint64(2000)
+	c, fake := newTestController(t, &heap)
+	cache, name := newRegisteredCache(t, "", 100, 100)
+	for i := 0; i < 100; i++ {
+		cache.Add(i, i, 1)
+	}
+	_, err := c.Register(name, 100, 100)
+	require.NoError(t, err)
+
+	assert.Error(t, c.Start(0))
+	require.NoError(t, c.Start(time.Second))
+	assert.Error(t, c.Start(time.Second))
+	fake.Advance(time.Second)
+	assert.Eventually(t, func() bool { return cache.Len() == 90 }, time.Second, time.Millisecond)
+	c.Stop()
+	c.Stop()
+
+	fake.Advance(time.Second)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 90, cache.Len())
+
+	require.NoError(t, c.Start(time.Second))
+	assert.NoError(t, c.Close())
+	assert.ErrorIs(t, c.Close(), cacheutils.ErrClosed)
+	assert.ErrorIs(t, c.Start(time.Second), cacheutils.ErrClosed)
+	fake.Advance(time.Second)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 90, cache.Len())
+}
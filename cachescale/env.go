@@ -0,0 +1,83 @@
+package cachescale
+
+import (
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+)
+
+// EnvVar is the conventional environment variable configuring the scale of
+// caches, for use with FromEnv.
+const EnvVar = "CACHE_SCALE"
+
+// FromEnv reads a scale expression from the named environment variable, see
+// ParseScale. If the variable is unset or empty, def is returned. An invalid
+// expression is reported as an error naming the variable, rather than
+// silently falling back to the default.
+func FromEnv(name string, def Func) (Func, error) {
+	expr := os.Getenv(name)
+	if strings.TrimSpace(expr) == "" {
+		return def, nil
+	}
+	r, err := ParseScale(expr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return r, nil
+}
+
+// ParseScale parses a human-readable scale expression into a Ratio. It is
+// either a factor, such as "2" or "0.5", a percentage, such as "150%", or a
+// quotient of two such numbers or memory sizes, such as "3/2" or
+// "16GiB/4GiB" for caches configured for 4GiB scaled to 16GiB. Sizes are
+// written as for ParseSize. The scale must be positive.
+func ParseScale(expr string) (Ratio, error) {
+	target, base, isQuotient := strings.Cut(expr, "/")
+	num, err := parseTerm(target)
+	if err != nil {
+		return Identity, fmt.Errorf("invalid scale %q: %w", expr, err)
+	}
+	den := big.NewRat(1, 1)
+	if isQuotient {
+		if den, err = parseTerm(base); err != nil {
+			return Identity, fmt.Errorf("invalid scale %q: %w", expr, err)
+		}
+	}
+	if num.Sign() <= 0 || den.Sign() <= 0 {
+		return Identity, fmt.Errorf("invalid scale %q: must be positive", expr)
+	}
+	// The quotient is in lowest terms, so it is represented exactly if both
+	// of them fit.
+	scale := new(big.Rat).Quo(num, den)
+	if !scale.Num().IsUint64() || !scale.Denom().IsUint64() {
+		return Identity, fmt.Errorf("invalid scale %q: out of range", expr)
+	}
+	return Ratio{Base: scale.Denom().Uint64(), Target: scale.Num().Uint64()}, nil
+}
+
+// parseTerm parses a number, percentage or memory size.
+func parseTerm(term string) (*big.Rat, error) {
+	term = strings.TrimSpace(term)
+	unit := big.NewRat(1, 1)
+	if s, ok := strings.CutSuffix(term, "%"); ok {
+		term, unit = s, big.NewRat(1, 100)
+	} else {
+		for _, u := range sizeUnits {
+			if s, ok := strings.CutSuffix(term, u.suffix); ok {
+				term, unit = s, big.NewRat(u.bytes, 1)
+				break
+			}
+		}
+	}
+	term = strings.TrimSpace(term)
+	// Only plain decimals are accepted, not fractions or exponents.
+	if term == "" || strings.ContainsAny(term, "/eE") {
+		return nil, fmt.Errorf("invalid number %q", term)
+	}
+	r, ok := new(big.Rat).SetString(term)
+	if !ok {
+		return nil, fmt.Errorf("invalid number %q", term)
+	}
+	return r.Mul(r, unit), nil
+}
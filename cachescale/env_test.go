@@ -0,0 +1,63 @@
+package cachescale
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseScale(t *testing.T) {
+	tests := []struct {
+		expr string
+		want Ratio
+	}{
+		{"2", Ratio{1, 2}},
+		{"0.5", Ratio{2, 1}},
+		{" 1.25 ", Ratio{4, 5}},
+		{"150%", Ratio{2, 3}},
+		{"3/2", Ratio{2, 3}},
+		{"16GiB/4GiB", Ratio{1, 4}},
+		{"512MiB / 1GiB", Ratio{2, 1}},
+		{"1GB/1000MB", Ratio{1, 1}},
+		{"50%/2", Ratio{4, 1}},
+		{"2000000", Ratio{1, 2000000}},
+		{"1GiB/3", Ratio{3, 1 << 30}},
+		{"1/3000000", Ratio{3000000, 1}},
+		{"16GiB/1", Ratio{1, 16 << 30}},
+		{"18446744073709551615", Ratio{1, 1<<64 - 1}},
+	}
+	for _, tt := range tests {
+		got, err := ParseScale(tt.expr)
+		require.NoError(t, err, tt.expr)
+		assert.Equal(t, tt.want, got, tt.expr)
+	}
+
+	for _, expr := range []string{
+		"", "x", "0", "-2", "2/0", "1e3", "GiB", "1/2/3", "2x",
+		"100000000000000000000000", "1/100000000000000000000000",
+		"18446744073709551616", "1/18446744073709551616", "0.00000000000000000001",
+	} {
+		_, err := ParseScale(expr)
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("TEST_CACHE_SCALE", "")
+	f, err := FromEnv("TEST_CACHE_SCALE", Identity)
+	require.NoError(t, err)
+	assert.Equal(t, Identity, f)
+
+	t.Setenv("TEST_CACHE_SCALE", "200%")
+	f, err = FromEnv("TEST_CACHE_SCALE", Identity)
+	require.NoError(t, err)
+	assert.Equal(t, 20, f.I(10))
+	bytes, err := f.Bytes("512MiB")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1<<30), bytes)
+
+	t.Setenv("TEST_CACHE_SCALE", "lots")
+	_, err = FromEnv("TEST_CACHE_SCALE", Identity)
+	assert.ErrorContains(t, err, "TEST_CACHE_SCALE")
+}
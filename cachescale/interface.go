@@ -9,4 +9,6 @@ type Func interface {
 	U64(uint64) uint64
 	F32(float32) float32
 	F64(float64) float64
+	// Bytes parses a memory size as for ParseSize and scales it.
+	Bytes(v string) (uint64, error)
 }
@@ -10,7 +10,15 @@
 
 package cachescale
 
-// Ratio alters the cache sizes proportionally to a ratio
+import (
+	"math"
+	"math/bits"
+)
+
+// Ratio alters the cache sizes proportionally to a ratio. Signed integers
+// are scaled by magnitude, so rounding applies to their absolute value. A
+// zero Base is invalid: integer results then saturate at their maximum and
+// float results are infinite or NaN, rather than the division panicking.
 type Ratio struct {
 	Base   uint64
 	Target uint64
@@ -21,12 +29,45 @@ var _ Func = (*Ratio)(nil)
 // Identity doesn't alter the cache sizes
 var Identity = Ratio{1, 1}
 
+// U64 scales v, rounding up. Results exceeding the range of uint64 saturate
+// at math.MaxUint64 rather than wrapping around.
 func (r Ratio) U64(v uint64) uint64 {
-	multipliedValue := v * r.Target
-	if multipliedValue%r.Base == 0 {
-		return multipliedValue / r.Base
+	return r.scale(v, RoundCeil)
+}
+
+// scale scales v, rounding as given and saturating at math.MaxUint64.
+func (r Ratio) scale(v uint64, mode Rounding) uint64 {
+	hi, lo := bits.Mul64(v, r.Target)
+	if hi >= r.Base {
+		return math.MaxUint64
+	}
+	quo, rem := bits.Div64(hi, lo, r.Base)
+	if rem == 0 || quo == math.MaxUint64 {
+		return quo
+	}
+	switch mode {
+	case RoundFloor:
+		return quo
+	case RoundNearest:
+		if rem < r.Base-rem {
+			return quo
+		}
+	}
+	return quo + 1
+}
+
+// scaleSigned scales the magnitude of v, rounding as given, and restores its
+// sign, saturating at -maxV-1 and maxV.
+func (r Ratio) scaleSigned(v int64, mode Rounding, maxV int64) int64 {
+	if v >= 0 {
+		return int64(min(r.scale(uint64(v), mode), uint64(maxV)))
+	}
+	// -v wraps around for math.MinInt64, but its conversion is exact.
+	mag := r.scale(uint64(-v), mode)
+	if mag > uint64(maxV)+1 {
+		return -maxV - 1
 	}
-	return multipliedValue/r.Base + 1
+	return -int64(mag)
 }
 
 func (r Ratio) F32(v float32) float32 {
@@ -38,21 +79,21 @@ func (r Ratio) F64(v float64) float64 {
 }
 
 func (r Ratio) U(v uint) uint {
-	return uint(r.U64(uint64(v)))
+	return uint(min(r.U64(uint64(v)), math.MaxUint))
 }
 
 func (r Ratio) U32(v uint32) uint32 {
-	return uint32(r.U64(uint64(v)))
+	return uint32(min(r.U64(uint64(v)), math.MaxUint32))
 }
 
 func (r Ratio) I(v int) int {
-	return int(r.U64(uint64(v)))
+	return int(r.scaleSigned(int64(v), RoundCeil, math.MaxInt))
 }
 
 func (r Ratio) I32(v int32) int32 {
-	return int32(r.U64(uint64(v)))
+	return int32(r.scaleSigned(int64(v), RoundCeil, math.MaxInt32))
 }
 
 func (r Ratio) I64(v int64) int64 {
-	return int64(r.U64(uint64(v)))
+	return r.scaleSigned(v, RoundCeil, math.MaxInt64)
 }
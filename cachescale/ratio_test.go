@@ -1,6 +1,7 @@
 package cachescale
 
 import (
+	"math"
 	"testing"
 )
 
@@ -18,6 +19,12 @@ func TestRatio_U64(t *testing.T) {
 		{"scale down with remainder", Ratio{2, 1}, 5, 3}, // (5*1)/2 = 2.5 → 3
 		{"zero value", Ratio{3, 5}, 0, 0},
 		{"large numbers", Ratio{100, 50}, 200, 100}, // (200*50)/100 = 100
+		{"large product", Ratio{1 << 30, 1 << 31}, 1 << 40, 1 << 41},
+		{"near max scaled down", Ratio{3, 2}, math.MaxUint64, 12297829382473034410},
+		{"near max identity", Ratio{1 << 40, 1 << 40}, math.MaxUint64 - 1, math.MaxUint64 - 1},
+		{"saturate", Ratio{1, 2}, math.MaxUint64/2 + 1, math.MaxUint64},
+		{"saturate when rounding up", Ratio{2, 3}, math.MaxUint64/3*2 + 1, math.MaxUint64},
+		{"saturate max", Ratio{1, math.MaxUint64}, math.MaxUint64, math.MaxUint64},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -114,3 +121,66 @@ func TestRatio_I64(t *testing.T) {
 		t.Errorf("I64() = %v, want %v", got, want)
 	}
 }
+
+func TestRatio_ConversionsSaturate(t *testing.T) {
+	r := Ratio{Base: 1, Target: 3}
+	if got := r.U(math.MaxUint / 2); got != math.MaxUint {
+		t.Errorf("U() = %v, want %v", got, uint(math.MaxUint))
+	}
+	if got := r.U32(math.MaxUint32 / 2); got != math.MaxUint32 {
+		t.Errorf("U32() = %v, want %v", got, uint32(math.MaxUint32))
+	}
+	if got := r.I(math.MaxInt / 2); got != math.MaxInt {
+		t.Errorf("I() = %v, want %v", got, math.MaxInt)
+	}
+	if got := r.I32(math.MaxInt32 / 2); got != math.MaxInt32 {
+		t.Errorf("I32() = %v, want %v", got, int32(math.MaxInt32))
+	}
+	if got := r.I64(math.MaxInt64 / 2); got != math.MaxInt64 {
+		t.Errorf("I64() = %v, want %v", got, int64(math.MaxInt64))
+	}
+}
+
+func TestRatio_NegativeInputs(t *testing.T) {
+	if got := Identity.I(-5); got != -5 {
+		t.Errorf("I() = %v, want -5", got)
+	}
+	if got := Identity.I32(-5); got != -5 {
+		t.Errorf("I32() = %v, want -5", got)
+	}
+	if got := (Ratio{Base: 2, Target: 1}).I(-1); got != -1 { // -0.5 → -1
+		t.Errorf("I() = %v, want -1", got)
+	}
+	if got := (Ratio{Base: 2, Target: 3}).I64(-3); got != -5 { // -4.5 → -5
+		t.Errorf("I64() = %v, want -5", got)
+	}
+	if got := Identity.I64(math.MinInt64); got != math.MinInt64 {
+		t.Errorf("I64() = %v, want %v", got, int64(math.MinInt64))
+	}
+	if got := Identity.I32(math.MinInt32); got != math.MinInt32 {
+		t.Errorf("I32() = %v, want %v", got, int32(math.MinInt32))
+	}
+}
+
+func TestRatio_NegativeConversionsSaturate(t *testing.T) {
+	r := Ratio{Base: 1, Target: 3}
+	if got := r.I(math.MinInt / 2); got != math.MinInt {
+		t.Errorf("I() = %v, want %v", got, math.MinInt)
+	}
+	if got := r.I32(math.MinInt32 / 2); got != math.MinInt32 {
+		t.Errorf("I32() = %v, want %v", got, int32(math.MinInt32))
+	}
+	if got := r.I64(math.MinInt64 / 2); got != math.MinInt64 {
+		t.Errorf("I64() = %v, want %v", got, int64(math.MinInt64))
+	}
+}
+
+func TestRatio_ZeroBaseSaturates(t *testing.T) {
+	r := Ratio{Base: 0, Target: 1}
+	if got := r.U64(1); got != math.MaxUint64 {
+		t.Errorf("U64() = %v, want %v", got, uint64(math.MaxUint64))
+	}
+	if got := r.I(-1); got != math.MinInt {
+		t.Errorf("I() = %v, want %v", got, math.MinInt)
+	}
+}
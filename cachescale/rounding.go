@@ -0,0 +1,74 @@
+package cachescale
+
+import (
+	"fmt"
+	"math"
+)
+
+// Rounding selects how scaled integers are rounded.
+type Rounding int
+
+const (
+	// RoundCeil rounds up, so that no scaled size ends up smaller than
+	// its share. This is the rounding of Ratio.
+	RoundCeil Rounding = iota
+	// RoundFloor rounds down, so that scaled sizes never add up to more
+	// than their share.
+	RoundFloor
+	// RoundNearest rounds to the nearest integer, halves up, so that
+	// rounding errors of many scaled sizes tend to cancel out.
+	RoundNearest
+)
+
+// String returns the name of the rounding mode.
+func (m Rounding) String() string {
+	switch m {
+	case RoundCeil:
+		return "ceil"
+	case RoundFloor:
+		return "floor"
+	case RoundNearest:
+		return "nearest"
+	}
+	return fmt.Sprintf("Rounding(%d)", int(m))
+}
+
+// Rounded alters the cache sizes proportionally to a ratio like Ratio,
+// rounding scaled integers as selected by Mode. Floats are not rounded.
+type Rounded struct {
+	Ratio
+	Mode Rounding
+}
+
+var _ Func = (*Rounded)(nil)
+
+// WithRounding returns the ratio rounding scaled integers as given.
+func (r Ratio) WithRounding(mode Rounding) Rounded {
+	return Rounded{Ratio: r, Mode: mode}
+}
+
+// U64 scales v, rounding as selected. Results exceeding the range of uint64
+// saturate at math.MaxUint64.
+func (r Rounded) U64(v uint64) uint64 {
+	return r.scale(v, r.Mode)
+}
+
+func (r Rounded) U(v uint) uint {
+	return uint(min(r.U64(uint64(v)), math.MaxUint))
+}
+
+func (r Rounded) U32(v uint32) uint32 {
+	return uint32(min(r.U64(uint64(v)), math.MaxUint32))
+}
+
+func (r Rounded) I(v int) int {
+	return int(r.scaleSigned(int64(v), r.Mode, math.MaxInt))
+}
+
+func (r Rounded) I32(v int32) int32 {
+	return int32(r.scaleSigned(int64(v), r.Mode, math.MaxInt32))
+}
+
+func (r Rounded) I64(v int64) int64 {
+	return r.scaleSigned(v, r.Mode, math.MaxInt64)
+}
@@ -0,0 +1,85 @@
+package cachescale
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRounded_U64(t *testing.T) {
+	tests := []struct {
+		name string
+		r    Ratio
+		v    uint64
+		want [3]uint64 // by mode: ceil, floor, nearest
+	}{
+		{"exact", Ratio{2, 1}, 4, [3]uint64{2, 2, 2}},
+		{"below half", Ratio{3, 1}, 4, [3]uint64{2, 1, 1}}, // 4/3 = 1.33
+		{"half", Ratio{2, 1}, 5, [3]uint64{3, 2, 3}},       // 5/2 = 2.5
+		{"above half", Ratio{3, 2}, 4, [3]uint64{3, 2, 3}}, // 8/3 = 2.67
+		{"scale up", Ratio{4, 5}, 3, [3]uint64{4, 3, 4}},   // 15/4 = 3.75
+		{"large base", Ratio{math.MaxUint64, 1}, math.MaxUint64 / 2, [3]uint64{1, 0, 0}},
+		{"large base half", Ratio{math.MaxUint64 - 1, 1}, math.MaxUint64 / 2, [3]uint64{1, 0, 1}},
+		{"saturate", Ratio{1, 2}, math.MaxUint64, [3]uint64{math.MaxUint64, math.MaxUint64, math.MaxUint64}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for mode, want := range tt.want {
+				r := tt.r.WithRounding(Rounding(mode))
+				if got := r.U64(tt.v); got != want {
+					t.Errorf("%v U64() = %v, want %v", r.Mode, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRounded_MatchesRatioByDefault(t *testing.T) {
+	r := Ratio{Base: 7, Target: 3}
+	rounded := Rounded{Ratio: r}
+	for v := 0; v < 100; v++ {
+		if got, want := rounded.I(v), r.I(v); got != want {
+			t.Errorf("I(%d) = %v, want %v", v, got, want)
+		}
+	}
+	if got, want := rounded.F64(1.5), r.F64(1.5); got != want {
+		t.Errorf("F64() = %v, want %v", got, want)
+	}
+}
+
+func TestRounded_Conversions(t *testing.T) {
+	r := Ratio{Base: 4, Target: 1}.WithRounding(RoundFloor)
+	if got := r.U(7); got != 1 {
+		t.Errorf("U() = %v, want 1", got)
+	}
+	if got := r.U32(7); got != 1 {
+		t.Errorf("U32() = %v, want 1", got)
+	}
+	if got := r.I(7); got != 1 {
+		t.Errorf("I() = %v, want 1", got)
+	}
+	if got := r.I32(7); got != 1 {
+		t.Errorf("I32() = %v, want 1", got)
+	}
+	if got := r.I64(7); got != 1 {
+		t.Errorf("I64() = %v, want 1", got)
+	}
+	if got := r.I(-7); got != -1 {
+		t.Errorf("I() = %v, want -1", got)
+	}
+	if got := (Ratio{2, 1}).WithRounding(RoundNearest).I64(-5); got != -3 { // -2.5 → -3
+		t.Errorf("I64() = %v, want -3", got)
+	}
+	if got := (Ratio{1, 3}).WithRounding(RoundNearest).I32(math.MaxInt32 / 2); got != math.MaxInt32 {
+		t.Errorf("I32() = %v, want %v", got, int32(math.MaxInt32))
+	}
+}
+
+func TestRounding_String(t *testing.T) {
+	for mode, want := range map[Rounding]string{
+		RoundCeil: "ceil", RoundFloor: "floor", RoundNearest: "nearest", 7: "Rounding(7)",
+	} {
+		if got := mode.String(); got != want {
+			t.Errorf("String() = %q, want %q", got, want)
+		}
+	}
+}
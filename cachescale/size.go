@@ -0,0 +1,66 @@
+package cachescale
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// sizeUnits are the units accepted for memory sizes.
+var sizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	// Longer suffixes first, so that "KiB" is not read as "B".
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+// ParseSize parses a human-readable memory size, such as "512MiB" or
+// "1.5GB", into bytes. It accepts the units B, KB, MB, GB, TB and KiB, MiB,
+// GiB, TiB; a number without a unit is a number of bytes. The size must be
+// a whole number of bytes.
+func ParseSize(s string) (uint64, error) {
+	if strings.HasSuffix(strings.TrimSpace(s), "%") {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	r, err := parseTerm(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", s, err)
+	}
+	if r.Sign() < 0 || !r.IsInt() || !r.Num().IsUint64() {
+		return 0, fmt.Errorf("invalid size %q: not a whole number of bytes", s)
+	}
+	return r.Num().Uint64(), nil
+}
+
+// FormatSize formats a memory size in the largest unit it is a multiple of,
+// such as "512MiB", so that ParseSize restores it exactly.
+func FormatSize(bytes uint64) string {
+	best := sizeUnits[len(sizeUnits)-1]
+	for _, u := range sizeUnits {
+		if bytes > 0 && bytes%uint64(u.bytes) == 0 && u.bytes > best.bytes {
+			best = u
+		}
+	}
+	return strconv.FormatUint(bytes/uint64(best.bytes), 10) + best.suffix
+}
+
+// Bytes parses a memory size as for ParseSize and scales it.
+func (r Ratio) Bytes(v string) (uint64, error) {
+	bytes, err := ParseSize(v)
+	if err != nil {
+		return 0, err
+	}
+	return r.U64(bytes), nil
+}
+
+// Bytes parses a memory size as for ParseSize and scales it.
+func (r Rounded) Bytes(v string) (uint64, error) {
+	bytes, err := ParseSize(v)
+	if err != nil {
+		return 0, err
+	}
+	return r.U64(bytes), nil
+}
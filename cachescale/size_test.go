@@ -0,0 +1,73 @@
+package cachescale
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s    string
+		want uint64
+	}{
+		{"0", 0},
+		{"4096", 4096},
+		{"100B", 100},
+		{"512MiB", 512 << 20},
+		{" 1.5 GiB ", 3 << 29},
+		{"2KB", 2000},
+		{"1TiB", 1 << 40},
+		{"18446744073709551615B", math.MaxUint64},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.s)
+		require.NoError(t, err, tt.s)
+		assert.Equal(t, tt.want, got, tt.s)
+	}
+
+	for _, s := range []string{
+		"", "MiB", "-1KiB", "0.5B", "50%", "1/2", "1e3", "12XB", "20000000TiB",
+	} {
+		_, err := ParseSize(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		bytes uint64
+		want  string
+	}{
+		{0, "0B"},
+		{100, "100B"},
+		{1536, "1536B"},
+		{512 << 20, "512MiB"},
+		{3 << 29, "1536MiB"},
+		{5e9, "5GB"},
+		{1 << 40, "1TiB"},
+		{4000 << 40, "4000TiB"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, FormatSize(tt.bytes))
+		parsed, err := ParseSize(tt.want)
+		require.NoError(t, err)
+		assert.Equal(t, tt.bytes, parsed, "sizes round-trip")
+	}
+}
+
+func TestFunc_Bytes(t *testing.T) {
+	for _, f := range []Func{Ratio{2, 1}, Ratio{2, 1}.WithRounding(RoundFloor)} {
+		got, err := f.Bytes("512MiB")
+		require.NoError(t, err)
+		assert.Equal(t, uint64(256<<20), got)
+		_, err = f.Bytes("lots")
+		assert.Error(t, err)
+	}
+	got, _ := Ratio{2, 1}.Bytes("3B")
+	assert.Equal(t, uint64(2), got)
+	got, _ = Ratio{2, 1}.WithRounding(RoundFloor).Bytes("3B")
+	assert.Equal(t, uint64(1), got)
+}
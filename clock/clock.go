@@ -0,0 +1,119 @@
+// Package clock abstracts the passage of time for the caches of this module,
+// so that time-dependent behaviour such as entry ages, expiry and background
+// maintenance can be tested with a fake clock.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time and creates tickers.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks at intervals, like time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real is the clock of the time package.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// Fake is a clock which only moves when advanced. Its tickers fire while the
+// clock is advanced past their next tick; like time.Ticker, they drop ticks
+// for slow receivers.
+type Fake struct {
+	lock    sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+// NewFake creates a fake clock set to the given time.
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Now returns the current time of the clock.
+func (f *Fake) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.now
+}
+
+// Advance moves the clock forward by d, firing due tickers.
+func (f *Fake) Advance(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.now = f.now.Add(d)
+	for _, t := range f.tickers {
+		if t.stopped || t.next.After(f.now) {
+			continue
+		}
+		select {
+		case t.c <- f.now:
+		default:
+		}
+		for !t.next.After(f.now) {
+			t.next = t.next.Add(t.interval)
+		}
+	}
+}
+
+// NewTicker creates a ticker firing every d as the clock is advanced.
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	t := &fakeTicker{clock: f, c: make(chan time.Time, 1), interval: d, next: f.now.Add(d)}
+	f.tickers = append(f.tickers, t)
+	return t
+}
+
+type fakeTicker struct {
+	clock    *Fake
+	c        chan time.Time
+	interval time.Duration
+	next     time.Time
+	stopped  bool
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	f := t.clock
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	t.stopped = true
+	for i, other := range f.tickers {
+		if other == t {
+			f.tickers = append(f.tickers[:i], f.tickers[i+1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReal(t *testing.T) {
+	before := time.Now()
+	assert.False(t, Real.Now().Before(before))
+	ticker := Real.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	select {
+	case <-ticker.C():
+	case <-time.After(time.Second):
+		t.Fatal("no tick")
+	}
+}
+
+func TestFake_Advance(t *testing.T) {
+	start := time.Unix(100, 0)
+	f := NewFake(start)
+	assert.Equal(t, start, f.Now())
+	f.Advance(time.Minute)
+	assert.Equal(t, start.Add(time.Minute), f.Now())
+}
+
+func TestFake_Ticker(t *testing.T) {
+	f := NewFake(time.Unix(0, 0))
+	ticker := f.NewTicker(10 * time.Second)
+	assert.Panics(t, func() { f.NewTicker(0) })
+
+	f.Advance(9 * time.Second)
+	assert.Empty(t, ticker.C())
+	f.Advance(time.Second)
+	assert.Equal(t, time.Unix(10, 0), <-ticker.C())
+
+	// Ticks are dropped while the receiver is not keeping up.
+	f.Advance(25 * time.Second)
+	f.Advance(5 * time.Second)
+	assert.Len(t, ticker.C(), 1)
+	assert.Equal(t, time.Unix(35, 0), <-ticker.C())
+	f.Advance(5 * time.Second)
+	assert.Empty(t, ticker.C())
+	f.Advance(5 * time.Second)
+	assert.Equal(t, time.Unix(50, 0), <-ticker.C())
+
+	ticker.Stop()
+	f.Advance(time.Minute)
+	assert.Empty(t, ticker.C())
+}
@@ -0,0 +1,427 @@
+// Package clockpro provides a weighted cache following the CLOCK-Pro
+// replacement policy, an approximation of LIRS built on clock hands instead
+// of a recency stack. A hit only sets a reference bit, so lookups are cheaper
+// than with LRU or LIRS, while, like LIRS, entries only accessed once do not
+// displace frequently reused ones.
+//
+// Entries are either hot or cold. New entries start cold, in a test period
+// which ends when the hot hand passes them. Cold entries referenced during
+// their test period become hot when the cold hand reaches them, unreferenced
+// ones are evicted, but stay on the clock as non-resident test entries until
+// their test period ends. Adding a key during its test period makes it hot
+// and grows the share of the limits for cold entries, while test periods
+// running out shrink it.
+//
+// The implementation follows Jiang, Chen and Zhang, "CLOCK-Pro: An Effective
+// Improvement of the CLOCK Replacement" (USENIX ATC 2005), extended to
+// weighted entries.
+package clockpro
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/0xsoniclabs/cacheutils/simplewlru"
+)
+
+// minColdShare is the smallest share of the limits kept for cold entries.
+const minColdShare = 0.01
+
+// status is the CLOCK-Pro status of an entry.
+type status uint8
+
+const (
+	cold status = iota // resident cold entry
+	hot                // resident hot entry
+	test               // non-resident cold entry in its test period
+)
+
+// entry is a resident entry or a non-resident test entry.
+type entry struct {
+	key       interface{}
+	value     interface{}
+	weight    uint
+	status    status
+	reference bool
+	testing   bool          // whether a resident cold entry is in its test period
+	clock     *list.Element // position on the clock
+	test      *list.Element // position in the test queue, for test entries
+}
+
+// Cache is a weighted CLOCK-Pro cache. It is safe for concurrent use.
+type Cache struct {
+	lock      sync.Mutex
+	maxWeight uint
+	maxSize   int
+	onEvict   simplewlru.EvictCallback
+	items     map[interface{}]*entry
+
+	// The clock holds all entries, new ones inserted just behind the hot
+	// hand. The test queue holds the test entries, oldest first, bounding
+	// their number.
+	clock, tests      list.List
+	handHot, handCold *list.Element
+
+	hotWeight, coldWeight uint
+	hotLen, coldLen       int
+	coldShare             float64 // target share of the limits for cold entries
+
+	evicted []evictedEntry // awaiting the callback until unlocking
+}
+
+// evictedEntry is an entry awaiting its eviction callback.
+type evictedEntry struct {
+	key, value interface{}
+}
+
+var _ cacheutils.WeightedCache = (*Cache)(nil)
+
+// Option configures a cache.
+type Option func(*Cache)
+
+// WithEvictCallback sets a callback called for every entry leaving the
+// cache, outside of the cache's lock.
+func WithEvictCallback(onEvict simplewlru.EvictCallback) Option {
+	return func(c *Cache) {
+		c.onEvict = onEvict
+	}
+}
+
+// New creates a CLOCK-Pro cache of the given size.
+func New(maxWeight uint, maxSize int, opts ...Option) (*Cache, error) {
+	if maxSize < 0 {
+		return nil, fmt.Errorf("%w: must provide a non-negative size", cacheutils.ErrInvalidSize)
+	}
+	c := &Cache{
+		maxWeight: maxWeight,
+		maxSize:   maxSize,
+		items:     make(map[interface{}]*entry),
+		coldShare: minColdShare,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// Get looks up a key's value, marking the entry as referenced.
+func (c *Cache) Get(key interface{}) (value interface{}, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.items[key]
+	if !ok || e.status == test {
+		return nil, false
+	}
+	e.reference = true
+	return e.value, true
+}
+
+// Peek looks up a key's value without marking the entry as referenced.
+func (c *Cache) Peek(key interface{}) (value interface{}, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.items[key]; ok && e.status != test {
+		return e.value, true
+	}
+	return nil, false
+}
+
+// Contains checks if a key is in the cache without marking it as
+// referenced.
+func (c *Cache) Contains(key interface{}) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.items[key]
+	return ok && e.status != test
+}
+
+// Add adds a value to the cache, marking an existing entry as referenced,
+// and returns the number of evictions. An entry heavier than the maximum
+// weight of the cache is rejected; an existing entry of the key is evicted,
+// as its value is outdated.
+func (c *Cache) Add(key, value interface{}, weight uint) (evicted int) {
+	c.lock.Lock()
+	defer c.unlock()
+	e, ok := c.items[key]
+	if weight > c.maxWeight || c.maxSize == 0 {
+		if ok && e.status != test {
+			c.report(e)
+			c.drop(e)
+			return 1
+		}
+		return 0
+	}
+	switch {
+	case ok && e.status != test:
+		// The old weight is taken out before making room for the new one,
+		// so that the total weight never exceeds the maximum.
+		c.setWeight(e, 0)
+		e.reference = true
+		evicted = c.makeRoom(weight, 0)
+		if c.items[key] == e && e.status != test {
+			e.value = value
+			c.setWeight(e, weight)
+			break
+		}
+		// The entry itself had to make room; the value is added anew.
+		if e, ok := c.items[key]; ok {
+			c.drop(e)
+		}
+		c.insert(&entry{key: key, value: value, weight: weight, status: cold, testing: true})
+	case ok:
+		// The key was evicted too early: it becomes hot and cold entries
+		// get more room.
+		c.coldShare = min(c.coldShare+c.step(), 1)
+		c.drop(e)
+		evicted = c.makeRoom(weight, 1)
+		c.insert(&entry{key: key, value: value, weight: weight, status: hot})
+	default:
+		evicted = c.makeRoom(weight, 1)
+		c.insert(&entry{key: key, value: value, weight: weight, status: cold, testing: true})
+	}
+	c.trimTests()
+	return evicted
+}
+
+// Remove removes the provided key from the cache, returning if the key was
+// contained.
+func (c *Cache) Remove(key interface{}) (present bool) {
+	c.lock.Lock()
+	defer c.unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return false
+	}
+	present = e.status != test
+	if present {
+		c.report(e)
+	}
+	c.drop(e)
+	c.trimTests()
+	return present
+}
+
+// Purge removes all entries from the cache.
+func (c *Cache) Purge() {
+	c.lock.Lock()
+	defer c.unlock()
+	for _, e := range c.items {
+		if e.status != test {
+			c.report(e)
+		}
+	}
+	clear(c.items)
+	c.clock.Init()
+	c.tests.Init()
+	c.handHot, c.handCold = nil, nil
+	c.hotWeight, c.coldWeight = 0, 0
+	c.hotLen, c.coldLen = 0, 0
+}
+
+// Len returns the number of resident entries in the cache.
+func (c *Cache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.hotLen + c.coldLen
+}
+
+// Weight returns the total weight of the resident entries in the cache.
+func (c *Cache) Weight() uint {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.hotWeight + c.coldWeight
+}
+
+// unlock releases the lock and runs the eviction callback for the entries
+// evicted while holding it.
+func (c *Cache) unlock() {
+	evicted := c.evicted
+	c.evicted = nil
+	c.lock.Unlock()
+	for _, e := range evicted {
+		c.onEvict(e.key, e.value)
+	}
+}
+
+// report queues the eviction callback for an entry leaving the cache.
+func (c *Cache) report(e *entry) {
+	if c.onEvict != nil {
+		c.evicted = append(c.evicted, evictedEntry{e.key, e.value})
+	}
+}
+
+// step is the change of the cold share caused by a single entry.
+func (c *Cache) step() float64 {
+	return 1 / float64(max(c.hotLen+c.coldLen, 1))
+}
+
+// makeRoom runs the cold hand until an entry of the given weight and size
+// fits into the cache. Returns the number of evictions.
+func (c *Cache) makeRoom(weight uint, size int) (evicted int) {
+	for c.hotLen+c.coldLen > 0 && (c.hotWeight+c.coldWeight > c.maxWeight-weight || c.hotLen+c.coldLen > c.maxSize-size) {
+		if c.coldLen == 0 {
+			c.runHandHot()
+			continue
+		}
+		if c.runHandCold() {
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// setWeight changes the weight of a resident entry.
+func (c *Cache) setWeight(e *entry, weight uint) {
+	if e.status == hot {
+		c.hotWeight = c.hotWeight - e.weight + weight
+	} else {
+		c.coldWeight = c.coldWeight - e.weight + weight
+	}
+	e.weight = weight
+}
+
+// insert adds an entry to the clock just behind the hot hand, where it is
+// reached last.
+func (c *Cache) insert(e *entry) {
+	c.items[e.key] = e
+	if c.handHot == nil {
+		e.clock = c.clock.PushBack(e)
+		c.handHot, c.handCold = e.clock, e.clock
+	} else {
+		e.clock = c.clock.InsertBefore(e, c.handHot)
+		if c.handCold == c.handHot {
+			c.handCold = e.clock
+		}
+	}
+	if e.status == hot {
+		c.hotWeight += e.weight
+		c.hotLen++
+	} else {
+		c.coldWeight += e.weight
+		c.coldLen++
+	}
+}
+
+// next returns the element following el on the clock.
+func (c *Cache) next(el *list.Element) *list.Element {
+	if next := el.Next(); next != nil {
+		return next
+	}
+	return c.clock.Front()
+}
+
+// runHandCold advances the cold hand by one entry. A cold entry referenced in
+// its test period becomes hot, one referenced afterwards starts a new test
+// period. An unreferenced cold entry is evicted, remaining as a test entry if
+// its test period has not ended. Afterwards, hot entries are demoted until
+// they fit into their share.
+// Returns whether an entry was evicted.
+func (c *Cache) runHandCold() (evicted bool) {
+	e := c.handCold.Value.(*entry)
+	c.handCold = c.next(c.handCold)
+	if e.status == cold {
+		switch {
+		case e.reference && e.testing:
+			e.reference, e.testing = false, false
+			e.status = hot
+			c.coldWeight -= e.weight
+			c.coldLen--
+			c.hotWeight += e.weight
+			c.hotLen++
+		case e.reference:
+			e.reference, e.testing = false, true
+			c.clock.MoveBefore(e.clock, c.handHot)
+		case e.testing:
+			c.report(e)
+			e.status = test
+			c.coldWeight -= e.weight
+			c.coldLen--
+			e.value = nil
+			e.test = c.tests.PushBack(e)
+			evicted = true
+		default:
+			c.report(e)
+			c.drop(e)
+			evicted = true
+		}
+	}
+	for c.hotLen > 0 && c.hotExceedsShare() {
+		c.runHandHot()
+	}
+	return evicted
+}
+
+// hotExceedsShare returns whether the hot entries exceed the share of the
+// limits left by the cold entries.
+func (c *Cache) hotExceedsShare() bool {
+	hotShare := 1 - c.coldShare
+	return float64(c.hotWeight) > hotShare*float64(c.maxWeight) || float64(c.hotLen) > hotShare*float64(c.maxSize)
+}
+
+// runHandHot advances the hot hand by one entry. An unreferenced hot entry
+// becomes cold, the reference of a referenced one is cleared. Cold and test
+// entries passed by the hot hand end their test period, the latter shrinking
+// the cold share.
+func (c *Cache) runHandHot() {
+	e := c.handHot.Value.(*entry)
+	switch e.status {
+	case hot:
+		c.handHot = c.next(c.handHot)
+		if e.reference {
+			e.reference = false
+			return
+		}
+		e.status = cold
+		c.hotWeight -= e.weight
+		c.hotLen--
+		c.coldWeight += e.weight
+		c.coldLen++
+	case cold:
+		c.handHot = c.next(c.handHot)
+		e.testing = false
+	case test:
+		c.expire(e)
+	}
+}
+
+// expire ends the test period of a test entry.
+func (c *Cache) expire(e *entry) {
+	c.coldShare = max(c.coldShare-c.step(), minColdShare)
+	c.drop(e)
+}
+
+// trimTests ends the oldest test periods while there are more test entries
+// than resident entries, bounding the memory spent on them.
+func (c *Cache) trimTests() {
+	for c.tests.Len() > max(c.hotLen+c.coldLen, 1) {
+		c.expire(c.tests.Front().Value.(*entry))
+	}
+}
+
+// drop removes an entry completely, moving the hands off it.
+func (c *Cache) drop(e *entry) {
+	switch e.status {
+	case hot:
+		c.hotWeight -= e.weight
+		c.hotLen--
+	case cold:
+		c.coldWeight -= e.weight
+		c.coldLen--
+	case test:
+		c.tests.Remove(e.test)
+	}
+	if c.clock.Len() == 1 {
+		c.handHot, c.handCold = nil, nil
+	} else {
+		if c.handHot == e.clock {
+			c.handHot = c.next(c.handHot)
+		}
+		if c.handCold == e.clock {
+			c.handCold = c.next(c.handCold)
+		}
+	}
+	c.clock.Remove(e.clock)
+	delete(c.items, e.key)
+}
@@ -0,0 +1,204 @@
+package clockpro
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/0xsoniclabs/cacheutils/simplewlru"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// checkInvariants verifies the bookkeeping of the cache.
+func checkInvariants(t *testing.T, c *Cache) {
+	t.Helper()
+	var hotWeight, coldWeight uint
+	var hotLen, coldLen, tests int
+	for key, e := range c.items {
+		require.Equal(t, key, e.key)
+		require.Equal(t, e, e.clock.Value, "entries are on the clock")
+		switch e.status {
+		case hot:
+			hotWeight += e.weight
+			hotLen++
+		case cold:
+			coldWeight += e.weight
+			coldLen++
+		case test:
+			require.Equal(t, e, e.test.Value, "test entries are in the test queue")
+			tests++
+		}
+	}
+	require.Equal(t, hotWeight, c.hotWeight)
+	require.Equal(t, coldWeight, c.coldWeight)
+	require.Equal(t, hotLen, c.hotLen)
+	require.Equal(t, coldLen, c.coldLen)
+	require.Equal(t, tests, c.tests.Len())
+	require.Equal(t, len(c.items), c.clock.Len())
+	require.LessOrEqual(t, hotWeight+coldWeight, c.maxWeight)
+	require.LessOrEqual(t, hotLen+coldLen, c.maxSize)
+	require.LessOrEqual(t, tests, max(hotLen+coldLen, 1))
+	require.Equal(t, c.clock.Len() == 0, c.handHot == nil)
+	require.Equal(t, c.clock.Len() == 0, c.handCold == nil)
+}
+
+func TestNew_ValidatesArguments(t *testing.T) {
+	_, err := New(10, -1)
+	assert.True(t, errors.Is(err, cacheutils.ErrInvalidSize))
+}
+
+func TestCache_AddGetRemove(t *testing.T) {
+	c, err := New(10, 10)
+	require.NoError(t, err)
+
+	assert.Equal(t, 0, c.Add("a", 1, 4))
+	assert.Equal(t, 0, c.Add("b", 2, 4))
+	value, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, value)
+	value, ok = c.Peek("b")
+	assert.True(t, ok)
+	assert.Equal(t, 2, value)
+	assert.Equal(t, 2, c.Len())
+	assert.Equal(t, uint(8), c.Weight())
+
+	assert.Equal(t, 0, c.Add("a", 3, 2))
+	assert.Equal(t, uint(6), c.Weight())
+	assert.Equal(t, 0, c.Add("c", 4, 11), "too heavy entries are rejected")
+	assert.False(t, c.Contains("c"))
+	assert.Equal(t, 1, c.Add("a", 4, 11), "outdated entries are evicted")
+	assert.False(t, c.Contains("a"))
+
+	assert.True(t, c.Remove("b"))
+	assert.False(t, c.Remove("b"))
+	assert.Equal(t, 0, c.Len())
+	checkInvariants(t, c)
+}
+
+func TestCache_ZeroSizeRejectsEntries(t *testing.T) {
+	c, _ := New(10, 0)
+	assert.Equal(t, 0, c.Add("a", 1, 1))
+	assert.False(t, c.Contains("a"))
+	checkInvariants(t, c)
+}
+
+func TestCache_ReferencedEntriesSurvive(t *testing.T) {
+	c, _ := New(4, 4)
+	for i := 0; i < 4; i++ {
+		c.Add(i, i, 1)
+	}
+	c.Get(0)
+	c.Get(1)
+	assert.Equal(t, 1, c.Add(4, 4, 1))
+	assert.Equal(t, 1, c.Add(5, 5, 1))
+	for _, key := range []int{0, 1, 4, 5} {
+		assert.True(t, c.Contains(key), "key %d", key)
+	}
+	checkInvariants(t, c)
+}
+
+func TestCache_ResistsLoops(t *testing.T) {
+	const size, keys = 100, 150
+	c, _ := New(size, size)
+	lru, _ := simplewlru.New(size, size)
+	var hits, lruHits int
+	for round := 0; round < 10; round++ {
+		for key := 0; key < keys; key++ {
+			if _, ok := c.Get(key); ok {
+				hits++
+			} else {
+				c.Add(key, key, 1)
+			}
+			if _, ok := lru.Get(key); ok {
+				lruHits++
+			} else {
+				lru.Add(key, key, 1)
+			}
+		}
+	}
+	checkInvariants(t, c)
+	assert.Equal(t, 0, lruHits)
+	assert.Greater(t, hits, 9*size/2)
+}
+
+func TestCache_RandomOperationsKeepInvariants(t *testing.T) {
+	var evicted int
+	c, _ := New(200, 50, WithEvictCallback(func(key, value interface{}) {
+		evicted++
+	}))
+	rnd := rand.New(rand.NewSource(1))
+	reported := 0
+	for i := 0; i < 20000; i++ {
+		key := rnd.Intn(120)
+		switch op := rnd.Intn(10); {
+		case op < 5:
+			c.Get(key)
+		case op < 9:
+			reported += c.Add(key, i, uint(rnd.Intn(12)))
+		default:
+			if c.Remove(key) {
+				reported++
+			}
+		}
+		checkInvariants(t, c)
+	}
+	assert.Equal(t, reported, evicted)
+
+	n := c.Len()
+	c.Purge()
+	assert.Equal(t, reported+n, evicted)
+	assert.Equal(t, 0, c.Len())
+	assert.Equal(t, uint(0), c.Weight())
+	checkInvariants(t, c)
+}
+
+func TestCache_EvictCallbackMayUseCache(t *testing.T) {
+	var c *Cache
+	c, _ = New(2, 2, WithEvictCallback(func(key, value interface{}) {
+		assert.False(t, c.Contains(key))
+	}))
+	for i := 0; i < 10; i++ {
+		c.Add(i, i, 1)
+	}
+	assert.Equal(t, 2, c.Len())
+}
+
+func TestCache_WeightsDoNotOverflow(t *testing.T) {
+	c, _ := New(math.MaxUint, 10)
+	c.Add("a", "A", math.MaxUint-1)
+	c.Add("b", "B", 1)
+	assert.Equal(t, 1, c.Add("b", "B2", 5))
+	assert.False(t, c.Contains("a"))
+	value, ok := c.Get("b")
+	assert.True(t, ok)
+	assert.Equal(t, "B2", value)
+	assert.Equal(t, uint(5), c.Weight())
+	checkInvariants(t, c)
+}
+
+func TestCache_UpdateEvictingItself(t *testing.T) {
+	var evicted []interface{}
+	c, _ := New(20, 6, WithEvictCallback(func(key, value interface{}) {
+		evicted = append(evicted, value)
+	}))
+	c.Add(3, 0, 1)
+	c.Add(2, 1, 16)
+	c.Add(5, 2, 13)
+	c.Add(4, 3, 2)
+	c.Add(2, 4, 13)
+	c.Get(3)
+	evicted = nil
+
+	// Making room for the new weight evicts the entry itself, whose value is
+	// then added anew.
+	assert.Equal(t, 3, c.Add(4, 6, 12))
+	assert.Contains(t, evicted, 3)
+	value, ok := c.Peek(4)
+	assert.True(t, ok)
+	assert.Equal(t, 6, value)
+	assert.Equal(t, uint(12), c.Weight())
+	checkInvariants(t, c)
+}
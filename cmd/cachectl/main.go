@@ -0,0 +1,157 @@
+// Command cachectl inspects and converts cache snapshots written by the
+// persist package.
+//
+// Usage:
+//
+//	cachectl inspect [-top n] <snapshot>
+//	cachectl convert [-version v] <snapshot> <output>
+//
+// inspect prints the number of entries, their total weight, a histogram of
+// entry weights in power-of-two buckets and the heaviest keys. convert
+// rewrites a snapshot of any supported format version in the given one,
+// persist.Version by default, validating it on the way. Converting to an
+// older version drops the metadata it cannot hold. Keys and values are
+// handled as raw bytes, so snapshots of any key and value codec can be read.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/0xsoniclabs/cacheutils/persist"
+	"github.com/0xsoniclabs/cacheutils/simplewlru"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "cachectl:", err)
+		os.Exit(1)
+	}
+}
+
+const usage = `usage:
+  cachectl inspect [-top n] <snapshot>
+  cachectl convert [-version v] <snapshot> <output>`
+
+func run(args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	switch args[0] {
+	case "inspect":
+		return inspect(args[1:], stdout)
+	case "convert":
+		return convert(args[1:])
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+	}
+}
+
+func inspect(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	top := flags.Int("top", 10, "number of heaviest keys to print")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New(usage)
+	}
+	entries, err := readFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	var total uint64
+	var oldest time.Duration
+	var buckets [bits.UintSize + 1]int
+	for _, e := range entries {
+		total += uint64(e.Weight)
+		oldest = max(oldest, e.Age)
+		buckets[bits.Len(e.Weight)]++
+	}
+	fmt.Fprintf(stdout, "entries: %d\n", len(entries))
+	fmt.Fprintf(stdout, "weight:  %d\n", total)
+	fmt.Fprintf(stdout, "oldest:  %v\n", oldest)
+	if len(entries) == 0 {
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(stdout, "\nweight distribution:")
+	fmt.Fprintln(tw, "weight\tentries\t")
+	for i, n := range buckets {
+		if n == 0 {
+			continue
+		}
+		if i == 0 {
+			fmt.Fprintf(tw, "0\t%d\t\n", n)
+		} else {
+			fmt.Fprintf(tw, "%d-%d\t%d\t\n", uint(1)<<(i-1), uint(1)<<(i-1)<<1-1, n)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if *top <= 0 {
+		return nil
+	}
+	heaviest := append([]simplewlru.Entry(nil), entries...)
+	sort.SliceStable(heaviest, func(i, j int) bool { return heaviest[i].Weight > heaviest[j].Weight })
+	heaviest = heaviest[:min(*top, len(heaviest))]
+	fmt.Fprintln(stdout, "\nheaviest keys:")
+	tw = tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "weight\tage\tkey")
+	for _, e := range heaviest {
+		fmt.Fprintf(tw, "%d\t%v\t%q\n", e.Weight, e.Age, e.Key)
+	}
+	return tw.Flush()
+}
+
+func convert(args []string) error {
+	flags := flag.NewFlagSet("convert", flag.ContinueOnError)
+	version := flags.Uint("version", persist.Version, fmt.Sprintf("format version to write, from %d to %d", persist.MinVersion, persist.Version))
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return errors.New(usage)
+	}
+	// Unsupported versions are rejected before reading the input.
+	if *version < persist.MinVersion || *version > persist.Version {
+		return fmt.Errorf("%w: cannot write version %d", persist.ErrUnsupportedVersion, *version)
+	}
+	entries, err := readFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	if err := persist.WriteVersion(out, uint16(*version), entries, persist.BytesCodec, persist.BytesCodec); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func readFile(path string) ([]simplewlru.Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries, err := persist.Read(f, persist.BytesCodec, persist.BytesCodec)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return entries, nil
+}
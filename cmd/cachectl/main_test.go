@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/0xsoniclabs/cacheutils/persist"
+	"github.com/0xsoniclabs/cacheutils/simplewlru"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeSnapshot(t *testing.T, path string, entries []simplewlru.Entry) {
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	require.NoError(t, persist.Write(f, entries, persist.StringCodec, persist.StringCodec))
+	require.NoError(t, f.Close())
+}
+
+func TestInspect(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snap")
+	writeSnapshot(t, path, []simplewlru.Entry{
+		{Key: "a", Value: "A", Weight: 1},
+		{Key: "b", Value: "B", Weight: 5},
+		{Key: "c", Value: "C", Weight: 6},
+		{Key: "d", Value: "D", Weight: 0},
+	})
+
+	var out bytes.Buffer
+	require.NoError(t, run([]string{"inspect", "-top", "2", path}, &out))
+	report := out.String()
+	assert.Contains(t, report, "entries: 4\n")
+	assert.Contains(t, report, "weight:  12\n")
+	assert.Regexp(t, `(?m)^\s+0\s+1\s*$`, report)
+	assert.Regexp(t, `(?m)^\s+1-1\s+1\s*$`, report)
+	assert.Regexp(t, `(?m)^\s+4-7\s+2\s*$`, report)
+	heaviest := report[strings.Index(report, "heaviest keys:"):]
+	assert.Regexp(t, `6\s+0s\s+"c"\n5\s+0s\s+"b"\n$`, heaviest)
+}
+
+// readSnapshot reads a snapshot file, returning its format version and
+// entries.
+func readSnapshot(t *testing.T, path string) (uint16, []simplewlru.Entry) {
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Greater(t, len(data), 10)
+	entries, err := persist.Read(bytes.NewReader(data), persist.StringCodec, persist.StringCodec)
+	require.NoError(t, err)
+	return binary.BigEndian.Uint16(data[8:]), entries
+}
+
+func TestConvert(t *testing.T) {
+	dir := t.TempDir()
+	in, v1, v2 := filepath.Join(dir, "in.snap"), filepath.Join(dir, "v1.snap"), filepath.Join(dir, "v2.snap")
+	entries := []simplewlru.Entry{{Key: "a", Value: "A", Weight: 1, Cost: 7}}
+	writeSnapshot(t, in, entries)
+
+	// Down to version 1, costs are dropped.
+	require.NoError(t, run([]string{"convert", "-version", "1", in, v1}, nil))
+	version, converted := readSnapshot(t, v1)
+	assert.Equal(t, uint16(1), version)
+	assert.Equal(t, []simplewlru.Entry{{Key: "a", Value: "A", Weight: 1}}, converted)
+
+	// And up to the current version again.
+	require.NoError(t, run([]string{"convert", v1, v2}, nil))
+	version, converted = readSnapshot(t, v2)
+	assert.Equal(t, uint16(persist.Version), version)
+	assert.Equal(t, []simplewlru.Entry{{Key: "a", Value: "A", Weight: 1}}, converted)
+
+	require.NoError(t, run([]string{"convert", in, v2}, nil))
+	_, converted = readSnapshot(t, v2)
+	assert.Equal(t, entries, converted)
+
+	assert.ErrorIs(t, run([]string{"convert", "-version", "0", in, v1}, nil), persist.ErrUnsupportedVersion)
+	assert.ErrorIs(t, run([]string{"convert", "-version", "3", in, v1}, nil), persist.ErrUnsupportedVersion)
+}
+
+func TestRun_Errors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "garbage")
+	require.NoError(t, os.WriteFile(path, []byte("not a snapshot"), 0o600))
+
+	assert.Error(t, run(nil, nil))
+	assert.Error(t, run([]string{"frobnicate"}, nil))
+	assert.Error(t, run([]string{"inspect"}, nil))
+	assert.ErrorIs(t, run([]string{"inspect", path}, &bytes.Buffer{}), persist.ErrBadMagic)
+	assert.Error(t, run([]string{"convert", path}, nil))
+}
@@ -0,0 +1,84 @@
+package doorkeeper
+
+import "github.com/0xsoniclabs/cacheutils"
+
+// Cache decorates a cache with a doorkeeper: adding a key not in the cache
+// only records a sighting the first time, and adds the entry on the next
+// attempt. Updates of keys already in the cache pass unconditionally. It is
+// safe for concurrent use if the underlying cache is.
+type Cache struct {
+	cache cacheutils.WeightedCache
+	door  *Doorkeeper
+}
+
+var _ cacheutils.ResizableCache = (*Cache)(nil)
+
+// Wrap guards the given cache with the doorkeeper.
+func Wrap(c cacheutils.WeightedCache, door *Doorkeeper) *Cache {
+	return &Cache{cache: c, door: door}
+}
+
+// Unwrap returns the underlying cache.
+func (c *Cache) Unwrap() cacheutils.WeightedCache {
+	return c.cache
+}
+
+// Doorkeeper returns the doorkeeper guarding the cache.
+func (c *Cache) Doorkeeper() *Doorkeeper {
+	return c.door
+}
+
+// Add adds a value to the underlying cache if the key is already cached or
+// has been seen before, and records a sighting of it otherwise. Returns the
+// number of evictions.
+func (c *Cache) Add(key, value interface{}, weight uint) (evicted int) {
+	if !c.cache.Contains(key) && !c.door.Allow(key) {
+		return 0
+	}
+	return c.cache.Add(key, value, weight)
+}
+
+// Get looks up a key's value from the underlying cache.
+func (c *Cache) Get(key interface{}) (value interface{}, ok bool) {
+	return c.cache.Get(key)
+}
+
+// Peek looks up a key's value from the underlying cache without updating
+// its recency.
+func (c *Cache) Peek(key interface{}) (value interface{}, ok bool) {
+	return c.cache.Peek(key)
+}
+
+// Contains checks if a key is in the underlying cache.
+func (c *Cache) Contains(key interface{}) bool {
+	return c.cache.Contains(key)
+}
+
+// Remove removes a key from the underlying cache.
+func (c *Cache) Remove(key interface{}) (present bool) {
+	return c.cache.Remove(key)
+}
+
+// Purge clears the underlying cache. The doorkeeper keeps its sightings.
+func (c *Cache) Purge() {
+	c.cache.Purge()
+}
+
+// Resize changes the limits of the underlying cache if it is a
+// cacheutils.ResizableCache and does nothing otherwise.
+func (c *Cache) Resize(maxWeight uint, maxSize int) (evicted int) {
+	if r, ok := c.cache.(cacheutils.ResizableCache); ok {
+		return r.Resize(maxWeight, maxSize)
+	}
+	return 0
+}
+
+// Len returns the number of entries in the underlying cache.
+func (c *Cache) Len() int {
+	return c.cache.Len()
+}
+
+// Weight returns the total weight of the entries in the underlying cache.
+func (c *Cache) Weight() uint {
+	return c.cache.Weight()
+}
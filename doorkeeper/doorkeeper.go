@@ -0,0 +1,136 @@
+// Package doorkeeper provides a bloom filter which lets new keys into a cache
+// only on their second sighting, so that keys requested just once do not
+// displace entries worth keeping. The filter forgets all keys periodically,
+// after as many insertions as it was sized for, so that its false positive
+// rate stays bounded and stale sightings expire.
+package doorkeeper
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/0xsoniclabs/cacheutils/wlru"
+)
+
+// Doorkeeper is a bloom filter of the keys seen since its last reset. It is
+// safe for concurrent use.
+type Doorkeeper struct {
+	lock       sync.Mutex
+	bits       []uint64
+	hashes     int // number of bits set per key
+	inserted   int // keys inserted since the last reset
+	resetAfter int
+
+	hasher            wlru.Hasher
+	falsePositiveRate float64
+}
+
+// Option configures a doorkeeper.
+type Option func(*Doorkeeper)
+
+// WithHasher sets the hasher mapping keys to filter bits. Defaults to
+// wlru.MapHasher.
+func WithHasher(h wlru.Hasher) Option {
+	return func(d *Doorkeeper) {
+		d.hasher = h
+	}
+}
+
+// WithFalsePositiveRate sets the rate at which unseen keys are reported as
+// seen once the filter holds as many keys as it was sized for. Defaults to
+// 1%.
+func WithFalsePositiveRate(rate float64) Option {
+	return func(d *Doorkeeper) {
+		d.falsePositiveRate = rate
+	}
+}
+
+// New creates a doorkeeper sized for the given number of keys, after which
+// it resets.
+func New(keys int, opts ...Option) (*Doorkeeper, error) {
+	if keys <= 0 {
+		return nil, fmt.Errorf("%w: must provide a positive number of keys", cacheutils.ErrInvalidSize)
+	}
+	d := &Doorkeeper{
+		resetAfter:        keys,
+		hasher:            wlru.MapHasher,
+		falsePositiveRate: 0.01,
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	if d.hasher == nil {
+		return nil, errors.New("must provide a hasher")
+	}
+	if !(d.falsePositiveRate > 0 && d.falsePositiveRate < 1) {
+		return nil, fmt.Errorf("false positive rate %v is not within (0, 1)", d.falsePositiveRate)
+	}
+	// The optimal filter has -n*ln(p)/ln(2)^2 bits and sets ln(2)*m/n of
+	// them per key.
+	bits := math.Ceil(-float64(keys) * math.Log(d.falsePositiveRate) / (math.Ln2 * math.Ln2))
+	d.bits = make([]uint64, (int(bits)+63)/64)
+	d.hashes = max(1, int(math.Round(math.Ln2*float64(len(d.bits)*64)/float64(keys))))
+	return d, nil
+}
+
+// Allow records a sighting of key and reports whether it had been seen
+// before since the last reset.
+func (d *Doorkeeper) Allow(key interface{}) bool {
+	h := d.hasher.Hash(key)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	seen := true
+	d.probe(h, func(word int, mask uint64) {
+		if d.bits[word]&mask == 0 {
+			seen = false
+			d.bits[word] |= mask
+		}
+	})
+	if !seen {
+		d.inserted++
+		if d.inserted >= d.resetAfter {
+			d.reset()
+		}
+	}
+	return seen
+}
+
+// Contains reports whether key has been seen since the last reset, without
+// recording a sighting. Unseen keys may be reported as seen at the false
+// positive rate.
+func (d *Doorkeeper) Contains(key interface{}) bool {
+	h := d.hasher.Hash(key)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	seen := true
+	d.probe(h, func(word int, mask uint64) {
+		seen = seen && d.bits[word]&mask != 0
+	})
+	return seen
+}
+
+// Reset forgets all keys.
+func (d *Doorkeeper) Reset() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.reset()
+}
+
+func (d *Doorkeeper) reset() {
+	clear(d.bits)
+	d.inserted = 0
+}
+
+// probe calls f with the position of every bit of the key with the given
+// hash, derived by double hashing.
+func (d *Doorkeeper) probe(h uint64, f func(word int, mask uint64)) {
+	n := uint64(len(d.bits) * 64)
+	h1, h2 := h&math.MaxUint32, h>>32|1
+	for i := 0; i < d.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % n
+		f(int(bit/64), 1<<(bit%64))
+	}
+}
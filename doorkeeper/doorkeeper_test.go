@@ -0,0 +1,90 @@
+package doorkeeper
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/0xsoniclabs/cacheutils/simplewlru"
+	"github.com/0xsoniclabs/cacheutils/wlru"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew_ValidatesArguments(t *testing.T) {
+	_, err := New(0)
+	assert.True(t, errors.Is(err, cacheutils.ErrInvalidSize))
+	_, err = New(10, WithHasher(nil))
+	assert.Error(t, err)
+	_, err = New(10, WithFalsePositiveRate(0))
+	assert.Error(t, err)
+	_, err = New(10, WithFalsePositiveRate(1))
+	assert.Error(t, err)
+}
+
+func TestAllow_AdmitsSecondSighting(t *testing.T) {
+	d, err := New(100)
+	require.NoError(t, err)
+
+	assert.False(t, d.Contains("a"))
+	assert.False(t, d.Allow("a"))
+	assert.True(t, d.Contains("a"))
+	assert.True(t, d.Allow("a"))
+	assert.True(t, d.Allow("a"))
+
+	d.Reset()
+	assert.False(t, d.Allow("a"))
+}
+
+func TestAllow_ResetsPeriodically(t *testing.T) {
+	d, err := New(10, WithHasher(wlru.XXHasher))
+	require.NoError(t, err)
+
+	for i := 0; i < 9; i++ {
+		d.Allow(i)
+	}
+	assert.True(t, d.Contains(0))
+	for i := 100; !d.Allow(i); i++ {
+		if !d.Contains(0) {
+			return
+		}
+	}
+	t.Errorf("expected the filter to reset after 10 keys")
+}
+
+func TestAllow_FalsePositiveRate(t *testing.T) {
+	const keys = 10000
+	d, err := New(keys, WithHasher(wlru.XXHasher), WithFalsePositiveRate(0.01))
+	require.NoError(t, err)
+	for i := 0; i < keys-1; i++ {
+		d.Allow(i)
+	}
+	falsePositives := 0
+	for i := keys; i < 2*keys; i++ {
+		if d.Contains(i) {
+			falsePositives++
+		}
+	}
+	assert.Less(t, falsePositives, keys/50)
+}
+
+func TestCache_AdmitsOnSecondAdd(t *testing.T) {
+	lru, _ := simplewlru.New(10, 10)
+	d, _ := New(100)
+	c := Wrap(lru, d)
+
+	c.Add("a", 1, 1)
+	assert.False(t, c.Contains("a"))
+	c.Add("a", 1, 1)
+	assert.True(t, c.Contains("a"))
+
+	d.Reset()
+	c.Add("a", 2, 1)
+	value, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 2, value)
+
+	assert.Equal(t, 1, c.Resize(10, 0))
+	assert.Same(t, lru, c.Unwrap())
+	assert.Same(t, d, c.Doorkeeper())
+}
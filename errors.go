@@ -0,0 +1,27 @@
+// Package cacheutils holds the definitions shared by the cache packages of
+// this module.
+package cacheutils
+
+import "errors"
+
+// Errors returned by the cache packages, possibly wrapped with details. Use
+// errors.Is to test for them.
+var (
+	// ErrInvalidSize is returned for negative size limits, capacities or
+	// buffer sizes.
+	ErrInvalidSize = errors.New("invalid size")
+	// ErrInvalidWeight is returned for invalid weight limits or entry
+	// weights.
+	ErrInvalidWeight = errors.New("invalid weight")
+	// ErrEntryTooLarge is returned when an entry could not be retained even
+	// by an empty cache.
+	ErrEntryTooLarge = errors.New("entry too large")
+	// ErrClosed is returned by operations on a closed cache or resource.
+	//
+	// A closed cache still serves lookups and removals of entries, such as
+	// Remove, Purge, EvictTo, expiry and shrinking by Resize. It refuses
+	// every operation adding or updating entries: those with an error
+	// result fail with ErrClosed, the others leave the cache unchanged and
+	// report that nothing was added or updated.
+	ErrClosed = errors.New("closed")
+)
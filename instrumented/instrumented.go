@@ -0,0 +1,214 @@
+// Package instrumented provides a decorator adding statistics, logging and
+// tracing to any cache implementing cacheutils.WeightedCache, without
+// modifying the underlying cache.
+package instrumented
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/0xsoniclabs/cacheutils"
+)
+
+// Op names an operation of a cache.
+type Op string
+
+// The operations reported to tracers and loggers.
+const (
+	OpGet      Op = "get"
+	OpPeek     Op = "peek"
+	OpContains Op = "contains"
+	OpAdd      Op = "add"
+	OpRemove   Op = "remove"
+	OpPurge    Op = "purge"
+	OpResize   Op = "resize"
+)
+
+// Event describes a completed operation.
+type Event struct {
+	Op  Op
+	Key interface{} // nil for Purge and Resize
+	// Hit reports whether a lookup found the key or Remove removed it.
+	Hit bool
+	// Evicted is the number of evictions caused by Add or Resize.
+	Evicted  int
+	Duration time.Duration
+}
+
+// Stats holds the operation counts of an instrumented cache.
+type Stats struct {
+	Hits      uint64 // successful Get and Peek calls
+	Misses    uint64 // unsuccessful Get and Peek calls
+	Adds      uint64
+	Evictions uint64 // evictions caused by Add and Resize
+	Removes   uint64 // Remove calls which removed an entry
+}
+
+// HitRatio returns the fraction of lookups which hit, or zero if there were
+// no lookups.
+func (s Stats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// Option configures an instrumented cache.
+type Option func(*Cache)
+
+// WithTracer calls trace with an event for every completed operation. It is
+// called synchronously on the goroutine performing the operation.
+func WithTracer(trace func(Event)) Option {
+	return func(c *Cache) {
+		c.tracers = append(c.tracers, trace)
+	}
+}
+
+// WithLogger logs every completed operation to logger at debug level, under
+// the given cache name.
+func WithLogger(logger *slog.Logger, name string) Option {
+	return WithTracer(func(e Event) {
+		if !logger.Enabled(context.Background(), slog.LevelDebug) {
+			return
+		}
+		logger.Debug("cache operation", "cache", name, "op", string(e.Op), "key", e.Key,
+			"hit", e.Hit, "evicted", e.Evicted, "duration", e.Duration)
+	})
+}
+
+// Cache decorates a cache with statistics, logging and tracing. It is safe
+// for concurrent use if the underlying cache is.
+type Cache struct {
+	cache   cacheutils.WeightedCache
+	tracers []func(Event)
+
+	hits, misses, adds, evictions, removes atomic.Uint64
+}
+
+var _ cacheutils.ResizableCache = (*Cache)(nil)
+
+// Wrap instruments the given cache. Statistics are always collected.
+func Wrap(c cacheutils.WeightedCache, opts ...Option) *Cache {
+	res := &Cache{cache: c}
+	for _, opt := range opts {
+		opt(res)
+	}
+	return res
+}
+
+// Unwrap returns the underlying cache.
+func (c *Cache) Unwrap() cacheutils.WeightedCache {
+	return c.cache
+}
+
+// Stats returns the operation counts collected so far.
+func (c *Cache) Stats() Stats {
+	return Stats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Adds:      c.adds.Load(),
+		Evictions: c.evictions.Load(),
+		Removes:   c.removes.Load(),
+	}
+}
+
+// trace reports an operation started at start to the tracers.
+func (c *Cache) trace(e Event, start time.Time) {
+	if len(c.tracers) == 0 {
+		return
+	}
+	e.Duration = time.Since(start)
+	for _, trace := range c.tracers {
+		trace(e)
+	}
+}
+
+// lookup counts and traces the result of a Get or Peek.
+func (c *Cache) lookup(op Op, key interface{}, ok bool, start time.Time) {
+	if ok {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+	c.trace(Event{Op: op, Key: key, Hit: ok}, start)
+}
+
+// Get looks up a key's value from the underlying cache.
+func (c *Cache) Get(key interface{}) (value interface{}, ok bool) {
+	start := time.Now()
+	value, ok = c.cache.Get(key)
+	c.lookup(OpGet, key, ok, start)
+	return value, ok
+}
+
+// Peek looks up a key's value from the underlying cache without updating
+// its recency.
+func (c *Cache) Peek(key interface{}) (value interface{}, ok bool) {
+	start := time.Now()
+	value, ok = c.cache.Peek(key)
+	c.lookup(OpPeek, key, ok, start)
+	return value, ok
+}
+
+// Contains checks if a key is in the underlying cache. It is traced but not
+// counted as a lookup.
+func (c *Cache) Contains(key interface{}) bool {
+	start := time.Now()
+	ok := c.cache.Contains(key)
+	c.trace(Event{Op: OpContains, Key: key, Hit: ok}, start)
+	return ok
+}
+
+// Add adds a value to the underlying cache.
+func (c *Cache) Add(key, value interface{}, weight uint) (evicted int) {
+	start := time.Now()
+	evicted = c.cache.Add(key, value, weight)
+	c.adds.Add(1)
+	c.evictions.Add(uint64(evicted))
+	c.trace(Event{Op: OpAdd, Key: key, Evicted: evicted}, start)
+	return evicted
+}
+
+// Remove removes a key from the underlying cache.
+func (c *Cache) Remove(key interface{}) (present bool) {
+	start := time.Now()
+	present = c.cache.Remove(key)
+	if present {
+		c.removes.Add(1)
+	}
+	c.trace(Event{Op: OpRemove, Key: key, Hit: present}, start)
+	return present
+}
+
+// Purge clears the underlying cache.
+func (c *Cache) Purge() {
+	start := time.Now()
+	c.cache.Purge()
+	c.trace(Event{Op: OpPurge}, start)
+}
+
+// Resize changes the limits of the underlying cache if it is a
+// cacheutils.ResizableCache and does nothing otherwise.
+func (c *Cache) Resize(maxWeight uint, maxSize int) (evicted int) {
+	r, ok := c.cache.(cacheutils.ResizableCache)
+	if !ok {
+		return 0
+	}
+	start := time.Now()
+	evicted = r.Resize(maxWeight, maxSize)
+	c.evictions.Add(uint64(evicted))
+	c.trace(Event{Op: OpResize, Evicted: evicted}, start)
+	return evicted
+}
+
+// Len returns the number of entries in the underlying cache.
+func (c *Cache) Len() int {
+	return c.cache.Len()
+}
+
+// Weight returns the total weight of the entries in the underlying cache.
+func (c *Cache) Weight() uint {
+	return c.cache.Weight()
+}
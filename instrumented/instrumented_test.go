@@ -0,0 +1,66 @@
+package instrumented
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/0xsoniclabs/cacheutils/nullcache"
+	"github.com/0xsoniclabs/cacheutils/simplewlru"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrap_CollectsStats(t *testing.T) {
+	lru, _ := simplewlru.New(10, 2)
+	c := Wrap(lru)
+	c.Add("a", 1, 1)
+	c.Add("b", 2, 1)
+	c.Add("c", 3, 1)
+	c.Get("a")
+	c.Get("b")
+	c.Peek("c")
+	c.Contains("a")
+	c.Remove("b")
+	c.Remove("b")
+	c.Resize(10, 0)
+
+	assert.Equal(t, Stats{Hits: 2, Misses: 1, Adds: 3, Evictions: 2, Removes: 1}, c.Stats())
+	assert.InDelta(t, 2.0/3, c.Stats().HitRatio(), 1e-9)
+	assert.Zero(t, Stats{}.HitRatio())
+	assert.Same(t, lru, c.Unwrap())
+	assert.Zero(t, c.Len())
+	assert.Zero(t, c.Weight())
+}
+
+func TestWrap_TracesOperations(t *testing.T) {
+	var events []Event
+	c := Wrap(nullcache.New(), WithTracer(func(e Event) {
+		assert.GreaterOrEqual(t, e.Duration, time.Duration(0))
+		e.Duration = 0
+		events = append(events, e)
+	}))
+	c.Add("a", 1, 1)
+	c.Get("a")
+	c.Purge()
+	c.Resize(1, 1)
+	assert.Equal(t, []Event{
+		{Op: OpAdd, Key: "a"},
+		{Op: OpGet, Key: "a"},
+		{Op: OpPurge},
+		{Op: OpResize},
+	}, events)
+}
+
+func TestWithLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	c := Wrap(nullcache.New(), WithLogger(logger, "test"))
+	c.Get("a")
+	assert.Contains(t, buf.String(), "cache=test op=get key=a hit=false")
+
+	buf.Reset()
+	c = Wrap(nullcache.New(), WithLogger(slog.New(slog.NewTextHandler(&buf, nil)), "test"))
+	c.Get("a")
+	assert.Empty(t, buf.String())
+}
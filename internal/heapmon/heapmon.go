@@ -0,0 +1,90 @@
+// Package heapmon holds what the memory driven components of this module
+// share: sampling the heap size, resolving the memory limit to compare it
+// to, and running a check periodically in the background.
+package heapmon
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"runtime/debug"
+	"runtime/metrics"
+	"sync"
+	"time"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/0xsoniclabs/cacheutils/clock"
+)
+
+// Size returns the memory occupied by live and not yet swept heap objects.
+func Size() uint64 {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	return sample[0].Value.Uint64()
+}
+
+// Limit returns the given heap limit in bytes or, if it is 0, the soft
+// memory limit of the runtime, as set by GOMEMLIMIT. It fails if neither is
+// configured.
+func Limit(limit uint64) (uint64, error) {
+	if limit == 0 {
+		if runtimeLimit := debug.SetMemoryLimit(-1); runtimeLimit != math.MaxInt64 {
+			limit = uint64(runtimeLimit)
+		}
+	}
+	if limit == 0 {
+		return 0, fmt.Errorf("%w: must provide a limit or set GOMEMLIMIT", cacheutils.ErrInvalidSize)
+	}
+	return limit, nil
+}
+
+// Loop runs a check every interval in the background. The zero value is
+// stopped and ready to use.
+type Loop struct {
+	lock sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Start calls check on every tick of a ticker of the given clock until Stop
+// is called. It fails if the loop is already running.
+func (l *Loop) Start(clk clock.Clock, interval time.Duration, check func()) error {
+	if interval <= 0 {
+		return errors.New("must provide a positive interval")
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.stop != nil {
+		return errors.New("already running")
+	}
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+	go run(clk.NewTicker(interval), check, l.stop, l.done)
+	return nil
+}
+
+// Stop stops the loop and waits for a check in progress to finish. It does
+// nothing if the loop is not running.
+func (l *Loop) Stop() {
+	l.lock.Lock()
+	stop, done := l.stop, l.done
+	l.stop, l.done = nil, nil
+	l.lock.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+func run(ticker clock.Ticker, check func(), stop, done chan struct{}) {
+	defer close(done)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C():
+			check()
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package heapmon
+
+import (
+	"math"
+	"runtime/debug"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/0xsoniclabs/cacheutils/clock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSize(t *testing.T) {
+	assert.NotZero(t, Size())
+}
+
+func TestLimit(t *testing.T) {
+	previous := debug.SetMemoryLimit(-1)
+	defer debug.SetMemoryLimit(previous)
+
+	debug.SetMemoryLimit(math.MaxInt64)
+	limit, err := Limit(1000)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1000), limit)
+	_, err = Limit(0)
+	assert.ErrorIs(t, err, cacheutils.ErrInvalidSize)
+
+	debug.SetMemoryLimit(1 << 30)
+	limit, err = Limit(0)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1<<30), limit)
+}
+
+func TestLoop_StartStop(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	var checks atomic.Int32
+	check := func() { checks.Add(1) }
+	var l Loop
+
+	assert.Error(t, l.Start(fake, 0, check))
+	require.NoError(t, l.Start(fake, time.Second, check))
+	assert.Error(t, l.Start(fake, time.Second, check))
+	fake.Advance(time.Second)
+	assert.Eventually(t, func() bool { return checks.Load() == 1 }, time.Second, time.Millisecond)
+	l.Stop()
+	l.Stop()
+
+	fake.Advance(time.Second)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int32(1), checks.Load())
+
+	require.NoError(t, l.Start(fake, time.Second, check), "restarts after Stop")
+	l.Stop()
+}
@@ -0,0 +1,430 @@
+// Package lirs provides a weighted cache following the LIRS (low
+// inter-reference recency set) replacement policy. Instead of the recency of
+// the last access, LIRS ranks entries by the recency of their last two
+// accesses: entries re-accessed within a short distance form the LIR set,
+// which takes most of the capacity, while the remaining HIR entries are
+// evicted first. Entries which are only accessed once, e.g. by a loop over
+// more keys than fit into the cache, therefore do not displace the working
+// set, where LRU would miss on every access.
+//
+// The implementation follows Jiang and Zhang, "LIRS: An Efficient Low
+// Inter-reference Recency Set Replacement Policy to Improve Buffer Cache
+// Performance" (SIGMETRICS 2002), extended to weighted entries.
+package lirs
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/0xsoniclabs/cacheutils/simplewlru"
+)
+
+// DefaultHIRPercent is the default share of the capacity reserved for
+// resident HIR entries.
+const DefaultHIRPercent = 1
+
+// status is the LIRS status of an entry.
+type status uint8
+
+const (
+	lir   status = iota // in the LIR set
+	hir                 // resident HIR entry
+	ghost               // non-resident HIR entry, only kept for its recency
+)
+
+// entry is a resident entry or a ghost of an evicted one.
+type entry struct {
+	key    interface{}
+	value  interface{}
+	weight uint
+	status status
+	stack  *list.Element // position in the stack, nil if not in it
+	queue  *list.Element // position in the HIR queue or the ghost list
+}
+
+// Cache is a weighted LIRS cache. It is safe for concurrent use.
+type Cache struct {
+	lock       sync.Mutex
+	maxWeight  uint
+	maxSize    int
+	hirPercent int
+	onEvict    simplewlru.EvictCallback
+	items      map[interface{}]*entry
+
+	// The stack holds the entries by recency, most recent at the front,
+	// and always ends with an LIR entry. The queue holds the resident HIR
+	// entries in eviction order and the ghost list the non-resident ones,
+	// oldest at the front.
+	stack, queue, ghosts list.List
+
+	lirWeight, hirWeight uint
+	lirLen, hirLen       int
+	lirMaxWeight         uint
+	lirMaxSize           int
+
+	evicted []evictedEntry // awaiting the callback until unlocking
+}
+
+// evictedEntry is an entry awaiting its eviction callback.
+type evictedEntry struct {
+	key, value interface{}
+}
+
+var _ cacheutils.WeightedCache = (*Cache)(nil)
+
+// Option configures a cache.
+type Option func(*Cache)
+
+// WithEvictCallback sets a callback called for every entry leaving the
+// cache, outside of the cache's lock.
+func WithEvictCallback(onEvict simplewlru.EvictCallback) Option {
+	return func(c *Cache) {
+		c.onEvict = onEvict
+	}
+}
+
+// WithHIRPercent sets the share of the weight and size limits reserved for
+// resident HIR entries. Defaults to DefaultHIRPercent; larger shares favor
+// recently added entries over the LIR set.
+func WithHIRPercent(percent int) Option {
+	return func(c *Cache) {
+		c.hirPercent = percent
+	}
+}
+
+// New creates a LIRS cache of the given size.
+func New(maxWeight uint, maxSize int, opts ...Option) (*Cache, error) {
+	c := &Cache{
+		maxWeight:  maxWeight,
+		maxSize:    maxSize,
+		hirPercent: DefaultHIRPercent,
+		items:      make(map[interface{}]*entry),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if maxSize < 0 {
+		return nil, fmt.Errorf("%w: must provide a non-negative size", cacheutils.ErrInvalidSize)
+	}
+	if c.hirPercent <= 0 || c.hirPercent >= 100 {
+		return nil, fmt.Errorf("%w: HIR percentage must be between 1 and 99", cacheutils.ErrInvalidSize)
+	}
+	// At least one entry or unit of weight is left to HIR entries, so that
+	// new entries can enter the cache once the LIR set is full.
+	c.lirMaxWeight = maxWeight - max(maxWeight/100*uint(c.hirPercent)+maxWeight%100*uint(c.hirPercent)/100, 1)
+	c.lirMaxSize = maxSize - max(maxSize/100*c.hirPercent+maxSize%100*c.hirPercent/100, 1)
+	if maxWeight == 0 {
+		c.lirMaxWeight = 0
+	}
+	c.lirMaxSize = max(c.lirMaxSize, 0)
+	return c, nil
+}
+
+// Get looks up a key's value, recording an access.
+func (c *Cache) Get(key interface{}) (value interface{}, ok bool) {
+	c.lock.Lock()
+	defer c.unlock()
+	e, ok := c.items[key]
+	if !ok || e.status == ghost {
+		return nil, false
+	}
+	c.access(e)
+	return e.value, true
+}
+
+// Peek looks up a key's value without recording an access.
+func (c *Cache) Peek(key interface{}) (value interface{}, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.items[key]; ok && e.status != ghost {
+		return e.value, true
+	}
+	return nil, false
+}
+
+// Contains checks if a key is in the cache without recording an access.
+func (c *Cache) Contains(key interface{}) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.items[key]
+	return ok && e.status != ghost
+}
+
+// Add adds a value to the cache, recording an access, and returns the
+// number of evictions. An entry heavier than the maximum weight of the cache
+// is rejected; an existing entry of the key is evicted, as its value is
+// outdated.
+func (c *Cache) Add(key, value interface{}, weight uint) (evicted int) {
+	c.lock.Lock()
+	defer c.unlock()
+	e, ok := c.items[key]
+	if weight > c.maxWeight {
+		if ok && e.status != ghost {
+			c.evict(e)
+			return 1
+		}
+		return 0
+	}
+	var resident uint
+	if ok && e.status != ghost {
+		resident = e.weight
+	}
+	if c.lirWeight+c.hirWeight-resident > math.MaxUint-weight {
+		// The new weight would overflow the total. An existing entry is
+		// replaced by a new one while making room.
+		if resident > 0 {
+			c.drop(e)
+			c.prune()
+		}
+		evicted = c.makeRoom(weight)
+		e, ok = c.items[key]
+	}
+	switch {
+	case ok && e.status != ghost:
+		if e.status == lir {
+			c.lirWeight = simplewlru.AddWeights(c.lirWeight-e.weight, weight)
+		} else {
+			c.hirWeight = simplewlru.AddWeights(c.hirWeight-e.weight, weight)
+		}
+		e.value, e.weight = value, weight
+		c.access(e)
+	case ok:
+		// A ghost re-accessed within the recency of the LIR set joins it.
+		c.ghosts.Remove(e.queue)
+		e.queue = nil
+		e.value, e.weight, e.status = value, weight, lir
+		c.lirWeight = simplewlru.AddWeights(c.lirWeight, weight)
+		c.lirLen++
+		c.stack.MoveToFront(e.stack)
+		c.demote()
+	default:
+		e = &entry{key: key, value: value, weight: weight}
+		c.items[key] = e
+		e.stack = c.stack.PushFront(e)
+		if c.lirWeight+weight <= c.lirMaxWeight && c.lirLen < c.lirMaxSize {
+			// Until the LIR set is full, new entries join it directly.
+			e.status = lir
+			c.lirWeight = simplewlru.AddWeights(c.lirWeight, weight)
+			c.lirLen++
+		} else {
+			e.status = hir
+			e.queue = c.queue.PushBack(e)
+			c.hirWeight = simplewlru.AddWeights(c.hirWeight, weight)
+			c.hirLen++
+		}
+	}
+	evicted += c.enforce()
+	c.trimGhosts()
+	return evicted
+}
+
+// Remove removes the provided key from the cache, returning if the key was
+// contained.
+func (c *Cache) Remove(key interface{}) (present bool) {
+	c.lock.Lock()
+	defer c.unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return false
+	}
+	present = e.status != ghost
+	if present {
+		c.report(e)
+	}
+	c.drop(e)
+	c.prune()
+	return present
+}
+
+// Purge removes all entries from the cache.
+func (c *Cache) Purge() {
+	c.lock.Lock()
+	defer c.unlock()
+	for _, e := range c.items {
+		if e.status != ghost {
+			c.report(e)
+		}
+	}
+	clear(c.items)
+	c.stack.Init()
+	c.queue.Init()
+	c.ghosts.Init()
+	c.lirWeight, c.hirWeight = 0, 0
+	c.lirLen, c.hirLen = 0, 0
+}
+
+// Len returns the number of resident entries in the cache.
+func (c *Cache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lirLen + c.hirLen
+}
+
+// Weight returns the total weight of the resident entries in the cache.
+func (c *Cache) Weight() uint {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lirWeight + c.hirWeight
+}
+
+// unlock releases the lock and runs the eviction callback for the entries
+// evicted while holding it.
+func (c *Cache) unlock() {
+	evicted := c.evicted
+	c.evicted = nil
+	c.lock.Unlock()
+	for _, e := range evicted {
+		c.onEvict(e.key, e.value)
+	}
+}
+
+// access records an access of a resident entry.
+func (c *Cache) access(e *entry) {
+	switch {
+	case e.status == lir:
+		c.stack.MoveToFront(e.stack)
+		c.prune()
+	case e.stack != nil:
+		// An HIR entry re-accessed within the recency of the LIR set joins
+		// it, displacing the least recent LIR entry.
+		c.queue.Remove(e.queue)
+		e.queue = nil
+		e.status = lir
+		c.hirWeight -= e.weight
+		c.hirLen--
+		c.lirWeight += e.weight
+		c.lirLen++
+		c.stack.MoveToFront(e.stack)
+		c.demote()
+		c.prune()
+	default:
+		e.stack = c.stack.PushFront(e)
+		c.queue.MoveToBack(e.queue)
+	}
+}
+
+// demote moves the least recent LIR entries to the HIR queue until the LIR
+// set fits its share of the limits.
+func (c *Cache) demote() {
+	for c.lirLen > 0 && (c.lirWeight > c.lirMaxWeight || c.lirLen > c.lirMaxSize) {
+		c.demoteOne()
+	}
+}
+
+// demoteOne moves the least recent LIR entry to the end of the HIR queue.
+func (c *Cache) demoteOne() {
+	c.prune()
+	e := c.stack.Back().Value.(*entry)
+	c.stack.Remove(e.stack)
+	e.stack = nil
+	e.status = hir
+	e.queue = c.queue.PushBack(e)
+	c.lirWeight -= e.weight
+	c.lirLen--
+	c.hirWeight += e.weight
+	c.hirLen++
+	c.prune()
+}
+
+// prune removes HIR entries from the bottom of the stack, so that it ends
+// with an LIR entry. Pruned ghosts are forgotten.
+func (c *Cache) prune() {
+	for back := c.stack.Back(); back != nil; back = c.stack.Back() {
+		e := back.Value.(*entry)
+		if e.status == lir {
+			return
+		}
+		c.stack.Remove(back)
+		e.stack = nil
+		if e.status == ghost {
+			c.ghosts.Remove(e.queue)
+			delete(c.items, e.key)
+		}
+	}
+}
+
+// enforce evicts entries until the cache fits its limits. Returns the
+// number of evictions.
+func (c *Cache) enforce() (evicted int) {
+	for c.lirLen+c.hirLen > 0 && (c.lirWeight+c.hirWeight > c.maxWeight || c.lirLen+c.hirLen > c.maxSize) {
+		c.evictNext()
+		evicted++
+	}
+	return evicted
+}
+
+// makeRoom evicts entries until weight can be added to the total weight
+// without overflowing. It only evicts for limits close to the largest
+// representable weight, evicting entries which would be evicted after the
+// addition anyway. Returns the number of evictions.
+func (c *Cache) makeRoom(weight uint) (evicted int) {
+	for c.lirLen+c.hirLen > 0 && c.lirWeight+c.hirWeight > math.MaxUint-weight {
+		c.evictNext()
+		evicted++
+	}
+	return evicted
+}
+
+// evictNext evicts the first HIR entry, demoting the least recent LIR entry
+// if no HIR entry is left.
+func (c *Cache) evictNext() {
+	if c.queue.Len() == 0 {
+		c.demoteOne()
+	}
+	c.evict(c.queue.Front().Value.(*entry))
+}
+
+// evict removes a resident entry, keeping a ghost if it is still in the
+// stack.
+func (c *Cache) evict(e *entry) {
+	c.report(e)
+	if e.status == lir || e.stack == nil {
+		c.drop(e)
+		c.prune()
+		return
+	}
+	c.queue.Remove(e.queue)
+	c.hirWeight -= e.weight
+	c.hirLen--
+	e.value, e.weight, e.status = nil, 0, ghost
+	e.queue = c.ghosts.PushBack(e)
+}
+
+// report queues the eviction callback for an entry leaving the cache.
+func (c *Cache) report(e *entry) {
+	if c.onEvict != nil {
+		c.evicted = append(c.evicted, evictedEntry{e.key, e.value})
+	}
+}
+
+// drop removes an entry or ghost completely.
+func (c *Cache) drop(e *entry) {
+	switch e.status {
+	case lir:
+		c.lirWeight -= e.weight
+		c.lirLen--
+	case hir:
+		c.queue.Remove(e.queue)
+		c.hirWeight -= e.weight
+		c.hirLen--
+	case ghost:
+		c.ghosts.Remove(e.queue)
+	}
+	if e.stack != nil {
+		c.stack.Remove(e.stack)
+	}
+	delete(c.items, e.key)
+}
+
+// trimGhosts forgets the oldest ghosts while there are more ghosts than
+// resident entries, bounding the memory spent on them.
+func (c *Cache) trimGhosts() {
+	for c.ghosts.Len() > max(c.lirLen+c.hirLen, 1) {
+		e := c.ghosts.Front().Value.(*entry)
+		c.drop(e)
+		c.prune()
+	}
+}
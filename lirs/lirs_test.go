@@ -0,0 +1,169 @@
+package lirs
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/0xsoniclabs/cacheutils/simplewlru"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// checkInvariants verifies the bookkeeping of the cache.
+func checkInvariants(t *testing.T, c *Cache) {
+	t.Helper()
+	var lirWeight, hirWeight uint
+	var lirLen, hirLen, ghosts int
+	for key, e := range c.items {
+		require.Equal(t, key, e.key)
+		switch e.status {
+		case lir:
+			require.NotNil(t, e.stack, "LIR entries are in the stack")
+			lirWeight += e.weight
+			lirLen++
+		case hir:
+			require.NotNil(t, e.queue, "HIR entries are in the queue")
+			hirWeight += e.weight
+			hirLen++
+		case ghost:
+			require.NotNil(t, e.stack, "ghosts are in the stack")
+			ghosts++
+		}
+	}
+	require.Equal(t, lirWeight, c.lirWeight)
+	require.Equal(t, hirWeight, c.hirWeight)
+	require.Equal(t, lirLen, c.lirLen)
+	require.Equal(t, hirLen, c.hirLen)
+	require.Equal(t, hirLen, c.queue.Len())
+	require.Equal(t, ghosts, c.ghosts.Len())
+	require.LessOrEqual(t, lirWeight+hirWeight, c.maxWeight)
+	require.LessOrEqual(t, lirLen+hirLen, c.maxSize)
+	if back := c.stack.Back(); back != nil {
+		require.Equal(t, lir, back.Value.(*entry).status, "the stack ends with an LIR entry")
+	}
+}
+
+func TestNew_ValidatesArguments(t *testing.T) {
+	_, err := New(10, -1)
+	assert.True(t, errors.Is(err, cacheutils.ErrInvalidSize))
+	_, err = New(10, 10, WithHIRPercent(0))
+	assert.Error(t, err)
+	_, err = New(10, 10, WithHIRPercent(100))
+	assert.Error(t, err)
+}
+
+func TestCache_AddGetRemove(t *testing.T) {
+	c, err := New(10, 10)
+	require.NoError(t, err)
+
+	assert.Equal(t, 0, c.Add("a", 1, 4))
+	assert.Equal(t, 0, c.Add("b", 2, 4))
+	value, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, value)
+	value, ok = c.Peek("b")
+	assert.True(t, ok)
+	assert.Equal(t, 2, value)
+	assert.Equal(t, 2, c.Len())
+	assert.Equal(t, uint(8), c.Weight())
+
+	assert.Equal(t, 0, c.Add("a", 3, 2))
+	assert.Equal(t, uint(6), c.Weight())
+	assert.Equal(t, 0, c.Add("c", 4, 11), "too heavy entries are rejected")
+	assert.False(t, c.Contains("c"))
+	assert.Equal(t, 1, c.Add("a", 4, 11), "outdated entries are evicted")
+	assert.False(t, c.Contains("a"))
+
+	assert.True(t, c.Remove("b"))
+	assert.False(t, c.Remove("b"))
+	assert.Equal(t, 0, c.Len())
+	checkInvariants(t, c)
+}
+
+func TestCache_WeightsDoNotOverflow(t *testing.T) {
+	const half = math.MaxUint/2 + 10
+	c, _ := New(math.MaxUint, 10)
+	c.Add("a", 1, half)
+	assert.Equal(t, 1, c.Add("b", 2, half))
+	assert.Equal(t, 1, c.Len())
+	assert.True(t, c.Contains("b"))
+	assert.Equal(t, uint(half), c.Weight())
+	checkInvariants(t, c)
+
+	c.Add("c", 3, 1)
+	c.Add("c", 3, half)
+	assert.Equal(t, 1, c.Len())
+	assert.True(t, c.Contains("c"))
+	assert.Equal(t, uint(half), c.Weight())
+	checkInvariants(t, c)
+}
+
+func TestCache_ResistsLoops(t *testing.T) {
+	const size, keys = 100, 150
+	c, _ := New(size, size)
+	lru, _ := simplewlru.New(size, size)
+	var hits, lruHits int
+	for round := 0; round < 10; round++ {
+		for key := 0; key < keys; key++ {
+			if _, ok := c.Get(key); ok {
+				hits++
+			} else {
+				c.Add(key, key, 1)
+			}
+			if _, ok := lru.Get(key); ok {
+				lruHits++
+			} else {
+				lru.Add(key, key, 1)
+			}
+		}
+	}
+	checkInvariants(t, c)
+	assert.Equal(t, 0, lruHits)
+	assert.Greater(t, hits, 9*size*8/10)
+}
+
+func TestCache_RandomOperationsKeepInvariants(t *testing.T) {
+	var evicted int
+	c, _ := New(200, 50, WithHIRPercent(10), WithEvictCallback(func(key, value interface{}) {
+		evicted++
+	}))
+	rnd := rand.New(rand.NewSource(1))
+	reported := 0
+	for i := 0; i < 20000; i++ {
+		key := rnd.Intn(120)
+		switch op := rnd.Intn(10); {
+		case op < 5:
+			c.Get(key)
+		case op < 9:
+			reported += c.Add(key, i, uint(rnd.Intn(12)))
+		default:
+			if c.Remove(key) {
+				reported++
+			}
+		}
+		checkInvariants(t, c)
+		require.LessOrEqual(t, c.ghosts.Len(), max(c.Len(), 1))
+	}
+	assert.Equal(t, reported, evicted)
+
+	n := c.Len()
+	c.Purge()
+	assert.Equal(t, reported+n, evicted)
+	assert.Equal(t, 0, c.Len())
+	assert.Equal(t, uint(0), c.Weight())
+	checkInvariants(t, c)
+}
+
+func TestCache_EvictCallbackMayUseCache(t *testing.T) {
+	var c *Cache
+	c, _ = New(2, 2, WithEvictCallback(func(key, value interface{}) {
+		assert.False(t, c.Contains(key))
+	}))
+	for i := 0; i < 10; i++ {
+		c.Add(i, i, 1)
+	}
+	assert.Equal(t, 2, c.Len())
+}
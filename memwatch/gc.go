@@ -0,0 +1,100 @@
+package memwatch
+
+import (
+	"errors"
+	"runtime"
+)
+
+// StartGCTrim makes the watcher check the heap size after every garbage
+// collection cycle and trim the registered caches once the threshold was
+// exceeded in the given number of consecutive cycles, so that caches behave
+// like soft references shedding their coldest entries under sustained
+// pressure. It is independent of periodic checks and their rate limit, and
+// runs until StopGCTrim is called.
+func (w *Watcher) StartGCTrim(cycles int) error {
+	if cycles <= 0 {
+		return errors.New("must provide a positive number of cycles")
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.gcStop != nil {
+		return errors.New("GC trimming already running")
+	}
+	w.gcCycles = cycles
+	w.underPress = 0
+	w.gcStop = make(chan struct{})
+	w.gcDone = make(chan struct{})
+	cycle := make(chan struct{}, 1)
+	armSentinel(cycle, w.gcStop)
+	go w.runGCTrim(cycle, w.gcStop, w.gcDone)
+	return nil
+}
+
+// StopGCTrim stops trimming on garbage collection and waits for a trim in
+// progress to finish. It does nothing if GC trimming is not running.
+func (w *Watcher) StopGCTrim() {
+	w.lock.Lock()
+	stop, done := w.gcStop, w.gcDone
+	w.gcStop, w.gcDone = nil, nil
+	w.lock.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// sentinel is an unreachable object whose finalizer signals the end of a
+// garbage collection cycle and arms the sentinel of the next cycle.
+type sentinel struct {
+	cycle chan<- struct{}
+	stop  <-chan struct{}
+}
+
+func armSentinel(cycle chan<- struct{}, stop <-chan struct{}) {
+	runtime.SetFinalizer(&sentinel{cycle: cycle, stop: stop}, finalizeSentinel)
+}
+
+func finalizeSentinel(s *sentinel) {
+	select {
+	case <-s.stop:
+		return
+	default:
+	}
+	// Signal without blocking the finalizer goroutine; cycles completing
+	// while a check is pending are merged.
+	select {
+	case s.cycle <- struct{}{}:
+	default:
+	}
+	armSentinel(s.cycle, s.stop)
+}
+
+func (w *Watcher) runGCTrim(cycle <-chan struct{}, stop, done chan struct{}) {
+	defer close(done)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-cycle:
+			w.gcCycle()
+		}
+	}
+}
+
+// gcCycle accounts for a completed garbage collection cycle, trimming the
+// caches after enough consecutive cycles under pressure.
+func (w *Watcher) gcCycle() (evicted int) {
+	pressure := float64(w.readHeap()) > w.threshold*float64(w.limit)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if !pressure {
+		w.underPress = 0
+		return 0
+	}
+	w.underPress++
+	if w.underPress < w.gcCycles {
+		return 0
+	}
+	w.underPress = 0
+	return w.trim()
+}
@@ -0,0 +1,184 @@
+// Package memwatch trims caches when the heap of the process grows close to
+// a memory limit, so that caches give memory back before the runtime has to
+// fight the limit with constant garbage collection. Pressure is checked
+// periodically, after garbage collection cycles, or both.
+package memwatch
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/0xsoniclabs/cacheutils/clock"
+	"github.com/0xsoniclabs/cacheutils/internal/heapmon"
+)
+
+// Trimmable is a cache which can shed weight.
+type Trimmable interface {
+	Weight() uint
+	EvictTo(weight uint) (evicted int)
+}
+
+// Defaults of the watcher options.
+const (
+	DefaultThreshold       = 0.9
+	DefaultTrimFraction    = 0.1
+	DefaultMinTrimInterval = 10 * time.Second
+)
+
+// Watcher periodically compares the heap size to a limit and trims the
+// registered caches while the heap exceeds a threshold fraction of the limit.
+// Each trim evicts a fraction of the weight of every cache. Trims are rate
+// limited, as freed memory only shows up in the heap size after the next
+// garbage collection.
+type Watcher struct {
+	limit        uint64
+	threshold    float64
+	trimFraction float64
+	minInterval  time.Duration
+	clock        clock.Clock
+	readHeap     func() uint64
+
+	lock     sync.Mutex
+	caches   []Trimmable
+	lastTrim time.Time
+	loop     heapmon.Loop
+
+	// State of trimming on garbage collection, see StartGCTrim.
+	gcCycles   int
+	underPress int
+	gcStop     chan struct{}
+	gcDone     chan struct{}
+}
+
+// Option configures optional behaviour of a Watcher.
+type Option func(*Watcher) error
+
+// WithThreshold sets the fraction of the limit above which caches are
+// trimmed. The default is DefaultThreshold.
+func WithThreshold(fraction float64) Option {
+	return func(w *Watcher) error {
+		if !(fraction > 0 && fraction <= 1) {
+			return errors.New("threshold must be in the range (0, 1]")
+		}
+		w.threshold = fraction
+		return nil
+	}
+}
+
+// WithTrimFraction sets the fraction of the weight of each cache evicted by
+// a trim. The default is DefaultTrimFraction.
+func WithTrimFraction(fraction float64) Option {
+	return func(w *Watcher) error {
+		if !(fraction > 0 && fraction <= 1) {
+			return errors.New("trim fraction must be in the range (0, 1]")
+		}
+		w.trimFraction = fraction
+		return nil
+	}
+}
+
+// WithMinTrimInterval sets the minimum time between two trims. The default
+// is DefaultMinTrimInterval.
+func WithMinTrimInterval(d time.Duration) Option {
+	return func(w *Watcher) error {
+		if d < 0 {
+			return errors.New("must provide a non-negative interval")
+		}
+		w.minInterval = d
+		return nil
+	}
+}
+
+// WithClock sets the clock driving the watcher. The default is clock.Real.
+func WithClock(c clock.Clock) Option {
+	return func(w *Watcher) error {
+		if c == nil {
+			return errors.New("must provide a clock")
+		}
+		w.clock = c
+		return nil
+	}
+}
+
+// New creates a watcher for the given heap limit in bytes. A limit of 0
+// uses the soft memory limit of the runtime, as set by GOMEMLIMIT, which
+// must then be configured.
+func New(limit uint64, opts ...Option) (*Watcher, error) {
+	limit, err := heapmon.Limit(limit)
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		limit:        limit,
+		threshold:    DefaultThreshold,
+		trimFraction: DefaultTrimFraction,
+		minInterval:  DefaultMinTrimInterval,
+		clock:        clock.Real,
+		readHeap:     heapmon.Size,
+	}
+	for _, opt := range opts {
+		if err := opt(w); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// Register adds a cache to be trimmed under memory pressure.
+func (w *Watcher) Register(c Trimmable) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.caches = append(w.caches, c)
+}
+
+// Unregister removes a cache registered before.
+func (w *Watcher) Unregister(c Trimmable) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for i, other := range w.caches {
+		if other == c {
+			w.caches = append(w.caches[:i], w.caches[i+1:]...)
+			return
+		}
+	}
+}
+
+// Check compares the heap size to the threshold once and trims the
+// registered caches if it is exceeded and the last trim is long enough ago.
+// Returns the number of evicted entries.
+func (w *Watcher) Check() (evicted int) {
+	if float64(w.readHeap()) <= w.threshold*float64(w.limit) {
+		return 0
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	now := w.clock.Now()
+	if !w.lastTrim.IsZero() && now.Sub(w.lastTrim) < w.minInterval {
+		return 0
+	}
+	w.lastTrim = now
+	return w.trim()
+}
+
+// trim evicts the trim fraction of the weight of every cache. It must be
+// called while holding the lock.
+func (w *Watcher) trim() (evicted int) {
+	for _, c := range w.caches {
+		weight := c.Weight()
+		evicted += c.EvictTo(weight - uint(float64(weight)*w.trimFraction))
+	}
+	return evicted
+}
+
+// Start checks the heap size every interval in the background until Stop is
+// called.
+func (w *Watcher) Start(interval time.Duration) error {
+	return w.loop.Start(w.clock, interval, func() { w.Check() })
+}
+
+// Stop stops background checks and waits for a check in progress to finish.
+// It does nothing if the watcher is not running.
+func (w *Watcher) Stop() {
+	w.loop.Stop()
+}
@@ -0,0 +1,141 @@
+package memwatch
+
+import (
+	"math"
+	"runtime"
+	"runtime/debug"
+	"testing"
+	"time"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/0xsoniclabs/cacheutils/clock"
+	"github.com/0xsoniclabs/cacheutils/wlru"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestWatcher(t *testing.T, heap *uint64, opts ...Option) (*Watcher, *clock.Fake) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	w, err := New(1000, append(opts, WithClock(fake))...)
+	require.NoError(t, err)
+	w.readHeap = func() uint64 { return *heap }
+	return w, fake
+}
+
+func TestNew_Validates(t *testing.T) {
+	for _, opt := range []Option{
+		WithThreshold(0), WithThreshold(1.5), WithTrimFraction(0),
+		WithTrimFraction(2), WithMinTrimInterval(-1), WithClock(nil),
+	} {
+		_, err := New(1000, opt)
+		assert.Error(t, err)
+	}
+
+	previous := debug.SetMemoryLimit(-1)
+	defer debug.SetMemoryLimit(previous)
+	debug.SetMemoryLimit(math.MaxInt64)
+	_, err := New(0)
+	assert.ErrorIs(t, err, cacheutils.ErrInvalidSize)
+	debug.SetMemoryLimit(1 << 30)
+	w, err := New(0)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1<<30), w.limit)
+}
+
+func TestWatcher_TrimsUnderPressure(t *testing.T) {
+	heap := uint64(800)
+	w, fake := newTestWatcher(t, &heap, WithThreshold(0.9), WithTrimFraction(0.25), WithMinTrimInterval(time.Minute))
+	a, _ := wlru.New(1000, 1000)
+	b, _ := wlru.New(1000, 1000)
+	for i := 0; i < 8; i++ {
+		a.Add(i, i, 10)
+		b.Add(i, i, 5)
+	}
+	w.Register(a)
+	w.Register(b)
+
+	assert.Equal(t, 0, w.Check())
+	heap = 950
+	assert.Equal(t, 4, w.Check())
+	assert.Equal(t, uint(60), a.Weight())
+	assert.Equal(t, uint(30), b.Weight())
+	assert.Equal(t, []interface{}{2, 3, 4, 5, 6, 7}, a.Keys())
+
+	// Trims are rate limited.
+	assert.Equal(t, 0, w.Check())
+	fake.Advance(time.Minute)
+	w.Unregister(b)
+	assert.Equal(t, 2, w.Check())
+	assert.Equal(t, uint(40), a.Weight())
+	assert.Equal(t, uint(30), b.Weight())
+}
+
+func TestWatcher_StartStop(t *testing.T) {
+	heap := uint64(2000)
+	w, fake := newTestWatcher(t, &heap, WithMinTrimInterval(0))
+	c, _ := wlru.New(1000, 1000)
+	for i := 0; i < 10; i++ {
+		c.Add(i, i, 10)
+	}
+	w.Register(c)
+
+	assert.Error(t, w.Start(0))
+	require.NoError(t, w.Start(time.Second))
+	assert.Error(t, w.Start(time.Second))
+	fake.Advance(time.Second)
+	assert.Eventually(t, func() bool { return c.Len() == 9 }, time.Second, time.Millisecond)
+	w.Stop()
+	w.Stop()
+
+	fake.Advance(time.Second)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 9, c.Len())
+}
+
+func TestWatcher_GCCycleCountsConsecutivePressure(t *testing.T) {
+	heap := uint64(950)
+	w, _ := newTestWatcher(t, &heap, WithTrimFraction(0.5))
+	c, _ := wlru.New(1000, 1000)
+	for i := 0; i < 8; i++ {
+		c.Add(i, i, 1)
+	}
+	w.Register(c)
+	w.gcCycles = 3
+
+	assert.Equal(t, 0, w.gcCycle())
+	assert.Equal(t, 0, w.gcCycle())
+	heap = 100
+	assert.Equal(t, 0, w.gcCycle(), "relief resets the count")
+	heap = 950
+	assert.Equal(t, 0, w.gcCycle())
+	assert.Equal(t, 0, w.gcCycle())
+	assert.Equal(t, 4, w.gcCycle())
+	assert.Equal(t, 0, w.gcCycle())
+}
+
+func TestWatcher_StartGCTrim(t *testing.T) {
+	heap := uint64(2000)
+	w, _ := newTestWatcher(t, &heap)
+	c, _ := wlru.New(1000, 1000)
+	for i := 0; i < 100; i++ {
+		c.Add(i, i, 1)
+	}
+	w.Register(c)
+
+	assert.Error(t, w.StartGCTrim(0))
+	require.NoError(t, w.StartGCTrim(2))
+	assert.Error(t, w.StartGCTrim(2))
+	assert.Eventually(t, func() bool {
+		runtime.GC()
+		return c.Len() < 100
+	}, 5*time.Second, time.Millisecond)
+	w.StopGCTrim()
+	w.StopGCTrim()
+
+	n := c.Len()
+	for i := 0; i < 5; i++ {
+		runtime.GC()
+	}
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, n, c.Len())
+}
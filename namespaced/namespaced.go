@@ -0,0 +1,353 @@
+// Package namespaced provides a weighted LRU cache shared by several
+// subsystems, each adding its entries under its own namespace. A namespace
+// may be given a weight quota: as long as its entries weigh no more than
+// that, other namespaces cannot evict them, so a subsystem filling the cache
+// only displaces its own entries and those of namespaces exceeding their
+// share. Capacity not claimed by a namespace is shared by all of them, and
+// namespaces without a quota live off it alone.
+package namespaced
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/0xsoniclabs/cacheutils/simplewlru"
+)
+
+// EvictCallback is called for every entry leaving the cache.
+type EvictCallback func(namespace string, key, value interface{})
+
+// nsKey is the key of an entry in the underlying cache.
+type nsKey struct {
+	namespace string
+	key       interface{}
+}
+
+// item is the value of an entry in the underlying cache.
+type item struct {
+	value  interface{}
+	weight uint
+}
+
+// usage is the share of the cache taken by a namespace.
+type usage struct {
+	weight uint
+	len    int
+}
+
+// Levels of protection of the namespaces within their quota while making
+// room for an added entry, relaxed if the cache does not fit its limits
+// otherwise.
+const (
+	guardAll    = iota // all namespaces within their quota
+	guardOthers        // all but the namespace of the added entry
+)
+
+// Cache is a weighted LRU cache of namespaced entries, see the package
+// documentation. It is safe for concurrent use.
+type Cache struct {
+	lock      sync.Mutex
+	lru       *simplewlru.Cache
+	maxWeight uint
+	maxSize   int
+	quotas    map[string]uint
+	usage     map[string]usage
+	counters  map[string]*counters
+	onEvict   EvictCallback
+	evicted   []evictedEntry // awaiting the callback until unlocking
+
+	// The namespace of the entry being added and the protection of the
+	// namespaces within their quota while making room for it. Entries
+	// removed while adding are counted as evictions.
+	adding   string
+	guard    int
+	evicting bool
+}
+
+// evictedEntry is an entry awaiting its eviction callback.
+type evictedEntry struct {
+	namespace  string
+	key, value interface{}
+}
+
+// Option configures a cache.
+type Option func(*Cache)
+
+// WithQuota reserves the given weight of the cache for the entries of a
+// namespace. Quotas must be positive and may not exceed the maximum weight
+// of the cache in total.
+func WithQuota(namespace string, weight uint) Option {
+	return func(c *Cache) {
+		c.quotas[namespace] = weight
+	}
+}
+
+// WithEvictCallback sets a callback called for every entry leaving the
+// cache, outside of the cache's lock.
+func WithEvictCallback(onEvict EvictCallback) Option {
+	return func(c *Cache) {
+		c.onEvict = onEvict
+	}
+}
+
+// New creates a namespaced cache of the given size.
+func New(maxWeight uint, maxSize int, opts ...Option) (*Cache, error) {
+	c := &Cache{
+		maxWeight: maxWeight,
+		maxSize:   maxSize,
+		quotas:    make(map[string]uint),
+		usage:     make(map[string]usage),
+		counters:  make(map[string]*counters),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	var reserved uint
+	for namespace, quota := range c.quotas {
+		if quota == 0 {
+			return nil, fmt.Errorf("%w: quota of namespace %q must be positive", cacheutils.ErrInvalidWeight, namespace)
+		}
+		if quota > maxWeight-reserved {
+			return nil, fmt.Errorf("%w: quotas exceed the maximum weight", cacheutils.ErrInvalidWeight)
+		}
+		reserved += quota
+	}
+	var err error
+	if c.lru, err = simplewlru.NewWithEvict(maxWeight, maxSize, c.removed); err != nil {
+		return nil, err
+	}
+	c.lru.SetProtected(c.protected)
+	return c, nil
+}
+
+// Add adds a value to the namespace and returns the number of evictions. To
+// make room, the least recently used entries of namespaces exceeding their
+// quota or without one are evicted first, then those of the entry's own
+// namespace, possibly including the added entry itself. Entries of other
+// namespaces within their quota are never evicted. An entry heavier than the
+// maximum weight of the cache is rejected; an existing entry of the key is
+// evicted, as its value is outdated.
+func (c *Cache) Add(namespace string, key, value interface{}, weight uint) (evicted int) {
+	c.lock.Lock()
+	defer c.unlock()
+	k := nsKey{namespace, key}
+	c.evicting = true
+	defer func() { c.evicting = false }()
+	if weight > c.maxWeight {
+		if c.lru.Remove(k) {
+			return 1
+		}
+		return 0
+	}
+
+	// The usage is updated upfront, so that the namespace loses its
+	// protection if the entry takes it over its quota.
+	u := c.usage[namespace]
+	if old, ok := c.lru.Peek(k); ok {
+		u.weight -= old.(item).weight
+		u.len--
+	}
+	u.weight += weight
+	u.len++
+	c.usage[namespace] = u
+
+	c.adding, c.guard = namespace, guardAll
+	evicted = c.lru.Add(k, item{value, weight}, weight)
+	if c.lru.Weight() > c.maxWeight || c.lru.Len() > c.maxSize {
+		c.guard = guardOthers
+		evicted += c.lru.Resize(c.maxWeight, c.maxSize)
+	}
+	c.adding, c.guard = "", guardAll
+	return evicted
+}
+
+// Get looks up a key's value in the namespace, marking the entry as used.
+func (c *Cache) Get(namespace string, key interface{}) (value interface{}, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n := c.count(namespace)
+	if it, ok := c.lru.Get(nsKey{namespace, key}); ok {
+		n.hits++
+		return it.(item).value, true
+	}
+	n.misses++
+	return nil, false
+}
+
+// Peek looks up a key's value in the namespace without marking the entry as
+// used.
+func (c *Cache) Peek(namespace string, key interface{}) (value interface{}, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if it, ok := c.lru.Peek(nsKey{namespace, key}); ok {
+		return it.(item).value, true
+	}
+	return nil, false
+}
+
+// Contains checks if a key is in the namespace without marking the entry as
+// used.
+func (c *Cache) Contains(namespace string, key interface{}) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Contains(nsKey{namespace, key})
+}
+
+// Remove removes a key from the namespace, returning if it was contained.
+func (c *Cache) Remove(namespace string, key interface{}) (present bool) {
+	c.lock.Lock()
+	defer c.unlock()
+	return c.lru.Remove(nsKey{namespace, key})
+}
+
+// PurgeNamespace removes all entries of the namespace. Takes time linear in
+// the number of entries of the cache.
+func (c *Cache) PurgeNamespace(namespace string) {
+	c.lock.Lock()
+	defer c.unlock()
+	if c.usage[namespace].len == 0 {
+		return
+	}
+	for _, k := range c.lru.Keys() {
+		if k.(nsKey).namespace == namespace {
+			c.lru.Remove(k)
+		}
+	}
+}
+
+// Purge removes all entries from the cache.
+func (c *Cache) Purge() {
+	c.lock.Lock()
+	defer c.unlock()
+	c.lru.Purge()
+}
+
+// Len returns the number of entries in the cache.
+func (c *Cache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Len()
+}
+
+// Weight returns the total weight of the entries in the cache.
+func (c *Cache) Weight() uint {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Weight()
+}
+
+// Usage returns the total weight and number of the entries of the
+// namespace.
+func (c *Cache) Usage(namespace string) (weight uint, num int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	u := c.usage[namespace]
+	return u.weight, u.len
+}
+
+// Quota returns the weight reserved for the namespace, 0 if it has no quota.
+func (c *Cache) Quota(namespace string) uint {
+	return c.quotas[namespace]
+}
+
+// protected reports whether capacity evictions must pass over an entry, see
+// simplewlru.Cache.SetProtected.
+func (c *Cache) protected(key interface{}) bool {
+	namespace := key.(nsKey).namespace
+	if c.guard == guardOthers && namespace == c.adding {
+		return false
+	}
+	quota, ok := c.quotas[namespace]
+	return ok && c.usage[namespace].weight <= quota
+}
+
+// removed accounts for an entry leaving the underlying cache and queues the
+// eviction callback for it.
+func (c *Cache) removed(key, value interface{}) {
+	k, it := key.(nsKey), value.(item)
+	u := c.usage[k.namespace]
+	u.weight -= it.weight
+	u.len--
+	if u.len == 0 {
+		delete(c.usage, k.namespace)
+	} else {
+		c.usage[k.namespace] = u
+	}
+	if c.evicting {
+		c.count(k.namespace).evictions++
+	}
+	if c.onEvict != nil {
+		c.evicted = append(c.evicted, evictedEntry{k.namespace, k.key, it.value})
+	}
+}
+
+// unlock releases the lock and runs the eviction callback for the entries
+// removed while holding it.
+func (c *Cache) unlock() {
+	evicted := c.evicted
+	c.evicted = nil
+	c.lock.Unlock()
+	for _, e := range evicted {
+		c.onEvict(e.namespace, e.key, e.value)
+	}
+}
+
+// Namespace returns a view of the cache restricted to the given namespace,
+// for handing to the subsystem owning it.
+func (c *Cache) Namespace(namespace string) *View {
+	return &View{cache: c, namespace: namespace}
+}
+
+// View is the part of a namespaced cache belonging to one namespace. Its
+// weight and length are those of the namespace's entries, and Purge only
+// removes them.
+type View struct {
+	cache     *Cache
+	namespace string
+}
+
+var _ cacheutils.WeightedCache = (*View)(nil)
+
+// Add adds a value to the namespace, see Cache.Add.
+func (v *View) Add(key, value interface{}, weight uint) (evicted int) {
+	return v.cache.Add(v.namespace, key, value, weight)
+}
+
+// Get looks up a key's value in the namespace, marking the entry as used.
+func (v *View) Get(key interface{}) (value interface{}, ok bool) {
+	return v.cache.Get(v.namespace, key)
+}
+
+// Peek looks up a key's value in the namespace without marking the entry as
+// used.
+func (v *View) Peek(key interface{}) (value interface{}, ok bool) {
+	return v.cache.Peek(v.namespace, key)
+}
+
+// Contains checks if a key is in the namespace.
+func (v *View) Contains(key interface{}) bool {
+	return v.cache.Contains(v.namespace, key)
+}
+
+// Remove removes a key from the namespace, returning if it was contained.
+func (v *View) Remove(key interface{}) (present bool) {
+	return v.cache.Remove(v.namespace, key)
+}
+
+// Purge removes all entries of the namespace.
+func (v *View) Purge() {
+	v.cache.PurgeNamespace(v.namespace)
+}
+
+// Len returns the number of entries of the namespace.
+func (v *View) Len() int {
+	_, num := v.cache.Usage(v.namespace)
+	return num
+}
+
+// Weight returns the total weight of the entries of the namespace.
+func (v *View) Weight() uint {
+	weight, _ := v.cache.Usage(v.namespace)
+	return weight
+}
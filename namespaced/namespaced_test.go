@@ -0,0 +1,228 @@
+package namespaced
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// checkInvariants verifies the bookkeeping of the cache.
+func checkInvariants(t *testing.T, c *Cache) {
+	t.Helper()
+	usages := make(map[string]usage)
+	for _, key := range c.lru.Keys() {
+		k := key.(nsKey)
+		it, _ := c.lru.Peek(key)
+		u := usages[k.namespace]
+		u.weight += it.(item).weight
+		u.len++
+		usages[k.namespace] = u
+	}
+	require.Equal(t, usages, c.usage)
+	require.LessOrEqual(t, c.lru.Weight(), c.maxWeight)
+	require.LessOrEqual(t, c.lru.Len(), c.maxSize)
+}
+
+func TestNew_ValidatesQuotas(t *testing.T) {
+	_, err := New(10, -1)
+	assert.True(t, errors.Is(err, cacheutils.ErrInvalidSize))
+	_, err = New(10, 10, WithQuota("a", 0))
+	assert.True(t, errors.Is(err, cacheutils.ErrInvalidWeight))
+	_, err = New(10, 10, WithQuota("a", 6), WithQuota("b", 5))
+	assert.True(t, errors.Is(err, cacheutils.ErrInvalidWeight))
+	c, err := New(10, 10, WithQuota("a", 5), WithQuota("b", 5))
+	require.NoError(t, err)
+	assert.Equal(t, uint(5), c.Quota("a"))
+	assert.Equal(t, uint(0), c.Quota("c"))
+}
+
+func TestCache_AddGetRemove(t *testing.T) {
+	c, _ := New(10, 10)
+	assert.Equal(t, 0, c.Add("a", 1, "a1", 4))
+	assert.Equal(t, 0, c.Add("b", 1, "b1", 3))
+	value, ok := c.Get("a", 1)
+	assert.True(t, ok)
+	assert.Equal(t, "a1", value)
+	value, ok = c.Peek("b", 1)
+	assert.True(t, ok)
+	assert.Equal(t, "b1", value)
+	assert.False(t, c.Contains("c", 1), "namespaces are separate")
+	assert.Equal(t, 2, c.Len())
+	assert.Equal(t, uint(7), c.Weight())
+
+	assert.Equal(t, 0, c.Add("a", 1, "a2", 2))
+	weight, num := c.Usage("a")
+	assert.Equal(t, uint(2), weight)
+	assert.Equal(t, 1, num)
+	assert.Equal(t, 0, c.Add("a", 2, "a3", 11), "too heavy entries are rejected")
+	assert.Equal(t, 1, c.Add("a", 1, "a4", 11), "outdated entries are evicted")
+	assert.False(t, c.Contains("a", 1))
+
+	assert.True(t, c.Remove("b", 1))
+	assert.False(t, c.Remove("b", 1))
+	assert.Equal(t, 0, c.Len())
+	checkInvariants(t, c)
+}
+
+func TestCache_QuotaProtectsNamespace(t *testing.T) {
+	c, _ := New(10, 100, WithQuota("a", 5))
+	for i := 0; i < 5; i++ {
+		c.Add("a", i, i, 1)
+	}
+	// A namespace without a quota only gets the remaining capacity.
+	for i := 0; i < 10; i++ {
+		c.Add("b", i, i, 1)
+	}
+	for i := 0; i < 5; i++ {
+		assert.True(t, c.Contains("a", i))
+	}
+	_, num := c.Usage("b")
+	assert.Equal(t, 5, num)
+	checkInvariants(t, c)
+}
+
+func TestCache_NamespaceOverQuotaIsEvictedFirst(t *testing.T) {
+	c, _ := New(10, 100, WithQuota("a", 5), WithQuota("b", 5))
+	// Unclaimed capacity may be used beyond the quota.
+	for i := 0; i < 10; i++ {
+		c.Add("a", i, i, 1)
+	}
+	// It is given back once the other namespace claims its share.
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, 1, c.Add("b", i, i, 1))
+	}
+	weight, _ := c.Usage("a")
+	assert.Equal(t, uint(5), weight)
+	assert.False(t, c.Contains("a", 4))
+	assert.True(t, c.Contains("a", 5))
+
+	// Beyond its quota, a namespace evicts its own entries.
+	c.Get("b", 0)
+	assert.Equal(t, 1, c.Add("b", 5, 5, 1))
+	assert.False(t, c.Contains("b", 1))
+	assert.True(t, c.Contains("b", 0))
+	weight, _ = c.Usage("a")
+	assert.Equal(t, uint(5), weight)
+	checkInvariants(t, c)
+}
+
+func TestCache_SizeLimitKeepsProtection(t *testing.T) {
+	c, _ := New(10, 4, WithQuota("a", 5), WithQuota("b", 5))
+	c.Add("a", 0, 0, 1)
+	c.Add("a", 1, 1, 1)
+	c.Add("b", 0, 0, 1)
+	c.Add("b", 1, 1, 1)
+
+	// Within their quotas, a namespace evicts its own entries first.
+	assert.Equal(t, 1, c.Add("a", 2, 2, 1))
+	assert.False(t, c.Contains("a", 0))
+	_, num := c.Usage("b")
+	assert.Equal(t, 2, num)
+
+	// Without room left, the added entry is evicted itself.
+	assert.Equal(t, 1, c.Add("c", 0, 0, 1))
+	assert.False(t, c.Contains("c", 0))
+	_, num = c.Usage("b")
+	assert.Equal(t, 2, num)
+	checkInvariants(t, c)
+}
+
+func TestView_IsRestrictedToNamespace(t *testing.T) {
+	c, _ := New(10, 10, WithQuota("a", 5))
+	var view cacheutils.WeightedCache = c.Namespace("a")
+	view.Add(1, "a1", 2)
+	view.Add(2, "a2", 3)
+	c.Add("b", 1, "b1", 4)
+
+	value, ok := view.Get(1)
+	assert.True(t, ok)
+	assert.Equal(t, "a1", value)
+	value, ok = view.Peek(2)
+	assert.True(t, ok)
+	assert.Equal(t, "a2", value)
+	assert.Equal(t, 2, view.Len())
+	assert.Equal(t, uint(5), view.Weight())
+	assert.True(t, view.Remove(2))
+	assert.False(t, view.Contains(2))
+
+	view.Purge()
+	assert.Equal(t, 0, view.Len())
+	assert.True(t, c.Contains("b", 1))
+	checkInvariants(t, c)
+}
+
+func TestCache_Stats(t *testing.T) {
+	c, _ := New(10, 100, WithQuota("a", 5), WithQuota("c", 2))
+	for i := 0; i < 8; i++ {
+		c.Add("a", i, i, 1)
+	}
+	c.Get("a", 7)
+	c.Get("a", 8)
+	c.Peek("a", 7)
+	for i := 0; i < 4; i++ {
+		c.Add("b", i, i, 1)
+	}
+	c.Remove("b", 0)
+
+	stats := c.Stats("a")
+	assert.Equal(t, Stats{Len: 6, Weight: 6, Quota: 5, Hits: 1, Misses: 1, Evictions: 2}, stats)
+	assert.Equal(t, 0.5, stats.HitRatio())
+	assert.Equal(t, map[string]Stats{
+		"a": stats,
+		"b": {Len: 3, Weight: 3},
+		"c": {Quota: 2},
+	}, c.AllStats())
+	assert.Equal(t, c.Stats("b"), c.Namespace("b").Stats())
+	assert.Equal(t, 0.0, c.Stats("b").HitRatio())
+}
+
+func TestCache_RandomOperationsKeepInvariants(t *testing.T) {
+	var evicted int
+	c, _ := New(100, 30, WithQuota("a", 30), WithQuota("b", 20), WithEvictCallback(func(namespace string, key, value interface{}) {
+		evicted++
+	}))
+	rnd := rand.New(rand.NewSource(1))
+	reported := 0
+	for i := 0; i < 20000; i++ {
+		namespace := string(rune('a' + rnd.Intn(4)))
+		key := rnd.Intn(40)
+		switch op := rnd.Intn(20); {
+		case op < 10:
+			c.Get(namespace, key)
+		case op < 18:
+			reported += c.Add(namespace, key, i, uint(rnd.Intn(12)))
+		case op < 19:
+			if c.Remove(namespace, key) {
+				reported++
+			}
+		default:
+			_, num := c.Usage(namespace)
+			c.PurgeNamespace(namespace)
+			reported += num
+		}
+		checkInvariants(t, c)
+	}
+	assert.Equal(t, reported, evicted)
+
+	n := c.Len()
+	c.Purge()
+	assert.Equal(t, reported+n, evicted)
+	assert.Equal(t, 0, c.Len())
+	assert.Equal(t, uint(0), c.Weight())
+	checkInvariants(t, c)
+}
+
+func TestCache_EvictCallbackMayUseCache(t *testing.T) {
+	var c *Cache
+	c, _ = New(2, 2, WithEvictCallback(func(namespace string, key, value interface{}) {
+		assert.False(t, c.Contains(namespace, key))
+	}))
+	for i := 0; i < 10; i++ {
+		c.Add("a", i, i, 1)
+	}
+	assert.Equal(t, 2, c.Len())
+}
@@ -0,0 +1,84 @@
+package namespaced
+
+// Stats describes the use of the cache by a namespace. Comparing the
+// namespaces of a cache shows whether their quotas match their working
+// sets: a namespace with many evictions and misses may deserve a larger
+// quota, one staying well below its quota a smaller one.
+type Stats struct {
+	Len    int
+	Weight uint
+	Quota  uint
+	// Hits and Misses count Get calls.
+	Hits   uint64
+	Misses uint64
+	// Evictions counts the entries evicted to make room for added ones or
+	// because their value was replaced by one too heavy for the cache.
+	// Explicit removals are not counted.
+	Evictions uint64
+}
+
+// HitRatio returns the fraction of Get calls which hit, or zero if there
+// were none.
+func (s Stats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// counters are the statistics of a namespace not derived from its entries.
+type counters struct {
+	hits, misses, evictions uint64
+}
+
+// Stats returns the statistics of the namespace.
+func (c *Cache) Stats(namespace string) Stats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.stats(namespace)
+}
+
+// AllStats returns the statistics of every namespace which has a quota or
+// has been used, by namespace.
+func (c *Cache) AllStats() map[string]Stats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	stats := make(map[string]Stats, len(c.counters))
+	for namespace := range c.quotas {
+		stats[namespace] = c.stats(namespace)
+	}
+	for namespace := range c.usage {
+		stats[namespace] = c.stats(namespace)
+	}
+	for namespace := range c.counters {
+		stats[namespace] = c.stats(namespace)
+	}
+	return stats
+}
+
+// stats returns the statistics of the namespace. It must be called while
+// holding the lock.
+func (c *Cache) stats(namespace string) Stats {
+	u := c.usage[namespace]
+	s := Stats{Len: u.len, Weight: u.weight, Quota: c.quotas[namespace]}
+	if n, ok := c.counters[namespace]; ok {
+		s.Hits, s.Misses, s.Evictions = n.hits, n.misses, n.evictions
+	}
+	return s
+}
+
+// count returns the counters of the namespace, creating them on first use.
+// It must be called while holding the lock.
+func (c *Cache) count(namespace string) *counters {
+	n, ok := c.counters[namespace]
+	if !ok {
+		n = new(counters)
+		c.counters[namespace] = n
+	}
+	return n
+}
+
+// Stats returns the statistics of the namespace.
+func (v *View) Stats() Stats {
+	return v.cache.Stats(v.namespace)
+}
@@ -0,0 +1,59 @@
+// Package nullcache provides a cache which stores nothing, so that caching
+// can be disabled by configuration without nil checks in consumer code.
+package nullcache
+
+import "github.com/0xsoniclabs/cacheutils"
+
+// Cache is a cache which stores nothing: every lookup misses. The zero value
+// is ready to use and safe for concurrent use.
+type Cache struct{}
+
+var _ cacheutils.ResizableCache = Cache{}
+
+// New returns a cache which stores nothing.
+func New() Cache {
+	return Cache{}
+}
+
+// Add discards the value. No evictions are reported, as nothing was stored.
+func (Cache) Add(key, value interface{}, weight uint) (evicted int) {
+	return 0
+}
+
+// Get always misses.
+func (Cache) Get(key interface{}) (value interface{}, ok bool) {
+	return nil, false
+}
+
+// Peek always misses.
+func (Cache) Peek(key interface{}) (value interface{}, ok bool) {
+	return nil, false
+}
+
+// Contains always returns false.
+func (Cache) Contains(key interface{}) bool {
+	return false
+}
+
+// Remove always returns false.
+func (Cache) Remove(key interface{}) (present bool) {
+	return false
+}
+
+// Purge does nothing.
+func (Cache) Purge() {}
+
+// Resize does nothing.
+func (Cache) Resize(maxWeight uint, maxSize int) (evicted int) {
+	return 0
+}
+
+// Len always returns 0.
+func (Cache) Len() int {
+	return 0
+}
+
+// Weight always returns 0.
+func (Cache) Weight() uint {
+	return 0
+}
@@ -0,0 +1,23 @@
+package nullcache
+
+import (
+	"testing"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCache_StoresNothing(t *testing.T) {
+	var c cacheutils.ResizableCache = New()
+	assert.Zero(t, c.Add("a", 1, 10))
+	_, ok := c.Get("a")
+	assert.False(t, ok)
+	_, ok = c.Peek("a")
+	assert.False(t, ok)
+	assert.False(t, c.Contains("a"))
+	assert.False(t, c.Remove("a"))
+	assert.Zero(t, c.Len())
+	assert.Zero(t, c.Weight())
+	assert.Zero(t, c.Resize(1, 1))
+	c.Purge()
+}
@@ -0,0 +1,274 @@
+package persist
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/0xsoniclabs/cacheutils/simplewlru"
+)
+
+// A snapshot consists of a header, a sequence of length-prefixed entry
+// records and a trailing checksum:
+//
+//	magic    [8]byte   "CUSNAPSH"
+//	version  uint16    format version, currently 2
+//	count    uint64    number of entry records
+//	records  count times:
+//	  length uvarint   length of the record body
+//	  body     key length (uvarint), key, value length (uvarint), value,
+//	           weight (uvarint), age in nanoseconds (uvarint) and, since
+//	           version 2, cost (uvarint)
+//	checksum uint32    CRC-32C of everything preceding it
+//
+// Fixed-size integers are big-endian. Entries are stored from oldest to
+// newest.
+
+// Version is the snapshot format version written by Write.
+const Version = 2
+
+// MinVersion is the oldest snapshot format version supported by Read and
+// WriteVersion.
+const MinVersion = 1
+
+var magic = [8]byte{'C', 'U', 'S', 'N', 'A', 'P', 'S', 'H'}
+
+var (
+	// ErrBadMagic is returned when reading data which is not a snapshot.
+	ErrBadMagic = errors.New("not a cache snapshot")
+	// ErrUnsupportedVersion is returned when reading a snapshot written in
+	// an unknown format version.
+	ErrUnsupportedVersion = errors.New("unsupported snapshot version")
+	// ErrCorrupted is returned when a snapshot is truncated or fails its
+	// checksum.
+	ErrCorrupted = errors.New("corrupted snapshot")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Codec converts keys or values to and from their binary representation.
+type Codec interface {
+	Encode(v interface{}) ([]byte, error)
+	Decode(data []byte) (interface{}, error)
+}
+
+// Write writes the entries, ordered from oldest to newest, as a snapshot
+// to w, encoding keys and values with the given codecs.
+func Write(w io.Writer, entries []simplewlru.Entry, keys, values Codec) error {
+	return WriteVersion(w, Version, entries, keys, values)
+}
+
+// WriteVersion writes a snapshot like Write, but in the given format version,
+// so that it can be read by older releases. Metadata unknown to the version,
+// such as costs before version 2, is dropped. Versions outside of MinVersion
+// and Version fail with ErrUnsupportedVersion.
+func WriteVersion(w io.Writer, version uint16, entries []simplewlru.Entry, keys, values Codec) error {
+	if version < MinVersion || version > Version {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+	bw := bufio.NewWriter(w)
+	sum := crc32.New(castagnoli)
+	out := io.MultiWriter(bw, sum)
+
+	header := make([]byte, 0, 18)
+	header = append(header, magic[:]...)
+	header = binary.BigEndian.AppendUint16(header, version)
+	header = binary.BigEndian.AppendUint64(header, uint64(len(entries)))
+	if _, err := out.Write(header); err != nil {
+		return err
+	}
+
+	var record []byte
+	for _, e := range entries {
+		key, err := keys.Encode(e.Key)
+		if err != nil {
+			return fmt.Errorf("failed to encode key %v: %w", e.Key, err)
+		}
+		value, err := values.Encode(e.Value)
+		if err != nil {
+			return fmt.Errorf("failed to encode value of key %v: %w", e.Key, err)
+		}
+		record = record[:0]
+		record = binary.AppendUvarint(record, uint64(len(key)))
+		record = append(record, key...)
+		record = binary.AppendUvarint(record, uint64(len(value)))
+		record = append(record, value...)
+		record = binary.AppendUvarint(record, uint64(e.Weight))
+		record = binary.AppendUvarint(record, uint64(e.Age))
+		if version >= 2 {
+			record = binary.AppendUvarint(record, uint64(e.Cost))
+		}
+		if _, err := out.Write(binary.AppendUvarint(nil, uint64(len(record)))); err != nil {
+			return err
+		}
+		if _, err := out.Write(record); err != nil {
+			return err
+		}
+	}
+
+	if _, err := bw.Write(binary.BigEndian.AppendUint32(nil, sum.Sum32())); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Read reads a snapshot of any supported format version from r, decoding
+// keys and values with the given codecs. The entries are only returned once the whole snapshot has been
+// verified against its checksum.
+func Read(r io.Reader, keys, values Codec) ([]simplewlru.Entry, error) {
+	var entries []simplewlru.Entry
+	err := scan(r, keys, values, func(e simplewlru.Entry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// scan reads a snapshot from r, passing each entry to f as soon as it is
+// decoded. The checksum is verified after the last entry. Scanning stops at
+// the first error returned by f.
+func scan(r io.Reader, keys, values Codec, f func(simplewlru.Entry) error) error {
+	sum := crc32.New(castagnoli)
+	in := &checksumReader{r: bufio.NewReader(r), sum: sum}
+
+	var header [18]byte
+	if _, err := io.ReadFull(in, header[:]); err != nil {
+		return fmt.Errorf("%w: %v", ErrBadMagic, err)
+	}
+	if [8]byte(header[:8]) != magic {
+		return ErrBadMagic
+	}
+	version := binary.BigEndian.Uint16(header[8:])
+	if version < MinVersion || version > Version {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+	count := binary.BigEndian.Uint64(header[10:])
+
+	var record []byte
+	for i := uint64(0); i < count; i++ {
+		length, err := binary.ReadUvarint(in)
+		if err != nil {
+			return corrupted(err)
+		}
+		if length > maxRecordLength {
+			return fmt.Errorf("%w: record of %d bytes", ErrCorrupted, length)
+		}
+		if uint64(cap(record)) < length {
+			record = make([]byte, length)
+		}
+		record = record[:length]
+		if _, err := io.ReadFull(in, record); err != nil {
+			return corrupted(err)
+		}
+		e, err := decodeRecord(record, version, keys, values)
+		if err != nil {
+			return err
+		}
+		if err := f(e); err != nil {
+			return err
+		}
+	}
+
+	expected := sum.Sum32()
+	var checksum [4]byte
+	if _, err := io.ReadFull(in.r, checksum[:]); err != nil {
+		return corrupted(err)
+	}
+	if binary.BigEndian.Uint32(checksum[:]) != expected {
+		return fmt.Errorf("%w: checksum mismatch", ErrCorrupted)
+	}
+	return nil
+}
+
+// maxRecordLength bounds the size of a single record, so that a corrupted
+// length cannot trigger a huge allocation.
+const maxRecordLength = 1 << 30
+
+// decodeRecord decodes the body of an entry record of the given format
+// version.
+func decodeRecord(record []byte, version uint16, keys, values Codec) (simplewlru.Entry, error) {
+	var e simplewlru.Entry
+	rawKey, rest, err := readBytes(record)
+	if err != nil {
+		return e, err
+	}
+	rawValue, rest, err := readBytes(rest)
+	if err != nil {
+		return e, err
+	}
+	weight, n := binary.Uvarint(rest)
+	if n <= 0 {
+		return e, fmt.Errorf("%w: invalid weight", ErrCorrupted)
+	}
+	age, m := binary.Uvarint(rest[n:])
+	if m <= 0 {
+		return e, fmt.Errorf("%w: invalid age", ErrCorrupted)
+	}
+	rest = rest[n+m:]
+	var cost uint64
+	if version >= 2 {
+		if cost, n = binary.Uvarint(rest); n <= 0 {
+			return e, fmt.Errorf("%w: invalid cost", ErrCorrupted)
+		}
+		rest = rest[n:]
+	}
+	if len(rest) != 0 {
+		return e, fmt.Errorf("%w: trailing record data", ErrCorrupted)
+	}
+	if e.Key, err = keys.Decode(rawKey); err != nil {
+		return e, fmt.Errorf("failed to decode key: %w", err)
+	}
+	if e.Value, err = values.Decode(rawValue); err != nil {
+		return e, fmt.Errorf("failed to decode value of key %v: %w", e.Key, err)
+	}
+	e.Weight = uint(weight)
+	e.Age = time.Duration(age)
+	e.Cost = uint(cost)
+	return e, nil
+}
+
+// readBytes reads a length-prefixed byte string.
+func readBytes(data []byte) (value, rest []byte, err error) {
+	length, n := binary.Uvarint(data)
+	if n <= 0 || length > uint64(len(data)-n) {
+		return nil, nil, fmt.Errorf("%w: invalid length", ErrCorrupted)
+	}
+	end := n + int(length)
+	return data[n:end], data[end:], nil
+}
+
+// corrupted wraps an error encountered while reading a truncated snapshot.
+func corrupted(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: truncated", ErrCorrupted)
+	}
+	return err
+}
+
+// checksumReader feeds everything read through it into a checksum.
+type checksumReader struct {
+	r   *bufio.Reader
+	sum hash.Hash32
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.sum.Write(p[:n])
+	return n, err
+}
+
+func (c *checksumReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.sum.Write([]byte{b})
+	}
+	return b, err
+}
@@ -0,0 +1,246 @@
+package persist
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/0xsoniclabs/cacheutils/wlru"
+)
+
+// A log is a sequence of length-prefixed operation records:
+//
+//	length   uvarint   length of the record body
+//	body     operation (1 byte), key length (uvarint), key and, for adds,
+//	         value length (uvarint), value, weight (uvarint)
+//	checksum uint32    CRC-32C of the body
+//
+// A crash may leave a partially written record at the end of the log, which
+// is ignored on replay. A damaged record followed by others is not the
+// result of a crash and fails replay.
+
+const (
+	opAdd    byte = 1
+	opRemove byte = 2
+)
+
+// Log is an append-only log of cache writes. It is not safe for concurrent
+// use.
+type Log struct {
+	file   *os.File
+	w      *bufio.Writer
+	keys   Codec
+	values Codec
+	record []byte
+}
+
+// OpenLog opens the log at path for appending, creating it if necessary.
+func OpenLog(path string, keys, values Codec) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{file: f, w: bufio.NewWriter(f), keys: keys, values: values}, nil
+}
+
+// Add records the addition of a value.
+func (l *Log) Add(key, value interface{}, weight uint) error {
+	if l.file == nil {
+		return cacheutils.ErrClosed
+	}
+	rawKey, err := l.keys.Encode(key)
+	if err != nil {
+		return fmt.Errorf("failed to encode key %v: %w", key, err)
+	}
+	rawValue, err := l.values.Encode(value)
+	if err != nil {
+		return fmt.Errorf("failed to encode value of key %v: %w", key, err)
+	}
+	l.record = append(l.record[:0], opAdd)
+	l.record = binary.AppendUvarint(l.record, uint64(len(rawKey)))
+	l.record = append(l.record, rawKey...)
+	l.record = binary.AppendUvarint(l.record, uint64(len(rawValue)))
+	l.record = append(l.record, rawValue...)
+	l.record = binary.AppendUvarint(l.record, uint64(weight))
+	return l.append()
+}
+
+// Remove records the removal of a key.
+func (l *Log) Remove(key interface{}) error {
+	if l.file == nil {
+		return cacheutils.ErrClosed
+	}
+	rawKey, err := l.keys.Encode(key)
+	if err != nil {
+		return fmt.Errorf("failed to encode key %v: %w", key, err)
+	}
+	l.record = append(l.record[:0], opRemove)
+	l.record = binary.AppendUvarint(l.record, uint64(len(rawKey)))
+	l.record = append(l.record, rawKey...)
+	return l.append()
+}
+
+// append writes the current record and hands it to the operating system.
+func (l *Log) append() error {
+	var prefix [binary.MaxVarintLen64]byte
+	if _, err := l.w.Write(prefix[:binary.PutUvarint(prefix[:], uint64(len(l.record)))]); err != nil {
+		return err
+	}
+	if _, err := l.w.Write(l.record); err != nil {
+		return err
+	}
+	if _, err := l.w.Write(binary.BigEndian.AppendUint32(nil, crc32.Checksum(l.record, castagnoli))); err != nil {
+		return err
+	}
+	return l.w.Flush()
+}
+
+// Sync commits the log to stable storage.
+func (l *Log) Sync() error {
+	if l.file == nil {
+		return cacheutils.ErrClosed
+	}
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// Close syncs and closes the log. Operations on a closed log fail with
+// ErrClosed.
+func (l *Log) Close() error {
+	err := l.Sync()
+	if err == cacheutils.ErrClosed {
+		return err
+	}
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	l.file = nil
+	return err
+}
+
+// ReplayLog applies the operations recorded in the log at path to the cache,
+// returning the number of applied operations. A missing log is treated as
+// empty; replay stops silently at a partially written final record. A
+// corrupted record before the end of the log fails with ErrCorrupted.
+func ReplayLog(path string, c *wlru.Cache, keys, values Codec) (int, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var record []byte
+	for applied := 0; ; applied++ {
+		length, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return applied, nil
+		}
+		if err != nil {
+			return applied, tornRecord(err)
+		}
+		if length > maxRecordLength {
+			return applied, fmt.Errorf("%w: log record %d too long", ErrCorrupted, applied+1)
+		}
+		if uint64(cap(record)) < length+4 {
+			record = make([]byte, length+4)
+		}
+		record = record[:length+4]
+		if n, err := io.ReadFull(r, record); err != nil {
+			// A record cut short by the end of the log is torn, unless its
+			// length is corrupted and it swallowed intact records.
+			if err == io.ErrUnexpectedEOF && holdsRecord(record[:n]) {
+				return applied, fmt.Errorf("%w: log record %d exceeds the log", ErrCorrupted, applied+1)
+			}
+			return applied, tornRecord(err)
+		}
+		body := record[:length]
+		if binary.BigEndian.Uint32(record[length:]) != crc32.Checksum(body, castagnoli) {
+			// Only the final record may be torn by a crash.
+			if _, err := r.Peek(1); err != io.EOF {
+				if err == nil {
+					err = fmt.Errorf("%w: checksum mismatch in log record %d", ErrCorrupted, applied+1)
+				}
+				return applied, err
+			}
+			return applied, nil
+		}
+		if err := applyRecord(c, body, keys, values); err != nil {
+			return applied, err
+		}
+	}
+}
+
+// holdsRecord returns whether data contains a complete record with a valid
+// checksum at any offset.
+func holdsRecord(data []byte) bool {
+	for i := range data {
+		length, n := binary.Uvarint(data[i:])
+		if n <= 0 || length > uint64(len(data)-i-n) || uint64(len(data)-i-n)-length < 4 {
+			continue
+		}
+		body := data[i+n : i+n+int(length)]
+		if binary.BigEndian.Uint32(data[i+n+int(length):]) == crc32.Checksum(body, castagnoli) {
+			return true
+		}
+	}
+	return false
+}
+
+// tornRecord handles an incomplete record. Only the end of the log may be
+// torn, so replay ends there.
+func tornRecord(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil
+	}
+	return err
+}
+
+// applyRecord applies a single operation to the cache.
+func applyRecord(c *wlru.Cache, body []byte, keys, values Codec) error {
+	if len(body) == 0 {
+		return fmt.Errorf("%w: empty log record", ErrCorrupted)
+	}
+	rawKey, rest, err := readBytes(body[1:])
+	if err != nil {
+		return err
+	}
+	key, err := keys.Decode(rawKey)
+	if err != nil {
+		return fmt.Errorf("failed to decode key: %w", err)
+	}
+	switch body[0] {
+	case opAdd:
+		rawValue, rest, err := readBytes(rest)
+		if err != nil {
+			return err
+		}
+		weight, n := binary.Uvarint(rest)
+		if n <= 0 || n != len(rest) {
+			return fmt.Errorf("%w: invalid weight", ErrCorrupted)
+		}
+		value, err := values.Decode(rawValue)
+		if err != nil {
+			return fmt.Errorf("failed to decode value of key %v: %w", key, err)
+		}
+		c.Add(key, value, uint(weight))
+	case opRemove:
+		if len(rest) != 0 {
+			return fmt.Errorf("%w: invalid remove record", ErrCorrupted)
+		}
+		c.Remove(key)
+	default:
+		return fmt.Errorf("%w: unknown log operation %d", ErrCorrupted, body[0])
+	}
+	return nil
+}
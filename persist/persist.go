@@ -0,0 +1,91 @@
+package persist
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/0xsoniclabs/cacheutils/simplewlru"
+	"github.com/0xsoniclabs/cacheutils/wlru"
+)
+
+// Save writes a snapshot of the entries of the cache passing the filter to w.
+func Save(c *wlru.Cache, w io.Writer, filter wlru.SnapshotFilter, keys, values Codec) error {
+	return Write(w, c.Snapshot(filter), keys, values)
+}
+
+// Restore reads a snapshot from r and fills the empty cache with its
+// entries, restoring their recency order, ages and costs, see
+// wlru.Cache.Fill.
+// Nothing is added if the snapshot is invalid or the cache is not empty.
+func Restore(c *wlru.Cache, r io.Reader, keys, values Codec) error {
+	entries, err := Read(r, keys, values)
+	if err != nil {
+		return err
+	}
+	return c.Fill(entries)
+}
+
+// StringCodec encodes string keys or values.
+var StringCodec Codec = stringCodec{}
+
+// BytesCodec encodes []byte keys or values.
+var BytesCodec Codec = bytesCodec{}
+
+type stringCodec struct{}
+
+func (stringCodec) Encode(v interface{}) ([]byte, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, errors.New("not a string")
+	}
+	return []byte(s), nil
+}
+
+func (stringCodec) Decode(data []byte) (interface{}, error) {
+	return string(data), nil
+}
+
+type bytesCodec struct{}
+
+func (bytesCodec) Encode(v interface{}) ([]byte, error) {
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, errors.New("not a byte slice")
+	}
+	return b, nil
+}
+
+func (bytesCodec) Decode(data []byte) (interface{}, error) {
+	return append([]byte{}, data...), nil
+}
+
+// WarmFrom reads a snapshot from r and adds its entries to the cache while
+// reading, at most perSecond of them per second if perSecond is positive,
+// see wlru.Cache.WarmFrom. Unlike Restore, the snapshot is streamed rather
+// than loaded in full, so an invalid snapshot is only detected once the
+// entries preceding the corruption have been added. Returns the number of
+// added entries.
+func WarmFrom(ctx context.Context, c *wlru.Cache, r io.Reader, keys, values Codec, perSecond int) (added int, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	entries := make(chan wlru.Entry)
+	read := make(chan error, 1)
+	go func() {
+		defer close(entries)
+		read <- scan(r, keys, values, func(e simplewlru.Entry) error {
+			select {
+			case entries <- e:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+	added, err = c.WarmFrom(ctx, entries, perSecond)
+	cancel()
+	if readErr := <-read; err == nil {
+		err = readErr
+	}
+	return added, err
+}
@@ -0,0 +1,476 @@
+package persist
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/0xsoniclabs/cacheutils/clock"
+	"github.com/0xsoniclabs/cacheutils/simplewlru"
+	"github.com/0xsoniclabs/cacheutils/wlru"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteRead_RoundTrip(t *testing.T) {
+	entries := []simplewlru.Entry{
+		{Key: "a", Value: []byte("A"), Weight: 1, Age: time.Second, Cost: 3},
+		{Key: "b", Value: []byte{}, Weight: 1 << 40, Age: 0},
+		{Key: "", Value: []byte("C"), Weight: 0, Age: time.Hour},
+	}
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, entries, StringCodec, BytesCodec))
+
+	read, err := Read(&buf, StringCodec, BytesCodec)
+	require.NoError(t, err)
+	assert.Equal(t, entries, read)
+}
+
+func TestWriteVersion(t *testing.T) {
+	entries := []simplewlru.Entry{{Key: "a", Value: []byte("A"), Weight: 1, Age: time.Second, Cost: 3}}
+	var buf bytes.Buffer
+	require.NoError(t, WriteVersion(&buf, 1, entries, StringCodec, BytesCodec))
+	assert.Equal(t, uint16(1), binary.BigEndian.Uint16(buf.Bytes()[8:]))
+	read, err := Read(&buf, StringCodec, BytesCodec)
+	require.NoError(t, err)
+	assert.Equal(t, []simplewlru.Entry{{Key: "a", Value: []byte("A"), Weight: 1, Age: time.Second}}, read,
+		"version 1 holds no costs")
+
+	for _, version := range []uint16{MinVersion - 1, Version + 1} {
+		err := WriteVersion(&buf, version, entries, StringCodec, BytesCodec)
+		assert.ErrorIs(t, err, ErrUnsupportedVersion)
+	}
+}
+
+func TestWriteRead_Empty(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, nil, StringCodec, BytesCodec))
+	read, err := Read(&buf, StringCodec, BytesCodec)
+	require.NoError(t, err)
+	assert.Empty(t, read)
+}
+
+func TestRead_DetectsInvalidSnapshots(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, []simplewlru.Entry{
+		{Key: "a", Value: []byte("A"), Weight: 1},
+		{Key: "b", Value: []byte("B"), Weight: 2},
+	}, StringCodec, BytesCodec))
+	valid := buf.Bytes()
+
+	modified := func(f func(data []byte) []byte) []byte {
+		return f(append([]byte(nil), valid...))
+	}
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"empty", nil, ErrBadMagic},
+		{"bad magic", modified(func(d []byte) []byte { d[0] = 'X'; return d }), ErrBadMagic},
+		{"unknown version", modified(func(d []byte) []byte {
+			binary.BigEndian.PutUint16(d[8:], Version+1)
+			return d
+		}), ErrUnsupportedVersion},
+		{"version 0", modified(func(d []byte) []byte {
+			binary.BigEndian.PutUint16(d[8:], 0)
+			return d
+		}), ErrUnsupportedVersion},
+		{"flipped bit", modified(func(d []byte) []byte { d[len(d)-8] ^= 1; return d }), ErrCorrupted},
+		{"bad checksum", modified(func(d []byte) []byte { d[len(d)-1] ^= 1; return d }), ErrCorrupted},
+		{"truncated", valid[:len(valid)-6], ErrCorrupted},
+		{"missing checksum", valid[:len(valid)-4], ErrCorrupted},
+		{"extra count", modified(func(d []byte) []byte {
+			binary.BigEndian.PutUint64(d[10:], 3)
+			return d
+		}), ErrCorrupted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Read(bytes.NewReader(tt.data), StringCodec, BytesCodec)
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+}
+
+func TestWrite_CodecErrors(t *testing.T) {
+	var buf bytes.Buffer
+	err := Write(&buf, []simplewlru.Entry{{Key: 1, Value: []byte("A")}}, StringCodec, BytesCodec)
+	assert.Error(t, err)
+	err = Write(&buf, []simplewlru.Entry{{Key: "a", Value: "A"}}, StringCodec, BytesCodec)
+	assert.Error(t, err)
+}
+
+func TestSaveRestore(t *testing.T) {
+	cache, _ := wlru.New(100, 100)
+	cache.Add("a", "A", 1)
+	cache.Add("b", "B", 2)
+	cache.Add("secret", "S", 3)
+	cache.Get("a")
+
+	var buf bytes.Buffer
+	require.NoError(t, Save(cache, &buf, wlru.SnapshotFilter{
+		Include: func(key, value interface{}) bool { return key != "secret" },
+	}, StringCodec, StringCodec))
+	snapshot := buf.Bytes()
+
+	restored, _ := wlru.New(100, 100)
+	require.NoError(t, Restore(restored, bytes.NewReader(snapshot), StringCodec, StringCodec))
+	assert.Equal(t, []interface{}{"b", "a"}, restored.Keys())
+	assert.Equal(t, uint(3), restored.Weight())
+
+	corrupted := append([]byte(nil), snapshot...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	empty, _ := wlru.New(100, 100)
+	err := Restore(empty, bytes.NewReader(corrupted), StringCodec, StringCodec)
+	assert.True(t, errors.Is(err, ErrCorrupted))
+	assert.Equal(t, 0, empty.Len())
+}
+
+func TestSaveRestore_KeepsOrderAndAges(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	var evicted []interface{}
+	newCache := func() *wlru.Cache {
+		c, _ := wlru.NewWithEvict(4, 4, func(key, value interface{}) {
+			evicted = append(evicted, key)
+		}, wlru.WithClock(fake))
+		return c
+	}
+	cache := newCache()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		cache.Add(key, key, 1)
+		fake.Advance(time.Second)
+	}
+	cache.Get("a")
+	cache.Get("c")
+
+	var buf bytes.Buffer
+	require.NoError(t, Save(cache, &buf, wlru.SnapshotFilter{}, StringCodec, StringCodec))
+	restored := newCache()
+	require.NoError(t, Restore(restored, bytes.NewReader(buf.Bytes()), StringCodec, StringCodec))
+	want, got := cache.OrderedEntries(), restored.OrderedEntries()
+	require.Len(t, got, len(want))
+	for i := range want {
+		assert.Equal(t, want[i].Key, got[i].Key)
+		assert.Equal(t, want[i].Age, got[i].Age)
+	}
+
+	// Both caches evict in the same order.
+	for i := 0; i < 4; i++ {
+		evicted = nil
+		cache.Add(i, i, 1)
+		want := evicted
+		evicted = nil
+		restored.Add(i, i, 1)
+		assert.Equal(t, want, evicted)
+	}
+	assert.Equal(t, []interface{}{0, 1, 2, 3}, restored.Keys())
+
+	// Only an empty cache is restored.
+	assert.Error(t, Restore(restored, bytes.NewReader(buf.Bytes()), StringCodec, StringCodec))
+	assert.Equal(t, []interface{}{0, 1, 2, 3}, restored.Keys())
+}
+
+func TestPersister_SaveAndRestoreFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snap")
+	cache, _ := wlru.New(100, 100)
+	p := New(cache, StringCodec, StringCodec, wlru.SnapshotFilter{})
+
+	assert.Error(t, p.RestoreFile(path))
+
+	cache.Add("a", "A", 1)
+	require.NoError(t, p.SaveFile(path))
+	cache.Add("b", "B", 1)
+	require.NoError(t, p.SaveFile(path))
+	_, err := os.Stat(path + PreviousSuffix)
+	require.NoError(t, err)
+
+	restored, _ := wlru.New(100, 100)
+	require.NoError(t, New(restored, StringCodec, StringCodec, wlru.SnapshotFilter{}).RestoreFile(path))
+	assert.Equal(t, []interface{}{"a", "b"}, restored.Keys())
+
+	// A corrupted snapshot falls back to the previous one.
+	require.NoError(t, os.WriteFile(path, []byte("garbage"), 0o600))
+	restored, _ = wlru.New(100, 100)
+	require.NoError(t, New(restored, StringCodec, StringCodec, wlru.SnapshotFilter{}).RestoreFile(path))
+	assert.Equal(t, []interface{}{"a"}, restored.Keys())
+}
+
+func TestPersister_PeriodicSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snap")
+	cache, _ := wlru.New(100, 100)
+	cache.Add("a", "A", 1)
+	clk := clock.NewFake(time.Unix(1000, 0))
+	p := New(cache, StringCodec, StringCodec, wlru.SnapshotFilter{}, WithClock(clk))
+
+	assert.Error(t, p.StartPeriodicSnapshot(0, path))
+	require.NoError(t, p.StartPeriodicSnapshot(time.Minute, path))
+	assert.Error(t, p.StartPeriodicSnapshot(time.Minute, path))
+
+	clk.Advance(59 * time.Second)
+	_, err := os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist, "no snapshot before the interval passed")
+	clk.Advance(time.Second)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, time.Second, time.Millisecond)
+	clk.Advance(time.Minute)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(path + PreviousSuffix)
+		return err == nil
+	}, time.Second, time.Millisecond)
+	p.StopPeriodicSnapshot()
+	p.StopPeriodicSnapshot()
+	assert.NoError(t, p.LastError())
+
+	restored, _ := wlru.New(100, 100)
+	require.NoError(t, New(restored, StringCodec, StringCodec, wlru.SnapshotFilter{}).RestoreFile(path))
+	assert.True(t, restored.Contains("a"))
+
+	// Background errors are reported.
+	cache.Add(1, "not a string key", 1)
+	require.NoError(t, p.StartPeriodicSnapshot(time.Minute, path))
+	clk.Advance(time.Minute)
+	assert.Eventually(t, func() bool { return p.LastError() != nil }, time.Second, time.Millisecond)
+	p.StopPeriodicSnapshot()
+}
+
+func TestLog_Replay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.log")
+	log, err := OpenLog(path, StringCodec, StringCodec)
+	require.NoError(t, err)
+	require.NoError(t, log.Add("a", "A", 1))
+	require.NoError(t, log.Add("b", "B", 2))
+	require.NoError(t, log.Remove("a"))
+	require.NoError(t, log.Add("c", "C", 3))
+	assert.Error(t, log.Add(1, "A", 1))
+	assert.Error(t, log.Remove(1))
+	require.NoError(t, log.Close())
+	assert.ErrorIs(t, log.Add("d", "D", 1), cacheutils.ErrClosed)
+	assert.ErrorIs(t, log.Remove("d"), cacheutils.ErrClosed)
+	assert.ErrorIs(t, log.Close(), cacheutils.ErrClosed)
+
+	cache, _ := wlru.New(100, 100)
+	applied, err := ReplayLog(path, cache, StringCodec, StringCodec)
+	require.NoError(t, err)
+	assert.Equal(t, 4, applied)
+	assert.Equal(t, []interface{}{"b", "c"}, cache.Keys())
+	assert.Equal(t, uint(5), cache.Weight())
+
+	// A torn final record is ignored.
+	data, _ := os.ReadFile(path)
+	require.NoError(t, os.WriteFile(path, data[:len(data)-2], 0o600))
+	cache, _ = wlru.New(100, 100)
+	applied, err = ReplayLog(path, cache, StringCodec, StringCodec)
+	require.NoError(t, err)
+	assert.Equal(t, 3, applied)
+	assert.Equal(t, []interface{}{"b"}, cache.Keys())
+
+	// So is a final record failing its checksum, but not an earlier one.
+	corrupted := append([]byte(nil), data...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(path, corrupted, 0o600))
+	cache, _ = wlru.New(100, 100)
+	applied, err = ReplayLog(path, cache, StringCodec, StringCodec)
+	require.NoError(t, err)
+	assert.Equal(t, 3, applied)
+	corrupted = append([]byte(nil), data...)
+	corrupted[2] ^= 0xff
+	require.NoError(t, os.WriteFile(path, corrupted, 0o600))
+	cache, _ = wlru.New(100, 100)
+	applied, err = ReplayLog(path, cache, StringCodec, StringCodec)
+	assert.ErrorIs(t, err, ErrCorrupted)
+	assert.Equal(t, 0, applied)
+
+	// A length swallowing the records after it is not mistaken for a torn
+	// final record.
+	corrupted = append([]byte(nil), data...)
+	corrupted[11] = 0x7f
+	require.NoError(t, os.WriteFile(path, corrupted, 0o600))
+	cache, _ = wlru.New(100, 100)
+	applied, err = ReplayLog(path, cache, StringCodec, StringCodec)
+	assert.ErrorIs(t, err, ErrCorrupted)
+	assert.Equal(t, 1, applied)
+
+	applied, err = ReplayLog(path+".missing", cache, StringCodec, StringCodec)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, applied)
+}
+
+func TestWarmFrom(t *testing.T) {
+	source, _ := wlru.New(100, 100)
+	source.Add("a", "A", 1)
+	source.Add("b", "B", 2)
+	var buf bytes.Buffer
+	require.NoError(t, Save(source, &buf, wlru.SnapshotFilter{}, StringCodec, StringCodec))
+	data := buf.Bytes()
+
+	cache, _ := wlru.New(100, 100)
+	added, err := WarmFrom(context.Background(), cache, bytes.NewReader(data), StringCodec, StringCodec, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 2, added)
+	assert.Equal(t, []interface{}{"a", "b"}, cache.Keys())
+
+	// Corruption is detected after the preceding entries were added.
+	corrupted := append([]byte(nil), data...)
+	corrupted[len(corrupted)-1] ^= 1
+	cache, _ = wlru.New(100, 100)
+	added, err = WarmFrom(context.Background(), cache, bytes.NewReader(corrupted), StringCodec, StringCodec, 1000)
+	assert.ErrorIs(t, err, ErrCorrupted)
+	assert.Equal(t, 2, added)
+}
+
+func TestPersister_SnapshotAndLog(t *testing.T) {
+	dir := t.TempDir()
+	snapshot, log := filepath.Join(dir, "cache.snap"), filepath.Join(dir, "cache.log")
+
+	cache, _ := wlru.New(100, 100)
+	p := New(cache, StringCodec, StringCodec, wlru.SnapshotFilter{})
+	require.NoError(t, p.OpenLog(log))
+	assert.Error(t, p.OpenLog(log))
+	_, err := p.Add("a", "A", 1)
+	require.NoError(t, err)
+	_, err = p.Add("b", "B", 1)
+	require.NoError(t, err)
+	require.NoError(t, p.SaveFile(snapshot))
+	_, err = os.Stat(log + RotatedSuffix)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	// Writes after the snapshot are only in the log.
+	_, err = p.Add("c", "C", 1)
+	require.NoError(t, err)
+	present, err := p.Remove("a")
+	require.NoError(t, err)
+	assert.True(t, present)
+	require.NoError(t, p.CloseLog())
+	require.NoError(t, p.CloseLog())
+
+	recovered, _ := wlru.New(100, 100)
+	r := New(recovered, StringCodec, StringCodec, wlru.SnapshotFilter{})
+	require.NoError(t, r.RestoreFile(snapshot))
+	applied, err := r.ReplayLog(log)
+	require.NoError(t, err)
+	assert.Equal(t, 2, applied)
+	assert.Equal(t, []interface{}{"b", "c"}, recovered.Keys())
+}
+
+func TestPersister_ConcurrentSaves(t *testing.T) {
+	dir := t.TempDir()
+	snapshot, log := filepath.Join(dir, "cache.snap"), filepath.Join(dir, "cache.log")
+
+	cache, _ := wlru.New(100, 100)
+	p := New(cache, StringCodec, StringCodec, wlru.SnapshotFilter{})
+	require.NoError(t, p.OpenLog(log))
+	var wg sync.WaitGroup
+	errs := make(chan error, 160)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				_, err := p.Add(strconv.Itoa(j), "v", 1)
+				errs <- err
+				errs <- p.SaveFile(snapshot)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	// The last snapshot holds all entries, so nothing is left to replay.
+	require.NoError(t, p.CloseLog())
+	recovered, _ := wlru.New(100, 100)
+	r := New(recovered, StringCodec, StringCodec, wlru.SnapshotFilter{})
+	require.NoError(t, r.RestoreFile(snapshot))
+	assert.Equal(t, 10, recovered.Len())
+	applied, err := r.ReplayLog(log)
+	require.NoError(t, err)
+	assert.Equal(t, 0, applied)
+}
+
+func TestPersister_Close(t *testing.T) {
+	dir := t.TempDir()
+	snapshot, log := filepath.Join(dir, "cache.snap"), filepath.Join(dir, "cache.log")
+
+	cache, _ := wlru.New(100, 100)
+	p := New(cache, StringCodec, StringCodec, wlru.SnapshotFilter{})
+	require.NoError(t, p.OpenLog(log))
+	require.NoError(t, p.StartPeriodicSnapshot(time.Millisecond, snapshot))
+	_, err := p.Add("a", "A", 1)
+	require.NoError(t, err)
+	require.NoError(t, p.Close())
+
+	_, err = p.Add("b", "B", 1)
+	assert.ErrorIs(t, err, cacheutils.ErrClosed)
+	_, err = p.Remove("a")
+	assert.ErrorIs(t, err, cacheutils.ErrClosed)
+	assert.ErrorIs(t, p.SaveFile(snapshot), cacheutils.ErrClosed)
+	assert.ErrorIs(t, p.StartPeriodicSnapshot(time.Millisecond, snapshot), cacheutils.ErrClosed)
+	assert.ErrorIs(t, p.OpenLog(log), cacheutils.ErrClosed)
+	assert.ErrorIs(t, p.Close(), cacheutils.ErrClosed)
+	assert.Equal(t, []interface{}{"a"}, cache.Keys())
+
+	recovered, _ := wlru.New(100, 100)
+	applied, err := New(recovered, StringCodec, StringCodec, wlru.SnapshotFilter{}).ReplayLog(log)
+	require.NoError(t, err)
+	assert.Equal(t, 1, applied)
+}
+
+func TestPersister_ShutdownIsBoundedByContext(t *testing.T) {
+	dir := t.TempDir()
+	cache, _ := wlru.New(100, 100)
+	p := New(cache, StringCodec, StringCodec, wlru.SnapshotFilter{})
+	require.NoError(t, p.OpenLog(filepath.Join(dir, "cache.log")))
+	require.NoError(t, p.StartPeriodicSnapshot(time.Hour, filepath.Join(dir, "cache.snap")))
+
+	// A snapshot in progress holds the lock.
+	p.lock.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, p.Shutdown(ctx), context.DeadlineExceeded)
+	_, err := p.Add("a", "A", 1)
+	assert.ErrorIs(t, err, cacheutils.ErrClosed)
+	p.lock.Unlock()
+
+	assert.Eventually(t, func() bool {
+		p.logLock.Lock()
+		defer p.logLock.Unlock()
+		return p.log == nil
+	}, time.Second, time.Millisecond)
+	assert.ErrorIs(t, p.Shutdown(context.Background()), cacheutils.ErrClosed)
+}
+
+func TestPersister_InterruptedSnapshotKeepsRotatedLog(t *testing.T) {
+	dir := t.TempDir()
+	log := filepath.Join(dir, "cache.log")
+	cache, _ := wlru.New(100, 100)
+	p := New(cache, StringCodec, StringCodec, wlru.SnapshotFilter{})
+	require.NoError(t, p.OpenLog(log))
+	_, err := p.Add("a", "A", 1)
+	require.NoError(t, err)
+
+	// Saving into a missing directory fails after the log was rotated.
+	assert.Error(t, p.SaveFile(filepath.Join(dir, "missing", "cache.snap")))
+	_, err = p.Add("b", "B", 1)
+	require.NoError(t, err)
+	assert.Error(t, p.SaveFile(filepath.Join(dir, "missing", "cache.snap")))
+	require.NoError(t, p.CloseLog())
+
+	recovered, _ := wlru.New(100, 100)
+	applied, err := New(recovered, StringCodec, StringCodec, wlru.SnapshotFilter{}).ReplayLog(log)
+	require.NoError(t, err)
+	assert.Equal(t, 2, applied)
+	assert.Equal(t, []interface{}{"a", "b"}, recovered.Keys())
+}
@@ -0,0 +1,351 @@
+package persist
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/0xsoniclabs/cacheutils/clock"
+	"github.com/0xsoniclabs/cacheutils/wlru"
+)
+
+// PreviousSuffix is appended to the path of a snapshot file to name the
+// rotated previous snapshot.
+const PreviousSuffix = ".prev"
+
+// Persister saves snapshots of a cache to files and restores them.
+type Persister struct {
+	cache  *wlru.Cache
+	keys   Codec
+	values Codec
+	filter wlru.SnapshotFilter
+	clock  clock.Clock
+
+	lock    sync.Mutex // serializes snapshot files and background control
+	stop    chan struct{}
+	done    chan struct{}
+	lastErr error
+
+	logLock sync.Mutex // orders logged writes and log rotation
+	log     *Log
+	logPath string
+
+	closed atomic.Bool
+}
+
+// RotatedSuffix is appended to the path of a log to name the log rotated
+// out while a snapshot is taken.
+const RotatedSuffix = ".old"
+
+// Option configures optional behaviour of a Persister.
+type Option func(*Persister)
+
+// WithClock sets the clock driving periodic snapshots. The default is
+// clock.Real.
+func WithClock(c clock.Clock) Option {
+	return func(p *Persister) {
+		p.clock = c
+	}
+}
+
+// New creates a persister for the given cache, encoding keys and values with
+// the given codecs. Only entries passing the filter are saved.
+func New(c *wlru.Cache, keys, values Codec, filter wlru.SnapshotFilter, opts ...Option) *Persister {
+	p := &Persister{
+		cache:  c,
+		keys:   keys,
+		values: values,
+		filter: filter,
+		clock:  clock.Real,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// SaveFile writes a snapshot of the cache to path. The snapshot is written to
+// a temporary file first; an existing snapshot at path is kept as the
+// previous snapshot at path+PreviousSuffix.
+//
+// Writers are only blocked while the entries of a shard are copied; encoding
+// and I/O happen without holding any cache lock.
+//
+// If a log is open, it is rotated before the snapshot is taken and the
+// rotated log is deleted once the snapshot has been saved. Concurrent saves
+// are serialized, so that a snapshot never replaces a newer one.
+func (p *Persister) SaveFile(path string) error {
+	if p.closed.Load() {
+		return cacheutils.ErrClosed
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	rotated, err := p.rotateLog()
+	if err != nil {
+		return err
+	}
+	entries := p.cache.Snapshot(p.filter)
+	if err := p.saveFile(path, entries); err != nil {
+		return err
+	}
+	if rotated != "" {
+		if err := os.Remove(rotated); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveFile writes the entries to path. It must be called while holding the
+// lock.
+func (p *Persister) saveFile(path string, entries []wlru.Entry) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := Write(f, entries, p.keys, p.values); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(path, path+PreviousSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// RestoreFile fills the empty cache with the entries of the snapshot at
+// path, see Restore. If that snapshot is missing or invalid, the previous
+// snapshot is tried instead.
+func (p *Persister) RestoreFile(path string) error {
+	err := p.restoreFile(path)
+	if err == nil {
+		return nil
+	}
+	if prevErr := p.restoreFile(path + PreviousSuffix); prevErr == nil {
+		return nil
+	}
+	return err
+}
+
+func (p *Persister) restoreFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return Restore(p.cache, f, p.keys, p.values)
+}
+
+// StartPeriodicSnapshot saves a snapshot of the cache to path every interval
+// in the background until StopPeriodicSnapshot is called. Errors of
+// background snapshots are reported by LastError.
+func (p *Persister) StartPeriodicSnapshot(interval time.Duration, path string) error {
+	if interval <= 0 {
+		return errors.New("must provide a positive interval")
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed.Load() {
+		return cacheutils.ErrClosed
+	}
+	if p.stop != nil {
+		return errors.New("periodic snapshot already running")
+	}
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go p.run(p.clock.NewTicker(interval), path, p.stop, p.done)
+	return nil
+}
+
+// StopPeriodicSnapshot stops periodic snapshots and waits for a snapshot in
+// progress to finish. It does nothing if no periodic snapshot is running.
+func (p *Persister) StopPeriodicSnapshot() {
+	p.lock.Lock()
+	stop, done := p.stop, p.done
+	p.stop, p.done = nil, nil
+	p.lock.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// LastError returns the error of the most recent background snapshot, or nil
+// if it succeeded.
+func (p *Persister) LastError() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.lastErr
+}
+
+func (p *Persister) run(ticker clock.Ticker, path string, stop, done chan struct{}) {
+	defer close(done)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C():
+			err := p.SaveFile(path)
+			p.lock.Lock()
+			p.lastErr = err
+			p.lock.Unlock()
+		}
+	}
+}
+
+// OpenLog starts logging the writes made through Add and Remove to the log at
+// path, so that they can be replayed on top of the last snapshot after a
+// restart. Recover earlier writes with ReplayLog before opening the log.
+func (p *Persister) OpenLog(path string) error {
+	p.logLock.Lock()
+	defer p.logLock.Unlock()
+	if p.closed.Load() {
+		return cacheutils.ErrClosed
+	}
+	if p.log != nil {
+		return errors.New("log already open")
+	}
+	log, err := OpenLog(path, p.keys, p.values)
+	if err != nil {
+		return err
+	}
+	p.log, p.logPath = log, path
+	return nil
+}
+
+// CloseLog stops logging writes and closes the log.
+func (p *Persister) CloseLog() error {
+	p.logLock.Lock()
+	defer p.logLock.Unlock()
+	if p.log == nil {
+		return nil
+	}
+	err := p.log.Close()
+	p.log = nil
+	return err
+}
+
+// Close stops periodic snapshots, waiting for a snapshot in progress to
+// finish, and syncs and closes the log. Afterwards, SaveFile,
+// StartPeriodicSnapshot, OpenLog, Add and Remove fail with ErrClosed, as does
+// closing the persister again. Restoring snapshots and replaying logs
+// remain possible.
+func (p *Persister) Close() error {
+	if !p.closed.CompareAndSwap(false, true) {
+		return cacheutils.ErrClosed
+	}
+	return p.stopAll()
+}
+
+// stopAll stops periodic snapshots and closes the log.
+func (p *Persister) stopAll() error {
+	p.StopPeriodicSnapshot()
+	return p.CloseLog()
+}
+
+// Shutdown closes the persister like Close, waiting for a snapshot in
+// progress at most until the context is done. In that case the context's
+// error is returned and closing completes in the background; the persister
+// is closed for new operations either way.
+func (p *Persister) Shutdown(ctx context.Context) error {
+	if !p.closed.CompareAndSwap(false, true) {
+		return cacheutils.ErrClosed
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- p.stopAll()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ReplayLog applies the writes logged at path to the cache, including those
+// in a log rotated out by an interrupted snapshot. Returns the number of
+// applied writes.
+func (p *Persister) ReplayLog(path string) (int, error) {
+	rotated, err := ReplayLog(path+RotatedSuffix, p.cache, p.keys, p.values)
+	if err != nil {
+		return rotated, err
+	}
+	current, err := ReplayLog(path, p.cache, p.keys, p.values)
+	return rotated + current, err
+}
+
+// Add adds a value to the cache and logs the write if a log is open.
+// Logged writes are serialized to keep the log in cache order.
+func (p *Persister) Add(key, value interface{}, weight uint) (evicted int, err error) {
+	p.logLock.Lock()
+	defer p.logLock.Unlock()
+	if p.closed.Load() {
+		return 0, cacheutils.ErrClosed
+	}
+	evicted = p.cache.Add(key, value, weight)
+	if p.log != nil {
+		err = p.log.Add(key, value, weight)
+	}
+	return evicted, err
+}
+
+// Remove removes the key from the cache and logs the write if a log is open.
+func (p *Persister) Remove(key interface{}) (present bool, err error) {
+	p.logLock.Lock()
+	defer p.logLock.Unlock()
+	if p.closed.Load() {
+		return false, cacheutils.ErrClosed
+	}
+	present = p.cache.Remove(key)
+	if p.log != nil {
+		err = p.log.Remove(key)
+	}
+	return present, err
+}
+
+// rotateLog moves the open log aside so that a snapshot can supersede it,
+// returning the path of the rotated log. If a previously rotated log was not
+// superseded yet, the log keeps growing instead; replaying writes already
+// contained in a snapshot is harmless.
+func (p *Persister) rotateLog() (string, error) {
+	p.logLock.Lock()
+	defer p.logLock.Unlock()
+	if p.log == nil {
+		return "", nil
+	}
+	rotated := p.logPath + RotatedSuffix
+	if _, err := os.Stat(rotated); err == nil {
+		return rotated, nil
+	}
+	if err := p.log.Close(); err != nil {
+		return "", err
+	}
+	p.log = nil
+	if err := os.Rename(p.logPath, rotated); err != nil {
+		return "", err
+	}
+	log, err := OpenLog(p.logPath, p.keys, p.values)
+	if err != nil {
+		return "", err
+	}
+	p.log = log
+	return rotated, nil
+}
@@ -0,0 +1,365 @@
+// Package s3fifo provides a weighted cache following the S3-FIFO replacement
+// policy, built from three FIFO queues. New entries enter a small queue; the
+// ones hit repeatedly before reaching its end move to the main queue, the
+// others are evicted early, leaving their key in a ghost queue. Keys added
+// again while in the ghost queue enter the main queue directly. The main
+// queue reinserts entries hit since they were last examined instead of
+// evicting them, like CLOCK.
+//
+// Hits only increment a small counter of the entry and leave the queues
+// untouched, so lookups share a read lock rather than serializing on an LRU
+// list. Only adding, removing and evicting entries takes the write lock.
+//
+// The implementation follows Yang, Zhang, Qiu, Yue and Rashmi, "FIFO Queues
+// are All You Need for Cache Eviction" (SOSP 2023), extended to weighted
+// entries.
+package s3fifo
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/0xsoniclabs/cacheutils/simplewlru"
+)
+
+// DefaultSmallPercent is the default share of the capacity taken by the
+// small queue.
+const DefaultSmallPercent = 10
+
+// maxFreq is the saturation point of the hit counter of entries.
+const maxFreq = 3
+
+// entry is a resident entry.
+type entry struct {
+	key     interface{}
+	value   interface{}
+	weight  uint
+	main    bool         // whether the entry is in the main queue
+	freq    atomic.Int32 // hits since the entry was last examined, up to maxFreq
+	element *list.Element
+}
+
+// hit increments the hit counter of the entry unless it is saturated.
+func (e *entry) hit() {
+	for {
+		freq := e.freq.Load()
+		if freq >= maxFreq || e.freq.CompareAndSwap(freq, freq+1) {
+			return
+		}
+	}
+}
+
+// Cache is a weighted S3-FIFO cache. It is safe for concurrent use.
+type Cache struct {
+	lock         sync.RWMutex
+	maxWeight    uint
+	maxSize      int
+	smallPercent int
+	onEvict      simplewlru.EvictCallback
+	items        map[interface{}]*entry
+
+	// The queues hold their entries oldest at the back; the ghost queue
+	// holds keys of entries evicted from the small queue.
+	small, main, ghost      list.List
+	ghosts                  map[interface{}]*list.Element
+	smallWeight, mainWeight uint
+	smallMaxWeight          uint
+	smallMaxSize            int
+	evicted                 []evictedEntry // awaiting the callback until unlocking
+}
+
+// evictedEntry is an entry awaiting its eviction callback.
+type evictedEntry struct {
+	key, value interface{}
+}
+
+var _ cacheutils.WeightedCache = (*Cache)(nil)
+
+// Option configures a cache.
+type Option func(*Cache)
+
+// WithEvictCallback sets a callback called for every entry leaving the
+// cache, outside of the cache's lock.
+func WithEvictCallback(onEvict simplewlru.EvictCallback) Option {
+	return func(c *Cache) {
+		c.onEvict = onEvict
+	}
+}
+
+// WithSmallPercent sets the share of the weight and size limits taken by the
+// small queue. Defaults to DefaultSmallPercent; larger shares give new
+// entries more time to prove themselves.
+func WithSmallPercent(percent int) Option {
+	return func(c *Cache) {
+		c.smallPercent = percent
+	}
+}
+
+// New creates an S3-FIFO cache of the given size.
+func New(maxWeight uint, maxSize int, opts ...Option) (*Cache, error) {
+	c := &Cache{
+		maxWeight:    maxWeight,
+		maxSize:      maxSize,
+		smallPercent: DefaultSmallPercent,
+		items:        make(map[interface{}]*entry),
+		ghosts:       make(map[interface{}]*list.Element),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if maxSize < 0 {
+		return nil, fmt.Errorf("%w: must provide a non-negative size", cacheutils.ErrInvalidSize)
+	}
+	if c.smallPercent <= 0 || c.smallPercent >= 100 {
+		return nil, fmt.Errorf("%w: small queue percentage must be between 1 and 99", cacheutils.ErrInvalidSize)
+	}
+	c.smallMaxWeight = maxWeight/100*uint(c.smallPercent) + maxWeight%100*uint(c.smallPercent)/100
+	c.smallMaxSize = maxSize/100*c.smallPercent + maxSize%100*c.smallPercent/100
+	return c, nil
+}
+
+// Get looks up a key's value, counting a hit of the entry.
+func (c *Cache) Get(key interface{}) (value interface{}, ok bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	e.hit()
+	return e.value, true
+}
+
+// Peek looks up a key's value without counting a hit.
+func (c *Cache) Peek(key interface{}) (value interface{}, ok bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if e, ok := c.items[key]; ok {
+		return e.value, true
+	}
+	return nil, false
+}
+
+// Contains checks if a key is in the cache without counting a hit.
+func (c *Cache) Contains(key interface{}) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	_, ok := c.items[key]
+	return ok
+}
+
+// Add adds a value to the cache and returns the number of evictions. Updating
+// an existing entry counts as a hit. An entry heavier than the maximum weight
+// of the cache is rejected; an existing entry of the key is evicted, as its
+// value is outdated.
+func (c *Cache) Add(key, value interface{}, weight uint) (evicted int) {
+	c.lock.Lock()
+	defer c.unlock()
+	e, ok := c.items[key]
+	if weight > c.maxWeight || c.maxSize == 0 {
+		if ok {
+			c.report(e)
+			c.drop(e)
+			return 1
+		}
+		return 0
+	}
+	switch {
+	case ok && c.smallWeight+c.mainWeight-e.weight <= math.MaxUint-weight:
+		if e.main {
+			c.mainWeight = simplewlru.AddWeights(c.mainWeight-e.weight, weight)
+		} else {
+			c.smallWeight = simplewlru.AddWeights(c.smallWeight-e.weight, weight)
+		}
+		e.value, e.weight = value, weight
+		e.hit()
+	case ok:
+		// The new weight would overflow the total, so the entry is taken
+		// out while making room and put back at the front of its queue.
+		c.drop(e)
+		evicted = c.makeRoom(weight)
+		e.value, e.weight = value, weight
+		e.hit()
+		c.items[key] = e
+		c.push(e)
+	default:
+		evicted = c.makeRoom(weight)
+		e = &entry{key: key, value: value, weight: weight}
+		c.items[key] = e
+		if g, ok := c.ghosts[key]; ok {
+			// The key was evicted too early and skips the small queue.
+			c.ghost.Remove(g)
+			delete(c.ghosts, key)
+			e.main = true
+		}
+		c.push(e)
+	}
+	evicted += c.enforce()
+	c.trimGhosts()
+	return evicted
+}
+
+// push inserts an entry at the front of its queue.
+func (c *Cache) push(e *entry) {
+	if e.main {
+		e.element = c.main.PushFront(e)
+		c.mainWeight = simplewlru.AddWeights(c.mainWeight, e.weight)
+	} else {
+		e.element = c.small.PushFront(e)
+		c.smallWeight = simplewlru.AddWeights(c.smallWeight, e.weight)
+	}
+}
+
+// Remove removes the provided key from the cache, returning if the key was
+// contained.
+func (c *Cache) Remove(key interface{}) (present bool) {
+	c.lock.Lock()
+	defer c.unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return false
+	}
+	c.report(e)
+	c.drop(e)
+	c.trimGhosts()
+	return true
+}
+
+// Purge removes all entries from the cache.
+func (c *Cache) Purge() {
+	c.lock.Lock()
+	defer c.unlock()
+	for _, e := range c.items {
+		c.report(e)
+	}
+	clear(c.items)
+	clear(c.ghosts)
+	c.small.Init()
+	c.main.Init()
+	c.ghost.Init()
+	c.smallWeight, c.mainWeight = 0, 0
+}
+
+// Len returns the number of entries in the cache.
+func (c *Cache) Len() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return len(c.items)
+}
+
+// Weight returns the total weight of the entries in the cache.
+func (c *Cache) Weight() uint {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.smallWeight + c.mainWeight
+}
+
+// unlock releases the write lock and runs the eviction callback for the
+// entries evicted while holding it.
+func (c *Cache) unlock() {
+	evicted := c.evicted
+	c.evicted = nil
+	c.lock.Unlock()
+	for _, e := range evicted {
+		c.onEvict(e.key, e.value)
+	}
+}
+
+// report queues the eviction callback for an entry leaving the cache.
+func (c *Cache) report(e *entry) {
+	if c.onEvict != nil {
+		c.evicted = append(c.evicted, evictedEntry{e.key, e.value})
+	}
+}
+
+// enforce evicts entries until the cache fits its limits. Returns the number
+// of evictions.
+func (c *Cache) enforce() (evicted int) {
+	for c.smallWeight+c.mainWeight > c.maxWeight || len(c.items) > c.maxSize {
+		if c.evictNext() {
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// makeRoom evicts entries until weight can be added to the total weight
+// without overflowing. It only evicts for limits close to the largest
+// representable weight, evicting entries which would be evicted after the
+// addition anyway. Returns the number of evictions.
+func (c *Cache) makeRoom(weight uint) (evicted int) {
+	for c.smallWeight+c.mainWeight > math.MaxUint-weight {
+		if c.evictNext() {
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// evictNext examines the oldest entry of the small queue while it exceeds
+// its share and of the main queue otherwise. Returns whether it was evicted.
+func (c *Cache) evictNext() bool {
+	if c.small.Len() > 0 && (c.smallWeight > c.smallMaxWeight || c.small.Len() > c.smallMaxSize || c.main.Len() == 0) {
+		return c.evictSmall()
+	}
+	return c.evictMain()
+}
+
+// evictSmall examines the oldest entry of the small queue, moving it to the
+// main queue if it was hit more than once and evicting it otherwise. Returns
+// whether it was evicted.
+func (c *Cache) evictSmall() bool {
+	e := c.small.Back().Value.(*entry)
+	c.small.Remove(e.element)
+	c.smallWeight -= e.weight
+	if e.freq.Load() > 1 {
+		e.freq.Store(0)
+		e.main = true
+		e.element = c.main.PushFront(e)
+		c.mainWeight += e.weight
+		return false
+	}
+	c.report(e)
+	delete(c.items, e.key)
+	c.ghosts[e.key] = c.ghost.PushFront(e.key)
+	return true
+}
+
+// evictMain examines the oldest entry of the main queue, reinserting it if
+// it was hit since it was last examined and evicting it otherwise. Returns
+// whether it was evicted.
+func (c *Cache) evictMain() bool {
+	e := c.main.Back().Value.(*entry)
+	if freq := e.freq.Load(); freq > 0 {
+		e.freq.Store(freq - 1)
+		c.main.MoveToFront(e.element)
+		return false
+	}
+	c.report(e)
+	c.drop(e)
+	return true
+}
+
+// drop removes a resident entry.
+func (c *Cache) drop(e *entry) {
+	if e.main {
+		c.main.Remove(e.element)
+		c.mainWeight -= e.weight
+	} else {
+		c.small.Remove(e.element)
+		c.smallWeight -= e.weight
+	}
+	delete(c.items, e.key)
+}
+
+// trimGhosts forgets the oldest ghosts while there are more ghosts than
+// resident entries, bounding the memory spent on them.
+func (c *Cache) trimGhosts() {
+	for c.ghost.Len() > max(len(c.items), 1) {
+		delete(c.ghosts, c.ghost.Remove(c.ghost.Back()))
+	}
+}
@@ -0,0 +1,200 @@
+package s3fifo
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/0xsoniclabs/cacheutils/simplewlru"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// checkInvariants verifies the bookkeeping of the cache.
+func checkInvariants(t *testing.T, c *Cache) {
+	t.Helper()
+	var smallWeight, mainWeight uint
+	var smallLen, mainLen int
+	for key, e := range c.items {
+		require.Equal(t, key, e.key)
+		require.Equal(t, e, e.element.Value, "entries are in their queue")
+		require.NotContains(t, c.ghosts, key, "resident keys are no ghosts")
+		if e.main {
+			mainWeight += e.weight
+			mainLen++
+		} else {
+			smallWeight += e.weight
+			smallLen++
+		}
+	}
+	require.Equal(t, smallWeight, c.smallWeight)
+	require.Equal(t, mainWeight, c.mainWeight)
+	require.Equal(t, smallLen, c.small.Len())
+	require.Equal(t, mainLen, c.main.Len())
+	require.Equal(t, len(c.ghosts), c.ghost.Len())
+	require.LessOrEqual(t, len(c.ghosts), max(len(c.items), 1))
+	require.LessOrEqual(t, smallWeight+mainWeight, c.maxWeight)
+	require.LessOrEqual(t, smallLen+mainLen, c.maxSize)
+}
+
+func TestNew_ValidatesArguments(t *testing.T) {
+	_, err := New(10, -1)
+	assert.True(t, errors.Is(err, cacheutils.ErrInvalidSize))
+	_, err = New(10, 10, WithSmallPercent(0))
+	assert.Error(t, err)
+	_, err = New(10, 10, WithSmallPercent(100))
+	assert.Error(t, err)
+}
+
+func TestCache_AddGetRemove(t *testing.T) {
+	c, err := New(10, 10)
+	require.NoError(t, err)
+
+	assert.Equal(t, 0, c.Add("a", 1, 4))
+	assert.Equal(t, 0, c.Add("b", 2, 4))
+	value, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, value)
+	value, ok = c.Peek("b")
+	assert.True(t, ok)
+	assert.Equal(t, 2, value)
+	assert.Equal(t, 2, c.Len())
+	assert.Equal(t, uint(8), c.Weight())
+
+	assert.Equal(t, 0, c.Add("a", 3, 2))
+	assert.Equal(t, uint(6), c.Weight())
+	assert.Equal(t, 0, c.Add("c", 4, 11), "too heavy entries are rejected")
+	assert.False(t, c.Contains("c"))
+	assert.Equal(t, 1, c.Add("a", 4, 11), "outdated entries are evicted")
+	assert.False(t, c.Contains("a"))
+
+	assert.True(t, c.Remove("b"))
+	assert.False(t, c.Remove("b"))
+	assert.Equal(t, 0, c.Len())
+	checkInvariants(t, c)
+}
+
+func TestCache_WeightsDoNotOverflow(t *testing.T) {
+	const half = math.MaxUint/2 + 10
+	c, _ := New(math.MaxUint, 10)
+	c.Add("a", 1, half)
+	assert.Equal(t, 1, c.Add("b", 2, half))
+	assert.Equal(t, 1, c.Len())
+	assert.True(t, c.Contains("b"))
+	assert.Equal(t, uint(half), c.Weight())
+	checkInvariants(t, c)
+
+	c.Add("c", 3, 1)
+	c.Add("c", 3, half)
+	assert.Equal(t, 1, c.Len())
+	assert.True(t, c.Contains("c"))
+	assert.Equal(t, uint(half), c.Weight())
+	checkInvariants(t, c)
+}
+
+func TestCache_GhostsEnterMainQueue(t *testing.T) {
+	c, _ := New(10, 10)
+	for i := 0; i < 11; i++ {
+		c.Add(i, i, 1)
+	}
+	assert.False(t, c.Contains(0))
+	assert.Contains(t, c.ghosts, 0)
+
+	c.Add(0, 0, 1)
+	assert.True(t, c.items[0].main)
+	assert.NotContains(t, c.ghosts, 0)
+	checkInvariants(t, c)
+}
+
+func TestCache_ResistsScans(t *testing.T) {
+	const size = 100
+	c, _ := New(size, size)
+	lru, _ := simplewlru.New(size, size)
+	var hits, lruHits int
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		// Half of the requests go to a working set fitting into the cache,
+		// the others scan over keys never requested again.
+		key := size + i
+		if i%2 == 0 {
+			key = rnd.Intn(size / 2)
+		}
+		if _, ok := c.Get(key); ok {
+			hits++
+		} else {
+			c.Add(key, key, 1)
+		}
+		if _, ok := lru.Get(key); ok {
+			lruHits++
+		} else {
+			lru.Add(key, key, 1)
+		}
+	}
+	checkInvariants(t, c)
+	assert.Greater(t, hits, 9000)
+	assert.Greater(t, hits, lruHits)
+}
+
+func TestCache_RandomOperationsKeepInvariants(t *testing.T) {
+	var evicted int
+	c, _ := New(200, 50, WithSmallPercent(20), WithEvictCallback(func(key, value interface{}) {
+		evicted++
+	}))
+	rnd := rand.New(rand.NewSource(1))
+	reported := 0
+	for i := 0; i < 20000; i++ {
+		key := rnd.Intn(120)
+		switch op := rnd.Intn(10); {
+		case op < 5:
+			c.Get(key)
+		case op < 9:
+			reported += c.Add(key, i, uint(rnd.Intn(12)))
+		default:
+			if c.Remove(key) {
+				reported++
+			}
+		}
+		checkInvariants(t, c)
+	}
+	assert.Equal(t, reported, evicted)
+
+	n := c.Len()
+	c.Purge()
+	assert.Equal(t, reported+n, evicted)
+	assert.Equal(t, 0, c.Len())
+	assert.Equal(t, uint(0), c.Weight())
+	checkInvariants(t, c)
+}
+
+func TestCache_ConcurrentAccess(t *testing.T) {
+	c, _ := New(100, 100)
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := (g*31 + i) % 150
+				if _, ok := c.Get(key); !ok {
+					c.Add(key, key, 1)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	checkInvariants(t, c)
+}
+
+func TestCache_EvictCallbackMayUseCache(t *testing.T) {
+	var c *Cache
+	c, _ = New(2, 2, WithEvictCallback(func(key, value interface{}) {
+		assert.False(t, c.Contains(key))
+	}))
+	for i := 0; i < 10; i++ {
+		c.Add(i, i, 1)
+	}
+	assert.Equal(t, 2, c.Len())
+}
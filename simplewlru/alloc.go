@@ -0,0 +1,61 @@
+//go:build !cacheutils_slab
+
+package simplewlru
+
+// slots holds one field of every entry, indexed by ref. The default backend
+// keeps it in a single slice, reallocated as the cache grows and compacted
+// once most of it is unused.
+type slots[T any] struct {
+	s []T
+}
+
+// reset drops all elements but the zeroed one at index 0 and reserves room
+// for n more.
+func (s *slots[T]) reset(n int) {
+	s.s = make([]T, 1, n+1)
+}
+
+// len returns the number of elements, including the one at index 0.
+func (s *slots[T]) len() int {
+	return len(s.s)
+}
+
+// capacity returns the number of elements the slots hold without growing.
+func (s *slots[T]) capacity() int {
+	return cap(s.s)
+}
+
+// get returns the element at index i.
+func (s *slots[T]) get(i ref) T {
+	return s.s[i]
+}
+
+// set replaces the element at index i.
+func (s *slots[T]) set(i ref, v T) {
+	s.s[i] = v
+}
+
+// at returns a pointer to the element at index i, valid until the slots
+// grow.
+func (s *slots[T]) at(i ref) *T {
+	return &s.s[i]
+}
+
+// push appends an element.
+func (s *slots[T]) push(v T) {
+	s.s = append(s.s, v)
+}
+
+// clone returns an independent copy of the slots.
+func (s *slots[T]) clone() slots[T] {
+	return slots[T]{append([]T(nil), s.s...)}
+}
+
+// appendTo appends all elements to dst and returns the extended slice.
+func (s *slots[T]) appendTo(dst []T) []T {
+	return append(dst, s.s...)
+}
+
+// keepReleased reports whether the slots of released entries are always kept
+// for reuse rather than compacted away.
+const keepReleased = false
@@ -0,0 +1,93 @@
+//go:build cacheutils_slab
+
+package simplewlru
+
+// This experimental backend, enabled by the cacheutils_slab build tag, keeps
+// the keys, values and recency links of the entries in fixed slabs of
+// slabEntries rather than in slices reallocated as the cache grows. Growing
+// a cache of millions of entries then allocates one slab at a time instead
+// of copying all of them, and never leaves the old copy to the garbage
+// collector. Slabs are never returned to the heap: released entries are
+// recycled instead of compacted away, and Purge clears the slabs for reuse,
+// so the memory of a cache is only freed once the cache is dropped.
+
+// slabShift is the base 2 logarithm of slabEntries.
+const slabShift = 8
+
+// slabEntries is the number of elements allocated at once.
+const slabEntries = 1 << slabShift
+
+// slots holds one field of every entry, indexed by ref, in slabs of
+// slabEntries elements.
+type slots[T any] struct {
+	slabs [][]T
+	n     int
+}
+
+// reset drops all elements but the zeroed one at index 0 and reserves room
+// for n more. Slabs allocated before are cleared and kept.
+func (s *slots[T]) reset(n int) {
+	for _, slab := range s.slabs {
+		clear(slab)
+	}
+	for len(s.slabs)*slabEntries < n+1 {
+		s.slabs = append(s.slabs, make([]T, slabEntries))
+	}
+	s.n = 1
+}
+
+// len returns the number of elements, including the one at index 0.
+func (s *slots[T]) len() int {
+	return s.n
+}
+
+// capacity returns the number of elements the slots hold without growing.
+func (s *slots[T]) capacity() int {
+	return len(s.slabs) * slabEntries
+}
+
+// get returns the element at index i.
+func (s *slots[T]) get(i ref) T {
+	return s.slabs[i>>slabShift][i&(slabEntries-1)]
+}
+
+// set replaces the element at index i.
+func (s *slots[T]) set(i ref, v T) {
+	s.slabs[i>>slabShift][i&(slabEntries-1)] = v
+}
+
+// at returns a pointer to the element at index i. Slabs never move, so it
+// stays valid as the slots grow.
+func (s *slots[T]) at(i ref) *T {
+	return &s.slabs[i>>slabShift][i&(slabEntries-1)]
+}
+
+// push appends an element, allocating a slab if all are full.
+func (s *slots[T]) push(v T) {
+	if s.n == s.capacity() {
+		s.slabs = append(s.slabs, make([]T, slabEntries))
+	}
+	s.set(ref(s.n), v)
+	s.n++
+}
+
+// clone returns an independent copy of the slots.
+func (s *slots[T]) clone() slots[T] {
+	clone := slots[T]{slabs: make([][]T, len(s.slabs)), n: s.n}
+	for i, slab := range s.slabs {
+		clone.slabs[i] = append([]T(nil), slab...)
+	}
+	return clone
+}
+
+// appendTo appends all elements to dst and returns the extended slice.
+func (s *slots[T]) appendTo(dst []T) []T {
+	for i := 0; i < s.n; i += slabEntries {
+		dst = append(dst, s.slabs[i>>slabShift][:min(s.n-i, slabEntries)]...)
+	}
+	return dst
+}
+
+// keepReleased reports whether the slots of released entries are always kept
+// for reuse rather than compacted away. Slabs are never freed, so they are.
+const keepReleased = true
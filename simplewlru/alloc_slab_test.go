@@ -0,0 +1,30 @@
+//go:build cacheutils_slab
+
+package simplewlru
+
+import "testing"
+
+func TestSlabAllocation(t *testing.T) {
+	c, _ := New(1000, 1000)
+	for i := 0; i < slabEntries; i++ {
+		c.Add(i, i, 1)
+	}
+	if len(c.keys.slabs) != 2 || len(c.evictList.links.slabs) != 2 {
+		t.Fatalf("expected entries to fill two slabs, got %d", len(c.keys.slabs))
+	}
+	first := &c.keys.slabs[0][0]
+	c.Remove(1)
+	c.Add(slabEntries, slabEntries, 1)
+	if len(c.keys.slabs) != 2 || &c.keys.slabs[0][0] != first {
+		t.Errorf("expected released entry to be reused in place")
+	}
+	if c.Contains(1) || !c.Contains(slabEntries) || c.Len() != slabEntries {
+		t.Errorf("expected entry 1 to be replaced")
+	}
+
+	c.Resize(1, 1)
+	c.Purge()
+	if len(c.keys.slabs) != 2 || &c.keys.slabs[0][0] != first || c.keys.get(2) != nil {
+		t.Errorf("expected slabs to be cleared and kept")
+	}
+}
@@ -0,0 +1,54 @@
+package simplewlru
+
+import (
+	"testing"
+)
+
+func BenchmarkAdd_Churn(b *testing.B) {
+	cache, _ := New(5000, 1000)
+	for i := 0; i < 1000; i++ {
+		cache.Add(i, i, 5)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.Add(i+1000, i, 5)
+	}
+}
+
+func BenchmarkAdd_Update(b *testing.B) {
+	cache, _ := New(5000, 1000)
+	for i := 0; i < 1000; i++ {
+		cache.Add(i, i, 5)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.Add(i%1000, i, 5)
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	cache, _ := New(5000, 1000)
+	for i := 0; i < 1000; i++ {
+		cache.Add(i, i, 5)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.Get(i % 2000)
+	}
+}
+
+func BenchmarkGet_Large(b *testing.B) {
+	const n = 1 << 20
+	cache, _ := New(n, n)
+	for i := 0; i < n; i++ {
+		cache.Add(i, i, 1)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.Get(int(uint(i) * 2654435761 % n))
+	}
+}
@@ -0,0 +1,83 @@
+package simplewlru
+
+import "errors"
+
+// NewFromEntries creates a cache of the given size holding the given
+// entries, ordered from oldest to newest as returned by OrderedEntries or
+// Snapshot. The result matches adding the entries in order, except that
+// entries which do not fit are skipped without being reported as evicted,
+// see Fill.
+func NewFromEntries(maxWeight uint, maxSize int, entries []Entry, opts ...Option) (*Cache, error) {
+	c, err := New(maxWeight, maxSize, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return c, c.Fill(entries)
+}
+
+// NewFromMap creates a cache of the given size holding the entries of m,
+// weighed by the weigher. Their recency order is unspecified, as is the
+// choice of entries if they exceed the limits.
+func NewFromMap(maxWeight uint, maxSize int, m map[interface{}]interface{}, weigher func(key, value interface{}) uint, opts ...Option) (*Cache, error) {
+	entries := make([]Entry, 0, len(m))
+	for key, value := range m {
+		entries = append(entries, Entry{Key: key, Value: value, Weight: weigher(key, value)})
+	}
+	return NewFromEntries(maxWeight, maxSize, entries, opts...)
+}
+
+// Fill adds the given entries, ordered from oldest to newest, to the empty
+// cache in a single pass. Their ages and costs are restored from Entry.Age
+// and Entry.Cost. As when adding the entries one by one, later entries of
+// the same key take precedence and only the newest entries fitting into the
+// cache are kept, but the others are skipped rather than added and evicted,
+// so the eviction callback is not called for them. Returns an error if the
+// cache is not empty.
+func (c *Cache) Fill(entries []Entry) error {
+	if c.Len() > 0 {
+		return errors.New("can only fill an empty cache")
+	}
+	n := min(len(entries), c.maxSize)
+	if n > c.keys.capacity()-1 {
+		c.reserve(n)
+	}
+
+	// Entries are selected from the newest on, until the cache is full.
+	kept := make([]ref, 0, n)
+	var weight uint
+	now := c.clock.Now()
+	for i := len(entries) - 1; i >= 0 && len(kept) < c.maxSize; i-- {
+		e := &entries[i]
+		if _, ok := c.items[e.Key]; ok {
+			continue
+		}
+		w, valid := c.weigh(e.Weight)
+		if !valid || w > c.maxWeight {
+			continue
+		}
+		if weight > c.maxWeight-w {
+			break
+		}
+		weight += w
+		ent := c.newEntry(e.Key, e.Value, w)
+		c.costs[ent] = e.Cost
+		c.written[ent] = now.Add(-e.Age)
+		c.items[e.Key] = ent
+		kept = append(kept, ent)
+	}
+
+	// They are inserted from the oldest on, as Add would.
+	for i := len(kept) - 1; i >= 0; i-- {
+		ent := kept[i]
+		c.version++
+		c.versions[ent] = c.version
+		c.weight += c.weights[ent]
+		if c.oldPercent > 0 || c.windowPercent > 0 {
+			c.insertOld(ent)
+		} else {
+			c.evictList.pushFront(ent)
+		}
+		c.accessed(ent)
+	}
+	return nil
+}
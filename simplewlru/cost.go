@@ -0,0 +1,28 @@
+package simplewlru
+
+// AddWithCost adds a value to the cache like Add, recording the expense of
+// recomputing it, e.g. the time taken to decode it. Unlike the weight, the
+// cost does not count against the limits of the cache; it only informs the
+// eviction score set by WithEvictionScore, e.g. WeightPerRankAndCost, so
+// that cheaply recomputed entries are evicted before expensive ones. Entries
+// added by other means have cost 0. Returns the number of evictions.
+func (c *Cache) AddWithCost(key, value interface{}, weight, cost uint) (evicted int) {
+	_, evicted = c.add(key, value, weight, cost)
+	return evicted
+}
+
+// CostOf returns the cost of the given key's entry without updating its
+// "recently used"-ness.
+func (c *Cache) CostOf(key interface{}) (cost uint, ok bool) {
+	if ent, ok := c.items[key]; ok {
+		return c.costs[ent], true
+	}
+	return 0, false
+}
+
+// WeightPerRankAndCost rates entries like WeightPerRank, further divided by
+// one more than their cost, so that of entries of similar weight and
+// recency, the cheapest to recompute are evicted first.
+func WeightPerRankAndCost(c Candidate) float64 {
+	return float64(c.Weight) / float64(c.Rank) / (float64(c.Cost) + 1)
+}
@@ -0,0 +1,100 @@
+package simplewlru
+
+import (
+	"container/heap"
+	"errors"
+	"sort"
+)
+
+// WithHeaviestFirst makes capacity evictions take the heaviest entry among
+// the least recently used percent of the entries, rather than the least
+// recently used one. Of equally heavy entries, the least recently used is
+// evicted. When weights vary widely, this frees the weight needed by new
+// entries with fewer evictions, while entries outside the considered share
+// remain protected by their recency. Each eviction takes time linear in the
+// number of considered entries. It replaces an eviction score and is mutually
+// exclusive with LRU-K and the admission window.
+func WithHeaviestFirst(percent int) Option {
+	return func(c *Cache) error {
+		if percent <= 0 || percent > 100 {
+			return errors.New("heaviest-first percentage must be between 1 and 100")
+		}
+		c.scorePercent, c.score = percent, nil
+		return nil
+	}
+}
+
+// HeaviestEntries returns up to n of the heaviest entries, from heaviest to
+// lightest, without updating their "recently used"-ness. Of entries weighing
+// the same, the least recently used come first. Takes O(len log n).
+func (c *Cache) HeaviestEntries(n int) []Entry {
+	n = min(n, c.evictList.len)
+	if n <= 0 {
+		return nil
+	}
+	// A min-heap keeps the n heaviest entries seen, visiting entries from
+	// the oldest, so that older entries win ties.
+	h := &weightHeap{c: c, refs: make([]rankedRef, 0, n)}
+	rank := 0
+	for ent := c.evictList.back(); ent != 0; ent = c.evictList.prev(ent) {
+		if len(h.refs) < n {
+			heap.Push(h, rankedRef{ent, rank})
+		} else if c.weights[ent] > c.weights[h.refs[0].ref] {
+			h.refs[0] = rankedRef{ent, rank}
+			heap.Fix(h, 0)
+		}
+		rank++
+	}
+	sort.Slice(h.refs, func(i, j int) bool {
+		a, b := h.refs[i], h.refs[j]
+		if wa, wb := c.weights[a.ref], c.weights[b.ref]; wa != wb {
+			return wa > wb
+		}
+		return a.rank < b.rank
+	})
+	now := c.clock.Now()
+	entries := make([]Entry, len(h.refs))
+	for i, r := range h.refs {
+		entries[i] = c.export(r.ref, now)
+	}
+	return entries
+}
+
+// rankedRef is an entry with its rank in recency order, oldest first.
+type rankedRef struct {
+	ref  ref
+	rank int
+}
+
+// weightHeap orders entries by weight, the lightest and, of equal weights,
+// the most recently used first.
+type weightHeap struct {
+	c    *Cache
+	refs []rankedRef
+}
+
+func (h *weightHeap) Len() int {
+	return len(h.refs)
+}
+
+func (h *weightHeap) Less(i, j int) bool {
+	a, b := h.refs[i], h.refs[j]
+	if wa, wb := h.c.weights[a.ref], h.c.weights[b.ref]; wa != wb {
+		return wa < wb
+	}
+	return a.rank > b.rank
+}
+
+func (h *weightHeap) Swap(i, j int) {
+	h.refs[i], h.refs[j] = h.refs[j], h.refs[i]
+}
+
+func (h *weightHeap) Push(x interface{}) {
+	h.refs = append(h.refs, x.(rankedRef))
+}
+
+func (h *weightHeap) Pop() interface{} {
+	r := h.refs[len(h.refs)-1]
+	h.refs = h.refs[:len(h.refs)-1]
+	return r
+}
@@ -0,0 +1,87 @@
+package simplewlru
+
+// ref refers to a cache entry by its index in the entry slices of the cache.
+// The zero ref is the sentinel of the recency list and doubles as nil.
+type ref int32
+
+// link holds the neighbours of an entry in the recency list.
+type link struct {
+	next, prev ref
+}
+
+// entryList is a doubly linked list of entries, linked by index. links[0] is
+// the sentinel: its next is the front and its prev the back of the list, so
+// that next and prev return the nil ref at either end.
+type entryList struct {
+	links slots[link]
+	len   int
+}
+
+// init clears the list, dropping all links, and reserves room for n
+// entries.
+func (l *entryList) init(n int) {
+	l.links.reset(n)
+	l.len = 0
+}
+
+// front returns the first entry of the list or nil if it is empty.
+func (l *entryList) front() ref {
+	return l.links.at(0).next
+}
+
+// back returns the last entry of the list or nil if it is empty.
+func (l *entryList) back() ref {
+	return l.links.at(0).prev
+}
+
+// next returns the entry following e or nil if e is the last one.
+func (l *entryList) next(e ref) ref {
+	return l.links.at(e).next
+}
+
+// prev returns the entry preceding e or nil if e is the first one.
+func (l *entryList) prev(e ref) ref {
+	return l.links.at(e).prev
+}
+
+// insertAfter inserts e after at.
+func (l *entryList) insertAfter(e, at ref) {
+	next := l.links.at(at).next
+	*l.links.at(e) = link{next: next, prev: at}
+	l.links.at(next).prev = e
+	l.links.at(at).next = e
+	l.len++
+}
+
+// pushFront inserts e at the front of the list.
+func (l *entryList) pushFront(e ref) {
+	l.insertAfter(e, 0)
+}
+
+// pushBack inserts e at the back of the list.
+func (l *entryList) pushBack(e ref) {
+	l.insertAfter(e, l.links.at(0).prev)
+}
+
+// insertBefore inserts e immediately before mark.
+func (l *entryList) insertBefore(e, mark ref) {
+	l.insertAfter(e, l.links.at(mark).prev)
+}
+
+// remove removes e from the list.
+func (l *entryList) remove(e ref) {
+	lk := l.links.get(e)
+	l.links.at(lk.prev).next = lk.next
+	l.links.at(lk.next).prev = lk.prev
+	*l.links.at(e) = link{}
+	l.len--
+}
+
+// moveToFront moves e to the front of the list.
+func (l *entryList) moveToFront(e ref) {
+	if l.links.at(0).next == e {
+		return
+	}
+	l.remove(e)
+	l.insertAfter(e, 0)
+}
@@ -0,0 +1,44 @@
+package simplewlru
+
+// ListenerID identifies an eviction listener registered with
+// AddEvictionListener.
+type ListenerID uint64
+
+// listener is a registered eviction listener.
+type listener struct {
+	id ListenerID
+	f  EvictCallback
+}
+
+// AddEvictionListener registers f to be called for every entry leaving the
+// cache, like the eviction callback given on construction. Listeners are
+// called after that callback, in the order they were registered. The
+// returned ID can be passed to RemoveEvictionListener.
+func (c *Cache) AddEvictionListener(f EvictCallback) ListenerID {
+	c.lastListener++
+	c.listeners = append(c.listeners, listener{id: c.lastListener, f: f})
+	return c.lastListener
+}
+
+// RemoveEvictionListener unregisters the listener with the given ID,
+// returning if it was registered.
+func (c *Cache) RemoveEvictionListener(id ListenerID) bool {
+	for i, l := range c.listeners {
+		if l.id == id {
+			c.listeners = append(c.listeners[:i:i], c.listeners[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// evicted reports an entry leaving the cache to the eviction callback and
+// all listeners.
+func (c *Cache) evicted(key, value interface{}) {
+	if c.onEvict != nil {
+		c.onEvict(key, value)
+	}
+	for _, l := range c.listeners {
+		l.f(key, value)
+	}
+}
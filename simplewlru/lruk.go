@@ -0,0 +1,148 @@
+package simplewlru
+
+import (
+	"container/heap"
+	"errors"
+)
+
+// WithLRUK enables LRU-K eviction. The cache records the times of the last k
+// accesses of every entry, counting its insertion, updates and hits, and
+// evicts the entry whose k-th most recent access is the oldest. Entries
+// accessed fewer than k times are evicted first, least recently used first,
+// except for the entry just added. Compared to LRU, entries need repeated
+// accesses to be retained, so that bursts of correlated accesses to one-off
+// keys, such as a scan, do not displace the working set.
+//
+// Eviction takes O(log n) per access. The methods on the oldest entry keep
+// referring to the least recently used one, which is not necessarily the
+// next to be evicted. LRU-K is mutually exclusive with midpoint insertion
+// and the admission window.
+func WithLRUK(k int) Option {
+	return func(c *Cache) error {
+		if k < 2 {
+			return errors.New("LRU-K requires k of at least 2")
+		}
+		c.k = k
+		c.reserveHistory(c.keys.capacity() - 1)
+		return nil
+	}
+}
+
+// reserveHistory clears the access history and allocates room for n
+// entries besides the list sentinel, if LRU-K is enabled.
+func (c *Cache) reserveHistory(n int) {
+	if c.k == 0 {
+		return
+	}
+	c.history = make([]uint64, c.k, (n+1)*c.k)
+	c.heapPos = make([]int, 1, n+1)
+	c.heap = make([]ref, 0, n)
+}
+
+// accessed records an access of the entry in its recency stamp and, for
+// LRU-K, its access history.
+func (c *Cache) accessed(e ref) {
+	c.used[e] = c.recency.Add(1)
+	if c.k == 0 {
+		return
+	}
+	h := c.history[int(e)*c.k : int(e+1)*c.k]
+	copy(h[1:], h)
+	c.tick++
+	h[0] = c.tick
+	if c.heapPos[e] < 0 {
+		heap.Push(accessHeap{c}, e)
+	} else {
+		heap.Fix(accessHeap{c}, c.heapPos[e])
+	}
+}
+
+// forget drops the entry from the LRU-K eviction order.
+func (c *Cache) forget(e ref) {
+	if c.k == 0 {
+		return
+	}
+	if i := c.heapPos[e]; i >= 0 {
+		heap.Remove(accessHeap{c}, i)
+	}
+	clear(c.history[int(e)*c.k : int(e+1)*c.k])
+}
+
+// kVictim returns the entry to evict under LRU-K, or nil if there is none.
+func (c *Cache) kVictim() ref {
+	if len(c.heap) == 0 {
+		return 0
+	}
+	h := accessHeap{c}
+	if top := c.heap[0]; top != c.fresh && (c.protected == nil || !c.protected(c.keys.get(top))) {
+		return top
+	}
+	if c.protected == nil {
+		// The top is the entry just added; the next one is among its
+		// children. Without other entries, it is evicted itself.
+		best := 0
+		for i := 1; i <= 2 && i < len(c.heap); i++ {
+			if best == 0 || h.Less(i, best) {
+				best = i
+			}
+		}
+		return c.heap[best]
+	}
+	best := -1
+	for i, e := range c.heap {
+		if e != c.fresh && !c.protected(c.keys.get(e)) && (best < 0 || h.Less(i, best)) {
+			best = i
+		}
+	}
+	if best >= 0 {
+		return c.heap[best]
+	}
+	if c.fresh != 0 && !c.protected(c.keys.get(c.fresh)) {
+		return c.fresh
+	}
+	return 0
+}
+
+// accessHeap orders the entries of a cache by their k-th most recent access
+// for LRU-K, entries with fewer accesses by their most recent one first.
+type accessHeap struct {
+	c *Cache
+}
+
+func (h accessHeap) Len() int {
+	return len(h.c.heap)
+}
+
+func (h accessHeap) Less(i, j int) bool {
+	k := h.c.k
+	a, b := int(h.c.heap[i])*k, int(h.c.heap[j])*k
+	aKth, bKth := h.c.history[a+k-1], h.c.history[b+k-1]
+	if (aKth == 0) != (bKth == 0) {
+		return aKth == 0
+	}
+	if aKth == 0 {
+		return h.c.history[a] < h.c.history[b]
+	}
+	return aKth < bKth
+}
+
+func (h accessHeap) Swap(i, j int) {
+	q := h.c.heap
+	q[i], q[j] = q[j], q[i]
+	h.c.heapPos[q[i]] = i
+	h.c.heapPos[q[j]] = j
+}
+
+func (h accessHeap) Push(x interface{}) {
+	e := x.(ref)
+	h.c.heapPos[e] = len(h.c.heap)
+	h.c.heap = append(h.c.heap, e)
+}
+
+func (h accessHeap) Pop() interface{} {
+	q := h.c.heap
+	e := q[len(q)-1]
+	h.c.heap = q[:len(q)-1]
+	h.c.heapPos[e] = -1
+	return e
+}
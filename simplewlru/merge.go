@@ -0,0 +1,47 @@
+package simplewlru
+
+// MergePolicy decides which entry is kept when a merged key is contained in
+// both caches.
+type MergePolicy int
+
+const (
+	// KeepExisting keeps the entry already contained in the cache.
+	KeepExisting MergePolicy = iota
+	// KeepNewer keeps the entry which was written more recently.
+	KeepNewer
+)
+
+// MergeFrom imports the entries of other, from oldest to newest, so that
+// the most recently used entries of other end up most recently used in the
+// cache. Capacity limits are enforced as for Add. Returns the number of
+// evictions.
+func (c *Cache) MergeFrom(other *Cache, policy MergePolicy) (evicted int) {
+	for ent := other.evictList.back(); ent != 0; ent = other.evictList.prev(ent) {
+		evicted += c.merge(other, ent, policy)
+	}
+	return evicted
+}
+
+// MergeKeyFrom imports the entry of key from other, if contained. Returns the
+// number of evictions.
+func (c *Cache) MergeKeyFrom(other *Cache, key interface{}, policy MergePolicy) (evicted int) {
+	if ent, ok := other.items[key]; ok {
+		return c.merge(other, ent, policy)
+	}
+	return 0
+}
+
+// merge imports a copy of the given entry of another cache.
+func (c *Cache) merge(other *Cache, ent ref, policy MergePolicy) (evicted int) {
+	key, written := other.keys.get(ent), other.written[ent]
+	if existing, ok := c.items[key]; ok {
+		if policy == KeepExisting || !written.After(c.written[existing]) {
+			return 0
+		}
+	}
+	_, evicted = c.add(key, other.values.get(ent), other.weights[ent], other.costs[ent])
+	if merged, ok := c.items[key]; ok {
+		c.written[merged] = written
+	}
+	return evicted
+}
@@ -0,0 +1,115 @@
+package simplewlru
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/0xsoniclabs/cacheutils"
+
+	"github.com/0xsoniclabs/cacheutils/clock"
+)
+
+// Option configures optional behaviour of a Cache.
+type Option func(*Cache) error
+
+// WithMaxWeight sets the maximum total weight of the cache, overriding the
+// limit given to the constructor.
+func WithMaxWeight(maxWeight uint) Option {
+	return func(c *Cache) error {
+		c.maxWeight = maxWeight
+		return nil
+	}
+}
+
+// WithMaxSize sets the maximum number of entries of the cache, overriding the
+// limit given to the constructor.
+func WithMaxSize(maxSize int) Option {
+	return func(c *Cache) error {
+		if maxSize < 0 {
+			return fmt.Errorf("%w: must provide a non-negative size", cacheutils.ErrInvalidSize)
+		}
+		c.maxSize = maxSize
+		return nil
+	}
+}
+
+// WithEvictCallback sets the callback called for every entry leaving the
+// cache, overriding the one given to the constructor.
+func WithEvictCallback(onEvict EvictCallback) Option {
+	return func(c *Cache) error {
+		c.onEvict = onEvict
+		return nil
+	}
+}
+
+// WithMidpointInsertion enables MySQL-style midpoint insertion. The cache
+// keeps the oldPercent least recently used entries in an old sublist; new
+// entries are inserted at the head of that sublist instead of the head of the
+// whole list, and are only promoted to the head after a second hit. This
+// protects frequently used entries from floods of one-off insertions.
+func WithMidpointInsertion(oldPercent int) Option {
+	return func(c *Cache) error {
+		if oldPercent <= 0 || oldPercent >= 100 {
+			return errors.New("old sublist percentage must be between 1 and 99")
+		}
+		c.oldPercent = oldPercent
+		return nil
+	}
+}
+
+// WithAdmissionWindow enables a small admission window holding at most
+// windowPercent of the cache's weight and size. New entries enter the window
+// and only move to the main area after a second hit. While the window is
+// within its budget, capacity evictions take the least recently used entry of
+// the main area; once it is exceeded, the window evicts its own entries. A
+// single large scan can therefore displace at most the window's share of the
+// working set.
+func WithAdmissionWindow(windowPercent int) Option {
+	return func(c *Cache) error {
+		if windowPercent <= 0 || windowPercent >= 100 {
+			return errors.New("admission window percentage must be between 1 and 99")
+		}
+		c.windowPercent = windowPercent
+		return nil
+	}
+}
+
+// WithInitialCapacity pre-sizes the cache for n entries, avoiding rehashing
+// and growing the entry slices while the cache is filled for the first time.
+func WithInitialCapacity(n int) Option {
+	return func(c *Cache) error {
+		if n < 0 {
+			return fmt.Errorf("%w: must provide a non-negative initial capacity", cacheutils.ErrInvalidSize)
+		}
+		c.items = make(map[interface{}]ref, n)
+		c.reserve(n)
+		return nil
+	}
+}
+
+// WithRecencyCounter sets the counter handing out the recency stamps of
+// entries, see Entry.Recency. Caches sharing a counter, such as the shards of
+// a wlru.Cache, stamp their entries comparably. By default, every cache has
+// a counter of its own.
+func WithRecencyCounter(counter *atomic.Uint64) Option {
+	return func(c *Cache) error {
+		if counter == nil {
+			return errors.New("must provide a recency counter")
+		}
+		c.recency = counter
+		return nil
+	}
+}
+
+// WithClock sets the clock used to record when entries are written, which
+// determines their ages. The default is clock.Real.
+func WithClock(c clock.Clock) Option {
+	return func(cache *Cache) error {
+		if c == nil {
+			return errors.New("must provide a clock")
+		}
+		cache.clock = c
+		return nil
+	}
+}
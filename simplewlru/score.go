@@ -0,0 +1,86 @@
+package simplewlru
+
+import (
+	"errors"
+	"time"
+)
+
+// Candidate describes an entry considered for eviction by an EvictionScore.
+type Candidate struct {
+	Key    interface{}
+	Weight uint
+	// Cost is the expense of recomputing the value; see AddWithCost.
+	Cost uint
+	// Rank is the position of the entry in recency order, counted from the
+	// least recently used entry, which has rank 1.
+	Rank int
+	// Age is the time elapsed since the entry was last written.
+	Age time.Duration
+}
+
+// EvictionScore rates an entry considered for eviction; the entry rated
+// highest is evicted. It must not use the cache.
+type EvictionScore func(Candidate) float64
+
+// WeightPerRank rates entries by their weight divided by their rank, so that
+// large entries are evicted before small ones unless they are much more
+// recently used.
+func WeightPerRank(c Candidate) float64 {
+	return float64(c.Weight) / float64(c.Rank)
+}
+
+// WithEvictionScore makes capacity evictions take the entry rated highest by
+// score among the least recently used percent of the entries, rather than
+// the least recently used one. Of equally rated entries, the least recently
+// used is evicted. Combining staleness and weight, e.g. by WeightPerRank,
+// evicts large and cold entries first while small and hot ones persist. Each
+// eviction calls score for every considered entry. It replaces heaviest-first
+// eviction and is mutually exclusive with LRU-K and the admission window.
+func WithEvictionScore(percent int, score EvictionScore) Option {
+	return func(c *Cache) error {
+		if percent <= 0 || percent > 100 {
+			return errors.New("eviction score percentage must be between 1 and 100")
+		}
+		if score == nil {
+			return errors.New("must provide an eviction score")
+		}
+		c.scorePercent, c.score = percent, score
+		return nil
+	}
+}
+
+// scoredVictim returns the unprotected entry rated highest among the least
+// recently used scorePercent of the entries, at least one, or nil if there is
+// none. Without a score, entries are rated by their weight. As with LRU-K,
+// the entry being added is only evicted as a last resort.
+func (c *Cache) scoredVictim() ref {
+	n := max(c.evictList.len/100*c.scorePercent+c.evictList.len%100*c.scorePercent/100, 1)
+	var victim ref
+	var best float64
+	var now time.Time
+	if c.score != nil {
+		now = c.clock.Now()
+	}
+	rank := 0
+	for ent := c.evictList.back(); ent != 0 && n > 0; ent = c.evictList.prev(ent) {
+		rank++
+		if ent == c.fresh || c.protected != nil && c.protected(c.keys.get(ent)) {
+			continue
+		}
+		n--
+		if c.score == nil {
+			if victim == 0 || c.weights[ent] > c.weights[victim] {
+				victim = ent
+			}
+			continue
+		}
+		score := c.score(Candidate{Key: c.keys.get(ent), Weight: c.weights[ent], Cost: c.costs[ent], Rank: rank, Age: now.Sub(c.written[ent])})
+		if victim == 0 || score > best {
+			victim, best = ent, score
+		}
+	}
+	if victim == 0 && c.fresh != 0 && (c.protected == nil || !c.protected(c.keys.get(c.fresh))) {
+		return c.fresh
+	}
+	return victim
+}
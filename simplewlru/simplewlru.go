@@ -1,11 +1,20 @@
 package simplewlru
 
 import (
-	"container/list"
+	"container/heap"
 	"errors"
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/0xsoniclabs/cacheutils/clock"
 )
 
-// EvictCallback is used to get a callback when a cache entry is evicted
+// EvictCallback is used to get a callback when a cache entry is evicted. It
+// is called synchronously once the entry has been removed, so entries evicted
+// by a single operation are reported in the order they were evicted.
 type EvictCallback func(key interface{}, value interface{})
 
 // Cache implements a non-thread safe fixed size/weight LRU cache
@@ -13,81 +22,373 @@ type Cache struct {
 	maxSize   int
 	weight    uint
 	maxWeight uint
-	evictList *list.List
-	items     map[interface{}]*list.Element
+	evictList entryList
+	items     map[interface{}]ref
 	onEvict   EvictCallback
+
+	listeners    []listener
+	lastListener ListenerID
+
+	graves []grave // entries removed by RemoveAfter, by deadline
+
+	protected func(key interface{}) bool // exempts entries from capacity eviction
+
+	zeroWeights ZeroWeightPolicy
+
+	// Entries are stored in parallel slices indexed by ref rather than as
+	// individually allocated nodes, keeping the bookkeeping of large caches
+	// in a few contiguous allocations. Index 0 belongs to the list sentinel.
+	// Keys, values and links are held in slots, which the cacheutils_slab
+	// build tag switches to an experimental slab backend.
+	keys     slots[interface{}]
+	values   slots[interface{}]
+	weights  []uint
+	costs    []uint
+	versions []uint64
+	written  []time.Time
+	used     []uint64
+	old      []bool
+	// free holds the refs of released entries for reuse by later
+	// insertions.
+	free []ref
+
+	// Midpoint insertion and admission window state: entries from mid to
+	// the back of evictList form the old sublist.
+	oldPercent    int
+	windowPercent int
+	mid           ref
+	oldLen        int
+	oldWeight     uint
+
+	// LRU-K state: the last k access ticks of every entry, most recent
+	// first, and a heap ordering the entries for eviction. fresh is the
+	// entry being added, which is only evicted as a last resort.
+	k       int
+	tick    uint64
+	history []uint64
+	heap    []ref
+	heapPos []int
+	fresh   ref
+
+	// scorePercent, if positive, makes capacity evictions take the least
+	// recently used entry rated highest by score, the heaviest one if score
+	// is nil; see WithEvictionScore and WithHeaviestFirst.
+	scorePercent int
+	score        EvictionScore
+
+	// version is the version assigned to the most recent write, invalidated
+	// the version at which an entry was last removed explicitly.
+	version     uint64
+	invalidated uint64
+
+	// recency hands out the stamps recording when entries were last used,
+	// see WithRecencyCounter.
+	recency *atomic.Uint64
+
+	clock clock.Clock
 }
 
-// entry is used to hold a value in the evictList
-type entry struct {
-	key    interface{}
-	value  interface{}
-	weight uint
+var _ cacheutils.ResizableCache = (*Cache)(nil)
+
+// Entry describes an entry of the cache.
+type Entry struct {
+	Key    interface{}
+	Value  interface{}
+	Weight uint
+	// Cost is the expense of recomputing the value; see AddWithCost.
+	Cost uint
+	// Age is the time elapsed since the entry was last written.
+	Age time.Duration
+	// Recency is stamped whenever the entry is added or used. Of entries
+	// stamped by the same counter, see WithRecencyCounter, the one with the
+	// larger stamp was used more recently.
+	Recency uint64
 }
 
+// minCompactEntries is the number of released entries below which the entry
+// slices are never compacted.
+const minCompactEntries = 1024
+
 // New creates a weighted LRU of the given size.
-func New(maxWeight uint, maxSize int) (*Cache, error) {
-	return NewWithEvict(maxWeight, maxSize, nil)
+func New(maxWeight uint, maxSize int, opts ...Option) (*Cache, error) {
+	return NewWithEvict(maxWeight, maxSize, nil, opts...)
+}
+
+// NewWithOptions creates a cache configured entirely by options. Without
+// WithMaxWeight or WithMaxSize, the respective limit is unbounded.
+func NewWithOptions(opts ...Option) (*Cache, error) {
+	return NewWithEvict(math.MaxUint, math.MaxInt, nil, opts...)
 }
 
 // NewWeightedLRU constructs an LRU of the given weight and size
-func NewWithEvict(maxWeight uint, maxSize int, onEvict EvictCallback) (*Cache, error) {
+func NewWithEvict(maxWeight uint, maxSize int, onEvict EvictCallback, opts ...Option) (*Cache, error) {
 	if maxSize < 0 {
-		return nil, errors.New("must provide a non-negative size")
+		return nil, fmt.Errorf("%w: must provide a non-negative size", cacheutils.ErrInvalidSize)
 	}
 	c := &Cache{
 		maxSize:   maxSize,
 		maxWeight: maxWeight,
-		evictList: list.New(),
-		items:     make(map[interface{}]*list.Element),
+		items:     make(map[interface{}]ref),
 		onEvict:   onEvict,
+		recency:   new(atomic.Uint64),
+		clock:     clock.Real,
+	}
+	c.reserve(0)
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	if c.oldPercent > 0 && c.windowPercent > 0 {
+		return nil, errors.New("midpoint insertion and admission window are mutually exclusive")
+	}
+	if c.k > 0 && (c.oldPercent > 0 || c.windowPercent > 0) {
+		return nil, errors.New("LRU-K is mutually exclusive with midpoint insertion and admission window")
+	}
+	if c.scorePercent > 0 && (c.k > 0 || c.windowPercent > 0) {
+		return nil, errors.New("scored eviction is mutually exclusive with LRU-K and admission window")
 	}
 	return c, nil
 }
 
+// reserve clears the entry slices and allocates room for n entries.
+func (c *Cache) reserve(n int) {
+	c.keys.reset(n)
+	c.values.reset(n)
+	c.weights = make([]uint, 1, n+1)
+	c.costs = make([]uint, 1, n+1)
+	c.versions = make([]uint64, 1, n+1)
+	c.written = make([]time.Time, 1, n+1)
+	c.used = make([]uint64, 1, n+1)
+	c.old = make([]bool, 1, n+1)
+	c.evictList.init(n)
+	c.free = nil
+	c.reserveHistory(n)
+}
+
+// Clone returns an independent copy of the cache holding the same entries,
+// weights and recency order, sharing the eviction callback and listeners.
+func (c *Cache) Clone() *Cache {
+	clone := c.CloneWithEvict(c.onEvict)
+	clone.listeners = append([]listener(nil), c.listeners...)
+	clone.lastListener = c.lastListener
+	return clone
+}
+
+// CloneWithEvict returns an independent copy of the cache holding the same
+// entries, weights and recency order, with the given eviction callback and
+// no eviction listeners.
+func (c *Cache) CloneWithEvict(onEvict EvictCallback) *Cache {
+	clone := &Cache{
+		maxSize:       c.maxSize,
+		weight:        c.weight,
+		maxWeight:     c.maxWeight,
+		items:         make(map[interface{}]ref, len(c.items)),
+		onEvict:       onEvict,
+		keys:          c.keys.clone(),
+		values:        c.values.clone(),
+		weights:       append([]uint(nil), c.weights...),
+		costs:         append([]uint(nil), c.costs...),
+		versions:      append([]uint64(nil), c.versions...),
+		written:       append([]time.Time(nil), c.written...),
+		used:          append([]uint64(nil), c.used...),
+		old:           append([]bool(nil), c.old...),
+		free:          append([]ref(nil), c.free...),
+		oldPercent:    c.oldPercent,
+		windowPercent: c.windowPercent,
+		mid:           c.mid,
+		oldLen:        c.oldLen,
+		oldWeight:     c.oldWeight,
+		version:       c.version,
+		invalidated:   c.invalidated,
+		recency:       c.recency,
+		clock:         c.clock,
+		protected:     c.protected,
+		zeroWeights:   c.zeroWeights,
+		k:             c.k,
+		scorePercent:  c.scorePercent,
+		score:         c.score,
+		tick:          c.tick,
+		history:       append([]uint64(nil), c.history...),
+		heap:          append([]ref(nil), c.heap...),
+		heapPos:       append([]int(nil), c.heapPos...),
+	}
+	clone.evictList = entryList{links: c.evictList.links.clone(), len: c.evictList.len}
+	for key, e := range c.items {
+		clone.items[key] = e
+	}
+	return clone
+}
+
 // Purge is used to completely clear the cache.
 func (c *Cache) Purge() {
-	for k, v := range c.items {
-		e := v.Value.(*entry)
-		c.weight -= e.weight
-		if c.onEvict != nil {
-			c.onEvict(k, e.value)
-		}
+	c.invalidate()
+	for k, e := range c.items {
+		c.weight -= c.weights[e]
 		delete(c.items, k)
+		c.evicted(k, c.values.get(e))
 	}
-	c.evictList.Init()
+	c.reserve(c.keys.capacity() - 1)
+	c.mid = 0
+	c.oldLen = 0
+	c.oldWeight = 0
+}
+
+// Flush removes all entries from the cache, from the least to the most
+// recently used, passing each to f after removing it, e.g. to persist the
+// contents on shutdown. The eviction callback and listeners are only called
+// if notify is set. Returns the number of flushed entries.
+func (c *Cache) Flush(f func(key, value interface{}, weight uint), notify bool) (flushed int) {
+	c.invalidate()
+	for ent := c.evictList.back(); ent != 0; ent = c.evictList.back() {
+		weight := c.weights[ent]
+		key, value := c.unlink(ent)
+		f(key, value, weight)
+		if notify {
+			c.evicted(key, value)
+		}
+		flushed++
+	}
+	return flushed
 }
 
 // Add adds a value to the cache.  Returns true if an eviction occurred.
 func (c *Cache) Add(key, value interface{}, weight uint) (evicted int) {
+	_, evicted = c.AddWithVersion(key, value, weight)
+	return evicted
+}
+
+// AddWithVersion adds a value to the cache, returning the version assigned
+// to the entry and the number of evictions. An entry heavier than the
+// maximum weight of the cache is rejected rather than evicting everything
+// else; an existing entry of the key is evicted, as its value is outdated.
+func (c *Cache) AddWithVersion(key, value interface{}, weight uint) (version uint64, evicted int) {
+	return c.add(key, value, weight, 0)
+}
+
+// add adds a value of the given cost to the cache, returning the version
+// assigned to the entry and the number of evictions.
+func (c *Cache) add(key, value interface{}, weight, cost uint) (version uint64, evicted int) {
+	c.Reap()
+	c.version++
+
+	weight, valid := c.weigh(weight)
+
 	// Check for existing item
 	if ent, ok := c.items[key]; ok {
-		c.evictList.MoveToFront(ent)
-		existing := ent.Value.(*entry)
-		c.weight -= existing.weight
-		c.weight += weight
-		existing.value = value
-		existing.weight = weight
-		return c.normalize()
+		if !valid || weight > c.maxWeight {
+			c.removeElement(ent)
+			return c.version, 1
+		}
+		c.touch(ent)
+		c.weight -= c.weights[ent]
+		if c.old[ent] {
+			c.oldWeight -= c.weights[ent]
+		}
+		c.weights[ent] = 0
+		evicted = c.makeRoom(weight, ent)
+		c.weight = AddWeights(c.weight, weight)
+		if c.old[ent] {
+			c.oldWeight += weight
+		}
+		c.values.set(ent, value)
+		c.weights[ent] = weight
+		c.costs[ent] = cost
+		c.versions[ent] = c.version
+		c.written[ent] = c.clock.Now()
+		return c.version, evicted + c.normalize()
+	}
+	if !valid || weight > c.maxWeight {
+		return c.version, 0
 	}
 
 	// Add new item
-	ent := &entry{key, value, weight}
-	entry := c.evictList.PushFront(ent)
-	c.items[key] = entry
-	c.weight += weight
+	evicted = c.makeRoom(weight, 0)
+	ent := c.newEntry(key, value, weight)
+	c.costs[ent] = cost
+	c.versions[ent] = c.version
+	c.written[ent] = c.clock.Now()
+	c.weight = AddWeights(c.weight, weight)
+	if c.oldPercent > 0 || c.windowPercent > 0 {
+		c.insertOld(ent)
+	} else {
+		c.evictList.pushFront(ent)
+	}
+	c.items[key] = ent
+	c.accessed(ent)
 
-	return c.normalize()
+	c.fresh = ent
+	evicted += c.normalize()
+	c.fresh = 0
+	return c.version, evicted
+}
+
+// TryAdd adds a value to the cache like Add, unless the entry could not be
+// retained even by an empty cache. In that case the cache is left unchanged
+// and ErrEntryTooLarge is returned. Entries rejected by ZeroWeightReject are
+// reported with ErrInvalidWeight.
+func (c *Cache) TryAdd(key, value interface{}, weight uint) (evicted int, err error) {
+	weighed, valid := c.weigh(weight)
+	if !valid {
+		return 0, fmt.Errorf("%w: zero weights are rejected", cacheutils.ErrInvalidWeight)
+	}
+	if c.maxSize == 0 {
+		return 0, fmt.Errorf("%w: the size limit is 0", cacheutils.ErrEntryTooLarge)
+	}
+	if weighed > c.maxWeight {
+		return 0, fmt.Errorf("%w: weight %d exceeds the limit of %d", cacheutils.ErrEntryTooLarge, weighed, c.maxWeight)
+	}
+	return c.Add(key, value, weight), nil
+}
+
+// AddResult describes the outcome of adding an entry.
+type AddResult int
+
+const (
+	// Added reports that the entry is in the cache after adding it.
+	Added AddResult = iota
+	// Rejected reports that the entry was not added as it could not be
+	// retained even by an empty cache, see TryAdd. A previous value of the
+	// key has been removed.
+	Rejected
+	// SelfEvicted reports that the entry was added but immediately evicted
+	// again to enforce the limits, e.g. when all other entries are protected
+	// or an admission window evicts its own entries.
+	SelfEvicted
+)
+
+// String returns the name of the result.
+func (r AddResult) String() string {
+	switch r {
+	case Added:
+		return "added"
+	case Rejected:
+		return "rejected"
+	case SelfEvicted:
+		return "self-evicted"
+	}
+	return fmt.Sprintf("AddResult(%d)", int(r))
+}
+
+// AddWithResult adds a value to the cache like Add, additionally reporting
+// whether the entry is in the cache afterwards. The number of evictions
+// includes a self-evicted entry and a removed previous value of the key.
+func (c *Cache) AddWithResult(key, value interface{}, weight uint) (result AddResult, evicted int) {
+	if weighed, valid := c.weigh(weight); !valid || weighed > c.maxWeight || c.maxSize == 0 {
+		result = Rejected
+	}
+	evicted = c.Add(key, value, weight)
+	if result == Added && !c.Contains(key) {
+		result = SelfEvicted
+	}
+	return result, evicted
 }
 
 // Get looks up a key's value from the cache.
 func (c *Cache) Get(key interface{}) (value interface{}, ok bool) {
 	if ent, ok := c.items[key]; ok {
-		c.evictList.MoveToFront(ent)
-		if ent.Value.(*entry) == nil {
-			return nil, false
-		}
-		return ent.Value.(*entry).value, true
+		c.touch(ent)
+		return c.values.get(ent), true
 	}
 	return
 }
@@ -102,17 +403,27 @@ func (c *Cache) Contains(key interface{}) (ok bool) {
 // Peek returns the key value (or undefined if not found) without updating
 // the "recently used"-ness of the key.
 func (c *Cache) Peek(key interface{}) (value interface{}, ok bool) {
-	var ent *list.Element
-	if ent, ok = c.items[key]; ok {
-		return ent.Value.(*entry).value, true
+	if ent, ok := c.items[key]; ok {
+		return c.values.get(ent), true
+	}
+	return nil, false
+}
+
+// WeightOf returns the weight of the entry of key, without updating its
+// "recently used"-ness.
+func (c *Cache) WeightOf(key interface{}) (weight uint, ok bool) {
+	if ent, ok := c.items[key]; ok {
+		return c.weights[ent], true
 	}
-	return nil, ok
+	return 0, false
 }
 
 // Remove removes the provided key from the cache, returning if the
 // key was contained.
 func (c *Cache) Remove(key interface{}) (present bool) {
+	c.Reap()
 	if ent, ok := c.items[key]; ok {
+		c.invalidate()
 		c.removeElement(ent)
 		return true
 	}
@@ -121,39 +432,212 @@ func (c *Cache) Remove(key interface{}) (present bool) {
 
 // RemoveOldest removes the oldest item from the cache.
 func (c *Cache) RemoveOldest() (key interface{}, value interface{}, ok bool) {
-	ent := c.evictList.Back()
-	if ent != nil {
+	ent := c.evictList.back()
+	if ent != 0 {
+		key, value = c.keys.get(ent), c.values.get(ent)
+		c.invalidate()
 		c.removeElement(ent)
-		kv := ent.Value.(*entry)
-		return kv.key, kv.value, true
+		return key, value, true
 	}
 	return nil, nil, false
 }
 
 // GetOldest returns the oldest entry
 func (c *Cache) GetOldest() (key interface{}, value interface{}, ok bool) {
-	ent := c.evictList.Back()
-	if ent != nil {
-		kv := ent.Value.(*entry)
-		return kv.key, kv.value, true
+	ent := c.evictList.back()
+	if ent != 0 {
+		return c.keys.get(ent), c.values.get(ent), true
 	}
 	return nil, nil, false
 }
 
+// GetOldestEntry returns the oldest entry including its weight and age,
+// without updating its "recently used"-ness.
+func (c *Cache) GetOldestEntry() (entry Entry, ok bool) {
+	ent := c.evictList.back()
+	if ent != 0 {
+		return c.export(ent, c.clock.Now()), true
+	}
+	return Entry{}, false
+}
+
+// RemoveOldestEntry removes the oldest entry from the cache, returning it
+// including its weight and age.
+func (c *Cache) RemoveOldestEntry() (entry Entry, ok bool) {
+	ent := c.evictList.back()
+	if ent != 0 {
+		entry = c.export(ent, c.clock.Now())
+		c.invalidate()
+		c.removeElement(ent)
+		return entry, true
+	}
+	return Entry{}, false
+}
+
+// GetNewest returns the most recently used entry and marks it as used.
+func (c *Cache) GetNewest() (key interface{}, value interface{}, ok bool) {
+	ent := c.evictList.front()
+	if ent != 0 {
+		c.touch(ent)
+		return c.keys.get(ent), c.values.get(ent), true
+	}
+	return nil, nil, false
+}
+
+// PeekNewest returns the most recently used entry without updating its
+// "recently used"-ness.
+func (c *Cache) PeekNewest() (key interface{}, value interface{}, ok bool) {
+	ent := c.evictList.front()
+	if ent != 0 {
+		return c.keys.get(ent), c.values.get(ent), true
+	}
+	return nil, nil, false
+}
+
+// PeekNewestEntry returns the most recently used entry including its weight
+// and age, without updating its "recently used"-ness.
+func (c *Cache) PeekNewestEntry() (entry Entry, ok bool) {
+	ent := c.evictList.front()
+	if ent != 0 {
+		return c.export(ent, c.clock.Now()), true
+	}
+	return Entry{}, false
+}
+
+// PeekOldestN returns up to n of the least recently used entries, from oldest
+// to newest, without updating their "recently used"-ness.
+func (c *Cache) PeekOldestN(n int) []Entry {
+	if n > c.evictList.len {
+		n = c.evictList.len
+	}
+	if n <= 0 {
+		return nil
+	}
+	now := c.clock.Now()
+	entries := make([]Entry, 0, n)
+	for ent := c.evictList.back(); ent != 0 && len(entries) < n; ent = c.evictList.prev(ent) {
+		entries = append(entries, c.export(ent, now))
+	}
+	return entries
+}
+
 // Keys returns a slice of the keys in the cache, from oldest to newest.
 func (c *Cache) Keys() []interface{} {
-	keys := make([]interface{}, len(c.items))
-	i := 0
-	for ent := c.evictList.Back(); ent != nil; ent = ent.Prev() {
-		keys[i] = ent.Value.(*entry).key
-		i++
+	return c.AppendKeys(make([]interface{}, 0, len(c.items)))
+}
+
+// AppendKeys appends the keys in the cache, from oldest to newest, to dst and
+// returns the extended slice.
+func (c *Cache) AppendKeys(dst []interface{}) []interface{} {
+	for ent := c.evictList.back(); ent != 0; ent = c.evictList.prev(ent) {
+		dst = append(dst, c.keys.get(ent))
+	}
+	return dst
+}
+
+// KeysNewestFirst returns a slice of the keys in the cache, from newest to
+// oldest.
+func (c *Cache) KeysNewestFirst() []interface{} {
+	keys := make([]interface{}, 0, len(c.items))
+	for ent := c.evictList.front(); ent != 0; ent = c.evictList.next(ent) {
+		keys = append(keys, c.keys.get(ent))
 	}
 	return keys
 }
 
+// RangeNewestFirst calls f for each entry in the cache, from newest to
+// oldest, until f returns false. The cache must not be modified by f.
+func (c *Cache) RangeNewestFirst(f func(key, value interface{}) bool) {
+	for ent := c.evictList.front(); ent != 0; ent = c.evictList.next(ent) {
+		if !f(c.keys.get(ent), c.values.get(ent)) {
+			return
+		}
+	}
+}
+
+// Order is a copy of the entries of a cache in recency order, taken by
+// CaptureOrder. It is unaffected by later changes of the cache.
+type Order struct {
+	keys   []interface{}
+	values []interface{}
+	links  []link
+	len    int
+}
+
+// CaptureOrder copies the entries of the cache and their recency order. The
+// entry slices are copied in bulk rather than walked, so that the copy is
+// cheap even for large caches; walking it is left to the caller.
+func (c *Cache) CaptureOrder() Order {
+	var o Order
+	o.Capture(c)
+	return o
+}
+
+// Capture copies the entries of the cache and their recency order into o
+// like CaptureOrder, reusing the storage of o.
+func (o *Order) Capture(c *Cache) {
+	o.keys = c.keys.appendTo(o.keys[:0])
+	o.values = c.values.appendTo(o.values[:0])
+	o.links = c.evictList.links.appendTo(o.links[:0])
+	o.len = c.evictList.len
+}
+
+// Reset empties o, dropping its references to keys and values while keeping
+// its storage for reuse.
+func (o *Order) Reset() {
+	clear(o.keys[:cap(o.keys)])
+	clear(o.values[:cap(o.values)])
+	o.keys = o.keys[:0]
+	o.values = o.values[:0]
+	o.links = append(o.links[:0], link{})
+	o.len = 0
+}
+
+// Len returns the number of entries in the order.
+func (o Order) Len() int {
+	return o.len
+}
+
+// AppendKeys appends the keys, from oldest to newest, to dst and returns the
+// extended slice.
+func (o Order) AppendKeys(dst []interface{}) []interface{} {
+	if o.len == 0 {
+		return dst
+	}
+	for ent := o.links[0].prev; ent != 0; ent = o.links[ent].prev {
+		dst = append(dst, o.keys[ent])
+	}
+	return dst
+}
+
+// AppendKeysNewestFirst appends the keys, from newest to oldest, to dst and
+// returns the extended slice.
+func (o Order) AppendKeysNewestFirst(dst []interface{}) []interface{} {
+	if o.len == 0 {
+		return dst
+	}
+	for ent := o.links[0].next; ent != 0; ent = o.links[ent].next {
+		dst = append(dst, o.keys[ent])
+	}
+	return dst
+}
+
+// RangeNewestFirst calls f for each entry, from newest to oldest, until f
+// returns false.
+func (o Order) RangeNewestFirst(f func(key, value interface{}) bool) {
+	if o.len == 0 {
+		return
+	}
+	for ent := o.links[0].next; ent != 0; ent = o.links[ent].next {
+		if !f(o.keys[ent], o.values[ent]) {
+			return
+		}
+	}
+}
+
 // Len returns the number of items in the cache.
 func (c *Cache) Len() int {
-	return c.evictList.Len()
+	return c.evictList.len
 }
 
 // Weight returns the total weight of items in the cache.
@@ -173,29 +657,315 @@ func (c *Cache) Resize(maxWeight uint, maxSize int) (evicted int) {
 	return c.normalize()
 }
 
+// EvictTo evicts entries, in the order of capacity evictions, until the total
+// weight of the cache is at most weight. The limits of the cache are left
+// unchanged. Returns the number of evictions.
+func (c *Cache) EvictTo(weight uint) (evicted int) {
+	for c.weight > weight {
+		ent := c.victim()
+		if ent == 0 {
+			break
+		}
+		c.removeElement(ent)
+		evicted++
+	}
+	return evicted
+}
+
+// SetProtected exempts the entries whose key matches the predicate from
+// capacity evictions, which then pick the least recently used unprotected
+// entry instead. The predicate is consulted whenever an entry is about to be
+// evicted, so the set of protected entries may change over time without
+// enumerating them; it must not use the cache. When protected entries alone
+// exceed the limits, the cache stays over its limits until they are no
+// longer protected. Explicit removals are unaffected. A nil predicate
+// protects nothing.
+func (c *Cache) SetProtected(protected func(key interface{}) bool) {
+	c.protected = protected
+}
+
+// RecalculateWeights sets the weight of every entry to the one reported by
+// the weigher and evicts entries until the cache fits its limits again. It is
+// needed after changing how weights are computed or when values are mutated
+// in place. Entries whose new weight is rejected by the zero weight policy
+// are evicted. Returns the number of evictions.
+func (c *Cache) RecalculateWeights(weigher func(key, value interface{}) uint) (evicted int) {
+	if c.zeroWeights == ZeroWeightReject {
+		for ent := c.evictList.front(); ent != 0; {
+			next := c.evictList.next(ent)
+			if _, valid := c.weigh(weigher(c.keys.get(ent), c.values.get(ent))); !valid {
+				c.removeElement(ent)
+				evicted++
+			}
+			ent = next
+		}
+	}
+	// Weights are summed from the most recently used entry on. Should the
+	// total overflow, the remaining, less recently used entries are evicted
+	// without being accounted for.
+	var weight, oldWeight uint
+	var overflow ref
+	for ent := c.evictList.front(); ent != 0; ent = c.evictList.next(ent) {
+		c.weights[ent], _ = c.weigh(weigher(c.keys.get(ent), c.values.get(ent)))
+		if overflow == 0 && weight > math.MaxUint-c.weights[ent] {
+			overflow = ent
+		}
+		if overflow != 0 {
+			c.weights[ent] = 0
+			continue
+		}
+		weight += c.weights[ent]
+		if c.old[ent] {
+			oldWeight += c.weights[ent]
+		}
+	}
+	c.weight, c.oldWeight = weight, oldWeight
+	for overflow != 0 {
+		ent := c.evictList.back()
+		if ent == overflow {
+			overflow = 0
+		}
+		c.removeElement(ent)
+		evicted++
+	}
+	return evicted + c.normalize()
+}
+
 func (c *Cache) normalize() (evicted int) {
 	for c.weight > c.maxWeight || c.Len() > c.maxSize {
-		c.removeOldest()
+		ent := c.victim()
+		if ent == 0 {
+			break
+		}
+		c.removeElement(ent)
 		evicted++
 	}
 	return evicted
 }
 
-// removeOldest removes the oldest item from the cache.
-func (c *Cache) removeOldest() {
-	ent := c.evictList.Back()
-	if ent != nil {
-		c.removeElement(ent)
+// victim returns the element to evict next. With an admission window, the
+// least recently used entry outside the window is chosen as long as the
+// window is within its budget, so that a scan can only displace the window.
+// A single window entry exceeding the budget on its own is admitted as well.
+// With an eviction score or heaviest-first eviction, the highest-rated of
+// the least recently used entries is chosen. Protected entries are passed
+// over; the zero ref is returned if all are protected.
+func (c *Cache) victim() ref {
+	if c.k > 0 {
+		return c.kVictim()
+	}
+	if c.scorePercent > 0 {
+		return c.scoredVictim()
 	}
+	if c.windowPercent > 0 && c.mid != 0 && c.evictList.prev(c.mid) != 0 {
+		maxWeight := c.maxWeight/100*uint(c.windowPercent) + c.maxWeight%100*uint(c.windowPercent)/100
+		maxSize := c.maxSize/100*c.windowPercent + c.maxSize%100*c.windowPercent/100
+		if c.oldLen == 1 || c.oldWeight <= maxWeight && c.oldLen <= maxSize {
+			if ent := c.unprotected(c.evictList.prev(c.mid)); ent != 0 {
+				return ent
+			}
+		}
+	}
+	return c.unprotected(c.evictList.back())
+}
+
+// unprotected returns the first unprotected entry from ent towards the front
+// of the list, or the zero ref if there is none.
+func (c *Cache) unprotected(ent ref) ref {
+	if c.protected == nil {
+		return ent
+	}
+	for ent != 0 && c.protected(c.keys.get(ent)) {
+		ent = c.evictList.prev(ent)
+	}
+	return ent
+}
+
+// removeElement is used to remove a given entry from the cache
+func (c *Cache) removeElement(e ref) {
+	key, value := c.unlink(e)
+	c.evicted(key, value)
+}
+
+// unlink removes a given entry from the cache without reporting it,
+// returning its key and value.
+func (c *Cache) unlink(e ref) (key, value interface{}) {
+	key, value = c.keys.get(e), c.values.get(e)
+	if c.old[e] {
+		if e == c.mid {
+			c.mid = c.evictList.next(e)
+		}
+		c.oldLen--
+		c.oldWeight -= c.weights[e]
+	}
+	c.evictList.remove(e)
+	c.forget(e)
+	delete(c.items, key)
+	c.weight -= c.weights[e]
+	c.balance()
+	c.release(e)
+	return key, value
+}
+
+// export describes the entry as of the given time.
+func (c *Cache) export(e ref, now time.Time) Entry {
+	return Entry{Key: c.keys.get(e), Value: c.values.get(e), Weight: c.weights[e], Cost: c.costs[e], Age: now.Sub(c.written[e]), Recency: c.used[e]}
 }
 
-// removeElement is used to remove a given list element from the cache
-func (c *Cache) removeElement(e *list.Element) {
-	c.evictList.Remove(e)
-	kv := e.Value.(*entry)
-	delete(c.items, kv.key)
-	c.weight -= kv.weight
-	if c.onEvict != nil {
-		c.onEvict(kv.key, kv.value)
+// newEntry returns an entry for the given data, reusing the slot of a
+// released one if available. Refs are 32 bits wide, so a cache holds at most
+// math.MaxInt32 entries; newEntry panics beyond that.
+func (c *Cache) newEntry(key, value interface{}, weight uint) ref {
+	if n := len(c.free); n > 0 {
+		ent := c.free[n-1]
+		c.free = c.free[:n-1]
+		c.keys.set(ent, key)
+		c.values.set(ent, value)
+		c.weights[ent] = weight
+		return ent
 	}
+	if c.keys.len() > math.MaxInt32 {
+		panic("simplewlru: too many entries")
+	}
+	ent := ref(c.keys.len())
+	c.keys.push(key)
+	c.values.push(value)
+	c.weights = append(c.weights, weight)
+	c.costs = append(c.costs, 0)
+	c.versions = append(c.versions, 0)
+	c.written = append(c.written, time.Time{})
+	c.used = append(c.used, 0)
+	c.old = append(c.old, false)
+	c.evictList.links.push(link{})
+	if c.k > 0 {
+		c.history = append(c.history, make([]uint64, c.k)...)
+		c.heapPos = append(c.heapPos, -1)
+	}
+	return ent
+}
+
+// release makes the slot of an entry no longer referenced by the cache
+// available for reuse. Once most slots are unused, e.g. after shrinking the
+// cache, the remaining entries are compacted to give the memory back.
+func (c *Cache) release(e ref) {
+	c.keys.set(e, nil)
+	c.values.set(e, nil)
+	c.weights[e], c.costs[e], c.versions[e], c.used[e], c.old[e] = 0, 0, 0, 0, false
+	c.written[e] = time.Time{}
+	c.free = append(c.free, e)
+	if !keepReleased && len(c.free) > minCompactEntries && len(c.free) > 3*c.evictList.len {
+		c.compact()
+	}
+}
+
+// compact moves all entries into a fresh set of slices sized for them,
+// preserving their recency order.
+func (c *Cache) compact() {
+	keys, values, weights, costs := c.keys, c.values, c.weights, c.costs
+	versions, written, used, old := c.versions, c.written, c.used, c.old
+	links, mid := c.evictList.links, c.mid
+	history, k := c.history, c.k
+	n := c.evictList.len
+	c.reserve(n)
+	c.mid = 0
+	for e := links.get(0).prev; e != 0; e = links.get(e).prev {
+		ent := c.newEntry(keys.get(e), values.get(e), weights[e])
+		c.costs[ent], c.versions[ent], c.written[ent], c.used[ent], c.old[ent] = costs[e], versions[e], written[e], used[e], old[e]
+		c.evictList.pushFront(ent)
+		c.items[keys.get(e)] = ent
+		if e == mid {
+			c.mid = ent
+		}
+		if k > 0 {
+			copy(c.history[int(ent)*k:int(ent+1)*k], history[int(e)*k:int(e+1)*k])
+			c.heapPos[ent] = len(c.heap)
+			c.heap = append(c.heap, ent)
+		}
+	}
+	if k > 0 {
+		heap.Init(accessHeap{c})
+	}
+}
+
+// touch marks the given entry as used. Entries in the old sublist are
+// promoted to the head of the list, as this is their second hit.
+func (c *Cache) touch(e ref) {
+	if c.old[e] {
+		if e == c.mid {
+			c.mid = c.evictList.next(e)
+		}
+		c.old[e] = false
+		c.oldLen--
+		c.oldWeight -= c.weights[e]
+	}
+	c.evictList.moveToFront(e)
+	c.balance()
+	c.accessed(e)
+}
+
+// insertOld inserts a new entry at the head of the old sublist.
+func (c *Cache) insertOld(e ref) {
+	if c.mid == 0 {
+		c.evictList.pushBack(e)
+	} else {
+		c.evictList.insertBefore(e, c.mid)
+	}
+	c.old[e] = true
+	c.mid = e
+	c.oldLen++
+	c.oldWeight += c.weights[e]
+	c.balance()
+}
+
+// balance moves the midpoint so that the old sublist spans oldPercent of the
+// entries.
+func (c *Cache) balance() {
+	if c.oldPercent == 0 {
+		return
+	}
+	target := c.evictList.len * c.oldPercent / 100
+	for c.oldLen > target {
+		c.old[c.mid] = false
+		c.oldLen--
+		c.oldWeight -= c.weights[c.mid]
+		c.mid = c.evictList.next(c.mid)
+	}
+	for c.oldLen < target {
+		if c.mid == 0 {
+			c.mid = c.evictList.back()
+		} else {
+			c.mid = c.evictList.prev(c.mid)
+		}
+		c.old[c.mid] = true
+		c.oldLen++
+		c.oldWeight += c.weights[c.mid]
+	}
+}
+
+// AsReadOnly returns a view of the cache restricted to lookups. The view
+// hides the cache itself, so its holder cannot modify the cache even by a
+// type assertion.
+func (c *Cache) AsReadOnly() cacheutils.ReadOnlyCache {
+	return readOnly{c}
+}
+
+// readOnly restricts a Cache to the methods of cacheutils.ReadOnlyCache.
+type readOnly struct {
+	c *Cache
+}
+
+func (r readOnly) Get(key interface{}) (value interface{}, ok bool) {
+	return r.c.Get(key)
+}
+
+func (r readOnly) Peek(key interface{}) (value interface{}, ok bool) {
+	return r.c.Peek(key)
+}
+
+func (r readOnly) Contains(key interface{}) bool {
+	return r.c.Contains(key)
+}
+
+func (r readOnly) Keys() []interface{} {
+	return r.c.Keys()
 }
@@ -1,7 +1,17 @@
 package simplewlru
 
 import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/0xsoniclabs/cacheutils/clock"
 )
 
 func TestNew(t *testing.T) {
@@ -203,23 +213,6 @@ func TestGetNonExistent(t *testing.T) {
 	}
 }
 
-func TestGetWithNilEntry(t *testing.T) {
-	c, _ := New(100, 10)
-	key := "nilEntryKey"
-
-	// Manually add an element with a nil *entry to the cache
-	element := c.evictList.PushFront((*entry)(nil))
-	c.items[key] = element
-
-	value, ok := c.Get(key)
-	if ok {
-		t.Error("expected ok to be false for nil entry")
-	}
-	if value != nil {
-		t.Errorf("expected value to be nil, got %v", value)
-	}
-}
-
 func TestRemoveOldestAndGetOldest(t *testing.T) {
 	c, _ := New(100, 10)
 	c.Add("first", 1, 1)
@@ -344,3 +337,1295 @@ func TestResize(t *testing.T) {
 		t.Errorf("expected cache length <= 2, got %d", c.Len())
 	}
 }
+
+func TestNewWithInvalidMidpoint(t *testing.T) {
+	for _, pct := range []int{-1, 0, 100} {
+		if _, err := New(100, 10, WithMidpointInsertion(pct)); err == nil {
+			t.Errorf("expected error for old sublist percentage %d", pct)
+		}
+	}
+}
+
+func TestMidpointInsertion(t *testing.T) {
+	c, _ := New(100, 4, WithMidpointInsertion(50))
+	c.Add("a", 1, 1)
+	c.Add("b", 2, 1)
+	c.Add("c", 3, 1)
+	c.Add("d", 4, 1)
+	// New entries enter at the midpoint instead of the head, so "a" remains
+	// the most recently used entry.
+	expectKeys(t, c, "b", "d", "c", "a")
+
+	// A second hit promotes an old entry to the head.
+	c.Get("d")
+	expectKeys(t, c, "b", "c", "a", "d")
+}
+
+func TestMidpointInsertionProtectsHotEntries(t *testing.T) {
+	c, _ := New(100, 10, WithMidpointInsertion(37))
+	for i := 0; i < 10; i++ {
+		c.Add(i, i, 1)
+		c.Get(i)
+	}
+	// Flood the cache with one-off insertions.
+	for i := 100; i < 200; i++ {
+		c.Add(i, i, 1)
+	}
+	hot := 0
+	for i := 0; i < 10; i++ {
+		if c.Contains(i) {
+			hot++
+		}
+	}
+	if hot < 10-10*37/100 {
+		t.Errorf("expected hot entries to survive the flood, only %d did", hot)
+	}
+	if c.Len() != 10 {
+		t.Errorf("expected 10 entries, got %d", c.Len())
+	}
+}
+
+func TestMidpointInsertionRemoval(t *testing.T) {
+	c, _ := New(100, 10, WithMidpointInsertion(50))
+	for i := 0; i < 10; i++ {
+		c.Add(i, i, 1)
+	}
+	for i := 0; i < 10; i++ {
+		if !c.Remove(i) {
+			t.Fatalf("expected key %d to be removed", i)
+		}
+		if c.oldLen != c.Len()*50/100 {
+			t.Fatalf("old sublist out of balance: %d of %d", c.oldLen, c.Len())
+		}
+	}
+	if c.mid != 0 {
+		t.Errorf("expected midpoint to be reset on empty cache")
+	}
+}
+
+func expectKeys(t *testing.T, c *Cache, expected ...interface{}) {
+	t.Helper()
+	keys := c.Keys()
+	if len(keys) != len(expected) {
+		t.Fatalf("expected keys %v, got %v", expected, keys)
+	}
+	for i, key := range keys {
+		if key != expected[i] {
+			t.Fatalf("expected keys %v, got %v", expected, keys)
+		}
+	}
+}
+
+func TestNewWithMidpointAndWindow(t *testing.T) {
+	if _, err := New(100, 10, WithMidpointInsertion(37), WithAdmissionWindow(10)); err == nil {
+		t.Errorf("expected error when combining midpoint insertion and admission window")
+	}
+	if _, err := New(100, 10, WithAdmissionWindow(100)); err == nil {
+		t.Errorf("expected error for admission window percentage 100")
+	}
+}
+
+func TestAdmissionWindowResistsScan(t *testing.T) {
+	c, _ := New(100, 100, WithAdmissionWindow(10))
+	for i := 0; i < 90; i++ {
+		c.Add(i, i, 1)
+		c.Get(i)
+	}
+	// A scan much larger than the cache only displaces the window's share
+	// of the working set.
+	for i := 1000; i < 2000; i++ {
+		c.Add(i, i, 1)
+	}
+	hot := 0
+	for i := 0; i < 90; i++ {
+		if c.Contains(i) {
+			hot++
+		}
+	}
+	if hot < 80 {
+		t.Errorf("expected most of the working set to survive the scan, only %d did", hot)
+	}
+	if c.Len() != 100 || c.Weight() != 100 {
+		t.Errorf("expected a full cache, got %d entries of weight %d", c.Len(), c.Weight())
+	}
+	if !c.Contains(1999) {
+		t.Errorf("expected the latest scanned entry to be in the window")
+	}
+}
+
+func TestAdmissionWindowAdmitsLargeEntry(t *testing.T) {
+	c, _ := New(100, 100, WithAdmissionWindow(10))
+	for i := 0; i < 10; i++ {
+		c.Add(i, i, 10)
+		c.Get(i)
+	}
+	c.Add("large", 0, 30)
+	if !c.Contains("large") {
+		t.Errorf("expected an entry exceeding the window budget to be admitted")
+	}
+	if c.Weight() != 100 {
+		t.Errorf("expected weight 100, got %d", c.Weight())
+	}
+	c.Get("large")
+	c.Add("next", 0, 5)
+	if !c.Contains("large") {
+		t.Errorf("expected promoted entry to stay in the cache")
+	}
+}
+
+func TestEntriesAreReused(t *testing.T) {
+	c, _ := New(100, 2)
+	c.Add("a", "A", 1)
+	c.Add("b", "B", 1)
+	key, value, _ := c.RemoveOldest()
+	if key != "a" || value != "A" {
+		t.Errorf("expected removed oldest to be ('a', 'A'), got (%v, %v)", key, value)
+	}
+	if len(c.free) != 1 || c.keys.get(c.free[0]) != nil || c.values.get(c.free[0]) != nil {
+		t.Fatalf("expected a single cleared entry to be released, got %v", c.free)
+	}
+	released := c.free[0]
+	c.Add("c", "C", 3)
+	if len(c.free) != 0 || c.items["c"] != released {
+		t.Errorf("expected released entry to be reused")
+	}
+	if value, ok := c.Get("c"); !ok || value != "C" {
+		t.Errorf("expected value 'C', got %v", value)
+	}
+	if c.Weight() != 4 {
+		t.Errorf("expected weight 4, got %d", c.Weight())
+	}
+
+	c.Purge()
+	if len(c.free) != 0 || c.keys.len() != 1 {
+		t.Errorf("expected purge to drop all entries, got %d slots and %d free", c.keys.len()-1, len(c.free))
+	}
+}
+
+func TestEntriesAreCompacted(t *testing.T) {
+	if keepReleased {
+		t.Skip("released entries are kept by this backend")
+	}
+	n := 4 * minCompactEntries
+	c, _ := New(uint(n), n, WithMidpointInsertion(50))
+	for i := 0; i < n; i++ {
+		c.Add(i, i, 1)
+	}
+	c.Get(0)
+	c.Resize(10, 10)
+	if c.keys.len() > 2*minCompactEntries {
+		t.Errorf("expected entry slices to be compacted, got %d slots", c.keys.len())
+	}
+	if c.keys.len()-1-len(c.free) != 10 {
+		t.Errorf("expected 10 entries in use, got %d", c.keys.len()-1-len(c.free))
+	}
+	expectKeys(t, c, 18, 16, 14, 12, 10, 8, 6, 4, 2, 0)
+	if c.oldLen != 5 || !c.old[c.mid] || c.keys.get(c.mid) != 10 {
+		t.Errorf("expected midpoint to survive compaction")
+	}
+	for i := 0; i < 20; i += 2 {
+		if value, ok := c.Peek(i); !ok || value != i {
+			t.Errorf("expected value %d, got %v", i, value)
+		}
+	}
+}
+
+func TestWithInitialCapacity(t *testing.T) {
+	if _, err := New(100, 10, WithInitialCapacity(-1)); err == nil {
+		t.Errorf("expected error for negative initial capacity")
+	}
+	c, err := New(100, 10, WithInitialCapacity(1000))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if c.keys.capacity() < 1001 || c.evictList.links.capacity() < 1001 {
+		t.Errorf("expected room for 1000 entries, got %d", c.keys.capacity()-1)
+	}
+	if allocs := testing.AllocsPerRun(10, func() {
+		c.Add("b", "B", 1)
+		c.Remove("b")
+	}); allocs != 0 {
+		t.Errorf("expected no allocations, got %v", allocs)
+	}
+}
+
+func TestAppendKeys(t *testing.T) {
+	c, _ := New(100, 10)
+	c.Add("a", "A", 1)
+	c.Add("b", "B", 1)
+	buf := make([]interface{}, 0, 4)
+	buf = append(buf, "x")
+	keys := c.AppendKeys(buf)
+	expected := []interface{}{"x", "a", "b"}
+	if len(keys) != len(expected) {
+		t.Fatalf("expected keys %v, got %v", expected, keys)
+	}
+	for i, key := range keys {
+		if key != expected[i] {
+			t.Errorf("at index %d: expected key %v, got %v", i, expected[i], key)
+		}
+	}
+	if allocs := testing.AllocsPerRun(10, func() {
+		c.AppendKeys(buf[:0])
+	}); allocs != 0 {
+		t.Errorf("expected no allocations, got %v", allocs)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	c, _ := New(100, 10)
+	v1, _ := c.AddWithVersion("a", "A", 1)
+	v2, _ := c.AddWithVersion("b", "B", 1)
+	if v2 <= v1 {
+		t.Errorf("expected increasing versions, got %d and %d", v1, v2)
+	}
+	value, version, ok := c.GetWithVersion("a")
+	if !ok || value != "A" || version != v1 {
+		t.Errorf("expected ('A', %d), got (%v, %d)", v1, value, version)
+	}
+	v3, _ := c.AddWithVersion("a", "A2", 1)
+	if v3 <= v2 {
+		t.Errorf("expected update to increase version, got %d", v3)
+	}
+
+	// A fill based on the outdated version is rejected.
+	if _, ok, _ := c.AddIfVersion("a", "stale", 1, v1); ok {
+		t.Errorf("expected stale fill to be rejected")
+	}
+	if _, ok, _ := c.AddIfVersion("a", "A3", 1, v3); !ok {
+		t.Errorf("expected fill with current version to succeed")
+	}
+	if value, _ := c.Peek("a"); value != "A3" {
+		t.Errorf("expected value 'A3', got %v", value)
+	}
+}
+
+func TestAddIfVersionRacingInvalidation(t *testing.T) {
+	c, _ := New(100, 10)
+	_, version, ok := c.GetWithVersion("a")
+	if ok {
+		t.Fatalf("expected miss")
+	}
+	// The fill succeeds if nothing was invalidated in the meantime.
+	if _, ok, _ := c.AddIfVersion("a", "A", 1, version); !ok {
+		t.Errorf("expected fill of missing key to succeed")
+	}
+
+	_, version, _ = c.GetWithVersion("a")
+	c.Remove("a")
+	if _, ok, _ := c.AddIfVersion("a", "stale", 1, version); ok {
+		t.Errorf("expected fill racing with removal to be rejected")
+	}
+
+	_, version, _ = c.GetWithVersion("a")
+	c.Purge()
+	if _, ok, _ := c.AddIfVersion("a", "stale", 1, version); ok {
+		t.Errorf("expected fill racing with purge to be rejected")
+	}
+}
+
+func TestTryAdd(t *testing.T) {
+	c, _ := New(10, 10)
+	c.Add("a", "A", 5)
+	if _, err := c.TryAdd("b", "B", 11); !errors.Is(err, cacheutils.ErrEntryTooLarge) {
+		t.Errorf("expected ErrEntryTooLarge, got %v", err)
+	}
+	expectKeys(t, c, "a")
+	if evicted, err := c.TryAdd("b", "B", 10); err != nil || evicted != 1 {
+		t.Errorf("expected one eviction without error, got %d, %v", evicted, err)
+	}
+	expectKeys(t, c, "b")
+
+	c, _ = New(10, 0)
+	if _, err := c.TryAdd("a", "A", 1); !errors.Is(err, cacheutils.ErrEntryTooLarge) || !strings.Contains(err.Error(), "size limit") {
+		t.Errorf("expected ErrEntryTooLarge naming the size limit, got %v", err)
+	}
+	if _, err := New(10, -1); !errors.Is(err, cacheutils.ErrInvalidSize) {
+		t.Errorf("expected ErrInvalidSize, got %v", err)
+	}
+}
+
+func TestAsReadOnly(t *testing.T) {
+	c, _ := New(10, 10)
+	c.Add("a", "A", 1)
+	c.Add("b", "B", 1)
+	view := c.AsReadOnly()
+	if _, ok := view.(interface{ Remove(interface{}) bool }); ok {
+		t.Errorf("expected the view to hide mutating methods")
+	}
+	if value, ok := view.Get("a"); !ok || value != "A" {
+		t.Errorf("expected value 'A', got %v", value)
+	}
+	if value, ok := view.Peek("b"); !ok || value != "B" {
+		t.Errorf("expected value 'B', got %v", value)
+	}
+	if view.Contains("c") {
+		t.Errorf("expected 'c' to be missing")
+	}
+	c.Add("c", "C", 1)
+	if keys := view.Keys(); len(keys) != 3 || keys[0] != "b" || keys[2] != "c" {
+		t.Errorf("expected the view to reflect the cache, got %v", keys)
+	}
+}
+
+func TestWeightOf(t *testing.T) {
+	c, _ := New(10, 5)
+	c.Add("a", "A", 3)
+	c.Add("b", "B", 4)
+	if weight, ok := c.WeightOf("a"); !ok || weight != 3 {
+		t.Errorf("expected weight 3, got %d (%v)", weight, ok)
+	}
+	if _, ok := c.WeightOf("c"); ok {
+		t.Errorf("expected no weight for missing key")
+	}
+	expectKeys(t, c, "a", "b")
+
+	c.Add("a", "A", 1)
+	if weight, _ := c.WeightOf("a"); weight != 1 {
+		t.Errorf("expected updated weight 1, got %d", weight)
+	}
+}
+
+func TestPeekOldestN(t *testing.T) {
+	c, _ := New(100, 10)
+	if entries := c.PeekOldestN(3); len(entries) != 0 {
+		t.Errorf("expected no entries for empty cache, got %v", entries)
+	}
+	c.Add("a", "A", 1)
+	time.Sleep(time.Millisecond)
+	c.Add("b", "B", 2)
+	c.Add("c", "C", 3)
+
+	entries := c.PeekOldestN(2)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	if entries[0].Key != "a" || entries[0].Value != "A" || entries[0].Weight != 1 {
+		t.Errorf("unexpected oldest entry %+v", entries[0])
+	}
+	if entries[1].Key != "b" || entries[1].Value != "B" || entries[1].Weight != 2 {
+		t.Errorf("unexpected second oldest entry %+v", entries[1])
+	}
+	if entries[0].Age < time.Millisecond || entries[0].Age < entries[1].Age {
+		t.Errorf("unexpected ages %v and %v", entries[0].Age, entries[1].Age)
+	}
+	// Peeking does not promote the entries.
+	if key, _, _ := c.GetOldest(); key != "a" {
+		t.Errorf("expected oldest key 'a', got %v", key)
+	}
+	if entries := c.PeekOldestN(10); len(entries) != 3 {
+		t.Errorf("expected all 3 entries, got %d", len(entries))
+	}
+}
+
+func TestHeaviestEntries(t *testing.T) {
+	c, _ := New(100, 10)
+	if entries := c.HeaviestEntries(3); len(entries) != 0 {
+		t.Errorf("expected no entries for empty cache, got %v", entries)
+	}
+	for i, weight := range []uint{3, 7, 1, 7, 5, 2} {
+		c.Add(i, i, weight)
+	}
+	c.Get(1)
+
+	var keys []interface{}
+	for _, e := range c.HeaviestEntries(4) {
+		if e.Weight != c.weights[c.items[e.Key]] {
+			t.Errorf("unexpected weight of entry %+v", e)
+		}
+		keys = append(keys, e.Key)
+	}
+	// Of equal weights, the least recently used come first.
+	if want := []interface{}{3, 1, 4, 0}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("expected keys %v, got %v", want, keys)
+	}
+	expectKeys(t, c, 0, 2, 3, 4, 5, 1)
+	if entries := c.HeaviestEntries(10); len(entries) != 6 || entries[5].Key != 2 {
+		t.Errorf("expected all 6 entries ending with the lightest, got %v", entries)
+	}
+}
+
+func TestGetAndPeekNewest(t *testing.T) {
+	c, _ := New(100, 10)
+	if _, _, ok := c.GetNewest(); ok {
+		t.Errorf("expected GetNewest to return false for empty cache")
+	}
+	if _, _, ok := c.PeekNewest(); ok {
+		t.Errorf("expected PeekNewest to return false for empty cache")
+	}
+	if _, ok := c.PeekNewestEntry(); ok {
+		t.Errorf("expected PeekNewestEntry to return false for empty cache")
+	}
+	c.Add("a", "A", 1)
+	c.Add("b", "B", 2)
+	if key, value, ok := c.PeekNewest(); !ok || key != "b" || value != "B" {
+		t.Errorf("expected newest to be ('b', 'B'), got (%v, %v)", key, value)
+	}
+	if e, ok := c.PeekNewestEntry(); !ok || e.Key != "b" || e.Weight != 2 || e.Recency != 2 {
+		t.Errorf("expected newest entry b of weight 2, got %v", e)
+	}
+	c.Get("a")
+	if key, value, ok := c.GetNewest(); !ok || key != "a" || value != "A" {
+		t.Errorf("expected newest to be ('a', 'A'), got (%v, %v)", key, value)
+	}
+}
+
+func TestGetNewestPromotesFromWindow(t *testing.T) {
+	c, _ := New(100, 10, WithAdmissionWindow(50))
+	c.Add("a", "A", 1)
+	c.PeekNewest()
+	if !c.old[c.items["a"]] {
+		t.Errorf("expected PeekNewest to leave the entry in the window")
+	}
+	c.GetNewest()
+	if c.old[c.items["a"]] {
+		t.Errorf("expected GetNewest to promote the entry")
+	}
+}
+
+func TestKeysNewestFirst(t *testing.T) {
+	c, _ := New(100, 10)
+	c.Add("a", "A", 1)
+	c.Add("b", "B", 1)
+	c.Add("c", "C", 1)
+	_, _ = c.Get("b")
+	keys := c.KeysNewestFirst()
+	expected := []interface{}{"b", "c", "a"}
+	if len(keys) != len(expected) {
+		t.Fatalf("expected %d keys, got %d", len(expected), len(keys))
+	}
+	for i, key := range keys {
+		if key != expected[i] {
+			t.Errorf("at index %d: expected key %v, got %v", i, expected[i], key)
+		}
+	}
+}
+
+func TestRangeNewestFirst(t *testing.T) {
+	c, _ := New(100, 10)
+	c.Add("a", "A", 1)
+	c.Add("b", "B", 1)
+	c.Add("c", "C", 1)
+
+	var visited []interface{}
+	c.RangeNewestFirst(func(key, value interface{}) bool {
+		visited = append(visited, key)
+		return key != "b"
+	})
+	if len(visited) != 2 || visited[0] != "c" || visited[1] != "b" {
+		t.Errorf("expected to visit [c b], got %v", visited)
+	}
+}
+
+func TestCaptureOrder(t *testing.T) {
+	c, _ := New(100, 10)
+	c.Add("a", "A", 1)
+	c.Add("b", "B", 1)
+	c.Add("c", "C", 1)
+
+	order := c.CaptureOrder()
+	c.Remove("b")
+	c.Add("d", "D", 1)
+	c.Get("a")
+
+	if order.Len() != 3 {
+		t.Errorf("expected order of 3 entries, got %d", order.Len())
+	}
+	if keys := order.AppendKeys(nil); len(keys) != 3 || keys[0] != "a" || keys[1] != "b" || keys[2] != "c" {
+		t.Errorf("expected keys [a b c], got %v", keys)
+	}
+	if keys := order.AppendKeysNewestFirst(nil); len(keys) != 3 || keys[0] != "c" || keys[2] != "a" {
+		t.Errorf("expected keys [c b a], got %v", keys)
+	}
+	var values []interface{}
+	order.RangeNewestFirst(func(key, value interface{}) bool {
+		values = append(values, value)
+		return true
+	})
+	if len(values) != 3 || values[0] != "C" || values[1] != "B" || values[2] != "A" {
+		t.Errorf("expected values [C B A], got %v", values)
+	}
+}
+
+func TestEvictionListeners(t *testing.T) {
+	var calls []string
+	c, _ := NewWithEvict(2, 10, func(key, value interface{}) {
+		calls = append(calls, fmt.Sprintf("callback %v", key))
+	})
+	first := c.AddEvictionListener(func(key, value interface{}) {
+		calls = append(calls, fmt.Sprintf("first %v", key))
+	})
+	c.AddEvictionListener(func(key, value interface{}) {
+		calls = append(calls, fmt.Sprintf("second %v", key))
+	})
+
+	c.Add(1, 1, 1)
+	c.Add(2, 2, 1)
+	c.Add(3, 3, 1)
+	want := []string{"callback 1", "first 1", "second 1"}
+	if fmt.Sprint(calls) != fmt.Sprint(want) {
+		t.Errorf("expected calls %v, got %v", want, calls)
+	}
+
+	if !c.RemoveEvictionListener(first) {
+		t.Errorf("expected listener to be removed")
+	}
+	if c.RemoveEvictionListener(first) {
+		t.Errorf("expected listener to be removed only once")
+	}
+	calls = nil
+	c.Remove(2)
+	want = []string{"callback 2", "second 2"}
+	if fmt.Sprint(calls) != fmt.Sprint(want) {
+		t.Errorf("expected calls %v, got %v", want, calls)
+	}
+}
+
+func TestRemoveAfter(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	var evicted []interface{}
+	c, _ := NewWithEvict(10, 10, func(key, value interface{}) {
+		evicted = append(evicted, key)
+	}, WithClock(fake))
+	c.Add("a", "A", 1)
+	c.Add("b", "B", 2)
+	c.Add("c", "C", 3)
+
+	if !c.RemoveAfter("a", 2*time.Second) || !c.RemoveAfter("b", time.Second) {
+		t.Errorf("expected keys to be removed")
+	}
+	if c.RemoveAfter("x", time.Second) {
+		t.Errorf("expected missing key not to be removed")
+	}
+	if _, ok := c.Get("a"); ok {
+		t.Errorf("expected tombstoned key to miss")
+	}
+	if c.Len() != 1 || c.Weight() != 3 || c.Tombstones() != 2 {
+		t.Errorf("expected only the live entry to count, got len %d, weight %d, tombstones %d", c.Len(), c.Weight(), c.Tombstones())
+	}
+	if len(evicted) != 0 {
+		t.Errorf("expected no callback within the grace period, got %v", evicted)
+	}
+
+	fake.Advance(time.Second)
+	c.Add("a", "A2", 1)
+	if len(evicted) != 1 || evicted[0] != "b" {
+		t.Errorf("expected b to be reported, got %v", evicted)
+	}
+	if c.Reap() != 0 {
+		t.Errorf("expected nothing to reap")
+	}
+	fake.Advance(time.Second)
+	if c.Reap() != 1 || len(evicted) != 2 || evicted[1] != "a" {
+		t.Errorf("expected a to be reported, got %v", evicted)
+	}
+	if v, ok := c.Get("a"); !ok || v != "A2" {
+		t.Errorf("expected re-added key to survive its tombstone, got %v", v)
+	}
+	if c.Tombstones() != 0 {
+		t.Errorf("expected no tombstones, got %d", c.Tombstones())
+	}
+}
+
+func TestSetProtected(t *testing.T) {
+	c, _ := New(10, 3)
+	epoch := 1
+	c.SetProtected(func(key interface{}) bool {
+		return key.(int)/10 == epoch
+	})
+	c.Add(10, 10, 1)
+	c.Add(1, 1, 1)
+	c.Add(11, 11, 1)
+	c.Add(2, 2, 1)
+	expectKeys(t, c, 10, 11, 2)
+
+	c.Add(12, 12, 1)
+	c.Add(13, 13, 1)
+	expectKeys(t, c, 10, 11, 12, 13)
+	if c.EvictTo(0) != 0 {
+		t.Errorf("expected protected entries not to be evicted")
+	}
+
+	epoch = 2
+	c.Add(20, 20, 1)
+	expectKeys(t, c, 12, 13, 20)
+	c.SetProtected(nil)
+	c.Add(3, 3, 1)
+	expectKeys(t, c, 13, 20, 3)
+}
+
+func TestOrderedEntries_Contract(t *testing.T) {
+	orderedKeys := func(c *Cache) []interface{} {
+		var keys []interface{}
+		for _, e := range c.OrderedEntries() {
+			keys = append(keys, e.Key)
+		}
+		return keys
+	}
+	expectOrder := func(t *testing.T, c *Cache, want ...interface{}) {
+		t.Helper()
+		if got := orderedKeys(c); !reflect.DeepEqual(got, want) {
+			t.Errorf("expected order %v, got %v", want, got)
+		}
+	}
+
+	c, _ := New(100, 10)
+	c.Add("a", 1, 1)
+	c.Add("b", 2, 2)
+	c.Add("c", 3, 3)
+	expectOrder(t, c, "a", "b", "c")
+
+	c.Peek("a")
+	c.Contains("a")
+	c.WeightOf("a")
+	c.Keys()
+	c.OrderedEntries()
+	expectOrder(t, c, "a", "b", "c")
+
+	c.Get("a")
+	expectOrder(t, c, "b", "c", "a")
+	c.Add("b", 4, 4)
+	expectOrder(t, c, "c", "a", "b")
+	c.Remove("a")
+	expectOrder(t, c, "c", "b")
+
+	entries := c.OrderedEntries()
+	if entries[1].Value != 4 || entries[1].Weight != 4 {
+		t.Errorf("expected updated entry, got %v", entries[1])
+	}
+	restored, _ := New(100, 10)
+	for _, e := range entries {
+		restored.Add(e.Key, e.Value, e.Weight)
+	}
+	expectOrder(t, restored, "c", "b")
+}
+
+func TestWeights_DoNotOverflow(t *testing.T) {
+	const half = math.MaxUint/2 + 1
+	c, _ := NewWithOptions()
+	c.Add("a", 1, half)
+	c.Add("b", 2, half)
+	expectKeys(t, c, "b")
+	if c.Weight() != half {
+		t.Errorf("expected weight %d, got %d", uint(half), c.Weight())
+	}
+
+	c.Add("c", 3, half-1)
+	c.Add("c", 3, half)
+	expectKeys(t, c, "c")
+	if c.Weight() != half {
+		t.Errorf("expected weight %d, got %d", uint(half), c.Weight())
+	}
+
+	c.Add("d", 4, 1)
+	c.Add("e", 5, 1)
+	evicted := c.RecalculateWeights(func(key, value interface{}) uint {
+		return half
+	})
+	if evicted != 2 {
+		t.Errorf("expected 2 evictions, got %d", evicted)
+	}
+	expectKeys(t, c, "e")
+	if c.Weight() != half {
+		t.Errorf("expected weight %d, got %d", uint(half), c.Weight())
+	}
+
+	if AddWeights(math.MaxUint, 1) != math.MaxUint || AddWeights(1, 2) != 3 {
+		t.Errorf("expected saturating addition")
+	}
+}
+
+func TestAdd_RejectsEntriesHeavierThanTheCache(t *testing.T) {
+	var evicted []interface{}
+	c, _ := NewWithEvict(10, 10, func(key, value interface{}) {
+		evicted = append(evicted, key)
+	})
+	c.Add("a", 1, 5)
+	c.Add("b", 2, 5)
+	if n := c.Add("c", 3, 11); n != 0 {
+		t.Errorf("expected no evictions, got %d", n)
+	}
+	expectKeys(t, c, "a", "b")
+	if n := c.Add("a", 4, 11); n != 1 {
+		t.Errorf("expected the outdated entry to be evicted, got %d evictions", n)
+	}
+	expectKeys(t, c, "b")
+	if len(evicted) != 1 || evicted[0] != "a" || c.Weight() != 5 {
+		t.Errorf("expected a to be evicted, got %v with weight %d", evicted, c.Weight())
+	}
+}
+
+func TestWithZeroWeights(t *testing.T) {
+	c, _ := New(2, 3)
+	for i := 0; i < 4; i++ {
+		c.Add(i, i, 0)
+	}
+	expectKeys(t, c, 1, 2, 3)
+	if c.Weight() != 0 {
+		t.Errorf("expected zero weights not to count, got weight %d", c.Weight())
+	}
+
+	c, _ = New(2, 3, WithZeroWeights(ZeroWeightAsOne))
+	for i := 0; i < 4; i++ {
+		c.Add(i, i, 0)
+	}
+	expectKeys(t, c, 2, 3)
+	if w, _ := c.WeightOf(3); w != 1 || c.Weight() != 2 {
+		t.Errorf("expected zero weights to count as 1, got %d of %d", w, c.Weight())
+	}
+
+	c, _ = New(2, 3, WithZeroWeights(ZeroWeightReject))
+	c.Add("a", 1, 1)
+	if n := c.Add("a", 2, 0); n != 1 {
+		t.Errorf("expected the outdated entry to be evicted, got %d evictions", n)
+	}
+	c.Add("b", 1, 0)
+	expectKeys(t, c)
+	if _, err := c.TryAdd("b", 1, 0); !errors.Is(err, cacheutils.ErrInvalidWeight) {
+		t.Errorf("expected ErrInvalidWeight, got %v", err)
+	}
+	c.Add("a", 1, 1)
+	c.Add("b", 2, 1)
+	if n := c.RecalculateWeights(func(key, value interface{}) uint { return uint(value.(int) - 1) }); n != 1 {
+		t.Errorf("expected the entry reweighed to 0 to be evicted, got %d evictions", n)
+	}
+	expectKeys(t, c, "b")
+
+	if _, err := New(2, 3, WithZeroWeights(ZeroWeightReject+1)); !errors.Is(err, cacheutils.ErrInvalidWeight) {
+		t.Errorf("expected ErrInvalidWeight for an unknown policy, got %v", err)
+	}
+}
+
+func TestAddWithResult(t *testing.T) {
+	c, _ := New(10, 2)
+	c.SetProtected(func(key interface{}) bool { return key != "c" })
+	if r, n := c.AddWithResult("a", 1, 5); r != Added || n != 0 {
+		t.Errorf("expected a to be added, got %v with %d evictions", r, n)
+	}
+	if r, n := c.AddWithResult("b", 2, 11); r != Rejected || n != 0 {
+		t.Errorf("expected b to be rejected, got %v with %d evictions", r, n)
+	}
+	c.Add("b", 2, 5)
+	if r, n := c.AddWithResult("c", 3, 1); r != SelfEvicted || n != 1 {
+		t.Errorf("expected c to be self-evicted, got %v with %d evictions", r, n)
+	}
+	expectKeys(t, c, "a", "b")
+	if r, n := c.AddWithResult("a", 4, 11); r != Rejected || n != 1 {
+		t.Errorf("expected the update of a to be rejected, got %v with %d evictions", r, n)
+	}
+	expectKeys(t, c, "b")
+
+	// Weights are compared to the limit as accounted for.
+	c, _ = New(0, 2, WithZeroWeights(ZeroWeightAsOne))
+	if r, n := c.AddWithResult("a", 1, 0); r != Rejected || n != 0 {
+		t.Errorf("expected a to be rejected, got %v with %d evictions", r, n)
+	}
+	if _, err := c.TryAdd("a", 1, 0); !errors.Is(err, cacheutils.ErrEntryTooLarge) {
+		t.Errorf("expected ErrEntryTooLarge, got %v", err)
+	}
+	expectKeys(t, c)
+}
+
+func TestNewFromEntries(t *testing.T) {
+	entries := []Entry{
+		{Key: "a", Value: 1, Weight: 4},
+		{Key: "b", Value: 2, Weight: 4},
+		{Key: "c", Value: 3, Weight: 11},
+		{Key: "d", Value: 4, Weight: 3, Age: time.Minute},
+		{Key: "b", Value: 5, Weight: 2},
+		{Key: "e", Value: 6, Weight: 1},
+	}
+	c, err := NewFromEntries(10, 3, entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want, _ := New(10, 3)
+	for _, e := range entries {
+		want.Add(e.Key, e.Value, e.Weight)
+	}
+	expectKeys(t, c, want.Keys()...)
+	expectKeys(t, c, "d", "b", "e")
+	if v, _ := c.Peek("b"); v != 5 || c.Weight() != 6 {
+		t.Errorf("expected the newest value of b and weight 6, got %v and %d", v, c.Weight())
+	}
+	if e, _ := c.GetOldestEntry(); e.Age < time.Minute {
+		t.Errorf("expected the age of d to be restored, got %v", e.Age)
+	}
+
+	if err := c.Fill(entries); err == nil {
+		t.Errorf("expected filling a non-empty cache to fail")
+	}
+
+	c, err = NewFromMap(10, 10, map[interface{}]interface{}{1: 1, 2: 2, 3: 3}, func(key, value interface{}) uint {
+		return uint(value.(int))
+	})
+	if err != nil || c.Len() != 3 || c.Weight() != 6 {
+		t.Errorf("expected all entries of the map, got %v with weight %d, error %v", c.Keys(), c.Weight(), err)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	var evicted []interface{}
+	c, _ := NewWithEvict(100, 10, func(key, value interface{}) {
+		evicted = append(evicted, key)
+	})
+	for _, notify := range []bool{false, true} {
+		c.Add("a", 1, 1)
+		c.Add("b", 2, 2)
+		c.Get("a")
+		var flushed []Entry
+		n := c.Flush(func(key, value interface{}, weight uint) {
+			if c.Contains(key) {
+				t.Errorf("expected %v to be removed before being flushed", key)
+			}
+			flushed = append(flushed, Entry{Key: key, Value: value, Weight: weight})
+		}, notify)
+		want := []Entry{{Key: "b", Value: 2, Weight: 2}, {Key: "a", Value: 1, Weight: 1}}
+		if n != 2 || !reflect.DeepEqual(flushed, want) {
+			t.Errorf("expected %v to be flushed, got %d: %v", want, n, flushed)
+		}
+		if c.Len() != 0 || c.Weight() != 0 {
+			t.Errorf("expected an empty cache, got %d entries of weight %d", c.Len(), c.Weight())
+		}
+	}
+	if !reflect.DeepEqual(evicted, []interface{}{"b", "a"}) {
+		t.Errorf("expected evictions to be reported only when notifying, got %v", evicted)
+	}
+}
+
+func TestWithHeaviestFirst(t *testing.T) {
+	for _, percent := range []int{0, 101} {
+		if _, err := New(10, 10, WithHeaviestFirst(percent)); err == nil {
+			t.Errorf("expected an error for percentage %d", percent)
+		}
+	}
+	if _, err := New(10, 10, WithHeaviestFirst(10), WithLRUK(2)); err == nil {
+		t.Errorf("expected an error combining heaviest-first eviction with LRU-K")
+	}
+
+	c, err := New(20, 10, WithHeaviestFirst(50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, weight := range []uint{2, 8, 1, 3, 1, 1} {
+		c.Add(i, i, weight)
+	}
+	// The heaviest of the three least recently used entries makes room.
+	if evicted := c.Add("x", "x", 6); evicted != 1 {
+		t.Errorf("expected 1 eviction, got %d", evicted)
+	}
+	expectKeys(t, c, 0, 2, 3, 4, 5, "x")
+
+	// Protected entries are passed over.
+	c.SetProtected(func(key interface{}) bool { return key == 3 })
+	if evicted := c.Add("y", "y", 9); evicted != 2 {
+		t.Errorf("expected 2 evictions, got %d", evicted)
+	}
+	expectKeys(t, c, 3, 4, 5, "x", "y")
+}
+
+func TestWithEvictionScore(t *testing.T) {
+	if _, err := New(10, 10, WithEvictionScore(0, WeightPerRank)); err == nil {
+		t.Errorf("expected an error for percentage 0")
+	}
+	if _, err := New(10, 10, WithEvictionScore(10, nil)); err == nil {
+		t.Errorf("expected an error for a missing score")
+	}
+
+	c, err := New(30, 10, WithEvictionScore(100, WeightPerRank))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, weight := range []uint{1, 1, 1, 1, 20} {
+		c.Add(i, i, weight)
+	}
+	// The large entry goes first, although more recently used.
+	if evicted := c.Add("x", "x", 8); evicted != 1 {
+		t.Errorf("expected 1 eviction, got %d", evicted)
+	}
+	expectKeys(t, c, 0, 1, 2, 3, "x")
+
+	var candidates []Candidate
+	c, _ = New(3, 10, WithEvictionScore(50, func(cand Candidate) float64 {
+		candidates = append(candidates, cand)
+		return 0
+	}))
+	for i := 0; i < 4; i++ {
+		c.Add(i, i, 1)
+	}
+	// Half of the four entries are considered, least recently used first.
+	if len(candidates) != 2 {
+		t.Fatalf("expected 2 candidates, got %v", candidates)
+	}
+	for i, cand := range candidates {
+		if cand.Key != i || cand.Weight != 1 || cand.Rank != i+1 {
+			t.Errorf("unexpected candidate %+v", cand)
+		}
+	}
+	expectKeys(t, c, 1, 2, 3)
+
+	// The entry being added is not rated against the others, unless it is
+	// the only one left.
+	c, _ = New(30, 10, WithEvictionScore(100, WeightPerRank))
+	for i := 0; i < 4; i++ {
+		c.Add(i, i, 1)
+	}
+	if evicted := c.Add("x", "x", 28); evicted != 2 {
+		t.Errorf("expected 2 evictions, got %d", evicted)
+	}
+	expectKeys(t, c, 2, 3, "x")
+	if evicted := c.Add("y", "y", 30); evicted != 3 {
+		t.Errorf("expected 3 evictions, got %d", evicted)
+	}
+	expectKeys(t, c, "y")
+}
+
+func TestAddWithCost(t *testing.T) {
+	c, _ := New(4, 10, WithEvictionScore(100, WeightPerRankAndCost))
+	c.AddWithCost("a", 1, 1, 9)
+	for _, key := range []string{"b", "c", "d"} {
+		c.Add(key, key, 1)
+	}
+	if cost, ok := c.CostOf("a"); !ok || cost != 9 {
+		t.Errorf("expected cost 9, got %d", cost)
+	}
+	// The expensive entry outlasts the more recently used cheap one.
+	if evicted := c.Add("e", "e", 1); evicted != 1 {
+		t.Errorf("expected 1 eviction, got %d", evicted)
+	}
+	expectKeys(t, c, "a", "c", "d", "e")
+	if c.Weight() != 4 {
+		t.Errorf("expected the cost not to count as weight, got %d", c.Weight())
+	}
+
+	// The cost is preserved by exporting and refilling the entries.
+	entries := c.PeekOldestN(1)
+	if len(entries) != 1 || entries[0].Cost != 9 {
+		t.Errorf("expected the oldest entry to cost 9, got %v", entries)
+	}
+	restored, _ := NewFromEntries(4, 10, entries)
+	if cost, _ := restored.CostOf("a"); cost != 9 {
+		t.Errorf("expected restored cost 9, got %d", cost)
+	}
+
+	// Rewriting the entry without a cost resets it.
+	c.Add("a", 1, 1)
+	if cost, _ := c.CostOf("a"); cost != 0 {
+		t.Errorf("expected cost 0, got %d", cost)
+	}
+}
+
+func TestWithLRUK(t *testing.T) {
+	c, _ := New(100, 3, WithLRUK(2))
+	c.Add("a", 1, 1)
+	c.Add("b", 2, 1)
+	c.Add("c", 3, 1)
+	c.Get("a")
+	c.Get("b")
+	// c was accessed once only.
+	c.Add("d", 4, 1)
+	expectKeys(t, c, "a", "b", "d")
+	c.Get("d")
+	c.Get("a")
+	// b's second most recent access is the oldest.
+	c.Add("e", 5, 1)
+	expectKeys(t, c, "d", "a", "e")
+
+	// A scan of one-off keys only displaces a single entry.
+	for i := 0; i < 100; i++ {
+		c.Add(i, i, 1)
+	}
+	expectKeys(t, c, "d", "a", 99)
+
+	if _, err := New(100, 3, WithLRUK(1)); err == nil {
+		t.Errorf("expected k of 1 to be rejected")
+	}
+	if _, err := New(100, 3, WithLRUK(2), WithMidpointInsertion(50)); err == nil {
+		t.Errorf("expected LRU-K and midpoint insertion to be rejected")
+	}
+}
+
+func TestWithLRUK_SurvivesCompaction(t *testing.T) {
+	c, _ := New(math.MaxUint, 4*minCompactEntries, WithLRUK(3))
+	for i := 0; i < 4*minCompactEntries; i++ {
+		c.Add(i, i, 1)
+		if i%2 == 0 {
+			c.Get(i)
+			c.Get(i)
+		}
+	}
+	c.Resize(math.MaxUint, 4)
+	// The entries accessed three times are retained, most recent first.
+	want := []interface{}{4*minCompactEntries - 8, 4*minCompactEntries - 6, 4*minCompactEntries - 4, 4*minCompactEntries - 2}
+	expectKeys(t, c, want...)
+	clone := c.Clone()
+	for i := 0; i < 10; i++ {
+		c.Add(-i, i, 1)
+	}
+	expectKeys(t, c, append(want[1:], -9)...)
+	expectKeys(t, clone, want...)
+}
+
+func TestClone(t *testing.T) {
+	var evicted []interface{}
+	c, _ := NewWithEvict(100, 10, func(key, value interface{}) {
+		evicted = append(evicted, key)
+	}, WithMidpointInsertion(50))
+	for i := 0; i < 6; i++ {
+		c.Add(i, i, uint(i))
+	}
+	c.Get(0)
+
+	clone := c.Clone()
+	expectKeys(t, clone, c.Keys()...)
+	if clone.Weight() != c.Weight() || clone.oldLen != c.oldLen || clone.oldWeight != c.oldWeight {
+		t.Errorf("expected clone to have the same weights")
+	}
+	if !clone.old[clone.mid] || clone.keys.get(clone.mid) != c.keys.get(c.mid) {
+		t.Errorf("expected clone to have the same midpoint")
+	}
+
+	// Modifications of the clone do not affect the original and vice versa.
+	clone.Add("x", "X", 1)
+	clone.Remove(0)
+	c.Add(1, "one", 1)
+	if c.Contains("x") || !c.Contains(0) {
+		t.Errorf("expected original to be unaffected by the clone")
+	}
+	if value, _ := clone.Peek(1); value != 1 {
+		t.Errorf("expected clone to be unaffected by the original, got %v", value)
+	}
+	if len(evicted) != 1 || evicted[0] != 0 {
+		t.Errorf("expected the clone to share the eviction callback, got %v", evicted)
+	}
+}
+
+func TestMergeFrom(t *testing.T) {
+	c, _ := New(100, 4)
+	c.Add("a", "old", 1)
+	c.Add("b", "B", 1)
+	time.Sleep(time.Millisecond)
+	other, _ := New(100, 10)
+	other.Add("a", "new", 2)
+	other.Add("c", "C", 1)
+	other.Add("d", "D", 1)
+	other.Get("c")
+
+	existing := c.Clone()
+	if evicted := existing.MergeFrom(other, KeepExisting); evicted != 0 {
+		t.Errorf("expected no evictions, got %d", evicted)
+	}
+	if value, _ := existing.Peek("a"); value != "old" {
+		t.Errorf("expected existing value to be kept, got %v", value)
+	}
+	expectKeys(t, existing, "a", "b", "d", "c")
+
+	if evicted := c.MergeFrom(other, KeepNewer); evicted != 0 {
+		t.Errorf("expected no evictions, got %d", evicted)
+	}
+	if value, _ := c.Peek("a"); value != "new" {
+		t.Errorf("expected newer value to be taken, got %v", value)
+	}
+	if c.Weight() != 5 {
+		t.Errorf("expected weight 5, got %d", c.Weight())
+	}
+	expectKeys(t, c, "b", "a", "d", "c")
+
+	// Older entries do not replace newer ones.
+	other.Add("b", "older", 1)
+	c.Add("b", "newest", 1)
+	c.MergeFrom(other, KeepNewer)
+	if value, _ := c.Peek("b"); value != "newest" {
+		t.Errorf("expected newer value to be kept, got %v", value)
+	}
+
+	// Capacity limits are respected.
+	full, _ := New(100, 2)
+	if evicted := full.MergeFrom(other, KeepNewer); evicted != 2 || full.Len() != 2 {
+		t.Errorf("expected 2 evictions, got %d with %d entries", evicted, full.Len())
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	c, _ := New(100, 10)
+	for i := 0; i < 6; i++ {
+		c.Add(i, i*10, uint(i))
+	}
+	c.Get(0)
+
+	expectEntries := func(entries []Entry, keys ...interface{}) {
+		t.Helper()
+		if len(entries) != len(keys) {
+			t.Fatalf("expected keys %v, got %v", keys, entries)
+		}
+		for i, e := range entries {
+			if e.Key != keys[i] || e.Value != e.Key.(int)*10 || e.Weight != uint(e.Key.(int)) {
+				t.Fatalf("expected keys %v, got %v", keys, entries)
+			}
+		}
+	}
+
+	expectEntries(c.Snapshot(SnapshotFilter{}), 1, 2, 3, 4, 5, 0)
+	even := func(key, value interface{}) bool { return key.(int)%2 == 0 }
+	expectEntries(c.Snapshot(SnapshotFilter{Include: even}), 2, 4, 0)
+	expectEntries(c.Snapshot(SnapshotFilter{MaxEntries: 2}), 5, 0)
+	// 5 and 4 fit into the weight bound, 3 is skipped in favour of 2.
+	expectEntries(c.Snapshot(SnapshotFilter{MaxWeight: 11}), 2, 4, 5, 0)
+	expectEntries(c.Snapshot(SnapshotFilter{Include: even, MaxWeight: 4}), 4, 0)
+
+	// Snapshots do not promote entries.
+	expectKeys(t, c, 1, 2, 3, 4, 5, 0)
+
+	all := c.Snapshot(SnapshotFilter{})
+	expectEntries(SnapshotFilter{MaxEntries: 3, Include: even}.Apply(all), 2, 4, 0)
+}
+
+func TestOldestEntry(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	c, _ := New(10, 10, WithClock(fake))
+	if _, ok := c.GetOldestEntry(); ok {
+		t.Errorf("expected no oldest entry in empty cache")
+	}
+	if _, ok := c.RemoveOldestEntry(); ok {
+		t.Errorf("expected nothing to remove from empty cache")
+	}
+	c.Add("a", "A", 3)
+	fake.Advance(time.Second)
+	c.Add("b", "B", 2)
+	fake.Advance(time.Second)
+
+	want := Entry{Key: "a", Value: "A", Weight: 3, Age: 2 * time.Second, Recency: 1}
+	if entry, ok := c.GetOldestEntry(); !ok || entry != want {
+		t.Errorf("expected %v, got %v", want, entry)
+	}
+	expectKeys(t, c, "a", "b")
+	if entry, ok := c.RemoveOldestEntry(); !ok || entry != want {
+		t.Errorf("expected %v to be removed, got %v", want, entry)
+	}
+	expectKeys(t, c, "b")
+	if c.Weight() != 2 {
+		t.Errorf("expected weight 2, got %d", c.Weight())
+	}
+}
+
+func TestNewWithOptions(t *testing.T) {
+	if _, err := NewWithOptions(WithMaxSize(-1)); err == nil {
+		t.Errorf("expected error for negative size")
+	}
+	evicted := 0
+	c, err := NewWithOptions(WithMaxWeight(5), WithEvictCallback(func(key, value interface{}) {
+		evicted++
+	}))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		c.Add(i, i, 1)
+	}
+	if c.Len() != 5 || evicted != 95 {
+		t.Errorf("expected 5 entries and 95 evictions, got %d and %d", c.Len(), evicted)
+	}
+
+	c, _ = New(10, 10, WithMaxSize(2))
+	c.Add("a", "A", 1)
+	c.Add("b", "B", 1)
+	c.Add("c", "C", 1)
+	expectKeys(t, c, "b", "c")
+}
+
+func TestWithClock(t *testing.T) {
+	if _, err := New(10, 10, WithClock(nil)); err == nil {
+		t.Fatalf("expected error for nil clock")
+	}
+	fake := clock.NewFake(time.Unix(0, 0))
+	c, _ := New(10, 10, WithClock(fake))
+	c.Add("a", 1, 1)
+	fake.Advance(time.Minute)
+	c.Add("b", 2, 1)
+	fake.Advance(time.Second)
+
+	entries := c.Clone().PeekOldestN(2)
+	if entries[0].Age != time.Minute+time.Second || entries[1].Age != time.Second {
+		t.Errorf("unexpected ages %v, %v", entries[0].Age, entries[1].Age)
+	}
+}
+
+func TestWithRecencyCounter(t *testing.T) {
+	if _, err := New(10, 10, WithRecencyCounter(nil)); err == nil {
+		t.Fatalf("expected error for nil counter")
+	}
+	var counter atomic.Uint64
+	a, _ := New(10, 10, WithRecencyCounter(&counter))
+	b, _ := New(10, 10, WithRecencyCounter(&counter))
+	a.Add("a", 1, 1)
+	b.Add("b", 2, 1)
+	a.Add("c", 3, 1)
+	a.Get("a")
+
+	recency := func(c *Cache, key interface{}) uint64 {
+		for _, e := range c.OrderedEntries() {
+			if e.Key == key {
+				return e.Recency
+			}
+		}
+		t.Fatalf("missing key %v", key)
+		return 0
+	}
+	// Stamps are shared, so entries of both caches are ordered by use.
+	if ra, rb, rc := recency(a, "a"), recency(b, "b"), recency(a, "c"); !(rb < rc && rc < ra) {
+		t.Errorf("unexpected stamps a=%d b=%d c=%d", ra, rb, rc)
+	}
+	// Reads which do not update the recency leave the stamp unchanged.
+	before := recency(b, "b")
+	b.Peek("b")
+	b.Contains("b")
+	if after := recency(b, "b"); after != before {
+		t.Errorf("expected stamp %d, got %d", before, after)
+	}
+}
+
+func TestRecalculateWeights(t *testing.T) {
+	var evicted []interface{}
+	c, _ := NewWithEvict(10, 10, func(key, value interface{}) {
+		evicted = append(evicted, key)
+	}, WithAdmissionWindow(50))
+	for i := 0; i < 4; i++ {
+		c.Add(i, i, 1)
+	}
+	c.Get(0)
+	c.Get(1)
+
+	if n := c.RecalculateWeights(func(key, value interface{}) uint { return 2 }); n != 0 {
+		t.Fatalf("expected no evictions, got %d", n)
+	}
+	if c.Weight() != 8 || c.oldWeight != 4 {
+		t.Fatalf("unexpected weights %d, %d", c.Weight(), c.oldWeight)
+	}
+
+	n := c.RecalculateWeights(func(key, value interface{}) uint { return uint(value.(int)) + 2 })
+	if n != 1 || c.Weight() != 10 {
+		t.Fatalf("expected one eviction and weight 10, got %d and %d", n, c.Weight())
+	}
+	expectKeys(t, c, 3, 0, 1)
+	if len(evicted) != 1 || evicted[0] != 2 {
+		t.Errorf("unexpected evictions %v", evicted)
+	}
+}
+
+func TestEvictTo(t *testing.T) {
+	c, _ := New(100, 10)
+	for i := 0; i < 5; i++ {
+		c.Add(i, i, 10)
+	}
+	if n := c.EvictTo(25); n != 3 {
+		t.Fatalf("expected 3 evictions, got %d", n)
+	}
+	expectKeys(t, c, 3, 4)
+	if n := c.EvictTo(25); n != 0 {
+		t.Fatalf("expected no evictions, got %d", n)
+	}
+	c.Add(5, 5, 10)
+	if c.Len() != 3 {
+		t.Errorf("limits must be unchanged, got %d entries", c.Len())
+	}
+}
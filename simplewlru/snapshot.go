@@ -0,0 +1,91 @@
+package simplewlru
+
+// SnapshotFilter restricts the entries included in a snapshot. The zero
+// value includes all entries.
+type SnapshotFilter struct {
+	// Include, if set, selects the entries to include, e.g. to exclude
+	// entries which are cheap to recompute or contain sensitive data.
+	Include func(key, value interface{}) bool
+	// MaxEntries, if positive, bounds the number of included entries.
+	MaxEntries int
+	// MaxWeight, if positive, bounds the total weight of included entries.
+	MaxWeight uint
+}
+
+// Apply filters the given entries, ordered from oldest to newest. If the
+// bounds are exceeded, the most recently used entries are kept; entries
+// which would exceed MaxWeight are skipped in favour of older, lighter ones.
+func (f SnapshotFilter) Apply(entries []Entry) []Entry {
+	s := snapshotter{filter: f}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if !s.offer(entries[i].Key, entries[i].Value, entries[i].Weight, func() Entry { return entries[i] }) {
+			break
+		}
+	}
+	return s.result()
+}
+
+// Snapshot returns the entries of the cache passing the filter, ordered from
+// oldest to newest, without updating their "recently used"-ness.
+func (c *Cache) Snapshot(filter SnapshotFilter) []Entry {
+	s := snapshotter{filter: filter}
+	now := c.clock.Now()
+	for ent := c.evictList.front(); ent != 0; ent = c.evictList.next(ent) {
+		if !s.offer(c.keys.get(ent), c.values.get(ent), c.weights[ent], func() Entry { return c.export(ent, now) }) {
+			break
+		}
+	}
+	return s.result()
+}
+
+// snapshotter collects the entries of a snapshot from newest to oldest.
+type snapshotter struct {
+	filter  SnapshotFilter
+	weight  uint
+	entries []Entry
+}
+
+// offer considers an entry for the snapshot, returning false once no more
+// entries can be included.
+func (s *snapshotter) offer(key, value interface{}, weight uint, export func() Entry) bool {
+	if s.filter.Include != nil && !s.filter.Include(key, value) {
+		return true
+	}
+	if s.filter.MaxWeight > 0 && (weight > s.filter.MaxWeight || s.weight > s.filter.MaxWeight-weight) {
+		return s.weight < s.filter.MaxWeight
+	}
+	s.entries = append(s.entries, export())
+	s.weight += weight
+	return s.filter.MaxEntries <= 0 || len(s.entries) < s.filter.MaxEntries
+}
+
+// result returns the collected entries ordered from oldest to newest.
+func (s *snapshotter) result() []Entry {
+	for i, j := 0, len(s.entries)-1; i < j; i, j = i+1, j-1 {
+		s.entries[i], s.entries[j] = s.entries[j], s.entries[i]
+	}
+	return s.entries
+}
+
+// OrderedEntries returns all entries of the cache ordered from least to most
+// recently used. The order is a stable contract:
+//
+//   - Add, for new keys as well as updates of existing ones, and Get make the
+//     entry the most recently used one.
+//   - Peek, Contains, WeightOf and all other read-only methods, including
+//     OrderedEntries itself, leave the order unchanged.
+//   - Removing an entry leaves the order of the others unchanged.
+//
+// Consequently, adding the returned entries in order to an empty cache with
+// the same configuration reproduces the order. With midpoint insertion or an
+// admission window, new entries enter the middle of the order rather than
+// its end, and the least recently used entry is not necessarily the next one
+// to be evicted.
+func (c *Cache) OrderedEntries() []Entry {
+	entries := make([]Entry, 0, c.Len())
+	now := c.clock.Now()
+	for ent := c.evictList.back(); ent != 0; ent = c.evictList.prev(ent) {
+		entries = append(entries, c.export(ent, now))
+	}
+	return entries
+}
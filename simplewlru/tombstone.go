@@ -0,0 +1,71 @@
+package simplewlru
+
+import (
+	"sort"
+	"time"
+)
+
+// grave holds an entry removed by RemoveAfter until its grace period ends.
+type grave struct {
+	key, value interface{}
+	deadline   time.Time
+}
+
+// RemoveAfter removes the provided key from the cache like Remove, but
+// reports the entry to the eviction callback and listeners only once the
+// grace period has passed, so that readers still holding the value can
+// finish with it before it is released. The entry is gone from the cache
+// immediately: lookups miss, and it counts towards neither the length nor
+// the weight of the cache. Entries whose grace period has passed are
+// reported by the next Add, Remove, RemoveAfter or Reap. Returns if the key
+// was contained.
+func (c *Cache) RemoveAfter(key interface{}, grace time.Duration) (present bool) {
+	now := c.clock.Now()
+	c.reap(now)
+	ent, ok := c.items[key]
+	if !ok {
+		return false
+	}
+	c.invalidate()
+	key, value := c.unlink(ent)
+	g := grave{key: key, value: value, deadline: now.Add(grace)}
+	i := sort.Search(len(c.graves), func(i int) bool {
+		return c.graves[i].deadline.After(g.deadline)
+	})
+	c.graves = append(c.graves, grave{})
+	copy(c.graves[i+1:], c.graves[i:])
+	c.graves[i] = g
+	return true
+}
+
+// Reap reports the entries removed by RemoveAfter whose grace period has
+// passed to the eviction callback and listeners, returning their number.
+func (c *Cache) Reap() (reaped int) {
+	if len(c.graves) == 0 {
+		return 0
+	}
+	return c.reap(c.clock.Now())
+}
+
+// Tombstones returns the number of entries removed by RemoveAfter which are
+// still within their grace period.
+func (c *Cache) Tombstones() int {
+	return len(c.graves)
+}
+
+// reap reports the entries whose grace period has passed by now.
+func (c *Cache) reap(now time.Time) (reaped int) {
+	for reaped < len(c.graves) && !c.graves[reaped].deadline.After(now) {
+		reaped++
+	}
+	if reaped == 0 {
+		return 0
+	}
+	expired := c.graves[:reaped:reaped]
+	c.graves = c.graves[reaped:]
+	for _, g := range expired {
+		c.evicted(g.key, g.value)
+	}
+	clear(expired)
+	return reaped
+}
@@ -0,0 +1,43 @@
+package simplewlru
+
+// Every write to the cache assigns the written entry a new version, which
+// increases monotonically within a cache. Versions allow a cache fill racing
+// with an invalidation to detect that it has become stale: read the version
+// with GetWithVersion, compute the value and store it with AddIfVersion.
+// Explicit removals (Remove, RemoveOldest and Purge) count as invalidations,
+// evictions due to capacity limits do not.
+
+// GetWithVersion looks up a key's value and its version from the cache. On a
+// miss, the current version of the cache is returned for use with
+// AddIfVersion.
+func (c *Cache) GetWithVersion(key interface{}) (value interface{}, version uint64, ok bool) {
+	if ent, ok := c.items[key]; ok {
+		c.touch(ent)
+		return c.values.get(ent), c.versions[ent], true
+	}
+	return nil, c.version, false
+}
+
+// AddIfVersion adds a value to the cache only if the key has not been
+// written or invalidated since the given version was obtained from
+// GetWithVersion. For a contained key, its version must equal expected. For
+// a missing key, no entry may have been removed explicitly after expected.
+// Returns the version assigned to the entry, whether it was added and the
+// number of evictions.
+func (c *Cache) AddIfVersion(key, value interface{}, weight uint, expected uint64) (version uint64, ok bool, evicted int) {
+	if ent, ok := c.items[key]; ok {
+		if c.versions[ent] != expected {
+			return c.versions[ent], false, 0
+		}
+	} else if expected < c.invalidated {
+		return c.version, false, 0
+	}
+	version, evicted = c.AddWithVersion(key, value, weight)
+	return version, true, evicted
+}
+
+// invalidate records an explicit removal.
+func (c *Cache) invalidate() {
+	c.version++
+	c.invalidated = c.version
+}
@@ -0,0 +1,78 @@
+package simplewlru
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/0xsoniclabs/cacheutils"
+)
+
+// AddWeights returns the sum of the weights, saturating at the largest
+// representable weight instead of wrapping around.
+func AddWeights(a, b uint) uint {
+	if a > math.MaxUint-b {
+		return math.MaxUint
+	}
+	return a + b
+}
+
+// makeRoom evicts entries, in the order of capacity evictions, until weight
+// can be added to the total weight without overflowing, keeping the entry
+// keep. It only evicts for limits close to the largest representable
+// weight, evicting entries which would be evicted after the addition
+// anyway. Returns the number of evictions.
+func (c *Cache) makeRoom(weight uint, keep ref) (evicted int) {
+	for c.weight > math.MaxUint-weight {
+		ent := c.victim()
+		if ent == 0 || ent == keep {
+			break
+		}
+		c.removeElement(ent)
+		evicted++
+	}
+	return evicted
+}
+
+// ZeroWeightPolicy determines how a cache treats entries of weight 0.
+type ZeroWeightPolicy int
+
+const (
+	// ZeroWeightCount accepts entries of weight 0. They count towards the
+	// size limit but not the weight limit, so only the size limit bounds
+	// how many of them the cache retains. This is the default.
+	ZeroWeightCount ZeroWeightPolicy = iota
+	// ZeroWeightAsOne accepts entries of weight 0 with a weight of 1, so
+	// that they count towards both limits.
+	ZeroWeightAsOne
+	// ZeroWeightReject rejects entries of weight 0 like entries too large
+	// for the cache: Add neither adds them nor retains a previous value of
+	// the key, and TryAdd returns ErrInvalidWeight.
+	ZeroWeightReject
+)
+
+// WithZeroWeights sets how the cache treats entries of weight 0, including
+// weights reported to RecalculateWeights. Defaults to ZeroWeightCount.
+func WithZeroWeights(policy ZeroWeightPolicy) Option {
+	return func(c *Cache) error {
+		if policy < ZeroWeightCount || policy > ZeroWeightReject {
+			return fmt.Errorf("%w: unknown zero weight policy %d", cacheutils.ErrInvalidWeight, policy)
+		}
+		c.zeroWeights = policy
+		return nil
+	}
+}
+
+// weigh applies the zero weight policy to the weight of an entry, returning
+// the weight to account for and whether the entry is accepted.
+func (c *Cache) weigh(weight uint) (uint, bool) {
+	if weight != 0 {
+		return weight, true
+	}
+	switch c.zeroWeights {
+	case ZeroWeightAsOne:
+		return 1, true
+	case ZeroWeightReject:
+		return 0, false
+	}
+	return 0, true
+}
@@ -0,0 +1,149 @@
+// Package sizeof estimates the memory footprint of values, for caches whose
+// weights are measured in bytes.
+//
+// Estimates follow pointers, strings, slices, maps and interfaces, counting
+// each referenced object once. They include the memory directly occupied by
+// the value but not allocator rounding or runtime metadata, and approximate
+// the internal layout of maps. Channels, functions and unsafe pointers are
+// not followed.
+package sizeof
+
+import (
+	"reflect"
+	"sync"
+	"unsafe"
+)
+
+// Of returns the estimated number of bytes occupied by v and everything
+// reachable from it.
+func Of(v interface{}) uint {
+	if v == nil {
+		return 0
+	}
+	rv := reflect.ValueOf(v)
+	s := sizer{seen: map[visit]bool{}}
+	return uint(rv.Type().Size()) + s.deep(rv)
+}
+
+// Weigher weighs cache entries by the estimated size of their key and
+// value. It can be passed to RecalculateWeights or used when adding entries.
+func Weigher(key, value interface{}) uint {
+	return Of(key) + Of(value)
+}
+
+// mapEntryOverhead approximates the per-entry overhead of the runtime's map
+// implementation (control bytes and load factor slack), in bytes.
+const mapEntryOverhead = 8
+
+// mapHeaderSize approximates the size of a map header.
+const mapHeaderSize = 48
+
+// flatTypes caches, per type, whether values of that type reference no
+// further memory, so that their contents need not be walked.
+var flatTypes sync.Map // reflect.Type -> bool
+
+func isFlat(t reflect.Type) bool {
+	if flat, ok := flatTypes.Load(t); ok {
+		return flat.(bool)
+	}
+	flat := true
+	switch t.Kind() {
+	case reflect.Pointer, reflect.String, reflect.Slice, reflect.Map, reflect.Interface:
+		flat = false
+	case reflect.Array:
+		flat = t.Len() == 0 || isFlat(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField() && flat; i++ {
+			flat = isFlat(t.Field(i).Type)
+		}
+	}
+	flatTypes.Store(t, flat)
+	return flat
+}
+
+// visit identifies a referenced object already accounted for.
+type visit struct {
+	ptr uintptr
+	typ reflect.Type
+}
+
+type sizer struct {
+	seen map[visit]bool
+}
+
+// first reports whether the object at ptr of the given type is visited for
+// the first time.
+func (s *sizer) first(ptr uintptr, t reflect.Type) bool {
+	key := visit{ptr, t}
+	if s.seen[key] {
+		return false
+	}
+	s.seen[key] = true
+	return true
+}
+
+// deep returns the size of the memory referenced by v, excluding the size of
+// v itself.
+func (s *sizer) deep(v reflect.Value) uint {
+	t := v.Type()
+	if isFlat(t) {
+		return 0
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() || !s.first(v.Pointer(), t) {
+			return 0
+		}
+		return uint(t.Elem().Size()) + s.deep(v.Elem())
+	case reflect.String:
+		if v.Len() == 0 || !s.first(uintptr(unsafe.Pointer(unsafe.StringData(v.String()))), t) {
+			return 0
+		}
+		return uint(v.Len())
+	case reflect.Slice:
+		if v.IsNil() || !s.first(v.Pointer(), t) {
+			return 0
+		}
+		size := uint(v.Cap()) * uint(t.Elem().Size())
+		if !isFlat(t.Elem()) {
+			for i := 0; i < v.Len(); i++ {
+				size += s.deep(v.Index(i))
+			}
+		}
+		return size
+	case reflect.Map:
+		if v.IsNil() || !s.first(v.Pointer(), t) {
+			return 0
+		}
+		size := uint(mapHeaderSize) + uint(v.Len())*(uint(t.Key().Size())+uint(t.Elem().Size())+mapEntryOverhead)
+		if !isFlat(t.Key()) || !isFlat(t.Elem()) {
+			for it := v.MapRange(); it.Next(); {
+				size += s.deep(it.Key()) + s.deep(it.Value())
+			}
+		}
+		return size
+	case reflect.Interface:
+		if v.IsNil() {
+			return 0
+		}
+		elem := v.Elem()
+		if elem.Kind() == reflect.Pointer || elem.Kind() == reflect.Map {
+			// Pointer-shaped values are stored in the interface directly.
+			return s.deep(elem)
+		}
+		return uint(elem.Type().Size()) + s.deep(elem)
+	case reflect.Array:
+		var size uint
+		for i := 0; i < v.Len(); i++ {
+			size += s.deep(v.Index(i))
+		}
+		return size
+	case reflect.Struct:
+		var size uint
+		for i := 0; i < v.NumField(); i++ {
+			size += s.deep(v.Field(i))
+		}
+		return size
+	}
+	return 0
+}
@@ -0,0 +1,69 @@
+package sizeof
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const word = uint(unsafe.Sizeof(uintptr(0)))
+
+type node struct {
+	value int64
+	next  *node
+}
+
+type record struct {
+	id   int32
+	name string
+	tags []string
+	meta interface{}
+}
+
+func TestOf_Scalars(t *testing.T) {
+	assert.Equal(t, uint(0), Of(nil))
+	assert.Equal(t, uint(8), Of(int64(1)))
+	assert.Equal(t, uint(1), Of(true))
+	assert.Equal(t, uint(16), Of([2]int64{}))
+	assert.Equal(t, uint(16), Of(struct{ a, b int64 }{}))
+}
+
+func TestOf_ReferencedMemory(t *testing.T) {
+	assert.Equal(t, 2*word+5, Of("hello"))
+	assert.Equal(t, 2*word, Of(""))
+	assert.Equal(t, 3*word+10, Of(make([]byte, 3, 10)))
+	assert.Equal(t, 3*word, Of([]int64(nil)))
+	assert.Equal(t, word+8, Of(new(int64)))
+	assert.Equal(t, 3*word+2*(2*word+1), Of([]string{"a", "b"}))
+
+	m := map[int64]int64{1: 1, 2: 2}
+	assert.Equal(t, word+mapHeaderSize+2*(16+mapEntryOverhead), Of(m))
+}
+
+func TestOf_Structs(t *testing.T) {
+	r := record{id: 1, name: "abc", tags: []string{"x"}, meta: int64(5)}
+	size := uint(unsafe.Sizeof(r)) + 3 + (2*word + 1) + 8
+	assert.Equal(t, size, Of(r))
+	assert.Equal(t, word+size, Of(&r))
+}
+
+func TestOf_CountsSharedMemoryOnce(t *testing.T) {
+	shared := &node{value: 1}
+	pair := [2]*node{shared, shared}
+	assert.Equal(t, 2*word+16, Of(pair))
+
+	s := "shared"
+	assert.Equal(t, 3*word+2*2*word+6, Of([]string{s, s}))
+}
+
+func TestOf_TerminatesOnCycles(t *testing.T) {
+	a := &node{value: 1}
+	b := &node{value: 2, next: a}
+	a.next = b
+	assert.Equal(t, word+32, Of(a))
+}
+
+func TestWeigher(t *testing.T) {
+	assert.Equal(t, Of("key")+Of([]byte{1, 2}), Weigher("key", []byte{1, 2}))
+}
@@ -0,0 +1,158 @@
+// Package sketch provides a count-min sketch estimating how often keys have
+// been seen, in constant space. It serves admission policies deciding
+// whether a new key is worth more than the entry it would displace, and can
+// be consulted directly to find frequently requested keys. Counts are aged
+// by halving them periodically, so that the estimates follow changes in
+// popularity.
+package sketch
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"sync"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/0xsoniclabs/cacheutils/wlru"
+)
+
+// depth is the number of rows, each counting every key once. The estimate
+// of a key is its smallest count.
+const depth = 4
+
+// MaxCount is the largest count tracked; counters saturate at it.
+const MaxCount = 255
+
+// CountMin is a count-min sketch with aging. It is safe for concurrent use.
+type CountMin struct {
+	lock       sync.Mutex
+	rows       [depth][]uint8
+	mask       uint64
+	increments int // increments since the last aging
+	sampleSize int // increments between agings
+
+	hasher wlru.Hasher
+}
+
+// Option configures a sketch.
+type Option func(*CountMin)
+
+// WithHasher sets the hasher mapping keys to counters. Defaults to
+// wlru.MapHasher.
+func WithHasher(h wlru.Hasher) Option {
+	return func(s *CountMin) {
+		s.hasher = h
+	}
+}
+
+// WithSampleSize sets the number of increments after which all counts are
+// halved. Defaults to ten times the number of keys the sketch is sized for;
+// zero disables aging.
+func WithSampleSize(n int) Option {
+	return func(s *CountMin) {
+		s.sampleSize = n
+	}
+}
+
+// New creates a sketch sized for tracking the given number of distinct keys.
+func New(keys int, opts ...Option) (*CountMin, error) {
+	if keys <= 0 {
+		return nil, fmt.Errorf("%w: must provide a positive number of keys", cacheutils.ErrInvalidSize)
+	}
+	width := uint64(1) << bits.Len64(uint64(keys-1))
+	s := &CountMin{
+		mask:       width - 1,
+		sampleSize: 10 * keys,
+		hasher:     wlru.MapHasher,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.hasher == nil {
+		return nil, errors.New("must provide a hasher")
+	}
+	if s.sampleSize < 0 {
+		return nil, fmt.Errorf("%w: must provide a non-negative sample size", cacheutils.ErrInvalidSize)
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s, nil
+}
+
+// Increment records a sighting of key. Only the smallest counters of the key
+// are incremented, which limits the overestimation caused by collisions.
+func (s *CountMin) Increment(key interface{}) {
+	var index [depth]uint64
+	s.indexes(key, &index)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	least := s.estimate(&index)
+	if least == MaxCount {
+		return
+	}
+	for i, row := range s.rows {
+		if row[index[i]] == least {
+			row[index[i]]++
+		}
+	}
+	s.increments++
+	if s.sampleSize > 0 && s.increments >= s.sampleSize {
+		s.age()
+	}
+}
+
+// Estimate returns how often key has been seen, accounting for aging. The
+// estimate never falls short of the true count but may exceed it when keys
+// collide.
+func (s *CountMin) Estimate(key interface{}) int {
+	var index [depth]uint64
+	s.indexes(key, &index)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return int(s.estimate(&index))
+}
+
+// Age halves all counts.
+func (s *CountMin) Age() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.age()
+}
+
+// Reset clears all counts.
+func (s *CountMin) Reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, row := range s.rows {
+		clear(row)
+	}
+	s.increments = 0
+}
+
+func (s *CountMin) age() {
+	for _, row := range s.rows {
+		for i := range row {
+			row[i] >>= 1
+		}
+	}
+	s.increments = 0
+}
+
+// estimate returns the smallest of the counters at the given indexes.
+func (s *CountMin) estimate(index *[depth]uint64) uint8 {
+	least := uint8(MaxCount)
+	for i, row := range s.rows {
+		least = min(least, row[index[i]])
+	}
+	return least
+}
+
+// indexes computes the counter of key in every row by double hashing.
+func (s *CountMin) indexes(key interface{}, index *[depth]uint64) {
+	h := s.hasher.Hash(key)
+	h1, h2 := h, h>>32|1
+	for i := range index {
+		index[i] = (h1 + uint64(i)*h2) & s.mask
+	}
+}
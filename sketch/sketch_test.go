@@ -0,0 +1,76 @@
+package sketch
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/0xsoniclabs/cacheutils/wlru"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew_ValidatesArguments(t *testing.T) {
+	_, err := New(0)
+	assert.True(t, errors.Is(err, cacheutils.ErrInvalidSize))
+	_, err = New(10, WithSampleSize(-1))
+	assert.True(t, errors.Is(err, cacheutils.ErrInvalidSize))
+	_, err = New(10, WithHasher(nil))
+	assert.Error(t, err)
+}
+
+func TestEstimate_CountsSightings(t *testing.T) {
+	s, err := New(100, WithSampleSize(0))
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		s.Increment("a")
+	}
+	s.Increment("b")
+	assert.Equal(t, 5, s.Estimate("a"))
+	assert.Equal(t, 1, s.Estimate("b"))
+	assert.Equal(t, 0, s.Estimate("c"))
+
+	for i := 0; i < 2*MaxCount; i++ {
+		s.Increment("a")
+	}
+	assert.Equal(t, MaxCount, s.Estimate("a"))
+
+	s.Reset()
+	assert.Equal(t, 0, s.Estimate("a"))
+}
+
+func TestEstimate_NeverUnderestimates(t *testing.T) {
+	s, err := New(64, WithHasher(wlru.XXHasher), WithSampleSize(0))
+	require.NoError(t, err)
+
+	for i := 0; i < 1000; i++ {
+		for j := 0; j <= i%10; j++ {
+			s.Increment(i)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		assert.GreaterOrEqual(t, s.Estimate(i), i%10+1)
+	}
+}
+
+func TestAge_HalvesCounts(t *testing.T) {
+	s, err := New(10, WithSampleSize(8))
+	require.NoError(t, err)
+
+	for i := 0; i < 6; i++ {
+		s.Increment("a")
+	}
+	s.Age()
+	assert.Equal(t, 3, s.Estimate("a"))
+
+	s.Increment("b")
+	s.Increment("b")
+	assert.Equal(t, 2, s.Estimate("b"))
+	for i := 0; i < 6; i++ {
+		s.Increment("c")
+	}
+	assert.Equal(t, 3, s.Estimate("c"))
+	assert.Equal(t, 1, s.Estimate("a"))
+	assert.Equal(t, 1, s.Estimate("b"))
+}
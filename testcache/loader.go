@@ -0,0 +1,63 @@
+package testcache
+
+import "sync"
+
+// Loader is a fake loader for code filling a cache on misses. It records the
+// keys it was asked to load and can be made to fail. It is safe for
+// concurrent use.
+type Loader struct {
+	lock     sync.Mutex
+	load     func(key interface{}) (interface{}, error)
+	failures map[interface{}][]error
+	failAll  error
+	keys     []interface{}
+}
+
+// NewLoader creates a loader producing values with load.
+func NewLoader(load func(key interface{}) (interface{}, error)) *Loader {
+	return &Loader{load: load, failures: make(map[interface{}][]error)}
+}
+
+// FailNext makes the next load of key fail with err. Injected failures are
+// consumed in the order they were added.
+func (l *Loader) FailNext(key interface{}, err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.failures[key] = append(l.failures[key], err)
+}
+
+// FailAll makes every load fail with err until called with nil. Failures
+// injected for a key with FailNext take precedence.
+func (l *Loader) FailAll(err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.failAll = err
+}
+
+// Load records the key and returns an injected failure, if any, or the
+// result of the load function.
+func (l *Loader) Load(key interface{}) (interface{}, error) {
+	l.lock.Lock()
+	l.keys = append(l.keys, key)
+	if failures := l.failures[key]; len(failures) > 0 {
+		l.failures[key] = failures[1:]
+		if len(failures) == 1 {
+			delete(l.failures, key)
+		}
+		l.lock.Unlock()
+		return nil, failures[0]
+	}
+	failAll := l.failAll
+	l.lock.Unlock()
+	if failAll != nil {
+		return nil, failAll
+	}
+	return l.load(key)
+}
+
+// Keys returns the keys loaded so far, in order, including failed loads.
+func (l *Loader) Keys() []interface{} {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]interface{}(nil), l.keys...)
+}
@@ -0,0 +1,201 @@
+// Package testcache provides test doubles for code using the caches of this
+// module: a fake cache with scripted lookups and recorded calls, and a fake
+// loader with failure injection.
+package testcache
+
+import (
+	"sync"
+
+	"github.com/0xsoniclabs/cacheutils"
+)
+
+// Call records a call made to a Fake. Fields not taken by the method are
+// left zero.
+type Call struct {
+	Method string
+	Key    interface{}
+	Value  interface{}
+	Weight uint
+}
+
+// Fake is a map-backed cache recording every call made to it. Entries are
+// never evicted. Lookups of a key can be scripted to hit or miss regardless
+// of the stored entries. It is safe for concurrent use.
+type Fake struct {
+	lock    sync.Mutex
+	entries map[interface{}]entry
+	scripts map[interface{}][]lookup
+	calls   []Call
+}
+
+var _ cacheutils.ResizableCache = (*Fake)(nil)
+
+type entry struct {
+	value  interface{}
+	weight uint
+}
+
+// lookup is a scripted result of a Get or Peek.
+type lookup struct {
+	value interface{}
+	hit   bool
+}
+
+// New creates an empty fake cache.
+func New() *Fake {
+	return &Fake{
+		entries: make(map[interface{}]entry),
+		scripts: make(map[interface{}][]lookup),
+	}
+}
+
+// Set stores an entry without recording a call, to prepare the contents of
+// the cache.
+func (f *Fake) Set(key, value interface{}, weight uint) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.entries[key] = entry{value, weight}
+}
+
+// ScriptHit makes the next unscripted Get or Peek of key return value.
+// Scripted results are consumed in the order they were added.
+func (f *Fake) ScriptHit(key, value interface{}) {
+	f.script(key, lookup{value: value, hit: true})
+}
+
+// ScriptMiss makes the next unscripted Get or Peek of key miss.
+func (f *Fake) ScriptMiss(key interface{}) {
+	f.script(key, lookup{})
+}
+
+func (f *Fake) script(key interface{}, l lookup) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.scripts[key] = append(f.scripts[key], l)
+}
+
+// Calls returns the calls made so far, in order.
+func (f *Fake) Calls() []Call {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]Call(nil), f.calls...)
+}
+
+// CallsTo returns the calls made so far to the given method, in order.
+func (f *Fake) CallsTo(method string) []Call {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var calls []Call
+	for _, call := range f.calls {
+		if call.Method == method {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// ResetCalls forgets the calls made so far.
+func (f *Fake) ResetCalls() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.calls = nil
+}
+
+// record records a call. It must be called while holding the lock.
+func (f *Fake) record(call Call) {
+	f.calls = append(f.calls, call)
+}
+
+// lookup returns the scripted or stored result for key. It must be called
+// while holding the lock.
+func (f *Fake) lookup(key interface{}) (interface{}, bool) {
+	if scripted := f.scripts[key]; len(scripted) > 0 {
+		f.scripts[key] = scripted[1:]
+		if len(scripted) == 1 {
+			delete(f.scripts, key)
+		}
+		return scripted[0].value, scripted[0].hit
+	}
+	e, ok := f.entries[key]
+	return e.value, ok
+}
+
+// Add stores the value and records the call. No evictions occur.
+func (f *Fake) Add(key, value interface{}, weight uint) (evicted int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.record(Call{Method: "Add", Key: key, Value: value, Weight: weight})
+	f.entries[key] = entry{value, weight}
+	return 0
+}
+
+// Get returns the next scripted result for key, or the stored value if none
+// is scripted.
+func (f *Fake) Get(key interface{}) (value interface{}, ok bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.record(Call{Method: "Get", Key: key})
+	return f.lookup(key)
+}
+
+// Peek returns the next scripted result for key, or the stored value if none
+// is scripted.
+func (f *Fake) Peek(key interface{}) (value interface{}, ok bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.record(Call{Method: "Peek", Key: key})
+	return f.lookup(key)
+}
+
+// Contains reports whether an entry is stored for key.
+func (f *Fake) Contains(key interface{}) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.record(Call{Method: "Contains", Key: key})
+	_, ok := f.entries[key]
+	return ok
+}
+
+// Remove removes the entry of key, returning if it was stored.
+func (f *Fake) Remove(key interface{}) (present bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.record(Call{Method: "Remove", Key: key})
+	_, present = f.entries[key]
+	delete(f.entries, key)
+	return present
+}
+
+// Purge removes all entries. Scripted results are kept.
+func (f *Fake) Purge() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.record(Call{Method: "Purge"})
+	f.entries = make(map[interface{}]entry)
+}
+
+// Resize records the call and otherwise does nothing.
+func (f *Fake) Resize(maxWeight uint, maxSize int) (evicted int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.record(Call{Method: "Resize", Weight: maxWeight, Value: maxSize})
+	return 0
+}
+
+// Len returns the number of stored entries.
+func (f *Fake) Len() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.entries)
+}
+
+// Weight returns the total weight of the stored entries.
+func (f *Fake) Weight() uint {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var weight uint
+	for _, e := range f.entries {
+		weight += e.weight
+	}
+	return weight
+}
@@ -0,0 +1,87 @@
+package testcache
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFake_StoresAndRecords(t *testing.T) {
+	f := New()
+	f.Set("a", 1, 2)
+	assert.Empty(t, f.Calls())
+
+	assert.Zero(t, f.Add("b", 2, 3))
+	val, ok := f.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, val)
+	assert.True(t, f.Remove("a"))
+	assert.False(t, f.Contains("a"))
+	f.Resize(10, 5)
+
+	assert.Equal(t, []Call{
+		{Method: "Add", Key: "b", Value: 2, Weight: 3},
+		{Method: "Get", Key: "a"},
+		{Method: "Remove", Key: "a"},
+		{Method: "Contains", Key: "a"},
+		{Method: "Resize", Value: 5, Weight: 10},
+	}, f.Calls())
+	assert.Len(t, f.CallsTo("Add"), 1)
+	assert.Equal(t, 1, f.Len())
+	assert.Equal(t, uint(3), f.Weight())
+
+	f.ResetCalls()
+	f.Purge()
+	assert.Equal(t, []Call{{Method: "Purge"}}, f.Calls())
+	assert.Zero(t, f.Len())
+}
+
+func TestFake_ScriptedLookups(t *testing.T) {
+	f := New()
+	f.Set("a", 1, 1)
+	f.ScriptMiss("a")
+	f.ScriptHit("a", 42)
+	f.ScriptHit("missing", "x")
+
+	_, ok := f.Get("a")
+	assert.False(t, ok)
+	val, ok := f.Peek("a")
+	assert.True(t, ok)
+	assert.Equal(t, 42, val)
+	val, ok = f.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, val)
+
+	val, ok = f.Get("missing")
+	assert.True(t, ok)
+	assert.Equal(t, "x", val)
+	_, ok = f.Get("missing")
+	assert.False(t, ok)
+}
+
+func TestLoader_InjectsFailures(t *testing.T) {
+	l := NewLoader(func(key interface{}) (interface{}, error) {
+		return fmt.Sprint(key), nil
+	})
+	errBoom := errors.New("boom")
+	l.FailNext(1, errBoom)
+
+	_, err := l.Load(1)
+	assert.ErrorIs(t, err, errBoom)
+	val, err := l.Load(1)
+	require.NoError(t, err)
+	assert.Equal(t, "1", val)
+
+	l.FailAll(errBoom)
+	_, err = l.Load(2)
+	assert.ErrorIs(t, err, errBoom)
+	l.FailAll(nil)
+	val, err = l.Load(2)
+	require.NoError(t, err)
+	assert.Equal(t, "2", val)
+
+	assert.Equal(t, []interface{}{1, 1, 2, 2}, l.Keys())
+}
@@ -0,0 +1,375 @@
+// Package tinylfu provides a weighted cache following the W-TinyLFU
+// replacement policy. New entries enter a small LRU window. Entries leaving
+// the window compete for the main area, a segmented LRU, with the entry the
+// main area would evict next: the one whose key has been requested more
+// often, as estimated by a frequency sketch, is kept. Within the main area,
+// entries hit again move from the probation segment to the protected one.
+// The window absorbs bursts of new keys, while the admission keeps one-off
+// keys, e.g. from scans, from displacing the frequently requested ones.
+//
+// The implementation follows Einziger, Friedman and Manes, "TinyLFU: A
+// Highly Efficient Cache Admission Policy" (ACM Transactions on Storage,
+// 2017), extended to weighted entries.
+package tinylfu
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/0xsoniclabs/cacheutils/simplewlru"
+	"github.com/0xsoniclabs/cacheutils/sketch"
+	"github.com/0xsoniclabs/cacheutils/wlru"
+)
+
+const (
+	// DefaultWindowPercent is the default share of the capacity taken by
+	// the window.
+	DefaultWindowPercent = 1
+	// DefaultProtectedPercent is the default share of the main area taken
+	// by the protected segment.
+	DefaultProtectedPercent = 80
+)
+
+const (
+	minSketchKeys = 16      // lower bound of the keys the sketch is sized for
+	maxSketchKeys = 1 << 20 // upper bound of the keys the sketch is sized for
+)
+
+// segment is the part of the cache holding an entry.
+type segment uint8
+
+const (
+	window segment = iota
+	probation
+	protected
+)
+
+// entry is a cached entry.
+type entry struct {
+	key     interface{}
+	value   interface{}
+	weight  uint
+	segment segment
+	element *list.Element
+}
+
+// Cache is a weighted W-TinyLFU cache. It is safe for concurrent use.
+type Cache struct {
+	lock             sync.Mutex
+	maxWeight        uint
+	maxSize          int
+	windowPercent    int
+	protectedPercent int
+	hasher           wlru.Hasher
+	onEvict          simplewlru.EvictCallback
+	freq             *sketch.CountMin
+	items            map[interface{}]*entry
+
+	// The segments hold their entries by recency, most recent at the front.
+	segments [3]list.List
+	weights  [3]uint
+
+	windowMaxWeight, mainMaxWeight, protectedMaxWeight uint
+	windowMaxSize, mainMaxSize, protectedMaxSize       int
+
+	evicted []evictedEntry // awaiting the callback until unlocking
+}
+
+// evictedEntry is an entry awaiting its eviction callback.
+type evictedEntry struct {
+	key, value interface{}
+}
+
+var _ cacheutils.WeightedCache = (*Cache)(nil)
+
+// Option configures a cache.
+type Option func(*Cache)
+
+// WithEvictCallback sets a callback called for every entry leaving the
+// cache, outside of the cache's lock.
+func WithEvictCallback(onEvict simplewlru.EvictCallback) Option {
+	return func(c *Cache) {
+		c.onEvict = onEvict
+	}
+}
+
+// WithWindowPercent sets the share of the weight and size limits taken by
+// the window. Defaults to DefaultWindowPercent; larger windows favor recency
+// over frequency.
+func WithWindowPercent(percent int) Option {
+	return func(c *Cache) {
+		c.windowPercent = percent
+	}
+}
+
+// WithProtectedPercent sets the share of the main area taken by the
+// protected segment. Defaults to DefaultProtectedPercent.
+func WithProtectedPercent(percent int) Option {
+	return func(c *Cache) {
+		c.protectedPercent = percent
+	}
+}
+
+// WithHasher sets the hasher used for estimating the frequencies of keys.
+// Defaults to wlru.MapHasher.
+func WithHasher(h wlru.Hasher) Option {
+	return func(c *Cache) {
+		c.hasher = h
+	}
+}
+
+// New creates a W-TinyLFU cache of the given size. The frequency sketch is
+// sized for ten times the maximum number of entries, within fixed bounds.
+func New(maxWeight uint, maxSize int, opts ...Option) (*Cache, error) {
+	c := &Cache{
+		maxWeight:        maxWeight,
+		maxSize:          maxSize,
+		windowPercent:    DefaultWindowPercent,
+		protectedPercent: DefaultProtectedPercent,
+		hasher:           wlru.MapHasher,
+		items:            make(map[interface{}]*entry),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if maxSize < 0 {
+		return nil, fmt.Errorf("%w: must provide a non-negative size", cacheutils.ErrInvalidSize)
+	}
+	if c.windowPercent <= 0 || c.windowPercent >= 100 {
+		return nil, fmt.Errorf("%w: window percentage must be between 1 and 99", cacheutils.ErrInvalidSize)
+	}
+	if c.protectedPercent < 0 || c.protectedPercent >= 100 {
+		return nil, fmt.Errorf("%w: protected percentage must be between 0 and 99", cacheutils.ErrInvalidSize)
+	}
+	if c.hasher == nil {
+		return nil, errors.New("must provide a hasher")
+	}
+	var err error
+	keys := min(max(maxSize, minSketchKeys), maxSketchKeys) * 10
+	if c.freq, err = sketch.New(keys, sketch.WithHasher(c.hasher)); err != nil {
+		return nil, err
+	}
+	// The window gets at least one entry or unit of weight, so that new
+	// entries can enter the cache.
+	c.windowMaxWeight = min(max(percentOf(maxWeight, c.windowPercent), 1), maxWeight)
+	c.windowMaxSize = min(max(int(percentOf(uint(maxSize), c.windowPercent)), 1), maxSize)
+	c.mainMaxWeight = maxWeight - c.windowMaxWeight
+	c.mainMaxSize = maxSize - c.windowMaxSize
+	c.protectedMaxWeight = percentOf(c.mainMaxWeight, c.protectedPercent)
+	c.protectedMaxSize = int(percentOf(uint(c.mainMaxSize), c.protectedPercent))
+	return c, nil
+}
+
+// percentOf returns percent percent of n, rounded down, without overflowing.
+func percentOf(n uint, percent int) uint {
+	return n/100*uint(percent) + n%100*uint(percent)/100
+}
+
+// Get looks up a key's value, recording a request of the key and an access
+// of its entry.
+func (c *Cache) Get(key interface{}) (value interface{}, ok bool) {
+	c.freq.Increment(key)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.access(e)
+	return e.value, true
+}
+
+// Peek looks up a key's value without recording a request or an access.
+func (c *Cache) Peek(key interface{}) (value interface{}, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.items[key]; ok {
+		return e.value, true
+	}
+	return nil, false
+}
+
+// Contains checks if a key is in the cache without recording a request or an
+// access.
+func (c *Cache) Contains(key interface{}) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, ok := c.items[key]
+	return ok
+}
+
+// Add adds a value to the cache and returns the number of evictions. A new
+// key counts as requested; updating an existing entry records an access of
+// it. New entries enter the window, and may be evicted themselves when
+// leaving it if their key is requested less often than those in the main
+// area. An entry heavier than the maximum weight of the cache is rejected;
+// an existing entry of the key is evicted, as its value is outdated.
+func (c *Cache) Add(key, value interface{}, weight uint) (evicted int) {
+	c.lock.Lock()
+	defer c.unlock()
+	e, ok := c.items[key]
+	if weight > c.maxWeight || c.maxSize == 0 {
+		if ok {
+			c.evict(e)
+			return 1
+		}
+		return 0
+	}
+	if ok {
+		c.weights[e.segment] += weight - e.weight
+		e.value, e.weight = value, weight
+		c.access(e)
+	} else {
+		c.freq.Increment(key)
+		e = &entry{key: key, value: value, weight: weight, segment: window}
+		e.element = c.segments[window].PushFront(e)
+		c.weights[window] += weight
+		c.items[key] = e
+	}
+	return c.enforce()
+}
+
+// Remove removes the provided key from the cache, returning if the key was
+// contained.
+func (c *Cache) Remove(key interface{}) (present bool) {
+	c.lock.Lock()
+	defer c.unlock()
+	e, ok := c.items[key]
+	if ok {
+		c.evict(e)
+	}
+	return ok
+}
+
+// Purge removes all entries from the cache. Frequencies are kept.
+func (c *Cache) Purge() {
+	c.lock.Lock()
+	defer c.unlock()
+	for _, e := range c.items {
+		c.report(e)
+	}
+	clear(c.items)
+	for i := range c.segments {
+		c.segments[i].Init()
+	}
+	c.weights = [3]uint{}
+}
+
+// Len returns the number of entries in the cache.
+func (c *Cache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.items)
+}
+
+// Weight returns the total weight of the entries in the cache.
+func (c *Cache) Weight() uint {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.weights[window] + c.weights[probation] + c.weights[protected]
+}
+
+// unlock releases the lock and runs the eviction callback for the entries
+// evicted while holding it.
+func (c *Cache) unlock() {
+	evicted := c.evicted
+	c.evicted = nil
+	c.lock.Unlock()
+	for _, e := range evicted {
+		c.onEvict(e.key, e.value)
+	}
+}
+
+// report queues the eviction callback for an entry leaving the cache.
+func (c *Cache) report(e *entry) {
+	if c.onEvict != nil {
+		c.evicted = append(c.evicted, evictedEntry{e.key, e.value})
+	}
+}
+
+// access records an access of an entry. Entries hit in the probation segment
+// are promoted to the protected one.
+func (c *Cache) access(e *entry) {
+	if e.segment == probation {
+		c.move(e, protected)
+		c.demote()
+		return
+	}
+	c.segments[e.segment].MoveToFront(e.element)
+}
+
+// move moves an entry to the front of the given segment.
+func (c *Cache) move(e *entry, to segment) {
+	c.segments[e.segment].Remove(e.element)
+	c.weights[e.segment] -= e.weight
+	e.segment = to
+	e.element = c.segments[to].PushFront(e)
+	c.weights[to] += e.weight
+}
+
+// demote moves the least recently used protected entries to the probation
+// segment until the protected segment fits its share of the main area.
+func (c *Cache) demote() {
+	for c.weights[protected] > c.protectedMaxWeight || c.segments[protected].Len() > c.protectedMaxSize {
+		c.move(c.segments[protected].Back().Value.(*entry), probation)
+	}
+}
+
+// mainFits returns whether the main area can take an additional entry of the
+// given weight and size.
+func (c *Cache) mainFits(weight uint, size int) bool {
+	mainWeight := c.weights[probation] + c.weights[protected]
+	mainLen := c.segments[probation].Len() + c.segments[protected].Len()
+	return weight <= c.mainMaxWeight && mainWeight <= c.mainMaxWeight-weight && mainLen+size <= c.mainMaxSize
+}
+
+// victim returns the entry the main area evicts next, or nil if it is empty.
+func (c *Cache) victim() *entry {
+	for _, s := range []segment{probation, protected} {
+		if back := c.segments[s].Back(); back != nil {
+			return back.Value.(*entry)
+		}
+	}
+	return nil
+}
+
+// enforce moves entries exceeding the window into the main area, admitting
+// them if their key is requested more often than those of the entries they
+// would displace, and evicts entries until the main area fits its limits.
+// Returns the number of evictions.
+func (c *Cache) enforce() (evicted int) {
+	for c.weights[window] > c.windowMaxWeight || c.segments[window].Len() > c.windowMaxSize {
+		candidate := c.segments[window].Back().Value.(*entry)
+		for !c.mainFits(candidate.weight, 1) {
+			victim := c.victim()
+			if victim == nil || c.freq.Estimate(candidate.key) <= c.freq.Estimate(victim.key) {
+				break
+			}
+			c.evict(victim)
+			evicted++
+		}
+		if c.mainFits(candidate.weight, 1) {
+			c.move(candidate, probation)
+		} else {
+			c.evict(candidate)
+			evicted++
+		}
+	}
+	for !c.mainFits(0, 0) {
+		c.evict(c.victim())
+		evicted++
+	}
+	c.demote()
+	return evicted
+}
+
+// evict removes an entry from the cache.
+func (c *Cache) evict(e *entry) {
+	c.report(e)
+	c.segments[e.segment].Remove(e.element)
+	c.weights[e.segment] -= e.weight
+	delete(c.items, e.key)
+}
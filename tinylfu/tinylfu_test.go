@@ -0,0 +1,171 @@
+package tinylfu
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/0xsoniclabs/cacheutils/simplewlru"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// checkInvariants verifies the bookkeeping of the cache.
+func checkInvariants(t *testing.T, c *Cache) {
+	t.Helper()
+	var weights [3]uint
+	var lens [3]int
+	for key, e := range c.items {
+		require.Equal(t, key, e.key)
+		require.Equal(t, e, e.element.Value, "entries are in their segment")
+		weights[e.segment] += e.weight
+		lens[e.segment]++
+	}
+	require.Equal(t, weights, c.weights)
+	for s := range c.segments {
+		require.Equal(t, lens[s], c.segments[s].Len())
+	}
+	require.LessOrEqual(t, weights[window], c.windowMaxWeight)
+	require.LessOrEqual(t, lens[window], c.windowMaxSize)
+	require.LessOrEqual(t, weights[probation]+weights[protected], c.mainMaxWeight)
+	require.LessOrEqual(t, lens[probation]+lens[protected], c.mainMaxSize)
+	require.LessOrEqual(t, weights[protected], c.protectedMaxWeight)
+	require.LessOrEqual(t, lens[protected], c.protectedMaxSize)
+}
+
+func TestNew_ValidatesArguments(t *testing.T) {
+	_, err := New(10, -1)
+	assert.True(t, errors.Is(err, cacheutils.ErrInvalidSize))
+	_, err = New(10, 10, WithWindowPercent(0))
+	assert.Error(t, err)
+	_, err = New(10, 10, WithWindowPercent(100))
+	assert.Error(t, err)
+	_, err = New(10, 10, WithProtectedPercent(100))
+	assert.Error(t, err)
+	_, err = New(10, 10, WithHasher(nil))
+	assert.Error(t, err)
+}
+
+func TestCache_AddGetRemove(t *testing.T) {
+	c, err := New(10, 10, WithWindowPercent(50))
+	require.NoError(t, err)
+
+	assert.Equal(t, 0, c.Add("a", 1, 4))
+	assert.Equal(t, 0, c.Add("b", 2, 4))
+	value, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, value)
+	value, ok = c.Peek("b")
+	assert.True(t, ok)
+	assert.Equal(t, 2, value)
+	assert.Equal(t, 2, c.Len())
+	assert.Equal(t, uint(8), c.Weight())
+
+	assert.Equal(t, 0, c.Add("a", 3, 2))
+	assert.Equal(t, uint(6), c.Weight())
+	assert.Equal(t, 0, c.Add("c", 4, 11), "too heavy entries are rejected")
+	assert.False(t, c.Contains("c"))
+	assert.Equal(t, 1, c.Add("a", 4, 11), "outdated entries are evicted")
+	assert.False(t, c.Contains("a"))
+
+	assert.True(t, c.Remove("b"))
+	assert.False(t, c.Remove("b"))
+	assert.Equal(t, 0, c.Len())
+	checkInvariants(t, c)
+}
+
+func TestCache_RejectsRarelyRequestedKeys(t *testing.T) {
+	c, _ := New(100, 100)
+	for i := 0; i < 99; i++ {
+		c.Add(i, i, 1)
+		c.Get(i)
+	}
+	// The newcomer was requested less often than the entry it would
+	// displace and is evicted itself when leaving the window.
+	assert.Equal(t, 0, c.Add(100, 100, 1), "the main area is not full yet")
+	assert.Equal(t, 1, c.Add(101, 101, 1))
+	assert.False(t, c.Contains(100))
+	assert.True(t, c.Contains(0))
+
+	// Once requested more often, it is admitted.
+	for i := 0; i < 3; i++ {
+		c.Get(102)
+	}
+	assert.Equal(t, 1, c.Add(102, 102, 1))
+	assert.Equal(t, 1, c.Add(103, 103, 1))
+	assert.True(t, c.Contains(102))
+	assert.False(t, c.Contains(0))
+	checkInvariants(t, c)
+}
+
+func TestCache_ResistsScans(t *testing.T) {
+	const size = 100
+	c, _ := New(size, size)
+	lru, _ := simplewlru.New(size, size)
+	var hits, lruHits int
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		// Half of the requests go to a working set fitting into the cache,
+		// the others scan over keys never requested again.
+		key := size + i
+		if i%2 == 0 {
+			key = rnd.Intn(size / 2)
+		}
+		if _, ok := c.Get(key); ok {
+			hits++
+		} else {
+			c.Add(key, key, 1)
+		}
+		if _, ok := lru.Get(key); ok {
+			lruHits++
+		} else {
+			lru.Add(key, key, 1)
+		}
+	}
+	checkInvariants(t, c)
+	assert.Greater(t, hits, 9000)
+	assert.Greater(t, hits, lruHits)
+}
+
+func TestCache_RandomOperationsKeepInvariants(t *testing.T) {
+	var evicted int
+	c, _ := New(200, 50, WithWindowPercent(10), WithEvictCallback(func(key, value interface{}) {
+		evicted++
+	}))
+	rnd := rand.New(rand.NewSource(1))
+	reported := 0
+	for i := 0; i < 20000; i++ {
+		key := rnd.Intn(120)
+		switch op := rnd.Intn(10); {
+		case op < 5:
+			c.Get(key)
+		case op < 9:
+			reported += c.Add(key, i, uint(rnd.Intn(12)))
+		default:
+			if c.Remove(key) {
+				reported++
+			}
+		}
+		checkInvariants(t, c)
+	}
+	assert.Equal(t, reported, evicted)
+
+	n := c.Len()
+	c.Purge()
+	assert.Equal(t, reported+n, evicted)
+	assert.Equal(t, 0, c.Len())
+	assert.Equal(t, uint(0), c.Weight())
+	checkInvariants(t, c)
+}
+
+func TestCache_EvictCallbackMayUseCache(t *testing.T) {
+	var c *Cache
+	c, _ = New(2, 2, WithEvictCallback(func(key, value interface{}) {
+		assert.False(t, c.Contains(key))
+	}))
+	for i := 0; i < 10; i++ {
+		c.Add(i, i, 1)
+	}
+	assert.Equal(t, 2, c.Len())
+}
@@ -0,0 +1,77 @@
+package ttlcache
+
+import (
+	"errors"
+	"time"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/0xsoniclabs/cacheutils/clock"
+)
+
+// StartJanitor removes expired entries every interval in the background
+// until StopJanitor is called. Each sweep removes at most the number of
+// entries set by WithSweepLimit. Caches using lazy expiration have no
+// janitor.
+func (c *Cache) StartJanitor(interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("must provide a positive interval")
+	}
+	if c.lazy {
+		return errors.New("janitor disabled by lazy expiration")
+	}
+	c.janitorLock.Lock()
+	defer c.janitorLock.Unlock()
+	if c.closed.Load() {
+		return cacheutils.ErrClosed
+	}
+	if c.stop != nil {
+		return errors.New("janitor already running")
+	}
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	go c.runJanitor(c.clock.NewTicker(interval), c.stop, c.done)
+	return nil
+}
+
+// StopJanitor stops the janitor and waits for a sweep in progress to finish.
+// It does nothing if the janitor is not running.
+func (c *Cache) StopJanitor() {
+	c.janitorLock.Lock()
+	stop, done := c.stop, c.done
+	c.stop, c.done = nil, nil
+	c.janitorLock.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// Close stops the janitor, waiting for a sweep in progress to finish.
+// Afterwards, the cache follows the rule of cacheutils.ErrClosed:
+// StartJanitor and TryAdd fail with ErrClosed, Add and AddWithTTL drop the
+// value, and SetTTL and ExtendTTL report that the entry was not changed.
+// Entries may still be read and removed, including by Expire and
+// RemoveExpired. Closing a closed cache fails with ErrClosed.
+func (c *Cache) Close() error {
+	c.janitorLock.Lock()
+	closed := c.closed.Swap(true)
+	c.janitorLock.Unlock()
+	if closed {
+		return cacheutils.ErrClosed
+	}
+	c.StopJanitor()
+	return nil
+}
+
+func (c *Cache) runJanitor(ticker clock.Ticker, stop, done chan struct{}) {
+	defer close(done)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C():
+			c.expire(c.sweepLimit)
+		}
+	}
+}
@@ -0,0 +1,644 @@
+// Package ttlcache provides a thread safe weighted LRU cache whose entries
+// expire a time after they were written, either the TTL of the cache or a TTL
+// given per entry.
+//
+// Expired entries are never returned. They are reclaimed lazily when
+// accessed, and in bulk by Expire, RemoveExpired or a background janitor,
+// which walk a hierarchical timing wheel instead of scanning the cache, so
+// expiring k entries costs O(k) plus O(1) amortized per elapsed tick.
+package ttlcache
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/0xsoniclabs/cacheutils/clock"
+	"github.com/0xsoniclabs/cacheutils/simplewlru"
+)
+
+// DefaultTick is the default resolution of the expiry timing wheel.
+const DefaultTick = time.Second
+
+// Cache is a thread safe weighted LRU cache with expiring entries.
+type Cache struct {
+	lock    sync.Mutex
+	lru     *simplewlru.Cache
+	ttl     time.Duration
+	tick    time.Duration
+	epoch   time.Time
+	wheel   wheel
+	onEvict simplewlru.EvictCallback
+	// onExpire, if set, replaces onEvict for entries removed by expiry,
+	// which is signalled by expiring.
+	onExpire simplewlru.EvictCallback
+	expiring bool
+	clock    clock.Clock
+	lazy     bool
+	jitter   float64
+	idle     time.Duration
+
+	// Adaptive TTL scales the write TTL of unread entries by shortenTo,
+	// doubling it on every read up to extendTo; disabled if extendTo is 0.
+	shortenTo, extendTo float64
+
+	// lruOpts configures the underlying LRU during construction.
+	lruOpts []simplewlru.Option
+
+	janitorLock sync.Mutex  // serializes janitor control
+	closed      atomic.Bool // set under janitorLock
+	sweepLimit  int
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+var _ cacheutils.WeightedCache = (*Cache)(nil)
+
+// item is the value stored in the underlying LRU.
+type item struct {
+	value     interface{}
+	expiresAt time.Time     // zero if the item never expires
+	written   time.Time     // expiry by the write TTL, zero if none
+	ttl       time.Duration // write TTL before scaling by adaptive TTL
+	reads     int           // reads scaling the write TTL by adaptive TTL
+	timer     timer
+}
+
+// Option configures optional behaviour of a Cache.
+type Option func(*Cache) error
+
+// WithClock sets the clock determining when entries expire and when the
+// janitor runs. The default is clock.Real.
+func WithClock(c clock.Clock) Option {
+	return func(cache *Cache) error {
+		if c == nil {
+			return errors.New("must provide a clock")
+		}
+		cache.clock = c
+		return nil
+	}
+}
+
+// WithMaxWeight sets the maximum total weight of the cache, overriding the
+// limit given to the constructor.
+func WithMaxWeight(maxWeight uint) Option {
+	return func(c *Cache) error {
+		c.lruOpts = append(c.lruOpts, simplewlru.WithMaxWeight(maxWeight))
+		return nil
+	}
+}
+
+// WithMaxSize sets the maximum number of entries of the cache, overriding the
+// limit given to the constructor.
+func WithMaxSize(maxSize int) Option {
+	return func(c *Cache) error {
+		c.lruOpts = append(c.lruOpts, simplewlru.WithMaxSize(maxSize))
+		return nil
+	}
+}
+
+// WithTTL sets the time after which entries expire once written, overriding
+// the TTL given to the constructor.
+func WithTTL(ttl time.Duration) Option {
+	return func(c *Cache) error {
+		if ttl == 0 {
+			return errors.New("ttl must be positive or NoExpiry")
+		}
+		c.ttl = ttl
+		return nil
+	}
+}
+
+// WithEvictCallback sets the callback called for every entry leaving the
+// cache, overriding the one given to the constructor.
+func WithEvictCallback(onEvict simplewlru.EvictCallback) Option {
+	return func(c *Cache) error {
+		c.onEvict = onEvict
+		return nil
+	}
+}
+
+// WithTick sets the resolution of the expiry timing wheel. Expire reclaims
+// entries up to one tick after they expired; accessed entries are checked
+// precisely.
+func WithTick(tick time.Duration) Option {
+	return func(c *Cache) error {
+		if tick <= 0 {
+			return errors.New("tick must be positive")
+		}
+		c.tick = tick
+		return nil
+	}
+}
+
+// WithSweepLimit bounds the number of entries removed by each sweep of the
+// janitor, so that expiring a large burst of entries does not hold the cache
+// lock for long. Entries left over are removed by the following sweeps.
+func WithSweepLimit(n int) Option {
+	return func(c *Cache) error {
+		if n <= 0 {
+			return errors.New("sweep limit must be positive")
+		}
+		c.sweepLimit = n
+		return nil
+	}
+}
+
+// WithLazyExpiration disables the timing wheel, so that no expiry work is
+// done in the background or by Expire. Expired entries are reclaimed only
+// when accessed, when evicted by capacity, and by Add, which first removes
+// expired entries from the least recently used end of the cache. This suits
+// workloads preferring no background goroutines and minimal bookkeeping.
+func WithLazyExpiration() Option {
+	return func(c *Cache) error {
+		c.lazy = true
+		return nil
+	}
+}
+
+// WithTTLJitter randomizes the TTL of each entry by up to ±fraction of the
+// cache TTL, so that entries added in the same burst do not all expire at the
+// same time. The fraction must be in the range [0, 1).
+func WithTTLJitter(fraction float64) Option {
+	return func(c *Cache) error {
+		if !(fraction >= 0 && fraction < 1) {
+			return errors.New("jitter fraction must be in the range [0, 1)")
+		}
+		c.jitter = fraction
+		return nil
+	}
+}
+
+// WithExpireAfterAccess makes entries expire once they were not read by Get
+// for the idle duration. Combined with the write TTL of the cache or of an
+// entry, whichever expires first applies; with a cache TTL of NoExpiry,
+// entries only expire after access. Adding an entry counts as an access.
+func WithExpireAfterAccess(idle time.Duration) Option {
+	return func(c *Cache) error {
+		if idle <= 0 {
+			return errors.New("idle duration must be positive")
+		}
+		c.idle = idle
+		return nil
+	}
+}
+
+// WithAdaptiveTTL scales the write TTL of entries by how often they are read,
+// so that the freshness budget goes to entries in use. An entry not read
+// since it was added expires after shortenTo times its TTL, and every read by
+// Get doubles the factor, up to extendTo. Rewriting an entry keeps its count
+// of reads. For example, with factors 0.5 and 4, unread entries expire after
+// half their TTL, and entries read three times after four times their TTL.
+// Requires 0 < shortenTo <= 1 <= extendTo.
+func WithAdaptiveTTL(shortenTo, extendTo float64) Option {
+	return func(c *Cache) error {
+		if !(shortenTo > 0 && shortenTo <= 1 && extendTo >= 1 && !math.IsInf(extendTo, 1)) {
+			return errors.New("adaptive TTL factors must satisfy 0 < shortenTo <= 1 <= extendTo")
+		}
+		c.shortenTo, c.extendTo = shortenTo, extendTo
+		return nil
+	}
+}
+
+// WithExpireCallback sets a callback for entries removed because they
+// expired, so that expiry can be told apart from other removals, which are
+// reported to the eviction callback. Without it, expired entries are
+// reported to the eviction callback as well.
+func WithExpireCallback(onExpire simplewlru.EvictCallback) Option {
+	return func(c *Cache) error {
+		c.onExpire = onExpire
+		return nil
+	}
+}
+
+// DefaultTTL makes AddWithTTL use the TTL of the cache.
+const DefaultTTL time.Duration = 0
+
+// NoExpiry makes AddWithTTL add an entry which never expires. Used as the TTL
+// of the cache, entries only expire if added with an explicit TTL.
+const NoExpiry time.Duration = -1
+
+// New creates a weighted LRU of the given size whose entries expire ttl
+// after they were written.
+func New(maxWeight uint, maxSize int, ttl time.Duration, opts ...Option) (*Cache, error) {
+	return NewWithEvict(maxWeight, maxSize, ttl, nil, opts...)
+}
+
+// NewWithOptions creates a cache configured entirely by options. Without
+// WithMaxWeight or WithMaxSize, the respective limit is unbounded; without
+// WithTTL, entries only expire if added with an explicit TTL.
+func NewWithOptions(opts ...Option) (*Cache, error) {
+	return NewWithEvict(math.MaxUint, math.MaxInt, NoExpiry, nil, opts...)
+}
+
+// NewWithEvict creates a weighted LRU of the given size whose entries expire
+// ttl after they were written, calling onEvict whenever an entry is removed.
+func NewWithEvict(maxWeight uint, maxSize int, ttl time.Duration, onEvict simplewlru.EvictCallback, opts ...Option) (*Cache, error) {
+	if ttl == 0 {
+		return nil, errors.New("ttl must be positive or NoExpiry")
+	}
+	c := &Cache{
+		ttl:     ttl,
+		tick:    DefaultTick,
+		onEvict: onEvict,
+		clock:   clock.Real,
+	}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	lruOpts := append(c.lruOpts, simplewlru.WithClock(c.clock))
+	lru, err := simplewlru.NewWithEvict(maxWeight, maxSize, c.evicted, lruOpts...)
+	if err != nil {
+		return nil, err
+	}
+	c.lru = lru
+	c.lruOpts = nil
+	c.epoch = c.clock.Now()
+	c.wheel.init(0)
+	return c, nil
+}
+
+// evicted is called by the LRU for every removed entry.
+func (c *Cache) evicted(key, value interface{}) {
+	it := value.(*item)
+	c.wheel.remove(&it.timer)
+	if c.expiring && c.onExpire != nil {
+		c.onExpire(key, it.value)
+	} else if c.onEvict != nil {
+		c.onEvict(key, it.value)
+	}
+}
+
+// removeExpired removes an entry which expired.
+func (c *Cache) removeExpired(key interface{}) {
+	c.expiring = true
+	c.lru.Remove(key)
+	c.expiring = false
+}
+
+// ticks converts a point in time to the first tick not before it.
+func (c *Cache) ticks(t time.Time) int64 {
+	d := t.Sub(c.epoch)
+	n := int64(d / c.tick)
+	if d%c.tick > 0 {
+		n++
+	}
+	return n
+}
+
+// Add adds a value to the cache, expiring after the cache TTL. Returns the
+// number of evictions. Once the cache is closed, the value is dropped; use
+// TryAdd to detect this.
+func (c *Cache) Add(key, value interface{}, weight uint) (evicted int) {
+	return c.AddWithTTL(key, value, weight, DefaultTTL)
+}
+
+// TryAdd adds a value to the cache like Add, unless the entry could not be
+// retained even by an empty cache. In that case ErrEntryTooLarge is returned
+// and a previous value of the key has been removed. Once the cache is
+// closed, ErrClosed is returned.
+func (c *Cache) TryAdd(key, value interface{}, weight uint) (evicted int, err error) {
+	if c.closed.Load() {
+		return 0, cacheutils.ErrClosed
+	}
+	result, evicted := c.add(key, value, weight, DefaultTTL)
+	if result == simplewlru.Rejected {
+		return evicted, fmt.Errorf("%w: weight %d exceeds the limits of the cache", cacheutils.ErrEntryTooLarge, weight)
+	}
+	return evicted, nil
+}
+
+// AddWithTTL adds a value to the cache, expiring after the given TTL instead
+// of the cache TTL. A TTL of DefaultTTL uses the cache TTL, a negative TTL
+// such as NoExpiry adds an entry which never expires. Returns the number of
+// evictions. Once the cache is closed, the value is dropped.
+func (c *Cache) AddWithTTL(key, value interface{}, weight uint, ttl time.Duration) (evicted int) {
+	if c.closed.Load() {
+		return 0
+	}
+	_, evicted = c.add(key, value, weight, ttl)
+	return evicted
+}
+
+// add adds a value to the cache with the given TTL, reporting whether it is
+// in the cache afterwards.
+func (c *Cache) add(key, value interface{}, weight uint, ttl time.Duration) (result simplewlru.AddResult, evicted int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	it := &item{value: value}
+	if old, ok := c.lru.Peek(key); ok {
+		c.wheel.remove(&old.(*item).timer)
+		it.reads = old.(*item).reads
+	}
+	now := c.clock.Now()
+	if ttl == DefaultTTL {
+		ttl = c.ttl
+	}
+	if ttl > 0 {
+		it.ttl = c.jittered(ttl)
+		it.written = now.Add(c.scaled(it.ttl, it.reads))
+	}
+	if c.lazy {
+		c.removeExpiredOldest(now)
+	}
+	c.schedule(key, it, now)
+	result, evicted = c.lru.AddWithResult(key, it, weight)
+	if result != simplewlru.Added {
+		// The entry was rejected, so its timer must not fire for a later
+		// entry of the key.
+		c.wheel.remove(&it.timer)
+	}
+	return result, evicted
+}
+
+// schedule sets the expiry of an item accessed now, being the earlier of its
+// write expiry and the end of its idle period.
+func (c *Cache) schedule(key interface{}, it *item, now time.Time) {
+	it.expiresAt = it.written
+	if c.idle > 0 {
+		if idle := now.Add(c.idle); it.expiresAt.IsZero() || idle.Before(it.expiresAt) {
+			it.expiresAt = idle
+		}
+	}
+	if c.lazy {
+		return
+	}
+	c.wheel.remove(&it.timer)
+	if !it.expiresAt.IsZero() {
+		it.timer.key = key
+		it.timer.expires = c.ticks(it.expiresAt)
+		c.wheel.add(&it.timer)
+	}
+}
+
+// jittered returns the TTL randomized by the configured jitter.
+func (c *Cache) jittered(ttl time.Duration) time.Duration {
+	if c.jitter == 0 {
+		return ttl
+	}
+	return ttl + time.Duration((2*rand.Float64()-1)*c.jitter*float64(ttl))
+}
+
+// scaled returns the write TTL of an entry read the given number of times,
+// scaled by adaptive TTL.
+func (c *Cache) scaled(ttl time.Duration, reads int) time.Duration {
+	if c.extendTo == 0 {
+		return ttl
+	}
+	scaled := min(c.shortenTo*math.Pow(2, float64(reads)), c.extendTo) * float64(ttl)
+	if scaled >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(scaled)
+}
+
+// read counts a read of the item for adaptive TTL, postponing its write
+// expiry. Returns whether the expiry changed.
+func (c *Cache) read(it *item) bool {
+	if c.extendTo == 0 || it.written.IsZero() {
+		return false
+	}
+	before := c.scaled(it.ttl, it.reads)
+	if before == c.scaled(it.ttl, it.reads+1) {
+		return false
+	}
+	it.reads++
+	it.written = it.written.Add(c.scaled(it.ttl, it.reads) - before)
+	return true
+}
+
+// expired reports whether the item expired by now.
+func (it *item) expired(now time.Time) bool {
+	return !it.expiresAt.IsZero() && !now.Before(it.expiresAt)
+}
+
+// removeExpiredOldest removes expired entries from the least recently used
+// end of the cache, stopping at the first entry which has not expired.
+func (c *Cache) removeExpiredOldest(now time.Time) {
+	for {
+		key, v, ok := c.lru.GetOldest()
+		if !ok || !v.(*item).expired(now) {
+			return
+		}
+		c.removeExpired(key)
+	}
+}
+
+// Get looks up a key's value from the cache, updating its recency and, with
+// expiry after access, restarting its idle period. Expired entries are
+// removed.
+func (c *Cache) Get(key interface{}) (value interface{}, ok bool) {
+	value, _, ok = c.GetWithExpiry(key)
+	return value, ok
+}
+
+// GetWithExpiry looks up a key's value from the cache like Get, also
+// returning when the entry expires, or the zero time if it never expires.
+func (c *Cache) GetWithExpiry(key interface{}) (value interface{}, expiresAt time.Time, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	v, ok := c.lru.Get(key)
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	it := v.(*item)
+	if value, ok = c.live(key, it); !ok {
+		return nil, time.Time{}, false
+	}
+	if c.read(it) || c.idle > 0 {
+		c.schedule(key, it, c.clock.Now())
+	}
+	return value, it.expiresAt, true
+}
+
+// Peek looks up a key's value from the cache without updating its recency or
+// idle period. Expired entries are removed.
+func (c *Cache) Peek(key interface{}) (value interface{}, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	v, ok := c.lru.Peek(key)
+	if !ok {
+		return nil, false
+	}
+	return c.live(key, v.(*item))
+}
+
+// live returns the value of the item, or removes it if it expired.
+func (c *Cache) live(key interface{}, it *item) (value interface{}, ok bool) {
+	if it.expired(c.clock.Now()) {
+		c.removeExpired(key)
+		return nil, false
+	}
+	return it.value, true
+}
+
+// SetTTL makes the entry expire after the given TTL from now, without
+// rewriting its value or updating its recency. The TTL is interpreted as by
+// AddWithTTL and scaled by adaptive TTL. With expiry after access, the idle
+// period restarts as well. Returns whether the key was in the cache and not
+// expired. A closed cache is left unchanged.
+func (c *Cache) SetTTL(key interface{}, ttl time.Duration) bool {
+	if c.closed.Load() {
+		return false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	it, now, ok := c.peekLive(key)
+	if !ok {
+		return false
+	}
+	if ttl == DefaultTTL {
+		ttl = c.ttl
+	}
+	it.written = time.Time{}
+	if ttl > 0 {
+		it.ttl = c.jittered(ttl)
+		it.written = now.Add(c.scaled(it.ttl, it.reads))
+	}
+	c.schedule(key, it, now)
+	return true
+}
+
+// ExtendTTL postpones the expiry of the entry by delta, without rewriting
+// its value or updating its recency. Entries which never expire are left
+// unchanged. With expiry after access, the idle period restarts as well.
+// Returns whether the key was in the cache and not expired. A closed cache
+// is left unchanged.
+func (c *Cache) ExtendTTL(key interface{}, delta time.Duration) bool {
+	if c.closed.Load() {
+		return false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	it, now, ok := c.peekLive(key)
+	if !ok {
+		return false
+	}
+	if !it.written.IsZero() {
+		it.written = it.written.Add(delta)
+	}
+	c.schedule(key, it, now)
+	return true
+}
+
+// peekLive returns the item of the key, removing it if it expired.
+func (c *Cache) peekLive(key interface{}) (it *item, now time.Time, ok bool) {
+	v, ok := c.lru.Peek(key)
+	if !ok {
+		return nil, now, false
+	}
+	it, now = v.(*item), c.clock.Now()
+	if it.expired(now) {
+		c.removeExpired(key)
+		return nil, now, false
+	}
+	return it, now, true
+}
+
+// Contains checks if a key is in the cache and not expired, without updating
+// its recency.
+func (c *Cache) Contains(key interface{}) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	v, ok := c.lru.Peek(key)
+	return ok && !v.(*item).expired(c.clock.Now())
+}
+
+// Remove removes the provided key from the cache, returning if the key was
+// contained.
+func (c *Cache) Remove(key interface{}) (present bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Remove(key)
+}
+
+// Purge removes all entries from the cache.
+func (c *Cache) Purge() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lru.Purge()
+}
+
+// Expire removes all entries which expired by now, returning their number.
+// It does nothing if the cache uses lazy expiration.
+func (c *Cache) Expire() (expired int) {
+	return c.expire(0)
+}
+
+// RemoveExpired removes all entries which expired by the given time,
+// returning their number. It suits callers running their own maintenance
+// loop: rather than reading the clock of the cache, it takes the time from
+// the caller, and it is precise where Expire lags up to a tick. Expired
+// entries are found through the timing wheel, so removing k entries costs
+// O(k) plus the ticks elapsed since the last sweep. With lazy expiration,
+// only the expired entries at the least recently used end of the cache are
+// removed, as by Add. A time ahead of the clock of the cache does not make
+// entries added later expire early.
+func (c *Cache) RemoveExpired(now time.Time) (removed int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.lazy {
+		n := c.lru.Len()
+		c.removeExpiredOldest(now)
+		return n - c.lru.Len()
+	}
+	return c.sweep(now, 0)
+}
+
+// expire removes up to limit expired entries, or all if limit is not
+// positive.
+func (c *Cache) expire(limit int) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.sweep(c.clock.Now(), limit)
+}
+
+// sweep advances the timing wheel to now, removing up to limit entries which
+// expired by then, or all if limit is not positive. As RemoveExpired may
+// move the wheel ahead of the clock, entries are checked before they are
+// removed: entries added meanwhile wait in the slot due next, and entries
+// which did not expire yet are scheduled again.
+func (c *Cache) sweep(now time.Time, limit int) (removed int) {
+	removed = c.wheel.advance(int64(now.Sub(c.epoch)/c.tick), limit, func(t *timer) bool {
+		if v, ok := c.lru.Peek(t.key); ok && !v.(*item).expired(now) {
+			c.wheel.add(t)
+			return false
+		}
+		c.removeExpired(t.key)
+		return true
+	})
+	// Entries due within the next tick are checked individually.
+	for _, key := range c.wheel.dueNext() {
+		if limit > 0 && removed >= limit {
+			break
+		}
+		if v, ok := c.lru.Peek(key); ok && v.(*item).expired(now) {
+			c.removeExpired(key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Len returns the number of entries in the cache, including expired entries
+// not reclaimed yet.
+func (c *Cache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Len()
+}
+
+// Weight returns the total weight of the entries in the cache, including
+// expired entries not reclaimed yet.
+func (c *Cache) Weight() uint {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Weight()
+}
@@ -0,0 +1,555 @@
+package ttlcache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/0xsoniclabs/cacheutils/clock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCache(t *testing.T, ttl time.Duration, onEvict func(key, value interface{}), opts ...Option) (*Cache, *clock.Fake) {
+	fake := clock.NewFake(time.Unix(1000, 0))
+	c, err := NewWithEvict(100, 100, ttl, onEvict, append(opts, WithClock(fake))...)
+	require.NoError(t, err)
+	return c, fake
+}
+
+func TestNew_Validates(t *testing.T) {
+	_, err := New(10, 10, 0)
+	assert.Error(t, err)
+	_, err = New(10, 10, time.Second, WithTick(0))
+	assert.Error(t, err)
+	_, err = New(10, -1, time.Second)
+	assert.Error(t, err)
+	_, err = New(10, 10, time.Second, WithTick(time.Millisecond))
+	assert.NoError(t, err)
+}
+
+func TestNewWithOptions(t *testing.T) {
+	_, err := NewWithOptions(WithTTL(0))
+	assert.Error(t, err)
+	_, err = NewWithOptions(WithMaxSize(-1))
+	assert.Error(t, err)
+
+	fake := clock.NewFake(time.Unix(1000, 0))
+	var evicted []interface{}
+	c, err := NewWithOptions(
+		WithMaxSize(2),
+		WithTTL(time.Minute),
+		WithClock(fake),
+		WithEvictCallback(func(key, value interface{}) {
+			evicted = append(evicted, key)
+		}),
+	)
+	require.NoError(t, err)
+	c.Add("a", 1, 100)
+	c.Add("b", 2, 100)
+	c.Add("c", 3, 100)
+	assert.Equal(t, []interface{}{"a"}, evicted)
+	assert.Equal(t, uint(200), c.Weight())
+
+	fake.Advance(time.Minute)
+	assert.False(t, c.Contains("b"))
+
+	// Without a TTL, entries do not expire by default.
+	c, err = NewWithOptions(WithClock(fake))
+	require.NoError(t, err)
+	c.Add("a", 1, 1)
+	fake.Advance(24 * time.Hour)
+	assert.True(t, c.Contains("a"))
+}
+
+func TestCache_EntriesExpireAfterTTL(t *testing.T) {
+	c, clock := newTestCache(t, 10*time.Second, nil)
+	c.Add("a", 1, 1)
+	clock.Advance(5 * time.Second)
+	c.Add("b", 2, 1)
+
+	v, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+
+	clock.Advance(5 * time.Second)
+	assert.False(t, c.Contains("a"))
+	_, ok = c.Peek("a")
+	assert.False(t, ok)
+	assert.Equal(t, 1, c.Len(), "expired entry is reclaimed on access")
+	_, ok = c.Get("b")
+	assert.True(t, ok)
+
+	clock.Advance(5 * time.Second)
+	_, ok = c.Get("b")
+	assert.False(t, ok)
+	assert.Equal(t, 0, c.Len())
+	assert.Equal(t, uint(0), c.Weight())
+}
+
+func TestCache_AddRestartsTTL(t *testing.T) {
+	c, clock := newTestCache(t, 10*time.Second, nil)
+	c.Add("a", 1, 1)
+	clock.Advance(8 * time.Second)
+	c.Add("a", 2, 1)
+	clock.Advance(8 * time.Second)
+	assert.Equal(t, 0, c.Expire())
+	v, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 2, v)
+}
+
+func TestCache_ExpireReclaimsExpiredEntries(t *testing.T) {
+	var evicted []interface{}
+	c, clock := newTestCache(t, 10*time.Second, func(key, value interface{}) {
+		evicted = append(evicted, key)
+	})
+	for i := 0; i < 10; i++ {
+		c.Add(i, i, 1)
+		clock.Advance(time.Second)
+	}
+	assert.Equal(t, 1, c.Expire())
+
+	clock.Advance(3500 * time.Millisecond)
+	assert.Equal(t, 3, c.Expire())
+	assert.Equal(t, []interface{}{0, 1, 2, 3}, evicted)
+	assert.Equal(t, 6, c.Len())
+
+	assert.True(t, c.Remove(5))
+	clock.Advance(time.Hour)
+	assert.Equal(t, 5, c.Expire())
+	assert.Equal(t, 0, c.Len())
+	assert.Equal(t, 0, c.wheel.len)
+}
+
+func TestCache_RemoveExpired(t *testing.T) {
+	var expired []interface{}
+	c, clock := newTestCache(t, NoExpiry, nil, WithExpireCallback(func(key, value interface{}) {
+		expired = append(expired, key)
+	}))
+	start := clock.Now()
+	c.AddWithTTL("a", 1, 1, 1500*time.Millisecond)
+	c.AddWithTTL("b", 2, 1, 1700*time.Millisecond)
+	c.AddWithTTL("c", 3, 1, time.Minute)
+	c.Add("d", 4, 1)
+
+	assert.Equal(t, 0, c.RemoveExpired(start.Add(time.Second)))
+	assert.Equal(t, 1, c.RemoveExpired(start.Add(1600*time.Millisecond)), "expiry within a tick is precise")
+	assert.Equal(t, []interface{}{"a"}, expired)
+	assert.Equal(t, 2, c.RemoveExpired(start.Add(time.Hour)))
+	assert.Equal(t, 0, c.RemoveExpired(start.Add(time.Hour)))
+	assert.Equal(t, []interface{}{"a", "b", "c"}, expired)
+	assert.Equal(t, []interface{}{"d"}, c.lru.Keys())
+}
+
+func TestCache_RemoveExpiredAheadOfClock(t *testing.T) {
+	c, clock := newTestCache(t, 10*time.Second, nil)
+	start := clock.Now()
+	assert.Equal(t, 0, c.RemoveExpired(start.Add(time.Hour)))
+	c.Add("a", 1, 1)
+	c.AddWithTTL("b", 2, 1, 2*time.Hour)
+
+	clock.Advance(5 * time.Second)
+	assert.Equal(t, 0, c.Expire())
+	assert.Equal(t, 0, c.RemoveExpired(clock.Now()))
+	assert.True(t, c.Contains("a"))
+
+	clock.Advance(5 * time.Second)
+	assert.Equal(t, 1, c.Expire(), "entries added after the wheel ran ahead still expire on time")
+	assert.False(t, c.Contains("a"))
+	assert.True(t, c.Contains("b"))
+
+	clock.Advance(2 * time.Hour)
+	assert.Equal(t, 1, c.Expire())
+	assert.Equal(t, 0, c.wheel.len)
+}
+
+func TestCache_RemoveExpiredWithLazyExpiration(t *testing.T) {
+	c, clock := newTestCache(t, 10*time.Second, nil, WithLazyExpiration())
+	c.Add("a", 1, 1)
+	c.Add("b", 2, 1)
+	clock.Advance(5 * time.Second)
+	c.Add("c", 3, 1)
+	assert.Equal(t, 2, c.RemoveExpired(clock.Now().Add(5*time.Second)))
+	assert.Equal(t, []interface{}{"c"}, c.lru.Keys())
+}
+
+func TestCache_CapacityEvictionCancelsExpiry(t *testing.T) {
+	c, clock := newTestCache(t, time.Minute, nil)
+	c.lru.Resize(2, 2)
+	c.Add("a", 1, 1)
+	c.Add("b", 2, 1)
+	assert.Equal(t, 1, c.Add("c", 3, 1))
+	assert.Equal(t, 2, c.wheel.len)
+
+	c.Purge()
+	assert.Equal(t, 0, c.wheel.len)
+	clock.Advance(time.Hour)
+	assert.Equal(t, 0, c.Expire())
+}
+
+func TestCache_RejectedEntryDoesNotExpireLaterEntry(t *testing.T) {
+	c, clock := newTestCache(t, time.Second, nil)
+	assert.Equal(t, 0, c.Add("a", 1, 1000), "too heavy entries are rejected")
+	assert.False(t, c.Contains("a"))
+	c.AddWithTTL("a", 2, 1, NoExpiry)
+
+	clock.Advance(5 * time.Second)
+	assert.Equal(t, 0, c.Expire())
+	value, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 2, value)
+}
+
+func TestCache_JanitorRemovesExpiredEntries(t *testing.T) {
+	c, err := New(100, 100, 10*time.Millisecond, WithTick(time.Millisecond), WithSweepLimit(2))
+	require.NoError(t, err)
+	_, err = New(100, 100, time.Second, WithSweepLimit(0))
+	assert.Error(t, err)
+	assert.Error(t, c.StartJanitor(0))
+
+	for i := 0; i < 5; i++ {
+		c.Add(i, i, 1)
+	}
+	require.NoError(t, c.StartJanitor(time.Millisecond))
+	assert.Error(t, c.StartJanitor(time.Millisecond))
+	assert.Eventually(t, func() bool { return c.Len() == 0 }, time.Second, time.Millisecond)
+	c.StopJanitor()
+	c.StopJanitor()
+
+	c.Add("a", 1, 1)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 1, c.Len(), "stopped janitor must not remove entries")
+}
+
+func TestCache_SweepLimitBoundsEachSweep(t *testing.T) {
+	c, clock := newTestCache(t, time.Second, nil, WithSweepLimit(3))
+	for i := 0; i < 5; i++ {
+		c.Add(i, i, 1)
+	}
+	clock.Advance(time.Minute)
+	assert.Equal(t, 3, c.expire(c.sweepLimit))
+	assert.Equal(t, 2, c.expire(c.sweepLimit))
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestCache_LazyExpiration(t *testing.T) {
+	var evicted []interface{}
+	c, clock := newTestCache(t, 10*time.Second, func(key, value interface{}) {
+		evicted = append(evicted, key)
+	}, WithLazyExpiration())
+	assert.Error(t, c.StartJanitor(time.Second))
+
+	c.Add("a", 1, 1)
+	c.Add("b", 2, 1)
+	clock.Advance(5 * time.Second)
+	c.Add("c", 3, 1)
+	assert.Equal(t, 0, c.wheel.len)
+
+	clock.Advance(5 * time.Second)
+	assert.Equal(t, 0, c.Expire())
+	assert.Equal(t, 3, c.Len())
+
+	// Adding reclaims expired entries from the least recently used end.
+	c.Add("d", 4, 1)
+	assert.Equal(t, []interface{}{"a", "b"}, evicted)
+	assert.Equal(t, []interface{}{"c", "d"}, c.lru.Keys())
+
+	clock.Advance(5 * time.Second)
+	_, ok := c.Get("c")
+	assert.False(t, ok)
+	assert.Equal(t, 1, c.Len())
+}
+
+func TestCache_TTLJitter(t *testing.T) {
+	for _, fraction := range []float64{-0.1, 1, 2} {
+		_, err := New(10, 10, time.Second, WithTTLJitter(fraction))
+		assert.Error(t, err, fraction)
+	}
+
+	c, clock := newTestCache(t, 100*time.Second, nil, WithTTLJitter(0.2))
+	expiries := map[time.Time]bool{}
+	for i := 0; i < 100; i++ {
+		c.Add(i, i, 1)
+		v, _ := c.lru.Peek(i)
+		expiresAt := v.(*item).expiresAt
+		assert.False(t, expiresAt.Before(clock.Now().Add(80*time.Second)))
+		assert.False(t, expiresAt.After(clock.Now().Add(120*time.Second)))
+		expiries[expiresAt] = true
+	}
+	assert.Greater(t, len(expiries), 1)
+
+	clock.Advance(80 * time.Second)
+	assert.Equal(t, 100, c.Len())
+	clock.Advance(40 * time.Second)
+	assert.Equal(t, 100, c.Expire())
+}
+
+func TestCache_AddWithTTLOverridesCacheTTL(t *testing.T) {
+	c, clock := newTestCache(t, 10*time.Second, nil)
+	c.Add("default", 1, 1)
+	c.AddWithTTL("short", 2, 1, time.Second)
+	c.AddWithTTL("long", 3, 1, time.Minute)
+	c.AddWithTTL("forever", 4, 1, NoExpiry)
+	assert.Equal(t, 3, c.wheel.len)
+
+	clock.Advance(time.Second)
+	assert.Equal(t, 1, c.Expire())
+	clock.Advance(9 * time.Second)
+	assert.Equal(t, 1, c.Expire())
+	clock.Advance(time.Minute)
+	assert.Equal(t, 1, c.Expire())
+	clock.Advance(24 * time.Hour)
+	assert.Equal(t, 0, c.Expire())
+	assert.True(t, c.Contains("forever"))
+
+	// Re-adding with a TTL makes the entry expire again.
+	c.AddWithTTL("forever", 4, 1, DefaultTTL)
+	clock.Advance(10 * time.Second)
+	assert.Equal(t, 1, c.Expire())
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestCache_NoExpiryByDefault(t *testing.T) {
+	_, err := New(10, 10, 0)
+	assert.Error(t, err)
+
+	c, clock := newTestCache(t, NoExpiry, nil, WithLazyExpiration())
+	c.Add("a", 1, 1)
+	c.AddWithTTL("b", 2, 1, time.Second)
+	clock.Advance(time.Hour)
+	assert.True(t, c.Contains("a"))
+	assert.False(t, c.Contains("b"))
+	_, ok := c.Get("b")
+	assert.False(t, ok)
+	assert.Equal(t, 1, c.Len())
+}
+
+func TestCache_ExpireAfterAccess(t *testing.T) {
+	_, err := New(10, 10, NoExpiry, WithExpireAfterAccess(0))
+	assert.Error(t, err)
+
+	c, clock := newTestCache(t, NoExpiry, nil, WithExpireAfterAccess(10*time.Second))
+	c.Add("read", 1, 1)
+	c.Add("peeked", 2, 1)
+	c.Add("idle", 3, 1)
+	for i := 0; i < 5; i++ {
+		clock.Advance(5 * time.Second)
+		_, ok := c.Get("read")
+		assert.True(t, ok)
+		if i == 0 {
+			_, ok = c.Peek("peeked")
+			assert.True(t, ok)
+		}
+	}
+	assert.Equal(t, 2, c.Expire())
+	assert.Equal(t, []interface{}{"read"}, c.lru.Keys())
+}
+
+func TestCache_ExpireAfterWriteOrAccess(t *testing.T) {
+	c, clock := newTestCache(t, 30*time.Second, nil, WithExpireAfterAccess(10*time.Second), WithLazyExpiration())
+	c.Add("read", 1, 1)
+	c.Add("idle", 2, 1)
+	for i := 0; i < 5; i++ {
+		clock.Advance(5 * time.Second)
+		_, ok := c.Get("read")
+		assert.True(t, ok)
+		if i == 1 {
+			assert.False(t, c.Contains("idle"), "idle period ends first")
+		}
+	}
+	// The write TTL ends first for entries read frequently.
+	clock.Advance(5 * time.Second)
+	_, ok := c.Get("read")
+	assert.False(t, ok)
+}
+
+func TestCache_AdaptiveTTL(t *testing.T) {
+	for _, factors := range [][2]float64{{0, 2}, {1.5, 2}, {0.5, 0.9}} {
+		_, err := New(10, 10, time.Second, WithAdaptiveTTL(factors[0], factors[1]))
+		assert.Error(t, err, "factors %v", factors)
+	}
+
+	c, clock := newTestCache(t, 10*time.Second, nil, WithAdaptiveTTL(0.5, 4))
+	start := clock.Now()
+	c.Add("hot", 1, 1)
+	c.Add("cold", 2, 1)
+	_, expiresAt, ok := c.GetWithExpiry("hot")
+	assert.True(t, ok)
+	assert.Equal(t, start.Add(10*time.Second), expiresAt)
+
+	clock.Advance(5 * time.Second)
+	assert.False(t, c.Contains("cold"), "unread entries expire early")
+	for i := 0; i < 3; i++ {
+		_, expiresAt, _ = c.GetWithExpiry("hot")
+	}
+	assert.Equal(t, start.Add(40*time.Second), expiresAt, "the extension is capped")
+
+	// Rewriting keeps the reads.
+	c.Add("hot", 3, 1)
+	_, expiresAt, _ = c.GetWithExpiry("hot")
+	assert.Equal(t, clock.Now().Add(40*time.Second), expiresAt)
+	clock.Advance(40 * time.Second)
+	assert.Equal(t, 2, c.Expire())
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestCache_GetWithExpiry(t *testing.T) {
+	c, clock := newTestCache(t, time.Minute, nil, WithExpireAfterAccess(20*time.Second))
+	start := clock.Now()
+	c.Add("a", 1, 1)
+	c.AddWithTTL("b", 2, 1, time.Second)
+
+	v, expiresAt, ok := c.GetWithExpiry("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+	assert.Equal(t, start.Add(20*time.Second), expiresAt)
+
+	// Reading restarts the idle period, capped by the write TTL.
+	clock.Advance(10 * time.Second)
+	_, expiresAt, _ = c.GetWithExpiry("a")
+	assert.Equal(t, start.Add(30*time.Second), expiresAt)
+	clock.Advance(15 * time.Second)
+	_, expiresAt, _ = c.GetWithExpiry("a")
+	assert.Equal(t, start.Add(45*time.Second), expiresAt)
+	clock.Advance(18 * time.Second)
+	_, expiresAt, _ = c.GetWithExpiry("a")
+	assert.Equal(t, start.Add(time.Minute), expiresAt)
+	_, _, ok = c.GetWithExpiry("b")
+	assert.False(t, ok)
+	_, _, ok = c.GetWithExpiry("missing")
+	assert.False(t, ok)
+
+	c2, _ := newTestCache(t, NoExpiry, nil)
+	c2.Add("a", 1, 1)
+	_, expiresAt, ok = c2.GetWithExpiry("a")
+	assert.True(t, ok)
+	assert.True(t, expiresAt.IsZero())
+}
+
+func TestCache_SetTTL(t *testing.T) {
+	c, clock := newTestCache(t, 10*time.Second, nil)
+	start := clock.Now()
+	c.Add("a", 1, 1)
+	c.Add("b", 2, 1)
+	c.Add("c", 3, 1)
+
+	assert.True(t, c.SetTTL("a", time.Minute))
+	assert.True(t, c.SetTTL("b", NoExpiry))
+	assert.True(t, c.SetTTL("c", time.Second))
+	assert.False(t, c.SetTTL("missing", time.Second))
+	assert.Equal(t, []interface{}{"a", "b", "c"}, c.lru.Keys(), "recency is unchanged")
+
+	clock.Advance(time.Second)
+	assert.False(t, c.SetTTL("c", time.Minute), "expired entries cannot be revived")
+	clock.Advance(time.Hour)
+	assert.Equal(t, 1, c.Expire())
+	_, expiresAt, ok := c.GetWithExpiry("b")
+	assert.True(t, ok)
+	assert.True(t, expiresAt.IsZero())
+
+	assert.True(t, c.SetTTL("b", DefaultTTL))
+	_, expiresAt, _ = c.GetWithExpiry("b")
+	assert.Equal(t, start.Add(time.Hour+11*time.Second), expiresAt)
+}
+
+func TestCache_ExtendTTL(t *testing.T) {
+	c, clock := newTestCache(t, 10*time.Second, nil)
+	c.Add("a", 1, 1)
+	c.AddWithTTL("forever", 2, 1, NoExpiry)
+
+	clock.Advance(8 * time.Second)
+	assert.True(t, c.ExtendTTL("a", 5*time.Second))
+	assert.True(t, c.ExtendTTL("forever", 5*time.Second))
+	assert.False(t, c.ExtendTTL("missing", 5*time.Second))
+	clock.Advance(5 * time.Second)
+	assert.Equal(t, 0, c.Expire())
+	clock.Advance(2 * time.Second)
+	assert.Equal(t, 1, c.Expire())
+	assert.True(t, c.Contains("forever"))
+}
+
+func TestCache_ExpireCallback(t *testing.T) {
+	var evicted, expired []interface{}
+	c, clock := newTestCache(t, 10*time.Second, func(key, value interface{}) {
+		evicted = append(evicted, key)
+	}, WithExpireCallback(func(key, value interface{}) {
+		expired = append(expired, key)
+	}))
+	c.lru.Resize(100, 3)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		c.Add(key, key, 1)
+	}
+	c.Remove("b")
+	clock.Advance(10 * time.Second)
+	_, ok := c.Get("c")
+	assert.False(t, ok)
+	assert.Equal(t, 1, c.Expire())
+
+	assert.Equal(t, []interface{}{"a", "b"}, evicted)
+	assert.Equal(t, []interface{}{"c", "d"}, expired)
+}
+
+func TestCache_CloseStopsJanitor(t *testing.T) {
+	c, _ := newTestCache(t, 10*time.Second, nil)
+	c.Add("a", 1, 1)
+	require.NoError(t, c.StartJanitor(time.Minute))
+	require.NoError(t, c.Close())
+
+	assert.ErrorIs(t, c.StartJanitor(time.Minute), cacheutils.ErrClosed)
+	assert.ErrorIs(t, c.Close(), cacheutils.ErrClosed)
+	value, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, value)
+}
+
+func TestCache_TryAdd(t *testing.T) {
+	c, _ := newTestCache(t, 10*time.Second, nil)
+	_, err := c.TryAdd("a", 1, 1)
+	require.NoError(t, err)
+	_, err = c.TryAdd("a", 2, 1000)
+	assert.ErrorIs(t, err, cacheutils.ErrEntryTooLarge)
+	assert.False(t, c.Contains("a"))
+}
+
+func TestCache_CloseRejectsWrites(t *testing.T) {
+	c, _ := newTestCache(t, 10*time.Second, nil)
+	c.Add("a", 1, 1)
+	c.Add("e", 5, 1)
+	require.NoError(t, c.Close())
+
+	_, err := c.TryAdd("b", 2, 1)
+	assert.ErrorIs(t, err, cacheutils.ErrClosed)
+	assert.Equal(t, 0, c.Add("c", 3, 1))
+	assert.Equal(t, 0, c.AddWithTTL("d", 4, 1, time.Minute))
+	assert.Equal(t, 2, c.Len())
+
+	// Expiry is not changed.
+	_, expiresAt, _ := c.GetWithExpiry("a")
+	assert.False(t, c.SetTTL("a", time.Hour))
+	assert.False(t, c.ExtendTTL("a", time.Hour))
+	_, after, _ := c.GetWithExpiry("a")
+	assert.Equal(t, expiresAt, after)
+
+	// Entries may still be read and removed, including by expiry.
+	value, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, value)
+	assert.True(t, c.Remove("e"))
+	assert.Equal(t, 0, c.Expire())
+	assert.Equal(t, 1, c.RemoveExpired(expiresAt.Add(time.Second)))
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestCache_JanitorFollowsClock(t *testing.T) {
+	c, fake := newTestCache(t, 10*time.Second, nil)
+	c.Add("a", 1, 1)
+	require.NoError(t, c.StartJanitor(time.Minute))
+	defer c.StopJanitor()
+
+	fake.Advance(30 * time.Second)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 1, c.Len(), "janitor has not run yet")
+	fake.Advance(30 * time.Second)
+	assert.Eventually(t, func() bool { return c.Len() == 0 }, time.Second, time.Millisecond)
+}
@@ -0,0 +1,144 @@
+package ttlcache
+
+// The timing wheel has wheelLevels levels of wheelSlots slots each. Level l
+// holds the timers due within wheelSlots^(l+1) ticks, in slots spanning
+// wheelSlots^l ticks. Whenever a level wraps around, the next slot of the
+// level above is cascaded, redistributing its timers to the lower levels.
+// Scheduling and cancelling a timer is O(1), and every timer is moved at most
+// once per level before it expires.
+const (
+	wheelBits   = 6
+	wheelSlots  = 1 << wheelBits
+	wheelMask   = wheelSlots - 1
+	wheelLevels = 5
+	// wheelSpan is the number of ticks covered by the wheel. Timers due
+	// later are parked in the last slot of the top level until they come
+	// into range.
+	wheelSpan = 1 << (wheelBits * wheelLevels)
+)
+
+// timer tracks the expiry of a cache entry in the timing wheel.
+type timer struct {
+	next, prev *timer
+	key        interface{}
+	expires    int64 // tick at which the timer is due
+}
+
+// scheduled reports whether the timer is in the wheel.
+func (t *timer) scheduled() bool {
+	return t.next != nil
+}
+
+// wheel is a hierarchical timing wheel.
+type wheel struct {
+	slots [wheelLevels][wheelSlots]timer // sentinels of the slot lists
+	tick  int64                          // last tick advanced to
+	len   int
+}
+
+func (w *wheel) init(tick int64) {
+	w.tick = tick
+	w.len = 0
+	for l := range w.slots {
+		for s := range w.slots[l] {
+			root := &w.slots[l][s]
+			root.next, root.prev = root, root
+		}
+	}
+}
+
+// add schedules the timer. Timers already due expire on the next tick.
+func (w *wheel) add(t *timer) {
+	w.place(t, max(t.expires, w.tick+1))
+}
+
+// place puts the timer in the slot covering the given due tick, which must
+// not be before the current tick.
+func (w *wheel) place(t *timer, due int64) {
+	delta := due - w.tick
+	if delta >= wheelSpan {
+		due = w.tick + wheelSpan - 1
+		delta = wheelSpan - 1
+	}
+	level := 0
+	for delta >= 1<<(wheelBits*(level+1)) {
+		level++
+	}
+	root := &w.slots[level][(due>>(wheelBits*level))&wheelMask]
+	t.prev, t.next = root.prev, root
+	root.prev.next = t
+	root.prev = t
+	w.len++
+}
+
+// remove cancels the timer if it is scheduled.
+func (w *wheel) remove(t *timer) {
+	if !t.scheduled() {
+		return
+	}
+	t.prev.next = t.next
+	t.next.prev = t.prev
+	t.next, t.prev = nil, nil
+	w.len--
+}
+
+// advance moves the wheel forward to the given tick, passing every timer
+// which became due to expire after removing it from the wheel. expire
+// reports whether the timer expired; a timer which did not may be added
+// again. If limit is positive, advance stops after expiring limit timers;
+// the next call resumes where it left off. Returns the number of expired
+// timers.
+func (w *wheel) advance(tick int64, limit int, expire func(*timer) bool) (expired int) {
+	for {
+		// The level 0 slot of the current tick only holds timers left over
+		// by a previous call stopping early.
+		root := &w.slots[0][w.tick&wheelMask]
+		for root.next != root {
+			if limit > 0 && expired >= limit {
+				return expired
+			}
+			t := root.next
+			w.remove(t)
+			if expire(t) {
+				expired++
+			}
+		}
+		if w.tick >= tick {
+			return expired
+		}
+		if w.len == 0 {
+			w.tick = tick
+			return expired
+		}
+		w.tick++
+		level := 0
+		for level < wheelLevels-1 && w.tick&(1<<(wheelBits*(level+1))-1) == 0 {
+			level++
+		}
+		// Cascade from the top, as higher levels may refill the slots of
+		// lower levels being cascaded in this tick.
+		for ; level > 0; level-- {
+			w.cascade(&w.slots[level][(w.tick>>(wheelBits*level))&wheelMask])
+		}
+	}
+}
+
+// dueNext returns the keys of the timers due at the tick after the current
+// one, which share a level 0 slot.
+func (w *wheel) dueNext() (keys []interface{}) {
+	root := &w.slots[0][(w.tick+1)&wheelMask]
+	for t := root.next; t != root; t = t.next {
+		keys = append(keys, t.key)
+	}
+	return keys
+}
+
+// cascade reschedules the timers of a slot relative to the current tick.
+// Timers due at the current tick land in the level 0 slot expired next.
+func (w *wheel) cascade(root *timer) {
+	for root.next != root {
+		t := root.next
+		w.remove(t)
+		w.place(t, max(t.expires, w.tick))
+	}
+}
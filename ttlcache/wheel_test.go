@@ -0,0 +1,103 @@
+package ttlcache
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWheel_ExpiresTimersOnTheirTick(t *testing.T) {
+	var w wheel
+	w.init(100)
+	rnd := rand.New(rand.NewSource(1))
+	timers := make([]*timer, 2000)
+	for i := range timers {
+		timers[i] = &timer{key: i, expires: 101 + rnd.Int63n(1<<(wheelBits*3))}
+		w.add(timers[i])
+	}
+	require.Equal(t, len(timers), w.len)
+
+	fired := map[interface{}]int64{}
+	for w.len > 0 {
+		w.advance(w.tick+1+rnd.Int63n(100), 0, func(tm *timer) bool {
+			assert.False(t, tm.scheduled())
+			fired[tm.key] = w.tick
+			return true
+		})
+	}
+	require.Len(t, fired, len(timers))
+	for _, tm := range timers {
+		assert.Equal(t, tm.expires, fired[tm.key], "timer %v", tm.key)
+	}
+}
+
+func TestWheel_DueTimersExpireOnNextTick(t *testing.T) {
+	var w wheel
+	w.init(10)
+	tm := &timer{key: "a", expires: 3}
+	w.add(tm)
+	var fired []int64
+	w.advance(11, 0, func(*timer) bool {
+		fired = append(fired, w.tick)
+		return true
+	})
+	assert.Equal(t, []int64{11}, fired)
+}
+
+func TestWheel_RemoveCancelsTimer(t *testing.T) {
+	var w wheel
+	w.init(0)
+	a, b := &timer{key: "a", expires: 5000}, &timer{key: "b", expires: 5000}
+	w.add(a)
+	w.add(b)
+	w.remove(a)
+	w.remove(a)
+	assert.Equal(t, 1, w.len)
+
+	var fired []interface{}
+	w.advance(5000, 0, func(tm *timer) bool {
+		fired = append(fired, tm.key)
+		return true
+	})
+	assert.Equal(t, []interface{}{"b"}, fired)
+	assert.Equal(t, 0, w.len)
+}
+
+func TestWheel_ParksTimersBeyondSpan(t *testing.T) {
+	var w wheel
+	w.init(0)
+	tm := &timer{key: "far", expires: 3 * wheelSpan}
+	w.add(tm)
+	assert.True(t, w.slots[wheelLevels-1][wheelMask].next == tm)
+
+	// Advancing an empty wheel jumps straight to the target tick.
+	w.remove(tm)
+	w.advance(wheelSpan, 0, func(*timer) bool {
+		t.Fatal("unexpected expiry")
+		return true
+	})
+	assert.Equal(t, int64(wheelSpan), w.tick)
+}
+
+func TestWheel_AdvanceResumesAfterLimit(t *testing.T) {
+	var w wheel
+	w.init(0)
+	for i := 0; i < 5; i++ {
+		w.add(&timer{key: i, expires: 10})
+	}
+	w.add(&timer{key: 5, expires: 12})
+
+	var fired []interface{}
+	record := func(tm *timer) bool {
+		fired = append(fired, tm.key)
+		return true
+	}
+	assert.Equal(t, 2, w.advance(20, 2, record))
+	assert.Equal(t, int64(10), w.tick)
+	assert.Equal(t, 3, w.advance(20, 3, record))
+	assert.Equal(t, 1, w.advance(20, 3, record))
+	assert.Equal(t, []interface{}{0, 1, 2, 3, 4, 5}, fired)
+	assert.Equal(t, int64(20), w.tick)
+}
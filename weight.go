@@ -0,0 +1,13 @@
+package cacheutils
+
+import "fmt"
+
+// IntWeight converts an entry weight computed as an int, e.g. from the
+// length of a slice, to the weight type of the caches. Negative weights are
+// rejected with ErrInvalidWeight rather than wrapping around to huge ones.
+func IntWeight(n int) (uint, error) {
+	if n < 0 {
+		return 0, fmt.Errorf("%w: negative weight %d", ErrInvalidWeight, n)
+	}
+	return uint(n), nil
+}
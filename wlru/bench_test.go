@@ -17,6 +17,25 @@ func BenchmarkWeightedCache_Add(b *testing.B) {
 	}
 }
 
+func BenchmarkWeightedCache_AddParallel(b *testing.B) {
+	cache, _ := New(5000, 1000)
+	benchmarkAddParallel(b, cache)
+}
+
+func BenchmarkWeightedCache_AddParallelBuffered(b *testing.B) {
+	cache, _ := New(5000, 1000, WithWriteBuffer(1024))
+	benchmarkAddParallel(b, cache)
+	cache.Wait()
+}
+
+func benchmarkAddParallel(b *testing.B, cache *Cache) {
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			cache.Add(i%2000, i, 5)
+		}
+	})
+}
+
 func BenchmarkCache_Add(b *testing.B) {
 	cache, _ := lru.New(1000)
 	data := make([]int, 1000)
@@ -40,6 +59,28 @@ func BenchmarkWeightedCache_Get(b *testing.B) {
 	}
 }
 
+func BenchmarkWeightedCache_GetParallel(b *testing.B) {
+	cache, _ := New(5000, 1000)
+	benchmarkGetParallel(b, cache)
+}
+
+func BenchmarkWeightedCache_GetParallelBuffered(b *testing.B) {
+	cache, _ := New(5000, 1000, WithReadBuffer(64))
+	benchmarkGetParallel(b, cache)
+}
+
+func benchmarkGetParallel(b *testing.B, cache *Cache) {
+	for i := 0; i < 1000; i++ {
+		cache.Add(i, i, 5)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			cache.Get(i % 2000)
+		}
+	})
+}
+
 func BenchmarkCache_Get(b *testing.B) {
 	cache, _ := lru.New(1000)
 	data := make([]int, 1000)
@@ -51,3 +92,51 @@ func BenchmarkCache_Get(b *testing.B) {
 		cache.Get(i % (len(data) * 2))
 	}
 }
+
+// BenchmarkWeightedCache_PeekUnderWrites measures Peek, served from the
+// published values, while a writer keeps adding. Compare to
+// BenchmarkWeightedCache_LockedPeekUnderWrites, which reads the shard under
+// its lock as Peek did before values were published.
+func BenchmarkWeightedCache_PeekUnderWrites(b *testing.B) {
+	benchmarkPeekUnderWrites(b, func(cache *Cache, key int) {
+		cache.Peek(key)
+	})
+}
+
+func BenchmarkWeightedCache_LockedPeekUnderWrites(b *testing.B) {
+	benchmarkPeekUnderWrites(b, func(cache *Cache, key int) {
+		s := cache.shard(key)
+		s.lock.RLock()
+		s.lru.Peek(key)
+		s.lock.RUnlock()
+	})
+}
+
+func benchmarkPeekUnderWrites(b *testing.B, peek func(cache *Cache, key int)) {
+	cache, _ := New(5000, 1000)
+	for i := 0; i < 1000; i++ {
+		cache.Add(i, i, 5)
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+				cache.Add(i%2000, i, 5)
+			}
+		}
+	}()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			peek(cache, i%2000)
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	<-done
+}
@@ -0,0 +1,290 @@
+package wlru
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/0xsoniclabs/cacheutils"
+)
+
+// maxWriteBatch bounds the number of buffered writes applied while holding a
+// shard lock, so that readers are not starved by a busy writer.
+const maxWriteBatch = 256
+
+// writeBuffer queues the writes of a cache created WithWriteBuffer, which are
+// applied in batches by a background goroutine. The goroutine is started on
+// demand and exits once the buffer is drained.
+type writeBuffer struct {
+	writes  chan bufferedWrite
+	running atomic.Bool
+
+	lock      sync.Mutex
+	closed    bool            // writes are no longer buffered
+	notifying bool            // the applier is running eviction callbacks
+	overflow  []bufferedWrite // writes queued behind the channel, see send
+	sending   sync.WaitGroup  // writes blocked on the full channel
+}
+
+// bufferedWrite is either an entry to add or, if done is set, a marker
+// closing done once all writes queued before it have been applied.
+type bufferedWrite struct {
+	key, value interface{}
+	weight     uint
+	done       chan struct{}
+}
+
+// enqueue queues a write, blocking while the buffer is full, and makes sure
+// it will be applied. Returns false, without queuing the write, once the
+// cache is closed.
+func (c *Cache) enqueue(w bufferedWrite) bool {
+	b := c.buffer
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return false
+	}
+	c.send(w)
+	return true
+}
+
+// send queues a write and makes sure it will be applied. It must be called
+// while holding the buffer lock, which it releases. While the channel is
+// full, writes wait for room, unless the applier is running eviction
+// callbacks: these may add values themselves and cannot wait for the applier,
+// so the write is appended to the overflow instead. Once the overflow holds
+// writes, later ones are appended to it as well to keep them in order.
+func (c *Cache) send(w bufferedWrite) {
+	b := c.buffer
+	if len(b.overflow) == 0 {
+		select {
+		case b.writes <- w:
+			b.lock.Unlock()
+			c.startApplier()
+			return
+		default:
+		}
+	}
+	if len(b.overflow) > 0 || b.notifying {
+		b.overflow = append(b.overflow, w)
+		b.lock.Unlock()
+		c.startApplier()
+		return
+	}
+	b.sending.Add(1)
+	b.lock.Unlock()
+	b.writes <- w
+	b.sending.Done()
+	c.startApplier()
+}
+
+// startApplier starts the goroutine applying the buffered writes unless it
+// is running.
+func (c *Cache) startApplier() {
+	if c.buffer.running.CompareAndSwap(false, true) {
+		go c.applyWrites()
+	}
+}
+
+// applyWrites applies buffered writes until the buffer is empty.
+func (c *Cache) applyWrites() {
+	b := c.buffer
+	for {
+		c.applyBatch()
+		b.running.Store(false)
+		// A write enqueued after the buffer was seen empty may have missed
+		// the running flag.
+		if len(b.writes) == 0 && !b.overflows() || !b.running.CompareAndSwap(false, true) {
+			return
+		}
+	}
+}
+
+// overflows reports whether writes are waiting in the overflow.
+func (b *writeBuffer) overflows() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.overflow) > 0
+}
+
+// takeOverflow removes and returns the writes waiting in the overflow.
+func (b *writeBuffer) takeOverflow() []bufferedWrite {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	overflow := b.overflow
+	b.overflow = nil
+	return overflow
+}
+
+// setNotifying records whether the applier is running eviction callbacks.
+func (b *writeBuffer) setNotifying(notifying bool) {
+	b.lock.Lock()
+	b.notifying = notifying
+	b.lock.Unlock()
+}
+
+// applyBatch applies buffered writes until the channel and the overflow are
+// empty, keeping the lock of a shard across consecutive writes to it. The
+// overflow is only taken once the channel is empty, as its writes were
+// queued after those in the channel.
+func (c *Cache) applyBatch() {
+	var s *shard
+	batch := 0
+	release := func() {
+		if s != nil {
+			s.publish()
+			c.buffer.setNotifying(true)
+			c.unlock(s)
+			c.buffer.setNotifying(false)
+			s, batch = nil, 0
+		}
+	}
+	apply := func(w bufferedWrite) {
+		if w.done != nil {
+			release()
+			close(w.done)
+			return
+		}
+		if next := c.shard(w.key); next != s || batch == maxWriteBatch {
+			release()
+			s = next
+			s.lock.Lock()
+		}
+		c.add(s, w.key, w.value, w.weight)
+		batch++
+	}
+	for {
+		select {
+		case w := <-c.buffer.writes:
+			apply(w)
+		default:
+			overflow := c.buffer.takeOverflow()
+			if len(overflow) == 0 {
+				release()
+				return
+			}
+			for _, w := range overflow {
+				apply(w)
+			}
+		}
+	}
+}
+
+// Wait blocks until all values added and all reads recorded before the call
+// have been applied to the cache. It returns immediately for caches without
+// write or read buffers.
+func (c *Cache) Wait() {
+	if c.buffer != nil {
+		done := make(chan struct{})
+		if c.enqueue(bufferedWrite{done: done}) {
+			<-done
+		}
+	}
+	for _, s := range c.shards {
+		if s.reads != nil {
+			s.lock.Lock()
+			s.applyReads()
+			s.lock.Unlock()
+		}
+	}
+}
+
+// readBuffer records the keys read from a shard of a cache created
+// WithReadBuffer, so that their promotions can be applied in batches instead
+// of taking the shard lock on every read.
+type readBuffer struct {
+	lock  sync.Mutex
+	keys  []interface{}
+	spare []interface{} // guarded by the shard lock
+}
+
+// newReadBuffer creates a read buffer recording up to size reads.
+func newReadBuffer(size int) *readBuffer {
+	return &readBuffer{
+		keys:  make([]interface{}, 0, size),
+		spare: make([]interface{}, 0, size),
+	}
+}
+
+// recordRead records a read of key from the shard. Once the buffer is full,
+// the recorded reads are applied if the shard lock is free; otherwise further
+// reads are dropped until they are, as promotions are only a hint.
+func (s *shard) recordRead(key interface{}) {
+	r := s.reads
+	r.lock.Lock()
+	if len(r.keys) < cap(r.keys) {
+		r.keys = append(r.keys, key)
+	}
+	full := len(r.keys) == cap(r.keys)
+	r.lock.Unlock()
+	if full && s.lock.TryLock() {
+		s.applyReads()
+		s.lock.Unlock()
+	}
+}
+
+// applyReads promotes the keys of the recorded reads, in the order they were
+// read. It must be called while holding the write lock.
+func (s *shard) applyReads() {
+	r := s.reads
+	r.lock.Lock()
+	keys := r.keys
+	r.keys = r.spare
+	r.lock.Unlock()
+	for i, key := range keys {
+		s.lru.Get(key)
+		keys[i] = nil
+	}
+	r.spare = keys[:0]
+}
+
+// Close applies the buffered writes and stops buffering, so that the cache
+// starts no more goroutines. Afterwards, the cache follows the rule of
+// cacheutils.ErrClosed: TryAdd, AddWithResult, TryContainsOrAdd,
+// TryPeekOrAdd, Fill and WarmFrom fail with ErrClosed, and the other
+// operations adding or updating entries, including MergeFrom and
+// RecalculateWeights, report that nothing was added, replaced or swapped.
+// Entries may still be read and removed, including by Reap, Flush, EvictTo
+// and Resize. Closing a closed cache fails with ErrClosed.
+func (c *Cache) Close() error {
+	if !c.closed.CompareAndSwap(false, true) {
+		return cacheutils.ErrClosed
+	}
+	<-c.stopBuffering()
+	return nil
+}
+
+// Shutdown closes the cache like Close, waiting for the buffered writes to
+// be applied at most until the context is done. In that case the context's
+// error is returned and the remaining writes are applied in the background.
+func (c *Cache) Shutdown(ctx context.Context) error {
+	if !c.closed.CompareAndSwap(false, true) {
+		return cacheutils.ErrClosed
+	}
+	done := c.stopBuffering()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stopBuffering makes writes bypass the write buffer, returning a channel
+// closed once the writes buffered before have been applied.
+func (c *Cache) stopBuffering() <-chan struct{} {
+	done := make(chan struct{})
+	b := c.buffer
+	if b == nil {
+		close(done)
+		return done
+	}
+	b.lock.Lock()
+	b.closed = true
+	b.lock.Unlock()
+	// The marker must follow the writes still waiting for room.
+	b.sending.Wait()
+	b.lock.Lock()
+	c.send(bufferedWrite{done: done})
+	return done
+}
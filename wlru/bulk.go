@@ -0,0 +1,78 @@
+package wlru
+
+import (
+	"errors"
+
+	"github.com/0xsoniclabs/cacheutils"
+)
+
+// NewFromEntries creates a cache of the given size holding the given
+// entries, ordered from oldest to newest as returned by OrderedEntries, see
+// Fill.
+func NewFromEntries(maxWeight uint, maxSize int, entries []Entry, opts ...Option) (*Cache, error) {
+	c, err := New(maxWeight, maxSize, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Fill(entries); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Fill adds the given entries, ordered from oldest to newest as returned by
+// OrderedEntries or Snapshot, to the empty cache, restoring their ages and
+// costs. Each shard is filled in a single pass, see simplewlru.Cache.Fill;
+// entries not fitting into their shard are skipped without being reported
+// as evicted. Returns an error if the cache is not empty, or ErrClosed if it
+// is closed.
+func (c *Cache) Fill(entries []Entry) error {
+	if c.closed.Load() {
+		return cacheutils.ErrClosed
+	}
+	perShard := make([][]Entry, len(c.shards))
+	if len(c.shards) == 1 {
+		perShard[0] = entries
+	} else {
+		for _, e := range entries {
+			i := c.hasher.Hash(e.Key) % uint64(len(c.shards))
+			perShard[i] = append(perShard[i], e)
+		}
+	}
+	// All shards are locked, so that the cache is filled only if all of
+	// them are empty.
+	for _, s := range c.shards {
+		s.lock.Lock()
+	}
+	defer func() {
+		for _, s := range c.shards {
+			s.lock.Unlock()
+		}
+	}()
+	for _, s := range c.shards {
+		if s.lru.Len() > 0 {
+			return errors.New("can only fill an empty cache")
+		}
+	}
+	for i, s := range c.shards {
+		if err := s.lru.Fill(perShard[i]); err != nil {
+			return err
+		}
+		for _, e := range s.lru.OrderedEntries() {
+			c.publishValue(e.Key, e.Value)
+		}
+		s.publish()
+	}
+	return nil
+}
+
+// NewFromMap creates a cache of the given size holding the entries of m,
+// weighed by the weigher. Their recency order is unspecified, as is the
+// choice of entries if they exceed the limits.
+func NewFromMap(maxWeight uint, maxSize int, m map[interface{}]interface{}, weigher func(key, value interface{}) uint, opts ...Option) (*Cache, error) {
+	entries := make([]Entry, 0, len(m))
+	for key, value := range m {
+		entries = append(entries, Entry{Key: key, Value: value, Weight: weigher(key, value)})
+	}
+	return NewFromEntries(maxWeight, maxSize, entries, opts...)
+}
@@ -0,0 +1,157 @@
+package wlru
+
+import (
+	"sync"
+
+	"github.com/0xsoniclabs/cacheutils/simplewlru"
+)
+
+// Frozen is an immutable point-in-time view of the entries of a Cache,
+// created by Freeze. It can be read concurrently without locks while the
+// cache keeps changing: before the cache changes an entry for the first time
+// after the freeze, the previous value is copied into the view, so freezing
+// costs nothing up front and the view grows with the number of entries
+// touched since. A view must be released once no longer needed, as every
+// write to the cache pays for the views still held.
+type Frozen struct {
+	cache  *Cache
+	saved  sync.Map // key -> savedValue of every entry touched since the freeze
+	length int
+	weight uint
+}
+
+// savedValue is the value of a key at the time of the freeze.
+type savedValue struct {
+	value   interface{}
+	present bool
+}
+
+// Freeze returns an immutable view of the current entries of the cache. All
+// shards are locked while freezing, so the view is a consistent snapshot of
+// the whole cache. Buffered writes not yet applied are not included.
+func (c *Cache) Freeze() *Frozen {
+	f := &Frozen{cache: c}
+	c.frozenLock.Lock()
+	defer c.frozenLock.Unlock()
+	for _, s := range c.shards {
+		s.lock.Lock()
+	}
+	for _, s := range c.shards {
+		f.length += s.lru.Len()
+		f.weight = simplewlru.AddWeights(f.weight, s.lru.Weight())
+	}
+	c.setFrozen(append(c.frozenViews(), f))
+	for _, s := range c.shards {
+		s.lock.Unlock()
+	}
+	return f
+}
+
+// Release detaches the view from the cache, which then stops preserving
+// entries for it. The view must not be used afterwards.
+func (f *Frozen) Release() {
+	c := f.cache
+	c.frozenLock.Lock()
+	defer c.frozenLock.Unlock()
+	var views []*Frozen
+	for _, view := range c.frozenViews() {
+		if view != f {
+			views = append(views, view)
+		}
+	}
+	c.setFrozen(views)
+}
+
+// frozenViews returns the views currently held. The returned slice must not
+// be modified.
+func (c *Cache) frozenViews() []*Frozen {
+	if views := c.frozen.Load(); views != nil {
+		return *views
+	}
+	return nil
+}
+
+// setFrozen replaces the views currently held.
+func (c *Cache) setFrozen(views []*Frozen) {
+	if len(views) == 0 {
+		c.frozen.Store(nil)
+		return
+	}
+	c.frozen.Store(&views)
+}
+
+// preserve copies the current value of key into the frozen views which have
+// not saved it yet. It must be called while holding the lock of the shard
+// of key, before the value of key is changed.
+func (c *Cache) preserve(key interface{}) {
+	for _, f := range c.frozenViews() {
+		if _, ok := f.saved.Load(key); !ok {
+			value, present := c.values.Load(key)
+			f.saved.Store(key, savedValue{value, present})
+		}
+	}
+}
+
+// publishValue makes the value of key visible to lock-free readers.
+func (c *Cache) publishValue(key, value interface{}) {
+	c.preserve(key)
+	c.values.Store(key, value)
+}
+
+// unpublish hides key from lock-free readers.
+func (c *Cache) unpublish(key interface{}) {
+	c.preserve(key)
+	c.values.Delete(key)
+}
+
+// Get returns the value of key at the time of the freeze.
+func (f *Frozen) Get(key interface{}) (value interface{}, ok bool) {
+	// The live value is read first: a writer saves the previous value before
+	// changing it, so if the change is observed, so is the saved value.
+	value, ok = f.cache.values.Load(key)
+	if saved, found := f.saved.Load(key); found {
+		return saved.(savedValue).value, saved.(savedValue).present
+	}
+	return value, ok
+}
+
+// Contains checks if key was in the cache at the time of the freeze.
+func (f *Frozen) Contains(key interface{}) bool {
+	_, ok := f.Get(key)
+	return ok
+}
+
+// Len returns the number of entries at the time of the freeze.
+func (f *Frozen) Len() int {
+	return f.length
+}
+
+// Weight returns the total weight of the entries at the time of the freeze.
+func (f *Frozen) Weight() uint {
+	return f.weight
+}
+
+// Range calls fn for each entry of the view, in no particular order, until
+// fn returns false.
+func (f *Frozen) Range(fn func(key, value interface{}) bool) {
+	visited := make(map[interface{}]struct{}, f.length)
+	done := false
+	f.cache.values.Range(func(key, _ interface{}) bool {
+		if value, ok := f.Get(key); ok {
+			visited[key] = struct{}{}
+			done = !fn(key, value)
+		}
+		return !done
+	})
+	if done {
+		return
+	}
+	// Entries removed from the cache before the walk above reached them
+	// have been saved in the meantime.
+	f.saved.Range(func(key, saved interface{}) bool {
+		if _, ok := visited[key]; ok || !saved.(savedValue).present {
+			return true
+		}
+		return fn(key, saved.(savedValue).value)
+	})
+}
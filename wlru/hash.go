@@ -0,0 +1,155 @@
+package wlru
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/maphash"
+	"math"
+	"reflect"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Hasher maps keys to the hashes used for shard placement.
+type Hasher interface {
+	Hash(key interface{}) uint64
+}
+
+// HasherFunc is an adapter to allow the use of ordinary functions as Hasher.
+type HasherFunc func(key interface{}) uint64
+
+// Hash calls f(key).
+func (f HasherFunc) Hash(key interface{}) uint64 {
+	return f(key)
+}
+
+var (
+	seed    = maphash.MakeSeed()
+	intSeed = maphash.String(seed, "")
+)
+
+// MapHasher hashes keys using hash/maphash with a random per-process seed,
+// so shard placement cannot be predicted from outside the process. It is the
+// default hasher.
+var MapHasher Hasher = HasherFunc(func(key interface{}) uint64 {
+	return hashKey(key, intSeed, func(s string) uint64 {
+		return maphash.String(seed, s)
+	}, func(b []byte) uint64 {
+		return maphash.Bytes(seed, b)
+	})
+})
+
+// XXHasher hashes keys using xxHash64. Shard placement is deterministic
+// across processes, except for keys holding pointers or channels, which are
+// hashed by address.
+var XXHasher Hasher = HasherFunc(func(key interface{}) uint64 {
+	return hashKey(key, 0, xxhash.Sum64String, xxhash.Sum64)
+})
+
+// hashKey hashes an arbitrary comparable key consistently with ==. Integers
+// are mixed with the given seed, other keys are hashed by the bytes of their
+// value, see appendKey. It panics if the key is not comparable.
+func hashKey(key interface{}, seed uint64, hashString func(string) uint64, hashBytes func([]byte) uint64) uint64 {
+	switch k := key.(type) {
+	case string:
+		return hashString(k)
+	case int:
+		return mix(uint64(k) ^ seed)
+	case int8:
+		return mix(uint64(k) ^ seed)
+	case int16:
+		return mix(uint64(k) ^ seed)
+	case int32:
+		return mix(uint64(k) ^ seed)
+	case int64:
+		return mix(uint64(k) ^ seed)
+	case uint:
+		return mix(uint64(k) ^ seed)
+	case uint8:
+		return mix(uint64(k) ^ seed)
+	case uint16:
+		return mix(uint64(k) ^ seed)
+	case uint32:
+		return mix(uint64(k) ^ seed)
+	case uint64:
+		return mix(k ^ seed)
+	case uintptr:
+		return mix(uint64(k) ^ seed)
+	}
+	v := reflect.ValueOf(key)
+	if v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8 {
+		// Fixed-size byte arrays such as hashes and addresses.
+		b := make([]byte, v.Len())
+		reflect.Copy(reflect.ValueOf(b), v)
+		return hashBytes(b)
+	}
+	return hashBytes(appendKey(nil, v))
+}
+
+// appendKey appends an encoding of v to b such that values equal under ==
+// have equal encodings. Pointers and channels are encoded by address, not by
+// what they point to, floats by value with -0 equal to +0, and structs,
+// arrays and interfaces by their contents.
+func appendKey(b []byte, v reflect.Value) []byte {
+	switch v.Kind() {
+	case reflect.Invalid:
+		return append(b, 0)
+	case reflect.Bool:
+		if v.Bool() {
+			return append(b, 1)
+		}
+		return append(b, 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return binary.LittleEndian.AppendUint64(b, uint64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return binary.LittleEndian.AppendUint64(b, v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return appendFloat(b, v.Float())
+	case reflect.Complex64, reflect.Complex128:
+		return appendFloat(appendFloat(b, real(v.Complex())), imag(v.Complex()))
+	case reflect.String:
+		b = binary.LittleEndian.AppendUint64(b, uint64(v.Len()))
+		return append(b, v.String()...)
+	case reflect.Pointer, reflect.Chan, reflect.UnsafePointer:
+		return binary.LittleEndian.AppendUint64(b, uint64(v.Pointer()))
+	case reflect.Interface:
+		if v.IsNil() {
+			return append(b, 0)
+		}
+		// Values of different dynamic types may encode alike, which only
+		// causes a collision.
+		return appendKey(append(b, 1), v.Elem())
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			b = appendKey(b, v.Index(i))
+		}
+		return b
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			if t.Field(i).Name != "_" { // blank fields are ignored by ==
+				b = appendKey(b, v.Field(i))
+			}
+		}
+		return b
+	}
+	panic(fmt.Sprintf("wlru: hash of unhashable type %v", v.Type()))
+}
+
+// appendFloat appends the bits of f, encoding -0 as +0 since they are equal.
+func appendFloat(b []byte, f float64) []byte {
+	if f == 0 {
+		f = 0
+	}
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(f))
+}
+
+// mix is the splitmix64 finalizer, spreading sequential integers evenly.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,101 @@
+package wlru
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets is the number of buckets of a Histogram. The last bucket
+// covers everything from about 9 minutes upwards.
+const latencyBuckets = 40
+
+// Histogram counts operation latencies in power-of-two buckets.
+type Histogram struct {
+	// Buckets[0] counts operations taking less than a nanosecond, and
+	// Buckets[i] those taking from 2^(i-1) up to 2^i nanoseconds, except
+	// for the last bucket, which is unbounded.
+	Buckets [latencyBuckets]uint64
+	// Count is the total number of operations.
+	Count uint64
+	// Sum is the total time taken by all operations.
+	Sum time.Duration
+}
+
+// Mean returns the average latency, or zero if no operations were recorded.
+func (h Histogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// Quantile returns an upper bound of the latency below which the fraction q
+// of operations fall, or zero if no operations were recorded.
+func (h Histogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(h.Count))
+	var seen uint64
+	for i, n := range h.Buckets {
+		seen += n
+		if seen > rank || seen == h.Count {
+			return time.Duration(1) << i
+		}
+	}
+	return time.Duration(1) << (latencyBuckets - 1)
+}
+
+// LatencyStats holds the latency histograms of the operations of a cache.
+type LatencyStats struct {
+	Get    Histogram
+	Add    Histogram
+	Remove Histogram
+}
+
+// latencies tracks the latencies of a cache created WithLatencyTracking.
+type latencies struct {
+	get, add, remove latencyHistogram
+}
+
+// latencyHistogram is a Histogram updated concurrently.
+type latencyHistogram struct {
+	buckets [latencyBuckets]atomic.Uint64
+	sum     atomic.Int64
+}
+
+// since records the latency of an operation started at start.
+func (h *latencyHistogram) since(start time.Time) {
+	d := time.Since(start)
+	i := bits.Len64(uint64(d))
+	if i >= latencyBuckets {
+		i = latencyBuckets - 1
+	}
+	h.buckets[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+// snapshot returns the current state of the histogram. Operations recorded
+// concurrently may be partially included.
+func (h *latencyHistogram) snapshot() Histogram {
+	res := Histogram{Sum: time.Duration(h.sum.Load())}
+	for i := range h.buckets {
+		res.Buckets[i] = h.buckets[i].Load()
+		res.Count += res.Buckets[i]
+	}
+	return res
+}
+
+// Latencies returns the latency histograms of Get, Add and Remove, which
+// are only recorded for caches created WithLatencyTracking.
+func (c *Cache) Latencies() LatencyStats {
+	if c.latencies == nil {
+		return LatencyStats{}
+	}
+	return LatencyStats{
+		Get:    c.latencies.get.snapshot(),
+		Add:    c.latencies.add.snapshot(),
+		Remove: c.latencies.remove.snapshot(),
+	}
+}
@@ -0,0 +1,82 @@
+package wlru
+
+import "github.com/0xsoniclabs/cacheutils/simplewlru"
+
+// ListenerID identifies an eviction listener registered with
+// AddEvictionListener.
+type ListenerID = simplewlru.ListenerID
+
+// listener is a registered eviction listener.
+type listener struct {
+	id ListenerID
+	f  func(key interface{}, value interface{})
+}
+
+// AddEvictionListener registers f to be called for every entry leaving the
+// cache, like the eviction callback given on construction. Listeners are
+// called after that callback, in the order they were registered, and like it
+// never while holding a lock. Entries leaving the cache while f is being
+// registered may or may not be reported to it. The returned ID can be passed
+// to RemoveEvictionListener.
+func (c *Cache) AddEvictionListener(f func(key interface{}, value interface{})) ListenerID {
+	c.listenersLock.Lock()
+	defer c.listenersLock.Unlock()
+	c.lastListener++
+	listeners := append([]listener(nil), c.evictionListeners()...)
+	c.setListeners(append(listeners, listener{id: c.lastListener, f: f}))
+	return c.lastListener
+}
+
+// RemoveEvictionListener unregisters the listener with the given ID,
+// returning if it was registered. The listener may still be called for
+// entries which left the cache before it was removed.
+func (c *Cache) RemoveEvictionListener(id ListenerID) bool {
+	c.listenersLock.Lock()
+	defer c.listenersLock.Unlock()
+	var listeners []listener
+	found := false
+	for _, l := range c.evictionListeners() {
+		if l.id == id {
+			found = true
+		} else {
+			listeners = append(listeners, l)
+		}
+	}
+	c.setListeners(listeners)
+	return found
+}
+
+// evictionListeners returns the listeners currently registered. The returned
+// slice must not be modified.
+func (c *Cache) evictionListeners() []listener {
+	if listeners := c.listeners.Load(); listeners != nil {
+		return *listeners
+	}
+	return nil
+}
+
+// setListeners replaces the listeners currently registered.
+func (c *Cache) setListeners(listeners []listener) {
+	if len(listeners) == 0 {
+		c.listeners.Store(nil)
+		return
+	}
+	c.listeners.Store(&listeners)
+}
+
+// notifiesEvictions returns if entries leaving the cache need to be
+// reported.
+func (c *Cache) notifiesEvictions() bool {
+	return c.onEvicted != nil || c.listeners.Load() != nil
+}
+
+// evicted reports an entry leaving the cache to the eviction callback and
+// all listeners.
+func (c *Cache) evicted(key, value interface{}) {
+	if c.onEvicted != nil {
+		c.onEvicted(key, value)
+	}
+	for _, l := range c.evictionListeners() {
+		l.f(key, value)
+	}
+}
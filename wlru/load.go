@@ -0,0 +1,66 @@
+package wlru
+
+// load is a construction of a value by GetOrAddFunc in progress. Calls for
+// the same key wait for done.
+type load struct {
+	done  chan struct{}
+	value interface{}
+	ok    bool // whether value is set, false if the constructor panicked
+}
+
+// GetOrAddFunc looks up a key's value like Get and, on a miss, adds the value
+// returned by construct. The constructor runs without holding a lock of the
+// cache, and concurrent calls for the same key wait for it instead of
+// constructing the value again, so expensive values are only computed when
+// they are not cached, and only once. Calls for other keys, including those
+// of the same shard, are not blocked by it. If the key is added otherwise
+// while the constructor runs, that value is kept and returned instead.
+//
+// Returns the value, whether it was found rather than constructed by this
+// call, and the number of evictions. The value is never buffered, and once
+// the cache is closed, it is returned without being added. If the
+// constructor panics, waiting calls retry with their own constructor.
+func (c *Cache) GetOrAddFunc(key interface{}, construct func() (value interface{}, weight uint)) (value interface{}, found bool, evicted int) {
+	for {
+		if value, ok := c.Get(key); ok {
+			return value, true, 0
+		}
+		l := &load{done: make(chan struct{})}
+		other, loading := c.loads.LoadOrStore(key, l)
+		if !loading {
+			return c.construct(key, l, construct)
+		}
+		running := other.(*load)
+		<-running.done
+		if running.ok {
+			return running.value, true, 0
+		}
+	}
+}
+
+// construct runs the constructor of a load started by GetOrAddFunc and adds
+// its value, unless the key has been added in the meantime.
+func (c *Cache) construct(key interface{}, l *load, construct func() (interface{}, uint)) (value interface{}, found bool, evicted int) {
+	defer func() {
+		c.loads.Delete(key)
+		close(l.done)
+	}()
+	// A previous load may have completed since the lookup.
+	if value, ok := c.values.Load(key); ok {
+		l.value, l.ok = value, true
+		return value, true, 0
+	}
+	value, weight := construct()
+
+	s := c.shard(key)
+	s.lock.Lock()
+	if existing, ok := s.lru.Peek(key); ok {
+		value, found = existing, true
+	} else if !c.closed.Load() {
+		_, evicted = c.add(s, key, value, weight)
+		s.publish()
+	}
+	c.unlock(s)
+	l.value, l.ok = value, true
+	return value, found, evicted
+}
@@ -0,0 +1,173 @@
+package wlru
+
+import (
+	"github.com/0xsoniclabs/cacheutils/clock"
+	"github.com/0xsoniclabs/cacheutils/simplewlru"
+)
+
+// Option configures optional behaviour of a Cache.
+type Option func(*options)
+
+type options struct {
+	maxWeight       uint
+	maxSize         int
+	onEvicted       func(key interface{}, value interface{})
+	lru             []simplewlru.Option
+	shards          int
+	hasher          Hasher
+	initialCapacity int
+	writeBuffer     int
+	readBuffer      int
+	latencies       bool
+	hitTracking     bool
+	clock           clock.Clock
+}
+
+// WithMaxWeight sets the maximum total weight of the cache, overriding the
+// limit given to the constructor.
+func WithMaxWeight(maxWeight uint) Option {
+	return func(o *options) {
+		o.maxWeight = maxWeight
+	}
+}
+
+// WithMaxSize sets the maximum number of entries of the cache, overriding the
+// limit given to the constructor.
+func WithMaxSize(maxSize int) Option {
+	return func(o *options) {
+		o.maxSize = maxSize
+	}
+}
+
+// WithEvictCallback sets the callback called for every entry leaving the
+// cache, overriding the one given to the constructor.
+func WithEvictCallback(onEvicted func(key interface{}, value interface{})) Option {
+	return func(o *options) {
+		o.onEvicted = onEvicted
+	}
+}
+
+// WithMidpointInsertion enables MySQL-style midpoint insertion, see
+// simplewlru.WithMidpointInsertion.
+func WithMidpointInsertion(oldPercent int) Option {
+	return func(o *options) {
+		o.lru = append(o.lru, simplewlru.WithMidpointInsertion(oldPercent))
+	}
+}
+
+// WithAdmissionWindow enables a small admission window protecting the working
+// set from large sequential scans, see simplewlru.WithAdmissionWindow.
+func WithAdmissionWindow(windowPercent int) Option {
+	return func(o *options) {
+		o.lru = append(o.lru, simplewlru.WithAdmissionWindow(windowPercent))
+	}
+}
+
+// WithShards stripes the cache over n independently locked shards, reducing
+// lock contention between writers of different keys. See Cache for the
+// consistency model of operations spanning multiple shards.
+func WithShards(n int) Option {
+	return func(o *options) {
+		o.shards = n
+	}
+}
+
+// WithHasher sets the hasher used to place keys on shards. The default is
+// MapHasher. Users with adversarial or poorly distributed keys can provide
+// their own.
+func WithHasher(h Hasher) Option {
+	return func(o *options) {
+		o.hasher = h
+	}
+}
+
+// WithInitialCapacity pre-sizes the cache for n entries, see
+// simplewlru.WithInitialCapacity. The capacity is divided among the shards.
+func WithInitialCapacity(n int) Option {
+	return func(o *options) {
+		o.initialCapacity = n
+	}
+}
+
+// WithLRUK enables LRU-K eviction, see simplewlru.WithLRUK.
+func WithLRUK(k int) Option {
+	return func(o *options) {
+		o.lru = append(o.lru, simplewlru.WithLRUK(k))
+	}
+}
+
+// WithHeaviestFirst makes capacity evictions take the heaviest of the least
+// recently used entries of a shard, see simplewlru.WithHeaviestFirst.
+func WithHeaviestFirst(percent int) Option {
+	return func(o *options) {
+		o.lru = append(o.lru, simplewlru.WithHeaviestFirst(percent))
+	}
+}
+
+// WithEvictionScore makes capacity evictions take the highest-rated of the
+// least recently used entries of a shard, see simplewlru.WithEvictionScore.
+func WithEvictionScore(percent int, score simplewlru.EvictionScore) Option {
+	return func(o *options) {
+		o.lru = append(o.lru, simplewlru.WithEvictionScore(percent, score))
+	}
+}
+
+// WithZeroWeights sets how the cache treats entries of weight 0, see
+// simplewlru.WithZeroWeights.
+func WithZeroWeights(policy simplewlru.ZeroWeightPolicy) Option {
+	return func(o *options) {
+		o.lru = append(o.lru, simplewlru.WithZeroWeights(policy))
+	}
+}
+
+// WithClock sets the clock determining the ages of entries, see
+// simplewlru.WithClock, and pacing WarmFrom.
+func WithClock(c clock.Clock) Option {
+	return func(o *options) {
+		o.clock = c
+		o.lru = append(o.lru, simplewlru.WithClock(c))
+	}
+}
+
+// WithWriteBuffer makes Add queue values in a buffer of the given size, from
+// which a background goroutine applies them in batches. This trades the
+// immediacy of writes for throughput under contention: an added value only
+// becomes visible once applied, Add reports no evictions, and the eviction
+// callback runs on the background goroutine. Other operations are not
+// ordered with buffered writes; call Wait first where this matters. Add
+// blocks while the buffer is full, except while the background goroutine
+// runs eviction callbacks: values added then, possibly by the callbacks
+// themselves, are queued beyond the size of the buffer.
+func WithWriteBuffer(size int) Option {
+	return func(o *options) {
+		o.writeBuffer = size
+	}
+}
+
+// WithReadBuffer makes Get serve values without taking a lock, recording the
+// read in a per-shard buffer of the given size instead. The promotions of
+// buffered reads are applied in batches once a buffer fills up, or dropped if
+// the shard is busy at that point. Recency is thus approximate: until
+// applied, a read does not protect its entry from eviction. Call Wait to
+// apply all buffered reads.
+func WithReadBuffer(size int) Option {
+	return func(o *options) {
+		o.readBuffer = size
+	}
+}
+
+// WithLatencyTracking records the latencies of Get, Add and Remove, including
+// the time spent waiting for locks, in histograms reported by Latencies.
+func WithLatencyTracking() Option {
+	return func(o *options) {
+		o.latencies = true
+	}
+}
+
+// WithHitTracking counts the hits and misses of Get per shard, reported by
+// ShardStats.
+func WithHitTracking() Option {
+	return func(o *options) {
+		o.hitTracking = true
+	}
+}
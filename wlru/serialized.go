@@ -0,0 +1,112 @@
+package wlru
+
+// Codec converts values to and from their binary representation.
+type Codec interface {
+	Encode(v interface{}) ([]byte, error)
+	Decode(data []byte) (interface{}, error)
+}
+
+// SerializedCache stores values encoded as byte slices instead of live
+// objects, decoding them on every read. Each entry then holds a single
+// pointer-free slice rather than an object graph the garbage collector has
+// to scan, which substantially reduces GC work for huge caches at the cost of
+// encoding and decoding. Values read are fresh copies; mutating them does not
+// affect the cache.
+type SerializedCache struct {
+	cache *Cache
+	codec Codec
+}
+
+// NewSerializedWithOptions creates a serialized cache configured entirely by
+// options, encoding values with the given codec, see NewWithOptions.
+func NewSerializedWithOptions(codec Codec, opts ...Option) (*SerializedCache, error) {
+	c, err := NewWithOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &SerializedCache{cache: c, codec: codec}, nil
+}
+
+// NewSerialized creates a serialized cache of the given size, encoding
+// values with the codec.
+func NewSerialized(maxWeight uint, maxSize int, codec Codec, opts ...Option) (*SerializedCache, error) {
+	c, err := New(maxWeight, maxSize, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &SerializedCache{cache: c, codec: codec}, nil
+}
+
+// Add encodes the value and adds it to the cache. Returns the number of
+// evictions, or an error if the value cannot be encoded or the entry is too
+// large for the cache, see Cache.TryAdd.
+func (c *SerializedCache) Add(key, value interface{}, weight uint) (evicted int, err error) {
+	data, err := c.codec.Encode(value)
+	if err != nil {
+		return 0, err
+	}
+	return c.cache.TryAdd(key, data, weight)
+}
+
+// AddSized encodes the value and adds it to the cache, weighted by the
+// length of its encoding. Errors are reported like for Add.
+func (c *SerializedCache) AddSized(key, value interface{}) (evicted int, err error) {
+	data, err := c.codec.Encode(value)
+	if err != nil {
+		return 0, err
+	}
+	return c.cache.TryAdd(key, data, uint(len(data)))
+}
+
+// Get looks up and decodes a key's value from the cache, updating its
+// recency.
+func (c *SerializedCache) Get(key interface{}) (value interface{}, ok bool, err error) {
+	data, ok := c.cache.Get(key)
+	if !ok {
+		return nil, false, nil
+	}
+	return c.decode(data)
+}
+
+// Peek looks up and decodes a key's value without updating its recency.
+func (c *SerializedCache) Peek(key interface{}) (value interface{}, ok bool, err error) {
+	data, ok := c.cache.Peek(key)
+	if !ok {
+		return nil, false, nil
+	}
+	return c.decode(data)
+}
+
+func (c *SerializedCache) decode(data interface{}) (interface{}, bool, error) {
+	value, err := c.codec.Decode(data.([]byte))
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// Contains checks if a key is in the cache without updating its recency.
+func (c *SerializedCache) Contains(key interface{}) bool {
+	return c.cache.Contains(key)
+}
+
+// Remove removes the provided key from the cache, returning if the key was
+// contained.
+func (c *SerializedCache) Remove(key interface{}) (present bool) {
+	return c.cache.Remove(key)
+}
+
+// Purge removes all entries from the cache.
+func (c *SerializedCache) Purge() {
+	c.cache.Purge()
+}
+
+// Len returns the number of entries in the cache.
+func (c *SerializedCache) Len() int {
+	return c.cache.Len()
+}
+
+// Weight returns the total weight of the entries in the cache.
+func (c *SerializedCache) Weight() uint {
+	return c.cache.Weight()
+}
@@ -0,0 +1,86 @@
+package wlru
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type point struct {
+	X, Y int
+}
+
+type pointCodec struct{}
+
+func (pointCodec) Encode(v interface{}) ([]byte, error) {
+	p, ok := v.(point)
+	if !ok {
+		return nil, errors.New("not a point")
+	}
+	return json.Marshal(p)
+}
+
+func (pointCodec) Decode(data []byte) (interface{}, error) {
+	var p point
+	err := json.Unmarshal(data, &p)
+	return p, err
+}
+
+func TestSerializedCache(t *testing.T) {
+	c, err := NewSerialized(100, 100, pointCodec{})
+	require.NoError(t, err)
+	_, err = NewSerialized(100, -1, pointCodec{})
+	assert.Error(t, err)
+
+	_, err = c.Add("a", point{1, 2}, 1)
+	require.NoError(t, err)
+	_, err = c.Add("b", "not a point", 1)
+	assert.Error(t, err)
+	assert.False(t, c.Contains("b"))
+
+	v, ok, err := c.Get("a")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, point{1, 2}, v)
+	v, ok, err = c.Peek("a")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, point{1, 2}, v)
+	_, ok, err = c.Get("missing")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	raw, _ := c.cache.Peek("a")
+	assert.IsType(t, []byte(nil), raw)
+
+	_, err = c.AddSized("c", point{3, 4})
+	require.NoError(t, err)
+	assert.Equal(t, uint(1+len(`{"X":3,"Y":4}`)), c.Weight())
+	assert.Equal(t, 2, c.Len())
+
+	c.cache.Add("corrupt", []byte("{"), 1)
+	_, _, err = c.Get("corrupt")
+	assert.Error(t, err)
+
+	assert.True(t, c.Remove("a"))
+	c.Purge()
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestNewSerializedWithOptions(t *testing.T) {
+	cache, err := NewSerializedWithOptions(pointCodec{}, WithMaxSize(1))
+	assert.NoError(t, err)
+	_, err = cache.Add(1, point{1, 2}, 1)
+	assert.NoError(t, err)
+	_, err = cache.Add(2, point{3, 4}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, cache.Len())
+
+	cache, _ = NewSerialized(4, 10, pointCodec{})
+	_, err = cache.AddSized(1, point{1, 2})
+	assert.ErrorIs(t, err, cacheutils.ErrEntryTooLarge)
+	assert.Zero(t, cache.Len())
+}
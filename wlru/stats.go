@@ -0,0 +1,52 @@
+package wlru
+
+// ShardStats describes a shard of a cache. Comparing the shards of a cache
+// reveals skewed key distributions, calling for a different hasher or
+// number of shards.
+type ShardStats struct {
+	Len    int
+	Weight uint
+	// Hits and Misses count Get calls, for caches created WithHitTracking.
+	Hits   uint64
+	Misses uint64
+}
+
+// HitRatio returns the fraction of Get calls which hit, or zero if there
+// were none or hits are not tracked.
+func (s ShardStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// ShardStats returns the statistics of every shard, in shard order. The
+// shards are read without locking, so the statistics of concurrently
+// changing shards may be slightly out of date.
+func (c *Cache) ShardStats() []ShardStats {
+	stats := make([]ShardStats, len(c.shards))
+	for i, s := range c.shards {
+		stats[i] = ShardStats{
+			Len:    int(s.length.Load()),
+			Weight: uint(s.weight.Load()),
+			Hits:   s.hits.Load(),
+			Misses: s.misses.Load(),
+		}
+	}
+	return stats
+}
+
+// TracksHits reports whether the cache counts hits and misses, as set by
+// WithHitTracking.
+func (c *Cache) TracksHits() bool {
+	return c.trackHits
+}
+
+// countLookup counts the result of a Get on the shard.
+func (s *shard) countLookup(hit bool) {
+	if hit {
+		s.hits.Add(1)
+	} else {
+		s.misses.Add(1)
+	}
+}
@@ -0,0 +1,67 @@
+package wlru
+
+import (
+	"context"
+	"time"
+
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/0xsoniclabs/cacheutils/clock"
+)
+
+// minWarmPause is the shortest pause taken to pace warming; shorter pauses
+// are accumulated to keep the cost of tickers low at high rates.
+const minWarmPause = time.Millisecond
+
+// WarmFrom adds the entries received from the channel to the cache, from
+// oldest to newest, until the channel is closed or the context is done. If
+// perSecond is positive, at most that many entries are added per second on
+// average, as measured by the clock of the cache, so that warming a large
+// cache in the background does not compete with the application for CPU.
+// Returns the number of added entries and the
+// context's error if it ended warming, or ErrClosed if the cache was closed.
+func (c *Cache) WarmFrom(ctx context.Context, entries <-chan Entry, perSecond int) (added int, err error) {
+	var interval time.Duration
+	if perSecond > 0 {
+		interval = time.Second / time.Duration(perSecond)
+	}
+	next := c.clock.Now()
+	for {
+		select {
+		case e, ok := <-entries:
+			if !ok {
+				return added, nil
+			}
+			if interval > 0 {
+				if pause := next.Sub(c.clock.Now()); pause >= minWarmPause {
+					if err := pauseFor(ctx, c.clock, pause); err != nil {
+						return added, err
+					}
+				}
+				if now := c.clock.Now(); next.Before(now) {
+					next = now
+				}
+				next = next.Add(interval)
+			}
+			if c.closed.Load() {
+				return added, cacheutils.ErrClosed
+			}
+			c.Add(e.Key, e.Value, e.Weight)
+			added++
+		case <-ctx.Done():
+			return added, ctx.Err()
+		}
+	}
+}
+
+// pauseFor waits for the given duration to pass on the clock, or for the
+// context to be done, in which case it returns the context's error.
+func pauseFor(ctx context.Context, clk clock.Clock, d time.Duration) error {
+	ticker := clk.NewTicker(d)
+	defer ticker.Stop()
+	select {
+	case <-ticker.C():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
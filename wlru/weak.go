@@ -0,0 +1,236 @@
+package wlru
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"sync"
+	"unsafe"
+)
+
+// WeakCache is an experimental cache holding its values weakly: an entry
+// whose value is no longer referenced outside of the cache is removed once
+// the garbage collector notices, regardless of its recency, and reported to
+// the eviction callback like any other entry leaving the cache. This suits
+// memoization of large derived objects, which then stay cached for as long
+// as they are in use anyway without pinning them afterwards.
+//
+// Weak references are implemented with finalizers, so values must be
+// non-nil pointers to the start of an allocation without a finalizer of its
+// own; setting a finalizer on a cached value aborts the program. Like
+// finalizers in general, collection is not guaranteed: in particular, small
+// pointer-free values may share an allocation and never be collected. The
+// weight of an entry is set on adding it, as for Cache.
+type WeakCache struct {
+	cache   *Cache
+	lock    sync.Mutex
+	targets map[uintptr]*weakTarget // address -> target of every value held
+}
+
+// weakTarget is a value held weakly, shared by all keys holding it. It is
+// stored in the underlying cache in place of the value.
+type weakTarget struct {
+	typ  reflect.Type
+	addr uintptr // the value, hidden from the garbage collector
+	keys map[interface{}]struct{}
+
+	// lock guards the fields below. Once the finalizer has found the value
+	// unreachable, dead is set and the address must no longer be followed;
+	// until then, the finalizer keeps the value alive.
+	lock        sync.Mutex
+	dead        bool
+	resurrected bool        // the value was handed out since the finalizer was set
+	final       interface{} // the value while the finalizer is removing it
+}
+
+// NewWeak creates a weak cache of the given size, see WeakCache.
+func NewWeak(maxWeight uint, maxSize int, opts ...Option) (*WeakCache, error) {
+	c, err := New(maxWeight, maxSize, opts...)
+	if err != nil {
+		return nil, err
+	}
+	w := &WeakCache{cache: c, targets: map[uintptr]*weakTarget{}}
+	if onEvicted := c.onEvicted; onEvicted != nil {
+		c.onEvicted = func(key interface{}, value interface{}) {
+			onEvicted(key, value.(*weakTarget).value())
+		}
+	}
+	c.AddEvictionListener(w.release)
+	return w, nil
+}
+
+// Add adds a value to the cache, returning the number of evictions. Returns
+// an error if the value is not a non-nil pointer or the entry is too large
+// for the cache, see Cache.TryAdd.
+func (w *WeakCache) Add(key, value interface{}, weight uint) (evicted int, err error) {
+	t, err := w.hold(key, value)
+	if err != nil {
+		return 0, err
+	}
+	evicted, err = w.cache.TryAdd(key, t, weight)
+	if err != nil {
+		w.release(key, t)
+	}
+	return evicted, err
+}
+
+// Get looks up a key's value from the cache, updating its recency.
+func (w *WeakCache) Get(key interface{}) (value interface{}, ok bool) {
+	if t, ok := w.cache.Get(key); ok {
+		return t.(*weakTarget).get()
+	}
+	return nil, false
+}
+
+// Peek looks up a key's value without updating its recency.
+func (w *WeakCache) Peek(key interface{}) (value interface{}, ok bool) {
+	if t, ok := w.cache.Peek(key); ok {
+		return t.(*weakTarget).get()
+	}
+	return nil, false
+}
+
+// Contains checks if a key is in the cache without updating its recency.
+// Entries whose value has been collected may be reported until the cache
+// has removed them.
+func (w *WeakCache) Contains(key interface{}) bool {
+	return w.cache.Contains(key)
+}
+
+// Remove removes the provided key from the cache, returning if the key was
+// contained.
+func (w *WeakCache) Remove(key interface{}) (present bool) {
+	return w.cache.Remove(key)
+}
+
+// Purge removes all entries from the cache.
+func (w *WeakCache) Purge() {
+	w.cache.Purge()
+}
+
+// Len returns the number of entries in the cache, including those whose
+// value has been collected but which the cache has not removed yet.
+func (w *WeakCache) Len() int {
+	return w.cache.Len()
+}
+
+// Weight returns the total weight of the entries in the cache.
+func (w *WeakCache) Weight() uint {
+	return w.cache.Weight()
+}
+
+// hold returns the target of value, registering key with it and setting its
+// finalizer if the value is not held yet.
+func (w *WeakCache) hold(key, value interface{}) (*weakTarget, error) {
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Pointer || v.IsNil() {
+		return nil, fmt.Errorf("weak values must be non-nil pointers, got %T", value)
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	t := w.targets[v.Pointer()]
+	if t != nil && t.isDead() {
+		t = nil
+	}
+	if t != nil && t.typ != v.Type() {
+		// Setting a second finalizer on the allocation would abort.
+		return nil, fmt.Errorf("weak value %T shares its address with a held value of type %v", value, t.typ)
+	}
+	if t == nil {
+		t = &weakTarget{typ: v.Type(), addr: v.Pointer(), keys: map[interface{}]struct{}{}}
+		w.targets[t.addr] = t
+		runtime.SetFinalizer(value, func(obj interface{}) { w.finalize(t, obj) })
+	}
+	t.keys[key] = struct{}{}
+	return t, nil
+}
+
+// release unregisters key from the target it held, clearing the finalizer
+// of the value once no key holds it anymore.
+func (w *WeakCache) release(key, value interface{}) {
+	t := value.(*weakTarget)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	delete(t.keys, key)
+	if len(t.keys) > 0 {
+		return
+	}
+	if w.targets[t.addr] == t {
+		delete(w.targets, t.addr)
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.dead {
+		t.dead = true
+		runtime.SetFinalizer(t.pointer(), nil)
+	}
+}
+
+// finalize is the finalizer of a held value, removing the entries holding
+// it unless it has been handed out again since the finalizer was set.
+func (w *WeakCache) finalize(t *weakTarget, obj interface{}) {
+	t.lock.Lock()
+	if t.resurrected {
+		t.resurrected = false
+		t.lock.Unlock()
+		runtime.SetFinalizer(obj, func(obj interface{}) { w.finalize(t, obj) })
+		return
+	}
+	t.dead = true
+	t.final = obj
+	t.lock.Unlock()
+
+	w.lock.Lock()
+	keys := make([]interface{}, 0, len(t.keys))
+	for key := range t.keys {
+		keys = append(keys, key)
+	}
+	w.lock.Unlock()
+	for _, key := range keys {
+		w.cache.removeValue(key, t)
+	}
+
+	w.lock.Lock()
+	if w.targets[t.addr] == t {
+		delete(w.targets, t.addr)
+	}
+	w.lock.Unlock()
+	t.lock.Lock()
+	t.final = nil
+	t.lock.Unlock()
+}
+
+// get returns the value for a lookup, missing once it has been collected.
+func (t *weakTarget) get() (value interface{}, ok bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.dead {
+		return nil, false
+	}
+	t.resurrected = true
+	return t.pointer(), true
+}
+
+// isDead returns if the value has been found unreachable or released.
+func (t *weakTarget) isDead() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.dead
+}
+
+// value returns the value for reporting an entry leaving the cache.
+func (t *weakTarget) value() interface{} {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.dead {
+		return t.final
+	}
+	return t.pointer()
+}
+
+// pointer rebuilds the value from its hidden address. It must be called
+// while holding the lock and the value is not dead.
+func (t *weakTarget) pointer() interface{} {
+	p := *(*unsafe.Pointer)(unsafe.Pointer(&t.addr))
+	return reflect.NewAt(t.typ.Elem(), p).Interface()
+}
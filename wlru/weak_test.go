@@ -0,0 +1,118 @@
+package wlru
+
+import (
+	"reflect"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type blob struct {
+	data [256]byte
+}
+
+// collect runs the garbage collector until cond holds or a deadline passes.
+func collect(cond func() bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		runtime.GC()
+		if cond() {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return false
+}
+
+func TestWeakCache_KeepsReferencedValues(t *testing.T) {
+	cache, err := NewWeak(100, 100)
+	require.NoError(t, err)
+
+	value := &blob{}
+	_, err = cache.Add(1, value, 1)
+	require.NoError(t, err)
+	_, err = cache.Add(2, value, 1)
+	require.NoError(t, err)
+	runtime.GC()
+	runtime.GC()
+
+	got, ok := cache.Get(1)
+	assert.True(t, ok)
+	assert.Same(t, value, got)
+	got, ok = cache.Peek(2)
+	assert.True(t, ok)
+	assert.Same(t, value, got)
+	runtime.KeepAlive(value)
+}
+
+func TestWeakCache_RemovesCollectedValues(t *testing.T) {
+	var lock sync.Mutex
+	var evicted []interface{}
+	cache, err := NewWeak(100, 100, WithEvictCallback(func(key, value interface{}) {
+		lock.Lock()
+		defer lock.Unlock()
+		assert.IsType(t, &blob{}, value)
+		evicted = append(evicted, key)
+	}))
+	require.NoError(t, err)
+
+	kept := &blob{}
+	_, err = cache.Add("kept", kept, 1)
+	require.NoError(t, err)
+	_, err = cache.Add("dropped", &blob{}, 1)
+	require.NoError(t, err)
+
+	assert.True(t, collect(func() bool { return !cache.Contains("dropped") }))
+	_, ok := cache.Get("dropped")
+	assert.False(t, ok)
+	assert.Equal(t, 1, cache.Len())
+	lock.Lock()
+	assert.Equal(t, []interface{}{"dropped"}, evicted)
+	lock.Unlock()
+
+	got, ok := cache.Get("kept")
+	assert.True(t, ok)
+	assert.Same(t, kept, got)
+	runtime.KeepAlive(kept)
+}
+
+func TestWeakCache_EvictedValuesCanBeAddedAgain(t *testing.T) {
+	cache, err := NewWeak(1, 1)
+	require.NoError(t, err)
+
+	first, second := &blob{}, &blob{}
+	_, err = cache.Add(1, first, 1)
+	require.NoError(t, err)
+	evicted, err := cache.Add(2, second, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, evicted)
+
+	_, err = cache.Add(1, first, 1)
+	require.NoError(t, err)
+	got, ok := cache.Get(1)
+	assert.True(t, ok)
+	assert.Same(t, first, got)
+	_, held := cache.targets[reflect.ValueOf(second).Pointer()]
+	assert.False(t, held)
+}
+
+func TestWeakCache_RejectsNonPointers(t *testing.T) {
+	cache, err := NewWeak(100, 100)
+	require.NoError(t, err)
+
+	_, err = cache.Add(1, blob{}, 1)
+	assert.Error(t, err)
+	_, err = cache.Add(1, (*blob)(nil), 1)
+	assert.Error(t, err)
+	assert.Equal(t, 0, cache.Len())
+
+	b := &blob{}
+	_, err = cache.Add(1, b, 1)
+	require.NoError(t, err)
+	_, err = cache.Add(2, &b.data, 1)
+	assert.Error(t, err)
+}
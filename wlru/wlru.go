@@ -1,166 +1,1110 @@
 package wlru
 
 import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/0xsoniclabs/cacheutils/clock"
 	"github.com/0xsoniclabs/cacheutils/simplewlru"
 )
 
 // Cache is a thread-safe fixed size LRU cache.
+//
+// Peek, Contains, Len and Weight never acquire a lock. They read state which
+// writers publish before releasing their lock, so they observe the cache as
+// of the most recently completed write.
+//
+// A cache created WithShards(n) stripes its entries over n independent LRU
+// shards, each owning 1/n of the weight and size limits and its own lock.
+// Eviction is performed per shard, but all shards stamp the entries they use
+// from a shared counter, see Entry.Recency, so that the least and most
+// recently used entries of the whole cache can be found. Operations on a
+// single key are atomic. Operations spanning the whole cache (Purge, Resize,
+// Keys, Total, GetOldest, GetNewest, Snapshot and the like) visit the shards
+// one after another: each shard is observed or modified atomically, but
+// writes to other shards may interleave, so the combined result is not a
+// point-in-time view of the cache.
+//
+// The eviction callback and listeners are never called while holding a lock.
+// Entries evicted or removed by an operation are collected under the lock of
+// their shard and reported once it is released, in the order they left the
+// shard, on the goroutine performing the operation and before it returns.
+// Callbacks may therefore use the cache itself, but callbacks of concurrent
+// operations may interleave, and an evicted key may have been added again by
+// the time its callback runs.
 type Cache struct {
-	lru  *simplewlru.Cache
-	lock sync.RWMutex
+	shards    []*shard
+	hasher    Hasher
+	values    sync.Map // key -> value of every entry in the shards
+	onEvicted func(key interface{}, value interface{})
+	buffer    *writeBuffer
+	closed    atomic.Bool
+	latencies *latencies
+	trackHits bool
+	clock     clock.Clock
+
+	frozenLock sync.Mutex // serializes changes of frozen
+	frozen     atomic.Pointer[[]*Frozen]
+
+	spareOrder atomic.Pointer[simplewlru.Order] // reused by enumerations
+
+	loads sync.Map // key -> *load in progress, see GetOrAddFunc
+
+	listenersLock sync.Mutex // serializes changes of listeners
+	listeners     atomic.Pointer[[]listener]
+	lastListener  ListenerID
+}
+
+var _ cacheutils.ResizableCache = (*Cache)(nil)
+
+// Entry describes an entry of the cache.
+type Entry = simplewlru.Entry
+
+// shard is a single lock stripe of a Cache.
+type shard struct {
+	lru    *simplewlru.Cache
+	lock   sync.RWMutex
+	length atomic.Int64
+	weight atomic.Uint64
+	// evicted collects the entries leaving the shard until the callback can
+	// be run outside of the lock.
+	evicted []evictedEntry
+	reads   *readBuffer
+
+	hits, misses atomic.Uint64 // Get calls, if tracking hits
+}
+
+// evictedEntry is an entry awaiting its eviction callback.
+type evictedEntry struct {
+	key, value interface{}
 }
 
 // New creates a weighted LRU of the given size.
-func New(maxWeight uint, maxSize int) (*Cache, error) {
-	return NewWithEvict(maxWeight, maxSize, nil)
+func New(maxWeight uint, maxSize int, opts ...Option) (*Cache, error) {
+	return NewWithEvict(maxWeight, maxSize, nil, opts...)
+}
+
+// NewWithOptions creates a cache configured entirely by options. Without
+// WithMaxWeight or WithMaxSize, the respective limit is unbounded.
+func NewWithOptions(opts ...Option) (*Cache, error) {
+	return NewWithEvict(math.MaxUint, math.MaxInt, nil, opts...)
 }
 
 // NewWithEvict constructs a fixed weight/size cache with the given eviction
 // callback.
-func NewWithEvict(maxWeight uint, maxSize int, onEvicted func(key interface{}, value interface{})) (*Cache, error) {
-	lru, err := simplewlru.NewWithEvict(maxWeight, maxSize, onEvicted)
-	if err != nil {
-		return nil, err
+func NewWithEvict(maxWeight uint, maxSize int, onEvicted func(key interface{}, value interface{}), opts ...Option) (*Cache, error) {
+	o := options{
+		maxWeight: maxWeight,
+		maxSize:   maxSize,
+		onEvicted: onEvicted,
+		shards:    1,
+		hasher:    MapHasher,
+		clock:     clock.Real,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.maxSize < 0 {
+		return nil, fmt.Errorf("%w: must provide a non-negative size", cacheutils.ErrInvalidSize)
+	}
+	if o.shards < 1 {
+		return nil, errors.New("must provide a positive number of shards")
+	}
+	if o.hasher == nil {
+		return nil, errors.New("must provide a hasher")
+	}
+	if o.writeBuffer < 0 {
+		return nil, fmt.Errorf("%w: must provide a non-negative write buffer size", cacheutils.ErrInvalidSize)
+	}
+	if o.readBuffer < 0 {
+		return nil, fmt.Errorf("%w: must provide a non-negative read buffer size", cacheutils.ErrInvalidSize)
 	}
 	c := &Cache{
-		lru: lru,
+		shards:    make([]*shard, o.shards),
+		hasher:    o.hasher,
+		onEvicted: o.onEvicted,
+		trackHits: o.hitTracking,
+		clock:     o.clock,
+	}
+	if o.latencies {
+		c.latencies = &latencies{}
+	}
+	if o.writeBuffer > 0 {
+		c.buffer = &writeBuffer{writes: make(chan bufferedWrite, o.writeBuffer)}
+	}
+	// The shards share their recency stamps, so that entries of different
+	// shards can be ordered by use.
+	o.lru = append(o.lru, simplewlru.WithRecencyCounter(new(atomic.Uint64)))
+	if o.initialCapacity != 0 {
+		shardCapacity := (o.initialCapacity + o.shards - 1) / o.shards
+		o.lru = append(o.lru, simplewlru.WithInitialCapacity(shardCapacity))
+	}
+	for i := range c.shards {
+		shardWeight, shardSize := c.shardLimits(i, o.maxWeight, o.maxSize)
+		s := &shard{}
+		lru, err := simplewlru.NewWithEvict(shardWeight, shardSize, c.evictFrom(s), o.lru...)
+		if err != nil {
+			return nil, err
+		}
+		s.lru = lru
+		if o.readBuffer > 0 {
+			s.reads = newReadBuffer(o.readBuffer)
+		}
+		c.shards[i] = s
 	}
 	return c, nil
 }
 
+// shardLimits returns the share of the given limits owned by the i-th shard.
+func (c *Cache) shardLimits(i int, maxWeight uint, maxSize int) (uint, int) {
+	n := len(c.shards)
+	shardWeight, shardSize := maxWeight/uint(n), maxSize/n
+	if uint(i) < maxWeight%uint(n) {
+		shardWeight++
+	}
+	if i < maxSize%n {
+		shardSize++
+	}
+	return shardWeight, shardSize
+}
+
+// shard returns the shard responsible for the given key.
+func (c *Cache) shard(key interface{}) *shard {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	return c.shards[c.hasher.Hash(key)%uint64(len(c.shards))]
+}
+
+// oldestShard returns the shard holding the least recently used entry, as
+// told by the recency stamps, or the first shard if the cache is empty.
+func (c *Cache) oldestShard() *shard {
+	return c.shardBy(func(s *shard) (Entry, bool) {
+		return s.lru.GetOldestEntry()
+	}, func(a, b uint64) bool { return a < b })
+}
+
+// newestShard returns the shard holding the most recently used entry, as
+// told by the recency stamps, or the first shard if the cache is empty.
+func (c *Cache) newestShard() *shard {
+	return c.shardBy(func(s *shard) (Entry, bool) {
+		return s.lru.PeekNewestEntry()
+	}, func(a, b uint64) bool { return a > b })
+}
+
+// shardBy returns the shard whose entry returned by get has the recency
+// stamp preferred by better, or the first shard if no shard has an entry.
+func (c *Cache) shardBy(get func(*shard) (Entry, bool), better func(a, b uint64) bool) *shard {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	var best *shard
+	var recency uint64
+	for _, s := range c.shards {
+		s.lock.RLock()
+		e, ok := get(s)
+		s.lock.RUnlock()
+		if ok && (best == nil || better(e.Recency, recency)) {
+			best, recency = s, e.Recency
+		}
+	}
+	if best == nil {
+		return c.shards[0]
+	}
+	return best
+}
+
+// evictFrom returns the eviction callback of the given shard, which
+// unpublishes entries leaving it and queues them for the callback of the
+// cache.
+func (c *Cache) evictFrom(s *shard) simplewlru.EvictCallback {
+	return func(key interface{}, value interface{}) {
+		// Entries removed by RemoveAfter are reported after their grace
+		// period, when the key may have been added again.
+		if !s.lru.Contains(key) {
+			c.unpublish(key)
+		}
+		if c.notifiesEvictions() {
+			s.evicted = append(s.evicted, evictedEntry{key, value})
+		}
+	}
+}
+
+// unlock releases the write lock of the shard and then runs the eviction
+// callback and listeners for the entries which left it while the lock was
+// held.
+func (c *Cache) unlock(s *shard) {
+	evicted := s.evicted
+	s.evicted = nil
+	s.lock.Unlock()
+	for _, e := range evicted {
+		c.evicted(e.key, e.value)
+	}
+}
+
+// add adds a value to the given shard and publishes it.
+func (c *Cache) add(s *shard, key, value interface{}, weight uint) (version uint64, evicted int) {
+	version, evicted = s.lru.AddWithVersion(key, value, weight)
+	if s.lru.Contains(key) {
+		c.publishValue(key, value)
+	}
+	return version, evicted
+}
+
+// publish makes the size of the shard visible to lock-free readers. It must
+// be called while holding the write lock.
+func (s *shard) publish() {
+	s.length.Store(int64(s.lru.Len()))
+	s.weight.Store(uint64(s.lru.Weight()))
+}
+
+// Clone returns an independent copy of the cache holding the same entries,
+// weights and recency order, sharing the eviction callback and the listeners
+// registered so far. With multiple shards, each shard is copied atomically
+// but writes to other shards may interleave. Buffered writes not yet applied
+// are not copied.
+func (c *Cache) Clone() *Cache {
+	clone := &Cache{
+		shards:    make([]*shard, len(c.shards)),
+		hasher:    c.hasher,
+		onEvicted: c.onEvicted,
+		trackHits: c.trackHits,
+		clock:     c.clock,
+	}
+	c.listenersLock.Lock()
+	clone.setListeners(append([]listener(nil), c.evictionListeners()...))
+	clone.lastListener = c.lastListener
+	c.listenersLock.Unlock()
+	if c.buffer != nil {
+		clone.buffer = &writeBuffer{writes: make(chan bufferedWrite, cap(c.buffer.writes))}
+	}
+	if c.latencies != nil {
+		clone.latencies = &latencies{}
+	}
+	for i, s := range c.shards {
+		cs := &shard{}
+		s.lock.RLock()
+		cs.lru = s.lru.CloneWithEvict(clone.evictFrom(cs))
+		if s.reads != nil {
+			cs.reads = newReadBuffer(cap(s.reads.spare))
+		}
+		s.lock.RUnlock()
+
+		cs.lru.RangeNewestFirst(func(key, value interface{}) bool {
+			clone.values.Store(key, value)
+			return true
+		})
+		cs.publish()
+		clone.shards[i] = cs
+	}
+	return clone
+}
+
+// MergePolicy decides which entry is kept when a merged key is contained in
+// both caches.
+type MergePolicy = simplewlru.MergePolicy
+
+const (
+	// KeepExisting keeps the entry already contained in the cache.
+	KeepExisting = simplewlru.KeepExisting
+	// KeepNewer keeps the entry which was written more recently.
+	KeepNewer = simplewlru.KeepNewer
+)
+
+// MergeFrom imports the entries of other, from oldest to newest per shard of
+// other, respecting the capacity limits of the cache. Other is copied first,
+// so concurrent merges between two caches in both directions are safe.
+// Returns the number of evictions.
+func (c *Cache) MergeFrom(other *Cache, policy MergePolicy) (evicted int) {
+	if c.closed.Load() {
+		return 0
+	}
+	for _, o := range other.shards {
+		o.lock.RLock()
+		source := o.lru.CloneWithEvict(nil)
+		o.lock.RUnlock()
+
+		for _, key := range source.Keys() {
+			s := c.shard(key)
+			s.lock.Lock()
+			evicted += s.lru.MergeKeyFrom(source, key, policy)
+			if value, ok := s.lru.Peek(key); ok {
+				c.publishValue(key, value)
+			}
+			s.publish()
+			c.unlock(s)
+		}
+	}
+	return evicted
+}
+
 // Purge is used to completely clear the cache.
 func (c *Cache) Purge() {
-	c.lock.Lock()
-	c.lru.Purge()
-	c.lock.Unlock()
+	for _, s := range c.shards {
+		s.lock.Lock()
+		s.lru.Purge()
+		s.publish()
+		c.unlock(s)
+	}
 }
 
-// Add adds a value to the cache. Returns true if an eviction occurred.
+// Flush removes all entries from the cache shard by shard, including
+// buffered writes, and passes each to f, e.g. to persist the contents on
+// shutdown. Within a shard, entries are passed from the least to the most
+// recently used, after the shard's entries have been removed and outside of
+// its lock. The eviction callback and listeners are only called if notify is
+// set. Returns the number of flushed entries.
+func (c *Cache) Flush(f func(key, value interface{}, weight uint), notify bool) (flushed int) {
+	c.Wait()
+	var batch []Entry
+	for _, s := range c.shards {
+		batch = batch[:0]
+		s.lock.Lock()
+		s.lru.Flush(func(key, value interface{}, weight uint) {
+			batch = append(batch, Entry{Key: key, Value: value, Weight: weight})
+			if !notify {
+				c.unpublish(key)
+			}
+		}, notify)
+		s.publish()
+		c.unlock(s)
+		for _, e := range batch {
+			f(e.Key, e.Value, e.Weight)
+		}
+		flushed += len(batch)
+	}
+	return flushed
+}
+
+// Add adds a value to the cache. Returns true if an eviction occurred. With
+// a write buffer, the value is queued and no evictions are reported. Once
+// the cache is closed, the value is dropped; use TryAdd to detect this.
 func (c *Cache) Add(key, value interface{}, weight uint) (evicted int) {
-	c.lock.Lock()
-	evicted = c.lru.Add(key, value, weight)
-	c.lock.Unlock()
+	if c.latencies != nil {
+		defer c.latencies.add.since(time.Now())
+	}
+	if c.closed.Load() {
+		return 0
+	}
+	if c.buffer != nil && c.enqueue(bufferedWrite{key: key, value: value, weight: weight}) {
+		return 0
+	}
+	s := c.shard(key)
+	s.lock.Lock()
+	_, evicted = c.add(s, key, value, weight)
+	s.publish()
+	c.unlock(s)
+	return evicted
+}
+
+// TryAdd adds a value to the cache like Add, unless the entry could not be
+// retained even by its empty shard. In that case the cache is left unchanged
+// and ErrEntryTooLarge is returned. The value is never buffered. Once the
+// cache is closed, ErrClosed is returned.
+func (c *Cache) TryAdd(key, value interface{}, weight uint) (evicted int, err error) {
+	if c.closed.Load() {
+		return 0, cacheutils.ErrClosed
+	}
+	s := c.shard(key)
+	s.lock.Lock()
+	defer c.unlock(s)
+
+	evicted, err = s.lru.TryAdd(key, value, weight)
+	if err == nil && s.lru.Contains(key) {
+		c.publishValue(key, value)
+	}
+	s.publish()
+	return evicted, err
+}
+
+// AddWithResult adds a value to the cache like Add, additionally reporting
+// whether the entry is in the cache afterwards, see
+// simplewlru.Cache.AddWithResult. Limits are those of the key's shard. The
+// value is never buffered. Once the cache is closed, the value is rejected
+// with ErrClosed.
+func (c *Cache) AddWithResult(key, value interface{}, weight uint) (result simplewlru.AddResult, evicted int, err error) {
+	if c.closed.Load() {
+		return simplewlru.Rejected, 0, cacheutils.ErrClosed
+	}
+	s := c.shard(key)
+	s.lock.Lock()
+	defer c.unlock(s)
+
+	result, evicted = s.lru.AddWithResult(key, value, weight)
+	if result == simplewlru.Added {
+		c.publishValue(key, value)
+	}
+	s.publish()
+	return result, evicted, nil
+}
+
+// AddWithVersion adds a value to the cache, returning the version assigned
+// to the entry and the number of evictions. See simplewlru for the semantics
+// of versions; with multiple shards, versions are only comparable per key.
+func (c *Cache) AddWithVersion(key, value interface{}, weight uint) (version uint64, evicted int) {
+	if c.closed.Load() {
+		return 0, 0
+	}
+	s := c.shard(key)
+	s.lock.Lock()
+	version, evicted = c.add(s, key, value, weight)
+	s.publish()
+	c.unlock(s)
+	return version, evicted
+}
+
+// AddWithCost adds a value to the cache like Add, recording the expense of
+// recomputing it for the eviction score, see simplewlru.Cache.AddWithCost.
+// The value is never buffered.
+func (c *Cache) AddWithCost(key, value interface{}, weight, cost uint) (evicted int) {
+	if c.closed.Load() {
+		return 0
+	}
+	s := c.shard(key)
+	s.lock.Lock()
+	evicted = s.lru.AddWithCost(key, value, weight, cost)
+	if s.lru.Contains(key) {
+		c.publishValue(key, value)
+	}
+	s.publish()
+	c.unlock(s)
 	return evicted
 }
 
-// Get looks up a key's value from the cache.
+// AddIfVersion adds a value to the cache only if the key has not been
+// written or invalidated since the given version was obtained from
+// GetWithVersion. Returns the version assigned to the entry, whether it was
+// added and the number of evictions.
+func (c *Cache) AddIfVersion(key, value interface{}, weight uint, expected uint64) (version uint64, ok bool, evicted int) {
+	if c.closed.Load() {
+		return 0, false, 0
+	}
+	s := c.shard(key)
+	s.lock.Lock()
+	defer c.unlock(s)
+
+	version, ok, evicted = s.lru.AddIfVersion(key, value, weight, expected)
+	if ok && s.lru.Contains(key) {
+		c.publishValue(key, value)
+	}
+	s.publish()
+	return version, ok, evicted
+}
+
+// GetWithVersion looks up a key's value and its version from the cache. On a
+// miss, the current version is returned for use with AddIfVersion.
+func (c *Cache) GetWithVersion(key interface{}) (value interface{}, version uint64, ok bool) {
+	s := c.shard(key)
+	s.lock.Lock()
+	value, version, ok = s.lru.GetWithVersion(key)
+	s.lock.Unlock()
+	return value, version, ok
+}
+
+// Get looks up a key's value from the cache. With a read buffer, the lookup
+// takes no lock and the promotion of the entry is deferred.
 func (c *Cache) Get(key interface{}) (value interface{}, ok bool) {
-	c.lock.Lock()
-	value, ok = c.lru.Get(key)
-	c.lock.Unlock()
+	if c.latencies != nil {
+		defer c.latencies.get.since(time.Now())
+	}
+	s := c.shard(key)
+	if s.reads != nil {
+		if value, ok = c.values.Load(key); ok {
+			s.recordRead(key)
+		}
+	} else {
+		s.lock.Lock()
+		value, ok = s.lru.Get(key)
+		s.lock.Unlock()
+	}
+	if c.trackHits {
+		s.countLookup(ok)
+	}
 	return value, ok
 }
 
 // Contains checks if a key is in the cache, without updating the
 // recent-ness or deleting it for being stale.
 func (c *Cache) Contains(key interface{}) bool {
-	c.lock.RLock()
-	containKey := c.lru.Contains(key)
-	c.lock.RUnlock()
+	_, containKey := c.values.Load(key)
 	return containKey
 }
 
 // Peek returns the key value (or undefined if not found) without updating
 // the "recently used"-ness of the key.
 func (c *Cache) Peek(key interface{}) (value interface{}, ok bool) {
-	c.lock.RLock()
-	value, ok = c.lru.Peek(key)
-	c.lock.RUnlock()
-	return value, ok
+	return c.values.Load(key)
+}
+
+// WeightOf returns the weight of the entry of key, without updating its
+// "recently used"-ness.
+func (c *Cache) WeightOf(key interface{}) (weight uint, ok bool) {
+	s := c.shard(key)
+	s.lock.RLock()
+	weight, ok = s.lru.WeightOf(key)
+	s.lock.RUnlock()
+	return weight, ok
+}
+
+// CostOf returns the cost of the given key's entry without updating its
+// "recently used"-ness.
+func (c *Cache) CostOf(key interface{}) (cost uint, ok bool) {
+	s := c.shard(key)
+	s.lock.RLock()
+	cost, ok = s.lru.CostOf(key)
+	s.lock.RUnlock()
+	return cost, ok
 }
 
 // ContainsOrAdd checks if a key is in the cache without updating the
 // recent-ness or deleting it for being stale, and if not, adds the value.
-// Returns whether found and whether an eviction occurred.
+// Returns whether found and whether an eviction occurred. Once the cache is
+// closed, a missing key is not added; use TryContainsOrAdd to detect this.
 func (c *Cache) ContainsOrAdd(key, value interface{}, weight uint) (ok bool, evicted int) {
-	c.lock.Lock()
-	defer c.lock.Unlock()
+	ok, evicted, _ = c.TryContainsOrAdd(key, value, weight)
+	return ok, evicted
+}
+
+// TryContainsOrAdd is like ContainsOrAdd, but fails with ErrClosed if the
+// key is missing from a closed cache.
+func (c *Cache) TryContainsOrAdd(key, value interface{}, weight uint) (ok bool, evicted int, err error) {
+	s := c.shard(key)
+	s.lock.Lock()
+	defer c.unlock(s)
 
-	if c.lru.Contains(key) {
-		return true, 0
+	if s.lru.Contains(key) {
+		return true, 0, nil
 	}
-	evicted = c.lru.Add(key, value, weight)
-	return false, evicted
+	if c.closed.Load() {
+		return false, 0, cacheutils.ErrClosed
+	}
+	_, evicted = c.add(s, key, value, weight)
+	s.publish()
+	return false, evicted, nil
 }
 
 // PeekOrAdd checks if a key is in the cache without updating the
 // recent-ness or deleting it for being stale, and if not, adds the value.
-// Returns whether found and whether an eviction occurred.
+// Returns whether found and whether an eviction occurred. Once the cache is
+// closed, a missing key is not added; use TryPeekOrAdd to detect this.
 func (c *Cache) PeekOrAdd(key, value interface{}, weight uint) (previous interface{}, ok bool, evicted int) {
-	c.lock.Lock()
-	defer c.lock.Unlock()
+	previous, ok, evicted, _ = c.TryPeekOrAdd(key, value, weight)
+	return previous, ok, evicted
+}
 
-	previous, ok = c.lru.Peek(key)
+// TryPeekOrAdd is like PeekOrAdd, but fails with ErrClosed if the key is
+// missing from a closed cache.
+func (c *Cache) TryPeekOrAdd(key, value interface{}, weight uint) (previous interface{}, ok bool, evicted int, err error) {
+	s := c.shard(key)
+	s.lock.Lock()
+	defer c.unlock(s)
+
+	previous, ok = s.lru.Peek(key)
 	if ok {
-		return previous, true, 0
+		return previous, true, 0, nil
+	}
+	if c.closed.Load() {
+		return nil, false, 0, cacheutils.ErrClosed
+	}
+
+	_, evicted = c.add(s, key, value, weight)
+	s.publish()
+	return nil, false, evicted, nil
+}
+
+// AddIfAbsent adds the value only if the key is not in the cache, never
+// overwriting an existing value. Returns whether the value was added and the
+// number of evictions.
+func (c *Cache) AddIfAbsent(key, value interface{}, weight uint) (added bool, evicted int) {
+	if c.closed.Load() {
+		return false, 0
+	}
+	s := c.shard(key)
+	s.lock.Lock()
+	defer c.unlock(s)
+
+	if s.lru.Contains(key) {
+		return false, 0
 	}
+	_, evicted = c.add(s, key, value, weight)
+	s.publish()
+	return true, evicted
+}
 
-	evicted = c.lru.Add(key, value, weight)
-	return nil, false, evicted
+// Replace updates the value and weight of key only if it is already in the
+// cache, never inserting it. Returns whether the entry was replaced and is
+// still in the cache; an entry too heavy for the cache is removed instead.
+func (c *Cache) Replace(key, value interface{}, weight uint) (replaced bool) {
+	if c.closed.Load() {
+		return false
+	}
+	s := c.shard(key)
+	s.lock.Lock()
+	defer c.unlock(s)
+
+	if !s.lru.Contains(key) {
+		return false
+	}
+	c.add(s, key, value, weight)
+	s.publish()
+	return s.lru.Contains(key)
+}
+
+// CompareAndSwap replaces the value of key with new and the given weight if
+// its current value equals old. The values are compared with ==, which
+// panics for non-comparable types. Returns whether the value was swapped and
+// is still in the cache; an entry too heavy for the cache is removed instead.
+func (c *Cache) CompareAndSwap(key, old, new interface{}, weight uint) (swapped bool) {
+	if c.closed.Load() {
+		return false
+	}
+	s := c.shard(key)
+	s.lock.Lock()
+	defer c.unlock(s)
+
+	if current, ok := s.lru.Peek(key); !ok || current != old {
+		return false
+	}
+	c.add(s, key, new, weight)
+	s.publish()
+	return s.lru.Contains(key)
+}
+
+// CompareAndDelete removes key if its current value equals old. The values
+// are compared with ==, which panics for non-comparable types. Returns
+// whether the entry was removed.
+func (c *Cache) CompareAndDelete(key, old interface{}) (deleted bool) {
+	s := c.shard(key)
+	s.lock.Lock()
+	defer c.unlock(s)
+
+	if current, ok := s.lru.Peek(key); !ok || current != old {
+		return false
+	}
+	s.lru.Remove(key)
+	s.publish()
+	return true
 }
 
 // Remove removes the provided key from the cache.
 func (c *Cache) Remove(key interface{}) (present bool) {
-	c.lock.Lock()
-	present = c.lru.Remove(key)
-	c.lock.Unlock()
+	if c.latencies != nil {
+		defer c.latencies.remove.since(time.Now())
+	}
+	s := c.shard(key)
+	s.lock.Lock()
+	present = s.lru.Remove(key)
+	s.publish()
+	c.unlock(s)
+	return
+}
+
+// removeValue removes the provided key from the cache if it holds value.
+func (c *Cache) removeValue(key, value interface{}) {
+	s := c.shard(key)
+	s.lock.Lock()
+	if current, ok := s.lru.Peek(key); ok && current == value {
+		s.lru.Remove(key)
+		s.publish()
+	}
+	c.unlock(s)
+}
+
+// SetProtected exempts the entries whose key matches the predicate from
+// capacity evictions, see simplewlru.Cache.SetProtected. The predicate is
+// called while holding the lock of a shard, possibly concurrently, so it must
+// be safe for concurrent use and must not use the cache.
+func (c *Cache) SetProtected(protected func(key interface{}) bool) {
+	for _, s := range c.shards {
+		s.lock.Lock()
+		s.lru.SetProtected(protected)
+		s.lock.Unlock()
+	}
+}
+
+// RemoveAfter removes the provided key from the cache like Remove, but
+// reports the entry to the eviction callback and listeners only once the
+// grace period has passed, so that readers still holding the value can
+// finish with it before it is released. Lookups miss immediately. Entries
+// whose grace period has passed are reported by the next Add, Remove or
+// RemoveAfter on their shard, or by Reap. Returns if the key was contained.
+func (c *Cache) RemoveAfter(key interface{}, grace time.Duration) (present bool) {
+	s := c.shard(key)
+	s.lock.Lock()
+	present = s.lru.RemoveAfter(key, grace)
+	if present {
+		c.unpublish(key)
+	}
+	s.publish()
+	c.unlock(s)
 	return
 }
 
+// Reap reports the entries removed by RemoveAfter whose grace period has
+// passed to the eviction callback and listeners, returning their number.
+func (c *Cache) Reap() (reaped int) {
+	for _, s := range c.shards {
+		s.lock.Lock()
+		reaped += s.lru.Reap()
+		c.unlock(s)
+	}
+	return reaped
+}
+
 // Resize changes the cache size.
 func (c *Cache) Resize(maxWeight uint, maxSize int) (evicted int) {
-	c.lock.Lock()
-	evicted = c.lru.Resize(maxWeight, maxSize)
-	c.lock.Unlock()
+	for i, s := range c.shards {
+		shardWeight, shardSize := c.shardLimits(i, maxWeight, maxSize)
+		s.lock.Lock()
+		evicted += s.lru.Resize(shardWeight, shardSize)
+		s.publish()
+		c.unlock(s)
+	}
 	return evicted
 }
 
-// RemoveOldest removes the oldest item from the cache.
+// EvictTo evicts entries until the total weight of the cache is at most
+// weight, leaving its limits unchanged. With multiple shards, the target is
+// split among the shards like the weight limit. Returns the number of
+// evictions.
+func (c *Cache) EvictTo(weight uint) (evicted int) {
+	for i, s := range c.shards {
+		shardWeight, _ := c.shardLimits(i, weight, 0)
+		s.lock.Lock()
+		evicted += s.lru.EvictTo(shardWeight)
+		s.publish()
+		c.unlock(s)
+	}
+	return evicted
+}
+
+// RecalculateWeights sets the weight of every entry to the one reported by
+// the weigher and evicts entries until the cache fits its limits again, see
+// simplewlru.Cache.RecalculateWeights. Shards are recalculated one at a time.
+// A closed cache is left unchanged.
+func (c *Cache) RecalculateWeights(weigher func(key, value interface{}) uint) (evicted int) {
+	if c.closed.Load() {
+		return 0
+	}
+	for _, s := range c.shards {
+		s.lock.Lock()
+		evicted += s.lru.RecalculateWeights(weigher)
+		s.publish()
+		c.unlock(s)
+	}
+	return evicted
+}
+
+// RemoveOldest removes the oldest item from the cache. With multiple shards,
+// the least recently used item of all shards is removed.
 func (c *Cache) RemoveOldest() (key interface{}, value interface{}, ok bool) {
-	c.lock.Lock()
-	key, value, ok = c.lru.RemoveOldest()
-	c.lock.Unlock()
+	s := c.oldestShard()
+	s.lock.Lock()
+	key, value, ok = s.lru.RemoveOldest()
+	s.publish()
+	c.unlock(s)
 	return
 }
 
-// GetOldest returns the oldest entry
+// GetOldest returns the oldest entry. With multiple shards, the least
+// recently used entry of all shards is returned.
 func (c *Cache) GetOldest() (key interface{}, value interface{}, ok bool) {
-	c.lock.Lock()
-	key, value, ok = c.lru.GetOldest()
-	c.lock.Unlock()
+	s := c.oldestShard()
+	s.lock.Lock()
+	key, value, ok = s.lru.GetOldest()
+	s.lock.Unlock()
+	return
+}
+
+// GetOldestEntry returns the oldest entry including its weight and age. With
+// multiple shards, the least recently used entry of all shards is returned.
+func (c *Cache) GetOldestEntry() (entry Entry, ok bool) {
+	s := c.oldestShard()
+	s.lock.RLock()
+	entry, ok = s.lru.GetOldestEntry()
+	s.lock.RUnlock()
+	return entry, ok
+}
+
+// RemoveOldestEntry removes the oldest entry from the cache, returning it
+// including its weight and age. With multiple shards, the least recently used
+// entry of all shards is removed.
+func (c *Cache) RemoveOldestEntry() (entry Entry, ok bool) {
+	s := c.oldestShard()
+	s.lock.Lock()
+	entry, ok = s.lru.RemoveOldestEntry()
+	s.publish()
+	c.unlock(s)
+	return entry, ok
+}
+
+// GetNewest returns the most recently used entry and marks it as used. With
+// multiple shards, the most recently used entry of all shards is returned.
+func (c *Cache) GetNewest() (key interface{}, value interface{}, ok bool) {
+	s := c.newestShard()
+	s.lock.Lock()
+	key, value, ok = s.lru.GetNewest()
+	s.lock.Unlock()
 	return
 }
 
-// Keys returns a slice of the keys in the cache, from oldest to newest.
+// PeekNewest returns the most recently used entry without updating its
+// "recently used"-ness. With multiple shards, the most recently used entry of
+// all shards is returned.
+func (c *Cache) PeekNewest() (key interface{}, value interface{}, ok bool) {
+	s := c.newestShard()
+	s.lock.RLock()
+	key, value, ok = s.lru.PeekNewest()
+	s.lock.RUnlock()
+	return
+}
+
+// PeekOldestN returns up to n of the least recently used entries, from oldest
+// to newest, without updating their "recently used"-ness. With multiple
+// shards, the oldest entries of all shards are merged by Entry.Recency.
+func (c *Cache) PeekOldestN(n int) []Entry {
+	if n <= 0 {
+		return nil
+	}
+	if len(c.shards) == 1 {
+		s := c.shards[0]
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+		return s.lru.PeekOldestN(n)
+	}
+	var entries []Entry
+	for _, s := range c.shards {
+		s.lock.RLock()
+		entries = append(entries, s.lru.PeekOldestN(n)...)
+		s.lock.RUnlock()
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Recency < entries[j].Recency
+	})
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+// HeaviestEntries returns up to n of the heaviest entries, from heaviest to
+// lightest, without updating their "recently used"-ness. Of entries weighing
+// the same, the least recently used come first. With multiple shards, the
+// heaviest entries of all shards are merged.
+func (c *Cache) HeaviestEntries(n int) []Entry {
+	if n <= 0 {
+		return nil
+	}
+	if len(c.shards) == 1 {
+		s := c.shards[0]
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+		return s.lru.HeaviestEntries(n)
+	}
+	var entries []Entry
+	for _, s := range c.shards {
+		s.lock.RLock()
+		entries = append(entries, s.lru.HeaviestEntries(n)...)
+		s.lock.RUnlock()
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Weight != entries[j].Weight {
+			return entries[i].Weight > entries[j].Weight
+		}
+		return entries[i].Recency < entries[j].Recency
+	})
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+// SnapshotFilter restricts the entries included in a snapshot.
+type SnapshotFilter = simplewlru.SnapshotFilter
+
+// Snapshot returns the entries of the cache passing the filter, ordered from
+// oldest to newest, without updating their "recently used"-ness. With
+// multiple shards, the snapshots of all shards are merged by Entry.Recency
+// before the bounds of the filter are applied.
+func (c *Cache) Snapshot(filter SnapshotFilter) []Entry {
+	if len(c.shards) == 1 {
+		s := c.shards[0]
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+		return s.lru.Snapshot(filter)
+	}
+	var entries []Entry
+	for _, s := range c.shards {
+		s.lock.RLock()
+		entries = append(entries, s.lru.Snapshot(filter)...)
+		s.lock.RUnlock()
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Recency < entries[j].Recency
+	})
+	return SnapshotFilter{MaxEntries: filter.MaxEntries, MaxWeight: filter.MaxWeight}.Apply(entries)
+}
+
+// OrderedEntries returns all entries of the cache ordered from least to most
+// recently used, with the contract of simplewlru.Cache.OrderedEntries. In
+// addition, ContainsOrAdd and PeekOrAdd leave the order unchanged if the key
+// is present and add it as the most recently used entry otherwise. With a
+// read buffer, Get updates the order only once buffered reads are applied,
+// see Wait. With multiple shards, the entries of each shard are ordered as
+// described and the shards follow one another, each copied atomically.
+// Adding the entries in order to an empty cache with the same configuration
+// reproduces the order of every shard, provided the hasher places keys
+// deterministically. XXHasher does so across processes and MapHasher only
+// within a process; keys holding pointers or channels are hashed by address
+// by both, so they are placed alike only within a process.
+func (c *Cache) OrderedEntries() []Entry {
+	entries := make([]Entry, 0, c.Len())
+	for _, s := range c.shards {
+		s.lock.RLock()
+		entries = append(entries, s.lru.OrderedEntries()...)
+		s.lock.RUnlock()
+	}
+	return entries
+}
+
+// Keys returns a slice of the keys in the cache, from oldest to newest. With
+// multiple shards, the keys are ordered from oldest to newest per shard.
 func (c *Cache) Keys() []interface{} {
-	c.lock.RLock()
-	keys := c.lru.Keys()
-	c.lock.RUnlock()
+	return c.AppendKeys(make([]interface{}, 0, c.Len()))
+}
+
+// AppendKeys appends the keys in the cache, from oldest to newest, to dst and
+// returns the extended slice. With multiple shards, the keys are ordered from
+// oldest to newest per shard. Each shard is copied under its lock and walked
+// after releasing it, so enumerating large caches does not stall writers.
+func (c *Cache) AppendKeys(dst []interface{}) []interface{} {
+	order := c.takeOrder()
+	defer c.returnOrder(order)
+	for _, s := range c.shards {
+		s.captureOrder(order)
+		dst = order.AppendKeys(dst)
+	}
+	return dst
+}
+
+// KeysNewestFirst returns a slice of the keys in the cache, from newest to
+// oldest. With multiple shards, the keys are ordered from newest to oldest
+// per shard.
+func (c *Cache) KeysNewestFirst() []interface{} {
+	keys := make([]interface{}, 0, c.Len())
+	order := c.takeOrder()
+	defer c.returnOrder(order)
+	for _, s := range c.shards {
+		s.captureOrder(order)
+		keys = order.AppendKeysNewestFirst(keys)
+	}
 	return keys
 }
 
+// RangeNewestFirst calls f for each entry in the cache, from newest to
+// oldest, until f returns false. With multiple shards, the entries are
+// visited from newest to oldest per shard. Each shard is copied before being
+// visited, so f is called without holding a lock and may use the cache; the
+// entries visited are those of the shard at the time it was copied.
+func (c *Cache) RangeNewestFirst(f func(key, value interface{}) bool) {
+	order := c.takeOrder()
+	defer c.returnOrder(order)
+	for _, s := range c.shards {
+		done := false
+		s.captureOrder(order)
+		order.RangeNewestFirst(func(key, value interface{}) bool {
+			done = !f(key, value)
+			return !done
+		})
+		if done {
+			return
+		}
+	}
+}
+
+// takeOrder returns storage for copying shards while enumerating the cache.
+// The storage is kept between enumerations, so that enumerating does not
+// allocate once it has grown; concurrent enumerations use fresh storage.
+func (c *Cache) takeOrder() *simplewlru.Order {
+	if o := c.spareOrder.Swap(nil); o != nil {
+		return o
+	}
+	return new(simplewlru.Order)
+}
+
+// returnOrder releases storage taken by takeOrder.
+func (c *Cache) returnOrder(o *simplewlru.Order) {
+	o.Reset()
+	c.spareOrder.Store(o)
+}
+
+// captureOrder copies the entries of the shard in recency order into o.
+func (s *shard) captureOrder(o *simplewlru.Order) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	o.Capture(s.lru)
+}
+
 // Len returns the number of items in the cache.
 func (c *Cache) Len() int {
-	c.lock.RLock()
-	length := c.lru.Len()
-	c.lock.RUnlock()
-	return length
+	var length int64
+	for _, s := range c.shards {
+		length += s.length.Load()
+	}
+	return int(length)
 }
 
 // Weight returns the total weight of items in the cache.
 func (c *Cache) Weight() uint {
-	c.lock.RLock()
-	w := c.lru.Weight()
-	c.lock.RUnlock()
-	return w
+	var weight uint
+	for _, s := range c.shards {
+		weight = simplewlru.AddWeights(weight, uint(s.weight.Load()))
+	}
+	return weight
 }
 
 // Total returns the total weight and number of items in the cache.
 func (c *Cache) Total() (weight uint, num int) {
-	c.lock.RLock()
-	weight, num = c.lru.Total()
-	c.lock.RUnlock()
+	for _, s := range c.shards {
+		s.lock.RLock()
+		shardWeight, shardNum := s.lru.Total()
+		s.lock.RUnlock()
+		weight = simplewlru.AddWeights(weight, shardWeight)
+		num += shardNum
+	}
 	return weight, num
 }
+
+// AsReadOnly returns a view of the cache restricted to lookups. The view
+// hides the cache itself, so its holder cannot modify the cache even by a
+// type assertion.
+func (c *Cache) AsReadOnly() cacheutils.ReadOnlyCache {
+	return readOnly{c}
+}
+
+// readOnly restricts a Cache to the methods of cacheutils.ReadOnlyCache.
+type readOnly struct {
+	c *Cache
+}
+
+func (r readOnly) Get(key interface{}) (value interface{}, ok bool) {
+	return r.c.Get(key)
+}
+
+func (r readOnly) Peek(key interface{}) (value interface{}, ok bool) {
+	return r.c.Peek(key)
+}
+
+func (r readOnly) Contains(key interface{}) bool {
+	return r.c.Contains(key)
+}
+
+func (r readOnly) Keys() []interface{} {
+	return r.c.Keys()
+}
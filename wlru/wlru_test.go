@@ -1,14 +1,45 @@
 package wlru
 
 import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/0xsoniclabs/cacheutils"
+	"github.com/0xsoniclabs/cacheutils/clock"
+	"github.com/0xsoniclabs/cacheutils/simplewlru"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNew_InvalidParameters(t *testing.T) {
 	_, err := New(10, -10)
-	assert.Error(t, err)
+	assert.ErrorIs(t, err, cacheutils.ErrInvalidSize)
+	_, err = New(10, 10, WithWriteBuffer(-1))
+	assert.ErrorIs(t, err, cacheutils.ErrInvalidSize)
+	_, err = New(10, 10, WithInitialCapacity(-1))
+	assert.ErrorIs(t, err, cacheutils.ErrInvalidSize)
+}
+
+func TestTryAdd(t *testing.T) {
+	parity := HasherFunc(func(key interface{}) uint64 { return uint64(key.(int)) })
+	cache, _ := New(10, 10, WithShards(2), WithHasher(parity))
+	cache.Add(1, "A", 1)
+	_, err := cache.TryAdd(2, "B", 6)
+	assert.ErrorIs(t, err, cacheutils.ErrEntryTooLarge)
+	assert.False(t, cache.Contains(2))
+	assert.True(t, cache.Contains(1))
+
+	evicted, err := cache.TryAdd(2, "B", 5)
+	assert.NoError(t, err)
+	assert.Zero(t, evicted)
+	val, ok := cache.Peek(2)
+	assert.True(t, ok)
+	assert.Equal(t, "B", val)
 }
 
 func TestAdd_EvictionAndWeightManagement(t *testing.T) {
@@ -26,6 +57,33 @@ func TestAdd_EvictionAndWeightManagement(t *testing.T) {
 	assert.Equal(t, uint(5), cache.Weight()) // 2 + 3
 }
 
+func TestNewWithOptions(t *testing.T) {
+	_, err := NewWithOptions(WithMaxSize(-1))
+	assert.Error(t, err)
+
+	var evicted []interface{}
+	cache, err := NewWithOptions(
+		WithMaxWeight(10),
+		WithShards(2),
+		WithEvictCallback(func(key, value interface{}) {
+			evicted = append(evicted, key)
+		}),
+	)
+	assert.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		cache.Add(i, i, 1)
+	}
+	assert.Equal(t, 10, cache.Len())
+	assert.Len(t, evicted, 90)
+
+	// Options override the positional limits.
+	cache, _ = New(10, 10, WithMaxSize(2))
+	for i := 0; i < 5; i++ {
+		cache.Add(i, i, 1)
+	}
+	assert.Equal(t, []interface{}{3, 4}, cache.Keys())
+}
+
 func TestTotal_ReturnsAccurateMetrics(t *testing.T) {
 	cache, _ := New(5, 5)
 	cache.Add(1, 1, 1)
@@ -94,6 +152,61 @@ func TestOldest_Operations(t *testing.T) {
 	assert.False(t, cache.Contains(1))
 }
 
+func TestAsReadOnly(t *testing.T) {
+	cache, _ := New(10, 10)
+	cache.Add(1, "A", 1)
+	view := cache.AsReadOnly()
+	_, isCache := view.(*Cache)
+	assert.False(t, isCache)
+
+	val, ok := view.Get(1)
+	assert.True(t, ok)
+	assert.Equal(t, "A", val)
+	cache.Add(2, "B", 1)
+	val, ok = view.Peek(2)
+	assert.True(t, ok)
+	assert.Equal(t, "B", val)
+	assert.True(t, view.Contains(2))
+	assert.Equal(t, []interface{}{1, 2}, view.Keys())
+}
+
+func TestWeightOf(t *testing.T) {
+	cache, _ := New(20, 10, WithShards(2))
+	cache.Add(1, "A", 3)
+	cache.Add(2, "B", 4)
+	cache.Add(1, "C", 2)
+
+	weight, ok := cache.WeightOf(1)
+	assert.True(t, ok)
+	assert.Equal(t, uint(2), weight)
+	weight, ok = cache.WeightOf(2)
+	assert.True(t, ok)
+	assert.Equal(t, uint(4), weight)
+	_, ok = cache.WeightOf(3)
+	assert.False(t, ok)
+}
+
+func TestAddWithCost(t *testing.T) {
+	cache, _ := New(3, 10, WithEvictionScore(100, simplewlru.WeightPerRankAndCost))
+	cache.AddWithCost(1, "A", 1, 9)
+	cache.Add(2, "B", 1)
+	cache.Add(3, "C", 1)
+
+	cost, ok := cache.CostOf(1)
+	assert.True(t, ok)
+	assert.Equal(t, uint(9), cost)
+	_, ok = cache.CostOf(4)
+	assert.False(t, ok)
+
+	// The expensive entry outlasts the more recently used cheap one.
+	assert.Equal(t, 1, cache.Add(4, "D", 1))
+	assert.True(t, cache.Contains(1))
+	assert.False(t, cache.Contains(2))
+	value, ok := cache.Peek(1)
+	assert.True(t, ok)
+	assert.Equal(t, "A", value)
+}
+
 func TestContainsOrAdd_KeyManagement(t *testing.T) {
 	cache, _ := New(5, 5)
 	cache.Add(2, 3, 2)
@@ -163,3 +276,1493 @@ func TestPeekOrAdd_EvictsForNewEntries(t *testing.T) {
 	_, _, evicted := cache.PeekOrAdd(3, "C", 1)
 	assert.Equal(t, 1, evicted) // Evicted weight 2 entry
 }
+
+func TestNew_WithMidpointInsertion(t *testing.T) {
+	_, err := New(10, 10, WithMidpointInsertion(0))
+	assert.Error(t, err)
+
+	cache, err := New(10, 2, WithMidpointInsertion(50))
+	assert.NoError(t, err)
+	cache.Add(1, 1, 1)
+	cache.Get(1)
+	cache.Add(2, 2, 1)
+	cache.Add(3, 3, 1) // Evicts the one-off entry 2 instead of the hot entry 1
+	assert.True(t, cache.Contains(1))
+	assert.False(t, cache.Contains(2))
+}
+
+func TestNew_WithAdmissionWindow(t *testing.T) {
+	cache, err := New(100, 100, WithAdmissionWindow(10))
+	assert.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		cache.Add(i, i, 1)
+		cache.Get(i)
+	}
+	for i := 100; i < 1000; i++ {
+		cache.Add(i, i, 1)
+	}
+	hot := 0
+	for i := 0; i < 100; i++ {
+		if cache.Contains(i) {
+			hot++
+		}
+	}
+	assert.GreaterOrEqual(t, hot, 90)
+}
+
+func TestReads_ReflectCompletedWrites(t *testing.T) {
+	var evictedKeys []interface{}
+	cache, _ := NewWithEvict(3, 5, func(key, value interface{}) {
+		evictedKeys = append(evictedKeys, key)
+	})
+	cache.Add(1, "A", 2)
+	cache.Add(2, "B", 1)
+	cache.Add(1, "C", 2)
+
+	val, ok := cache.Peek(1)
+	assert.True(t, ok)
+	assert.Equal(t, "C", val)
+	assert.Equal(t, 2, cache.Len())
+	assert.Equal(t, uint(3), cache.Weight())
+
+	cache.Add(3, "D", 3) // Evicts both 2 and 1
+	assert.False(t, cache.Contains(1))
+	assert.False(t, cache.Contains(2))
+	assert.Equal(t, []interface{}{2, 1}, evictedKeys)
+	assert.Equal(t, 1, cache.Len())
+
+	cache.Add(4, "E", 4) // Too heavy, rejected without evicting anything
+	assert.False(t, cache.Contains(4))
+	assert.True(t, cache.Contains(3))
+	assert.Equal(t, 1, cache.Len())
+	assert.Equal(t, uint(3), cache.Weight())
+
+	cache.Add(3, "F", 4) // Too heavy, evicts the outdated entry
+	assert.False(t, cache.Contains(3))
+	assert.Equal(t, []interface{}{2, 1, 3}, evictedKeys)
+	assert.Equal(t, 0, cache.Len())
+	assert.Equal(t, uint(0), cache.Weight())
+}
+
+func TestEvictionListeners(t *testing.T) {
+	var callback, first, second []interface{}
+	cache, _ := NewWithEvict(100, 100, func(key, value interface{}) {
+		callback = append(callback, key)
+	}, WithShards(4))
+	id := cache.AddEvictionListener(func(key, value interface{}) {
+		first = append(first, key)
+		cache.Add(key.(int)+100, value, 1)
+	})
+	cache.AddEvictionListener(func(key, value interface{}) {
+		second = append(second, key)
+	})
+
+	for i := 0; i < 4; i++ {
+		cache.Add(i, i, 1)
+	}
+	cache.Remove(0)
+	cache.Remove(1)
+	assert.Equal(t, []interface{}{0, 1}, callback)
+	assert.Equal(t, []interface{}{0, 1}, first)
+	assert.Equal(t, []interface{}{0, 1}, second)
+	assert.True(t, cache.Contains(100))
+
+	assert.True(t, cache.RemoveEvictionListener(id))
+	assert.False(t, cache.RemoveEvictionListener(id))
+	cache.Remove(2)
+	assert.Equal(t, []interface{}{0, 1}, first)
+	assert.Equal(t, []interface{}{0, 1, 2}, second)
+
+	clone := cache.Clone()
+	clone.Remove(3)
+	assert.Equal(t, []interface{}{0, 1, 2, 3}, second)
+}
+
+func TestRemoveAfter(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	var evicted []interface{}
+	cache, _ := NewWithEvict(100, 100, func(key, value interface{}) {
+		evicted = append(evicted, key)
+	}, WithShards(4), WithClock(fake))
+	for i := 0; i < 8; i++ {
+		cache.Add(i, i, 1)
+	}
+
+	assert.True(t, cache.RemoveAfter(1, time.Second))
+	assert.True(t, cache.RemoveAfter(2, time.Second))
+	assert.False(t, cache.RemoveAfter(1, time.Second))
+	_, ok := cache.Get(1)
+	assert.False(t, ok)
+	assert.Equal(t, 6, cache.Len())
+	assert.Equal(t, 0, cache.Reap())
+	assert.Empty(t, evicted)
+
+	cache.Add(2, "again", 1)
+	fake.Advance(time.Second)
+	assert.Equal(t, 2, cache.Reap())
+	assert.ElementsMatch(t, []interface{}{1, 2}, evicted)
+	value, ok := cache.Get(2)
+	assert.True(t, ok)
+	assert.Equal(t, "again", value)
+}
+
+func TestSetProtected(t *testing.T) {
+	parity := HasherFunc(func(key interface{}) uint64 { return uint64(key.(int)) })
+	cache, _ := New(100, 8, WithShards(2), WithHasher(parity))
+	cache.SetProtected(func(key interface{}) bool {
+		return key.(int) < 4
+	})
+	for i := 0; i < 100; i++ {
+		cache.Add(i, i, 1)
+	}
+	assert.Equal(t, 8, cache.Len())
+	for i := 0; i < 4; i++ {
+		assert.True(t, cache.Contains(i))
+	}
+	assert.True(t, cache.Contains(99))
+}
+
+func TestAddWithResult(t *testing.T) {
+	cache, _ := New(10, 2, WithShards(1))
+	cache.SetProtected(func(key interface{}) bool { return key != "c" })
+	result, _, _ := cache.AddWithResult("a", 1, 5)
+	assert.Equal(t, simplewlru.Added, result)
+	result, _, _ = cache.AddWithResult("b", 2, 11)
+	assert.Equal(t, simplewlru.Rejected, result)
+	cache.Add("b", 2, 5)
+	result, evicted, err := cache.AddWithResult("c", 3, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, simplewlru.SelfEvicted, result)
+	assert.Equal(t, 1, evicted)
+	assert.False(t, cache.Contains("c"))
+	_, ok := cache.Get("c")
+	assert.False(t, ok)
+}
+
+func TestNewFromEntries(t *testing.T) {
+	parity := HasherFunc(func(key interface{}) uint64 { return uint64(key.(int)) })
+	var entries []Entry
+	for i := 0; i < 10; i++ {
+		entries = append(entries, Entry{Key: i, Value: i, Weight: 1})
+	}
+	cache, err := NewFromEntries(100, 6, entries, WithShards(2), WithHasher(parity))
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{4, 6, 8, 5, 7, 9}, cache.Keys())
+	assert.Equal(t, uint(6), cache.Weight())
+	value, ok := cache.Get(9)
+	assert.True(t, ok)
+	assert.Equal(t, 9, value)
+	assert.False(t, cache.Contains(3))
+
+	cache, err = NewFromMap(100, 10, map[interface{}]interface{}{1: 1, 2: 2}, func(key, value interface{}) uint {
+		return 1
+	}, WithShards(2))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, cache.Len())
+}
+
+func TestFill_OnlyEmptyOpenCaches(t *testing.T) {
+	entries := []Entry{{Key: 1, Value: 1, Weight: 1}, {Key: 2, Value: 2, Weight: 1}}
+	cache, _ := New(100, 100, WithShards(2))
+	cache.Add(3, 3, 1)
+	assert.Error(t, cache.Fill(entries))
+	assert.Equal(t, []interface{}{3}, cache.Keys())
+
+	cache.Remove(3)
+	require.NoError(t, cache.Fill(entries))
+	assert.Equal(t, 2, cache.Len())
+	value, ok := cache.Peek(2)
+	assert.True(t, ok)
+	assert.Equal(t, 2, value)
+
+	cache, _ = New(100, 100)
+	require.NoError(t, cache.Close())
+	assert.ErrorIs(t, cache.Fill(entries), cacheutils.ErrClosed)
+	assert.Equal(t, 0, cache.Len())
+}
+
+func TestFlush(t *testing.T) {
+	var evicted []interface{}
+	cache, _ := NewWithEvict(100, 100, func(key, value interface{}) {
+		evicted = append(evicted, key)
+	}, WithShards(4), WithWriteBuffer(8))
+	for i := 0; i < 10; i++ {
+		cache.Add(i, i, 1)
+	}
+	flushed := map[interface{}]interface{}{}
+	n := cache.Flush(func(key, value interface{}, weight uint) {
+		// The cache may be used while flushing.
+		assert.False(t, cache.Contains(key))
+		flushed[key] = value
+	}, false)
+	assert.Equal(t, 10, n)
+	assert.Len(t, flushed, 10)
+	assert.Empty(t, evicted)
+	assert.Equal(t, 0, cache.Len())
+	_, ok := cache.Get(1)
+	assert.False(t, ok)
+
+	cache.Add(1, 1, 1)
+	cache.Flush(func(key, value interface{}, weight uint) {}, true)
+	assert.Equal(t, []interface{}{1}, evicted)
+}
+
+func TestClose_AppliesBufferedWrites(t *testing.T) {
+	cache, _ := New(100, 100, WithWriteBuffer(8))
+	for i := 0; i < 20; i++ {
+		cache.Add(i, i, 1)
+	}
+	assert.NoError(t, cache.Close())
+	assert.Equal(t, 20, cache.Len())
+	cache.Wait()
+	assert.ErrorIs(t, cache.Close(), cacheutils.ErrClosed)
+}
+
+func TestClose_RejectsWrites(t *testing.T) {
+	other, _ := New(100, 100)
+	other.Add(2, 2, 1)
+	tests := map[string]func(t *testing.T, cache *Cache){
+		"Add": func(t *testing.T, cache *Cache) {
+			assert.Equal(t, 0, cache.Add(2, 2, 1))
+		},
+		"TryAdd": func(t *testing.T, cache *Cache) {
+			_, err := cache.TryAdd(2, 2, 1)
+			assert.ErrorIs(t, err, cacheutils.ErrClosed)
+		},
+		"AddWithResult": func(t *testing.T, cache *Cache) {
+			result, _, err := cache.AddWithResult(2, 2, 1)
+			assert.ErrorIs(t, err, cacheutils.ErrClosed)
+			assert.Equal(t, simplewlru.Rejected, result)
+		},
+		"AddWithVersion": func(t *testing.T, cache *Cache) {
+			version, evicted := cache.AddWithVersion(2, 2, 1)
+			assert.Zero(t, version)
+			assert.Zero(t, evicted)
+		},
+		"AddWithCost": func(t *testing.T, cache *Cache) {
+			assert.Equal(t, 0, cache.AddWithCost(2, 2, 1, 1))
+		},
+		"AddIfVersion": func(t *testing.T, cache *Cache) {
+			_, version, _ := cache.GetWithVersion(1)
+			_, ok, _ := cache.AddIfVersion(1, 2, 1, version)
+			assert.False(t, ok)
+		},
+		"ContainsOrAdd": func(t *testing.T, cache *Cache) {
+			ok, evicted := cache.ContainsOrAdd(2, 2, 1)
+			assert.False(t, ok)
+			assert.Zero(t, evicted)
+		},
+		"TryContainsOrAdd": func(t *testing.T, cache *Cache) {
+			_, _, err := cache.TryContainsOrAdd(2, 2, 1)
+			assert.ErrorIs(t, err, cacheutils.ErrClosed)
+			ok, _, err := cache.TryContainsOrAdd(1, 2, 1)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+		},
+		"PeekOrAdd": func(t *testing.T, cache *Cache) {
+			_, ok, evicted := cache.PeekOrAdd(2, 2, 1)
+			assert.False(t, ok)
+			assert.Zero(t, evicted)
+		},
+		"TryPeekOrAdd": func(t *testing.T, cache *Cache) {
+			_, _, _, err := cache.TryPeekOrAdd(2, 2, 1)
+			assert.ErrorIs(t, err, cacheutils.ErrClosed)
+			previous, ok, _, err := cache.TryPeekOrAdd(1, 2, 1)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, 1, previous)
+		},
+		"RecalculateWeights": func(t *testing.T, cache *Cache) {
+			assert.Equal(t, 0, cache.RecalculateWeights(func(key, value interface{}) uint { return 1000 }))
+		},
+		"AddIfAbsent": func(t *testing.T, cache *Cache) {
+			added, _ := cache.AddIfAbsent(2, 2, 1)
+			assert.False(t, added)
+		},
+		"Replace": func(t *testing.T, cache *Cache) {
+			assert.False(t, cache.Replace(1, 2, 1))
+		},
+		"CompareAndSwap": func(t *testing.T, cache *Cache) {
+			assert.False(t, cache.CompareAndSwap(1, 1, 2, 1))
+		},
+		"MergeFrom": func(t *testing.T, cache *Cache) {
+			assert.Equal(t, 0, cache.MergeFrom(other, KeepNewer))
+		},
+		"GetOrAddFunc": func(t *testing.T, cache *Cache) {
+			value, found, _ := cache.GetOrAddFunc(2, func() (interface{}, uint) { return 2, 1 })
+			assert.False(t, found)
+			assert.Equal(t, 2, value, "the constructed value is still returned")
+		},
+		"WarmFrom": func(t *testing.T, cache *Cache) {
+			entries := make(chan Entry, 1)
+			entries <- Entry{Key: 2, Value: 2, Weight: 1}
+			added, err := cache.WarmFrom(context.Background(), entries, 0)
+			assert.ErrorIs(t, err, cacheutils.ErrClosed)
+			assert.Equal(t, 0, added)
+		},
+	}
+	for name, write := range tests {
+		t.Run(name, func(t *testing.T) {
+			cache, _ := New(100, 100, WithWriteBuffer(8))
+			cache.Add(1, 1, 1)
+			require.NoError(t, cache.Close())
+
+			write(t, cache)
+			cache.Wait()
+			assert.Equal(t, []interface{}{1}, cache.Keys())
+			value, ok := cache.Get(1)
+			assert.True(t, ok)
+			assert.Equal(t, 1, value)
+
+			// Entries may still be removed.
+			assert.True(t, cache.Remove(1))
+		})
+	}
+}
+
+func TestClose_ServesRemovals(t *testing.T) {
+	cache, _ := New(100, 100)
+	for i := 0; i < 10; i++ {
+		cache.Add(i, i, 1)
+	}
+	require.NoError(t, cache.Close())
+
+	assert.True(t, cache.Remove(0))
+	assert.True(t, cache.CompareAndDelete(1, 1))
+	assert.Equal(t, 2, cache.EvictTo(6))
+	assert.Equal(t, 2, cache.Resize(4, 4))
+	assert.Equal(t, []interface{}{6, 7, 8, 9}, cache.Keys())
+	assert.Equal(t, 0, cache.Resize(100, 100))
+	assert.Equal(t, 0, cache.Add(10, 10, 1))
+	assert.Equal(t, 4, cache.Len())
+}
+
+func TestShutdown_IsBoundedByContext(t *testing.T) {
+	cache, _ := New(100, 100, WithWriteBuffer(8))
+	// A writer holding the lock stalls the buffered writes.
+	s := cache.shard(1)
+	s.lock.Lock()
+	cache.Add(1, 1, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, cache.Shutdown(ctx), context.DeadlineExceeded)
+	s.lock.Unlock()
+
+	assert.Eventually(t, func() bool { return cache.Contains(1) }, time.Second, time.Millisecond)
+	assert.ErrorIs(t, cache.Shutdown(context.Background()), cacheutils.ErrClosed)
+}
+
+func TestWarmFrom(t *testing.T) {
+	cache, _ := New(100, 100)
+	entries := make(chan Entry, 10)
+	for i := 0; i < 10; i++ {
+		entries <- Entry{Key: i, Value: i, Weight: 1}
+	}
+	close(entries)
+	start := time.Now()
+	added, err := cache.WarmFrom(context.Background(), entries, 200)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, added)
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+	assert.Equal(t, []interface{}{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, cache.Keys())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = cache.WarmFrom(ctx, make(chan Entry), 0)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestWarmFrom_PacedByClock(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	cache, _ := New(100, 100, WithClock(fake))
+	entries := make(chan Entry, 3)
+	for i := 0; i < 3; i++ {
+		entries <- Entry{Key: i, Value: i, Weight: 1}
+	}
+	close(entries)
+	done := make(chan int)
+	go func() {
+		added, _ := cache.WarmFrom(context.Background(), entries, 1)
+		done <- added
+	}()
+
+	assert.Eventually(t, func() bool { return cache.Len() == 1 }, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 1, cache.Len(), "waits for the clock")
+	assert.Eventually(t, func() bool {
+		fake.Advance(100 * time.Millisecond)
+		return cache.Len() == 3
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, 3, <-done)
+}
+
+func TestWarmFrom_Clone(t *testing.T) {
+	cache, _ := New(100, 100, WithClock(clock.NewFake(time.Unix(0, 0))))
+	clone := cache.Clone()
+	entries := make(chan Entry, 1)
+	entries <- Entry{Key: 1, Value: 1, Weight: 1}
+	close(entries)
+	added, err := clone.WarmFrom(context.Background(), entries, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, added)
+	assert.Equal(t, 0, cache.Len())
+	assert.Equal(t, 1, clone.Len())
+}
+
+func TestEvictCallback_RunsOutsideLock(t *testing.T) {
+	var cache *Cache
+	var evictedKeys []interface{}
+	cache, _ = NewWithEvict(10, 10, func(key, value interface{}) {
+		// Using the cache from the callback must not deadlock.
+		assert.False(t, cache.Contains(key))
+		if _, ok := cache.Get(key); !ok {
+			evictedKeys = append(evictedKeys, key)
+		}
+		if key == 6 {
+			cache.Add("reinserted", 0, 1) // evicts 7
+		}
+	})
+	for i := 0; i < 10; i++ {
+		cache.Add(i, i, 1)
+	}
+	cache.Get(3)
+
+	// A heavy entry evicts several others, reported oldest first after the
+	// lock is released.
+	assert.Equal(t, 6, cache.Add("heavy", "H", 6))
+	assert.Equal(t, []interface{}{0, 1, 2, 4, 5, 6, 7}, evictedKeys)
+	assert.True(t, cache.Contains("heavy"))
+	assert.True(t, cache.Contains("reinserted"))
+	assert.Equal(t, uint(10), cache.Weight())
+}
+
+func TestReads_ConcurrentWithWriters(t *testing.T) {
+	cache, _ := New(100, 50)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				cache.Add(w*1000+i, i, uint(i%5))
+				cache.Peek(i)
+				cache.Contains(i)
+				if i%100 == 0 {
+					cache.Remove(w*1000 + i)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	weight, num := cache.Total()
+	assert.Equal(t, num, cache.Len())
+	assert.Equal(t, weight, cache.Weight())
+	for _, key := range cache.Keys() {
+		assert.True(t, cache.Contains(key))
+	}
+}
+
+func TestNew_WithShards(t *testing.T) {
+	_, err := New(10, 10, WithShards(0))
+	assert.Error(t, err)
+
+	cache, err := New(10, 4, WithShards(3))
+	assert.NoError(t, err)
+	weights, sizes := uint(0), 0
+	for i := range cache.shards {
+		shardWeight, shardSize := cache.shardLimits(i, 10, 4)
+		weights += shardWeight
+		sizes += shardSize
+	}
+	assert.Equal(t, uint(10), weights)
+	assert.Equal(t, 4, sizes)
+}
+
+func TestShards_Operations(t *testing.T) {
+	cache, _ := New(1000, 100, WithShards(4))
+	for i := 0; i < 50; i++ {
+		cache.Add(i, i*10, 2)
+	}
+	assert.Equal(t, 50, cache.Len())
+	assert.Equal(t, uint(100), cache.Weight())
+	weight, num := cache.Total()
+	assert.Equal(t, uint(100), weight)
+	assert.Equal(t, 50, num)
+	assert.Len(t, cache.Keys(), 50)
+
+	for i := 0; i < 50; i++ {
+		val, ok := cache.Get(i)
+		assert.True(t, ok)
+		assert.Equal(t, i*10, val)
+	}
+
+	_, _, ok := cache.RemoveOldest()
+	assert.True(t, ok)
+	assert.Equal(t, 49, cache.Len())
+
+	evicted := cache.Resize(40, 100)
+	assert.Equal(t, 29, evicted)
+	assert.Equal(t, 20, cache.Len())
+
+	cache.Purge()
+	assert.Equal(t, 0, cache.Len())
+	_, _, ok = cache.GetOldest()
+	assert.False(t, ok)
+}
+
+func TestShards_DistributeKeys(t *testing.T) {
+	keys := []interface{}{"key", 1, int8(2), int16(3), int32(4), int64(5), uint(6), uint8(7),
+		uint16(8), uint32(9), uint64(10), uintptr(11), [4]byte{1, 2, 3, 4}, struct{ a, b int }{1, 2}}
+	cache, _ := New(1000, 1000, WithShards(4))
+	for _, key := range keys {
+		assert.Equal(t, MapHasher.Hash(key), MapHasher.Hash(key))
+		assert.Equal(t, XXHasher.Hash(key), XXHasher.Hash(key))
+		cache.Add(key, key, 1)
+	}
+	for _, key := range keys {
+		val, ok := cache.Get(key)
+		assert.True(t, ok)
+		assert.Equal(t, key, val)
+	}
+
+	for i := 0; i < 1000; i++ {
+		cache.Add(i, i, 0)
+	}
+	for _, s := range cache.shards {
+		assert.Greater(t, s.lru.Len(), 150)
+	}
+}
+
+func TestNew_WithInitialCapacity(t *testing.T) {
+	_, err := New(10, 10, WithInitialCapacity(-1))
+	assert.Error(t, err)
+
+	cache, err := New(1000, 1000, WithInitialCapacity(100), WithShards(3))
+	assert.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		cache.Add(i, i, 1)
+	}
+	assert.Equal(t, 100, cache.Len())
+}
+
+func TestAppendKeys_ReusesBuffer(t *testing.T) {
+	cache, _ := New(5, 5)
+	cache.Add(1, 1, 1)
+	cache.Add(2, 2, 2)
+
+	buf := make([]interface{}, 0, 8)
+	keys := cache.AppendKeys(buf)
+	assert.Equal(t, []interface{}{1, 2}, keys)
+	assert.Equal(t, 0.0, testing.AllocsPerRun(10, func() {
+		cache.AppendKeys(buf[:0])
+	}))
+}
+
+func TestNew_WithHasher(t *testing.T) {
+	_, err := New(10, 10, WithHasher(nil))
+	assert.Error(t, err)
+
+	// A hasher placing all keys on the same shard.
+	cache, err := New(1000, 1000, WithShards(4), WithHasher(HasherFunc(func(interface{}) uint64 {
+		return 2
+	})))
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		cache.Add(i, i, 1)
+	}
+	assert.Equal(t, 10, cache.shards[2].lru.Len())
+
+	cache, _ = New(1000, 1000, WithShards(4), WithHasher(XXHasher))
+	for i := 0; i < 1000; i++ {
+		cache.Add(fmt.Sprint(i), i, 0)
+	}
+	for _, s := range cache.shards {
+		assert.Greater(t, s.lru.Len(), 150)
+	}
+}
+
+func TestHashKey_ConsistentWithEquality(t *testing.T) {
+	type node struct{ n int }
+	type pair struct {
+		a, b interface{}
+		_    int
+	}
+	n1, n2 := &node{1}, &node{1}
+	equal := [][2]interface{}{
+		{0.0, math.Copysign(0, -1)},
+		{float32(0), float32(math.Copysign(0, -1))},
+		{complex(0, 0), complex(math.Copysign(0, -1), 0)},
+		{pair{a: 0.0, b: "x"}, pair{a: math.Copysign(0, -1), b: "x"}},
+		{[2]float64{0, 1}, [2]float64{math.Copysign(0, -1), 1}},
+		{pair{a: n1}, pair{a: n1}},
+	}
+	for _, h := range []Hasher{MapHasher, XXHasher} {
+		for _, keys := range equal {
+			assert.Equal(t, keys[0], keys[1])
+			assert.Equal(t, h.Hash(keys[0]), h.Hash(keys[1]), "%v", keys)
+		}
+		// Pointers are hashed by address, not by what they point to.
+		hash := h.Hash(n1)
+		n1.n = 2
+		assert.Equal(t, hash, h.Hash(n1))
+		assert.NotEqual(t, h.Hash(n1), h.Hash(n2))
+
+		assert.Panics(t, func() { h.Hash(pair{a: []int{1}}) })
+	}
+}
+
+func TestShards_PointerKeys(t *testing.T) {
+	type node struct{ n int }
+	cache, _ := New(100, 100, WithShards(8))
+	keys := make([]*node, 16)
+	for i := range keys {
+		keys[i] = &node{i}
+		cache.Add(keys[i], i, 1)
+	}
+	for i, k := range keys {
+		k.n = i + 100
+		val, ok := cache.Get(k)
+		assert.True(t, ok)
+		assert.Equal(t, i, val)
+	}
+	for _, k := range keys {
+		assert.True(t, cache.Remove(k))
+	}
+	assert.Equal(t, 0, cache.Len())
+
+	cache.Add(0.0, "a", 1)
+	cache.Add(math.Copysign(0, -1), "b", 1)
+	assert.Equal(t, 1, cache.Len())
+	val, _ := cache.Get(0.0)
+	assert.Equal(t, "b", val)
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	cache, _ := New(10, 10)
+	assert.False(t, cache.CompareAndSwap(1, nil, "A", 1))
+
+	cache.Add(1, "A", 1)
+	assert.False(t, cache.CompareAndSwap(1, "B", "C", 1))
+	assert.True(t, cache.CompareAndSwap(1, "A", "B", 3))
+
+	val, _ := cache.Peek(1)
+	assert.Equal(t, "B", val)
+	assert.Equal(t, uint(3), cache.Weight())
+
+	// An entry too heavy for the cache is removed rather than swapped.
+	assert.False(t, cache.CompareAndSwap(1, "B", "C", 100))
+	assert.False(t, cache.Contains(1))
+}
+
+func TestCompareAndDelete(t *testing.T) {
+	cache, _ := New(10, 10)
+	assert.False(t, cache.CompareAndDelete(1, "A"))
+
+	cache.Add(1, "A", 1)
+	assert.False(t, cache.CompareAndDelete(1, "B"))
+	assert.True(t, cache.Contains(1))
+	assert.True(t, cache.CompareAndDelete(1, "A"))
+	assert.False(t, cache.Contains(1))
+	assert.Equal(t, 0, cache.Len())
+}
+
+func TestCompareAndSwap_Concurrent(t *testing.T) {
+	cache, _ := New(10, 10, WithShards(2))
+	cache.Add("counter", 0, 1)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				for {
+					val, _ := cache.Peek("counter")
+					if cache.CompareAndSwap("counter", val, val.(int)+1, 1) {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	val, _ := cache.Peek("counter")
+	assert.Equal(t, 400, val)
+}
+
+func TestVersions_DetectStaleFills(t *testing.T) {
+	cache, _ := New(10, 10, WithShards(2))
+	v1, _ := cache.AddWithVersion(1, "A", 1)
+
+	val, version, ok := cache.GetWithVersion(1)
+	assert.True(t, ok)
+	assert.Equal(t, "A", val)
+	assert.Equal(t, v1, version)
+
+	v2, _ := cache.AddWithVersion(1, "B", 1)
+	assert.Greater(t, v2, v1)
+	_, ok, _ = cache.AddIfVersion(1, "stale", 1, v1)
+	assert.False(t, ok)
+
+	_, version, ok = cache.GetWithVersion(2)
+	assert.False(t, ok)
+	v3, ok, _ := cache.AddIfVersion(2, "C", 1, version)
+	assert.True(t, ok)
+	val, _ = cache.Peek(2)
+	assert.Equal(t, "C", val)
+
+	cache.Remove(2)
+	_, ok, _ = cache.AddIfVersion(2, "stale", 1, v3)
+	assert.False(t, ok)
+	assert.False(t, cache.Contains(2))
+}
+
+func TestAddIfAbsent(t *testing.T) {
+	cache, _ := New(3, 5)
+	added, evicted := cache.AddIfAbsent(1, "A", 2)
+	assert.True(t, added)
+	assert.Equal(t, 0, evicted)
+
+	added, _ = cache.AddIfAbsent(1, "B", 1)
+	assert.False(t, added)
+	val, _ := cache.Peek(1)
+	assert.Equal(t, "A", val)
+
+	added, evicted = cache.AddIfAbsent(2, "C", 2)
+	assert.True(t, added)
+	assert.Equal(t, 1, evicted)
+}
+
+func TestReplace(t *testing.T) {
+	cache, _ := New(5, 5)
+	assert.False(t, cache.Replace(1, "A", 1))
+	assert.False(t, cache.Contains(1))
+
+	cache.Add(1, "A", 1)
+	assert.True(t, cache.Replace(1, "B", 2))
+	val, _ := cache.Peek(1)
+	assert.Equal(t, "B", val)
+	assert.Equal(t, uint(2), cache.Weight())
+
+	cache.Remove(1)
+	assert.False(t, cache.Replace(1, "C", 1))
+	assert.False(t, cache.Contains(1))
+
+	// An entry too heavy for the cache is removed rather than replaced.
+	cache.Add(1, "A", 1)
+	assert.False(t, cache.Replace(1, "D", 100))
+	assert.False(t, cache.Contains(1))
+}
+
+func TestHeaviestEntries(t *testing.T) {
+	for _, shards := range []int{1, 4} {
+		cache, _ := New(1000, 100, WithShards(shards))
+		for i := 0; i < 20; i++ {
+			cache.Add(i, i, uint(i%10+1))
+		}
+		entries := cache.HeaviestEntries(4)
+		assert.Len(t, entries, 4)
+		for i, e := range entries {
+			assert.Equal(t, uint(10-i/2), e.Weight)
+		}
+		// Of equally heavy entries, the least recently used come first.
+		assert.Equal(t, []interface{}{9, 19}, []interface{}{entries[0].Key, entries[1].Key})
+		cache.Get(9)
+		entries = cache.HeaviestEntries(2)
+		assert.Equal(t, []interface{}{19, 9}, []interface{}{entries[0].Key, entries[1].Key})
+		assert.Len(t, cache.HeaviestEntries(100), 20)
+		assert.Empty(t, cache.HeaviestEntries(0))
+	}
+}
+
+func TestPeekOldestN(t *testing.T) {
+	for _, shards := range []int{1, 4} {
+		cache, _ := New(100, 100, WithShards(shards))
+		for i := 0; i < 10; i++ {
+			cache.Add(i, i, 1)
+		}
+		time.Sleep(time.Millisecond)
+		for i := 10; i < 20; i++ {
+			cache.Add(i, i, 1)
+		}
+		entries := cache.PeekOldestN(10)
+		assert.Len(t, entries, 10)
+		for _, e := range entries {
+			assert.Less(t, e.Key, 10)
+			assert.GreaterOrEqual(t, e.Age, time.Millisecond)
+		}
+		assert.Len(t, cache.PeekOldestN(100), 20)
+		assert.Empty(t, cache.PeekOldestN(-1))
+
+		// Entries are ordered by use across shards.
+		cache.Get(0)
+		var keys []interface{}
+		for _, e := range cache.PeekOldestN(3) {
+			keys = append(keys, e.Key)
+		}
+		assert.Equal(t, []interface{}{1, 2, 3}, keys)
+	}
+}
+
+func TestNewest_Operations(t *testing.T) {
+	cache, _ := New(5, 5)
+	_, _, ok := cache.PeekNewest()
+	assert.False(t, ok)
+
+	cache.Add(1, 1, 1)
+	cache.Add(2, 2, 2)
+
+	k, v, ok := cache.PeekNewest()
+	assert.True(t, ok)
+	assert.Equal(t, 2, k)
+	assert.Equal(t, 2, v)
+
+	cache.Get(1)
+	k, _, ok = cache.GetNewest()
+	assert.True(t, ok)
+	assert.Equal(t, 1, k)
+}
+
+func TestOldestAndNewest_Shards(t *testing.T) {
+	cache, _ := New(1000, 100, WithShards(8))
+	for i := 0; i < 16; i++ {
+		cache.Add(i, i, uint(16-i))
+	}
+	cache.Get(0)
+	cache.Peek(1)
+
+	k, _, ok := cache.GetOldest()
+	assert.True(t, ok)
+	assert.Equal(t, 1, k)
+	e, ok := cache.GetOldestEntry()
+	assert.True(t, ok)
+	assert.Equal(t, 1, e.Key)
+	k, _, ok = cache.PeekNewest()
+	assert.True(t, ok)
+	assert.Equal(t, 0, k)
+
+	cache.Get(5)
+	k, _, ok = cache.GetNewest()
+	assert.True(t, ok)
+	assert.Equal(t, 5, k)
+
+	k, _, ok = cache.RemoveOldest()
+	assert.True(t, ok)
+	assert.Equal(t, 1, k)
+	e, ok = cache.RemoveOldestEntry()
+	assert.True(t, ok)
+	assert.Equal(t, 2, e.Key)
+	assert.Equal(t, 14, cache.Len())
+}
+
+func TestKeysNewestFirst_Order(t *testing.T) {
+	cache, _ := New(5, 5)
+	cache.Add(1, 1, 1)
+	cache.Add(2, 2, 2)
+	cache.Add(3, 3, 1)
+	cache.Get(1)
+
+	assert.Equal(t, []interface{}{1, 3, 2}, cache.KeysNewestFirst())
+}
+
+func TestRangeNewestFirst_EarlyExit(t *testing.T) {
+	cache, _ := New(100, 100)
+	for i := 0; i < 10; i++ {
+		cache.Add(i, i*10, 1)
+	}
+
+	var visited []interface{}
+	cache.RangeNewestFirst(func(key, value interface{}) bool {
+		assert.Equal(t, key.(int)*10, value)
+		visited = append(visited, key)
+		return len(visited) < 3
+	})
+	assert.Equal(t, []interface{}{9, 8, 7}, visited)
+
+	sharded, _ := New(100, 100, WithShards(4))
+	for i := 0; i < 10; i++ {
+		sharded.Add(i, i, 1)
+	}
+	count := 0
+	sharded.RangeNewestFirst(func(key, value interface{}) bool {
+		count++
+		return count < 5
+	})
+	assert.Equal(t, 5, count)
+}
+
+func TestRangeNewestFirst_MayModifyCache(t *testing.T) {
+	cache, _ := New(100, 100)
+	for i := 0; i < 10; i++ {
+		cache.Add(i, i, 1)
+	}
+
+	count := 0
+	cache.RangeNewestFirst(func(key, value interface{}) bool {
+		count++
+		cache.Remove(key)
+		cache.Add(key.(int)+100, value, 1)
+		return true
+	})
+	assert.Equal(t, 10, count)
+	assert.Equal(t, 10, cache.Len())
+	for i := 0; i < 10; i++ {
+		assert.True(t, cache.Contains(i+100))
+	}
+}
+
+func TestClone_IsIndependent(t *testing.T) {
+	var evicted []interface{}
+	cache, _ := NewWithEvict(100, 100, func(key, value interface{}) {
+		evicted = append(evicted, key)
+	}, WithShards(2))
+	for i := 0; i < 10; i++ {
+		cache.Add(i, i, 2)
+	}
+	cache.Get(0)
+
+	clone := cache.Clone()
+	assert.Equal(t, cache.Keys(), clone.Keys())
+	assert.Equal(t, cache.Len(), clone.Len())
+	assert.Equal(t, cache.Weight(), clone.Weight())
+
+	clone.Remove(1)
+	clone.Add(100, 100, 1)
+	assert.True(t, cache.Contains(1))
+	assert.False(t, cache.Contains(100))
+	assert.False(t, clone.Contains(1))
+	val, ok := clone.Peek(100)
+	assert.True(t, ok)
+	assert.Equal(t, 100, val)
+	assert.Equal(t, []interface{}{1}, evicted)
+}
+
+func TestMergeFrom_Policies(t *testing.T) {
+	cache, _ := New(100, 100, WithShards(4))
+	cache.Add(1, "old", 1)
+	time.Sleep(time.Millisecond)
+	other, _ := New(100, 100, WithShards(3))
+	for i := 0; i < 10; i++ {
+		other.Add(i, "new", 1)
+	}
+
+	kept := cache.Clone()
+	kept.MergeFrom(other, KeepExisting)
+	val, _ := kept.Peek(1)
+	assert.Equal(t, "old", val)
+	assert.Equal(t, 10, kept.Len())
+
+	cache.MergeFrom(other, KeepNewer)
+	val, _ = cache.Peek(1)
+	assert.Equal(t, "new", val)
+	assert.Equal(t, 10, cache.Len())
+	assert.Equal(t, uint(10), cache.Weight())
+
+	small, _ := New(5, 5)
+	assert.Equal(t, 5, small.MergeFrom(other, KeepNewer))
+	assert.Equal(t, 5, small.Len())
+}
+
+func TestSnapshot_Filtered(t *testing.T) {
+	for _, shards := range []int{1, 4} {
+		// Entries are ordered by use, not by the time they were written.
+		cache, _ := New(100, 100, WithShards(shards), WithClock(clock.NewFake(time.Unix(0, 0))))
+		for i := 0; i < 10; i++ {
+			cache.Add(i, i, 1)
+		}
+		entries := cache.Snapshot(SnapshotFilter{})
+		assert.Len(t, entries, 10)
+		for i, e := range entries {
+			assert.Equal(t, i, e.Key)
+		}
+
+		entries = cache.Snapshot(SnapshotFilter{
+			Include:    func(key, value interface{}) bool { return key.(int) != 9 },
+			MaxEntries: 3,
+		})
+		var keys []interface{}
+		for _, e := range entries {
+			keys = append(keys, e.Key)
+		}
+		assert.Equal(t, []interface{}{6, 7, 8}, keys)
+
+		cache.Get(0)
+		keys = keys[:0]
+		for _, e := range cache.Snapshot(SnapshotFilter{MaxEntries: 3}) {
+			keys = append(keys, e.Key)
+		}
+		assert.Equal(t, []interface{}{8, 9, 0}, keys)
+	}
+}
+
+func TestOldestEntry(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	cache, _ := New(10, 10, WithClock(fake))
+	_, ok := cache.GetOldestEntry()
+	assert.False(t, ok)
+	cache.Add(1, "A", 3)
+	fake.Advance(time.Second)
+	cache.Add(2, "B", 2)
+
+	want := Entry{Key: 1, Value: "A", Weight: 3, Age: time.Second, Recency: 1}
+	entry, ok := cache.GetOldestEntry()
+	assert.True(t, ok)
+	assert.Equal(t, want, entry)
+	entry, ok = cache.RemoveOldestEntry()
+	assert.True(t, ok)
+	assert.Equal(t, want, entry)
+	assert.False(t, cache.Contains(1))
+	assert.Equal(t, uint(2), cache.Weight())
+}
+
+func TestNew_WithClock(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	c, err := New(100, 100, WithShards(4), WithClock(fake))
+	assert.NoError(t, err)
+	c.Add("a", 1, 1)
+	fake.Advance(time.Minute)
+	c.Add("b", 2, 1)
+
+	entries := c.PeekOldestN(2)
+	assert.Equal(t, []interface{}{"a", "b"}, []interface{}{entries[0].Key, entries[1].Key})
+	assert.Equal(t, time.Minute, entries[0].Age)
+	assert.Equal(t, time.Duration(0), entries[1].Age)
+
+	_, err = New(100, 100, WithClock(nil))
+	assert.Error(t, err)
+}
+
+func TestCache_RecalculateWeights(t *testing.T) {
+	parity := HasherFunc(func(key interface{}) uint64 { return uint64(key.(int)) })
+	c, _ := New(20, 100, WithShards(2), WithHasher(parity))
+	for i := 0; i < 10; i++ {
+		c.Add(i, i, 1)
+	}
+	assert.Equal(t, uint(10), c.Weight())
+
+	evicted := c.RecalculateWeights(func(key, value interface{}) uint { return 3 })
+	assert.Equal(t, 4, evicted)
+	assert.Equal(t, 6, c.Len())
+	assert.Equal(t, uint(18), c.Weight())
+	for _, key := range c.Keys() {
+		_, ok := c.Peek(key)
+		assert.True(t, ok)
+	}
+}
+
+func TestCache_EvictTo(t *testing.T) {
+	c, _ := New(100, 100, WithShards(2))
+	for i := 0; i < 10; i++ {
+		c.Add(i, i, 1)
+	}
+	evicted := c.EvictTo(4)
+	assert.Equal(t, 10-c.Len(), evicted)
+	assert.LessOrEqual(t, c.Weight(), uint(4))
+	for i := 0; i < 10; i++ {
+		c.Add(i, i, 1)
+	}
+	assert.Equal(t, 10, c.Len())
+}
+
+func TestNew_WithWriteBuffer(t *testing.T) {
+	_, err := New(10, 10, WithWriteBuffer(-1))
+	assert.Error(t, err)
+
+	var evicted []interface{}
+	cache, err := NewWithEvict(10, 10, func(key, value interface{}) {
+		evicted = append(evicted, key)
+	}, WithWriteBuffer(4))
+	assert.NoError(t, err)
+	for i := 0; i < 12; i++ {
+		assert.Equal(t, 0, cache.Add(i, i, 1))
+	}
+	cache.Wait()
+	assert.Equal(t, 10, cache.Len())
+	assert.Equal(t, []interface{}{0, 1}, evicted)
+	val, ok := cache.Get(11)
+	assert.True(t, ok)
+	assert.Equal(t, 11, val)
+	cache.Wait()
+}
+
+func TestWriteBuffer_ConcurrentWriters(t *testing.T) {
+	cache, _ := New(1000, 1000, WithWriteBuffer(16), WithShards(4))
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				cache.Add(w*100+i, i, 1)
+			}
+		}(w)
+	}
+	wg.Wait()
+	cache.Wait()
+	assert.Equal(t, 800, cache.Len())
+	assert.Equal(t, uint(800), cache.Weight())
+	for w := 0; w < 8; w++ {
+		assert.True(t, cache.Contains(w*100+99))
+	}
+}
+
+func TestWriteBuffer_CallbackMayAddToFullBuffer(t *testing.T) {
+	var cache *Cache
+	cache, _ = NewWithEvict(2, 2, func(key, value interface{}) {
+		// The applier runs this for the evictions of buffered writes, so
+		// these writes find the buffer full.
+		if key.(int) < 100 {
+			for i := 1; i <= 4; i++ {
+				cache.Add(key.(int)+100*i, value, 1)
+			}
+		}
+	}, WithShards(1), WithWriteBuffer(1))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			cache.Add(i, i, 1)
+		}
+		cache.Wait()
+		assert.NoError(t, cache.Close())
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("deadlock on re-entering the write buffer")
+	}
+	assert.Equal(t, 2, cache.Len())
+}
+
+func TestWait_WithoutWriteBuffer(t *testing.T) {
+	cache, _ := New(10, 10)
+	assert.Equal(t, 0, cache.Add(1, 1, 1))
+	cache.Wait()
+	assert.True(t, cache.Contains(1))
+}
+
+func TestNew_WithReadBuffer(t *testing.T) {
+	_, err := New(10, 10, WithReadBuffer(-1))
+	assert.Error(t, err)
+
+	cache, err := New(3, 3, WithReadBuffer(2))
+	assert.NoError(t, err)
+	cache.Add(1, "A", 1)
+	cache.Add(2, "B", 1)
+	cache.Add(3, "C", 1)
+
+	// The promotion of a buffered read is deferred.
+	val, ok := cache.Get(1)
+	assert.True(t, ok)
+	assert.Equal(t, "A", val)
+	_, ok = cache.Get(4)
+	assert.False(t, ok)
+	assert.Equal(t, []interface{}{1, 2, 3}, cache.Keys())
+
+	// Filling the buffer applies the recorded reads in order.
+	cache.Get(2)
+	assert.Equal(t, []interface{}{3, 1, 2}, cache.Keys())
+
+	cache.Get(3)
+	cache.Wait()
+	assert.Equal(t, []interface{}{1, 2, 3}, cache.Keys())
+	cache.Add(4, "D", 1)
+	assert.False(t, cache.Contains(1))
+}
+
+func TestReadBuffer_ConcurrentWithWriters(t *testing.T) {
+	cache, _ := New(100, 50, WithReadBuffer(8), WithShards(2))
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				if w%2 == 0 {
+					cache.Add(i%100, i, 1)
+				} else {
+					cache.Get(i % 100)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	cache.Wait()
+	assert.LessOrEqual(t, cache.Len(), 50)
+	assert.Equal(t, cache.Len(), len(cache.Keys()))
+}
+
+func TestNew_WithLatencyTracking(t *testing.T) {
+	cache, _ := New(10, 10)
+	cache.Add(1, 1, 1)
+	assert.Equal(t, LatencyStats{}, cache.Latencies())
+
+	cache, _ = New(10, 10, WithLatencyTracking())
+	for i := 0; i < 5; i++ {
+		cache.Add(i, i, 1)
+		cache.Get(i)
+		cache.Get(i + 100)
+	}
+	cache.Remove(0)
+
+	stats := cache.Latencies()
+	assert.Equal(t, uint64(5), stats.Add.Count)
+	assert.Equal(t, uint64(10), stats.Get.Count)
+	assert.Equal(t, uint64(1), stats.Remove.Count)
+	assert.LessOrEqual(t, stats.Get.Quantile(0.5), stats.Get.Quantile(1))
+	assert.Greater(t, stats.Get.Quantile(1), stats.Get.Mean())
+}
+
+func TestHistogram_Quantile(t *testing.T) {
+	var h Histogram
+	assert.Zero(t, h.Quantile(0.5))
+	assert.Zero(t, h.Mean())
+
+	h.Buckets[3] = 90 // 4ns to 8ns
+	h.Buckets[10] = 10
+	h.Count = 100
+	h.Sum = 1000
+	assert.Equal(t, 10*time.Nanosecond, h.Mean())
+	assert.Equal(t, 8*time.Nanosecond, h.Quantile(0))
+	assert.Equal(t, 8*time.Nanosecond, h.Quantile(0.89))
+	assert.Equal(t, 1024*time.Nanosecond, h.Quantile(0.9))
+	assert.Equal(t, 1024*time.Nanosecond, h.Quantile(1))
+}
+
+func TestFreeze_IsolatedFromWrites(t *testing.T) {
+	cache, _ := New(100, 100, WithShards(2))
+	cache.Add(1, "A", 1)
+	cache.Add(2, "B", 1)
+	cache.Add(3, "C", 1)
+
+	frozen := cache.Freeze()
+	cache.Add(1, "X", 1)
+	cache.Remove(2)
+	cache.Add(4, "D", 1)
+	cache.Purge()
+	cache.Add(5, "E", 1)
+
+	assert.Equal(t, 3, frozen.Len())
+	assert.Equal(t, uint(3), frozen.Weight())
+	val, ok := frozen.Get(1)
+	assert.True(t, ok)
+	assert.Equal(t, "A", val)
+	assert.True(t, frozen.Contains(2))
+	assert.False(t, frozen.Contains(4))
+	assert.False(t, frozen.Contains(5))
+
+	entries := map[interface{}]interface{}{}
+	frozen.Range(func(key, value interface{}) bool {
+		entries[key] = value
+		return true
+	})
+	assert.Equal(t, map[interface{}]interface{}{1: "A", 2: "B", 3: "C"}, entries)
+
+	count := 0
+	frozen.Range(func(key, value interface{}) bool {
+		count++
+		return false
+	})
+	assert.Equal(t, 1, count)
+
+	later := cache.Freeze()
+	assert.Len(t, cache.frozenViews(), 2)
+	frozen.Release()
+	later.Release()
+	assert.Nil(t, cache.frozen.Load())
+}
+
+func TestFreeze_ConcurrentWithWriters(t *testing.T) {
+	cache, _ := New(1000, 1000, WithShards(4))
+	for i := 0; i < 100; i++ {
+		cache.Add(i, i, 1)
+	}
+	frozen := cache.Freeze()
+	defer frozen.Release()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 2000; i++ {
+			if i%3 == 0 {
+				cache.Remove(i % 100)
+			} else {
+				cache.Add(i%150, -i, 1)
+			}
+		}
+	}()
+	for round := 0; round < 20; round++ {
+		seen := 0
+		frozen.Range(func(key, value interface{}) bool {
+			assert.Equal(t, key, value)
+			seen++
+			return true
+		})
+		assert.Equal(t, 100, seen)
+	}
+	wg.Wait()
+	for i := 0; i < 100; i++ {
+		val, ok := frozen.Get(i)
+		assert.True(t, ok)
+		assert.Equal(t, i, val)
+	}
+}
+
+func TestShardStats(t *testing.T) {
+	parity := HasherFunc(func(key interface{}) uint64 { return uint64(key.(int)) })
+	cache, _ := New(100, 100, WithShards(2), WithHasher(parity), WithHitTracking())
+	cache.Add(0, 0, 5)
+	cache.Add(2, 2, 5)
+	cache.Add(1, 1, 1)
+	cache.Get(0)
+	cache.Get(2)
+	cache.Get(4)
+	cache.Get(3)
+
+	stats := cache.ShardStats()
+	assert.Equal(t, []ShardStats{
+		{Len: 2, Weight: 10, Hits: 2, Misses: 1},
+		{Len: 1, Weight: 1, Misses: 1},
+	}, stats)
+	assert.InDelta(t, 2.0/3, stats[0].HitRatio(), 1e-9)
+	assert.Zero(t, stats[1].HitRatio())
+
+	untracked, _ := New(100, 100, WithShards(2))
+	untracked.Get(0)
+	for _, s := range untracked.ShardStats() {
+		assert.Zero(t, s.Hits+s.Misses)
+	}
+}
+
+func TestOrderedEntries_Contract(t *testing.T) {
+	orderedKeys := func(c *Cache) []interface{} {
+		var keys []interface{}
+		for _, e := range c.OrderedEntries() {
+			keys = append(keys, e.Key)
+		}
+		return keys
+	}
+
+	cache, _ := New(100, 100)
+	for i := 0; i < 4; i++ {
+		cache.Add(i, i, 1)
+	}
+	cache.Peek(0)
+	cache.Contains(0)
+	ok, _ := cache.ContainsOrAdd(0, 0, 1)
+	assert.True(t, ok)
+	_, ok, _ = cache.PeekOrAdd(0, 0, 1)
+	assert.True(t, ok)
+	assert.Equal(t, []interface{}{0, 1, 2, 3}, orderedKeys(cache))
+
+	cache.Get(0)
+	cache.Add(1, 10, 1)
+	cache.ContainsOrAdd(4, 4, 1)
+	assert.Equal(t, []interface{}{2, 3, 0, 1, 4}, orderedKeys(cache))
+
+	parity := HasherFunc(func(key interface{}) uint64 { return uint64(key.(int)) })
+	sharded, _ := New(100, 100, WithShards(2), WithHasher(parity))
+	for _, key := range []int{3, 2, 1, 0} {
+		sharded.Add(key, key, 1)
+	}
+	sharded.Get(2)
+	entries := sharded.OrderedEntries()
+	assert.Equal(t, []interface{}{0, 2, 3, 1}, orderedKeys(sharded))
+
+	restored, _ := New(100, 100, WithShards(2), WithHasher(parity))
+	for _, e := range entries {
+		restored.Add(e.Key, e.Value, e.Weight)
+	}
+	assert.Equal(t, orderedKeys(sharded), orderedKeys(restored))
+}
+
+func TestGetOrAddFunc_ConstructsOnlyOnMiss(t *testing.T) {
+	c, _ := New(10, 10)
+	c.Add("a", 1, 1)
+	value, found, _ := c.GetOrAddFunc("a", func() (interface{}, uint) {
+		t.Fatal("constructed a cached value")
+		return nil, 0
+	})
+	assert.Equal(t, 1, value)
+	assert.True(t, found)
+
+	value, found, evicted := c.GetOrAddFunc("b", func() (interface{}, uint) {
+		return 2, 1
+	})
+	assert.Equal(t, 2, value)
+	assert.False(t, found)
+	assert.Equal(t, 0, evicted)
+	value, _ = c.Get("b")
+	assert.Equal(t, 2, value)
+}
+
+func TestGetOrAddFunc_ConcurrentCallsConstructOnce(t *testing.T) {
+	c, _ := New(10, 10)
+	release := make(chan struct{})
+	var constructed atomic.Int32
+	var wg sync.WaitGroup
+	values := make([]interface{}, 8)
+	for i := range values {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			values[i], _, _ = c.GetOrAddFunc("a", func() (interface{}, uint) {
+				constructed.Add(1)
+				<-release
+				return "value", 1
+			})
+		}(i)
+	}
+
+	// A slow constructor blocks neither other keys nor their shard.
+	value, found, _ := c.GetOrAddFunc("b", func() (interface{}, uint) {
+		return "other", 1
+	})
+	assert.Equal(t, "other", value)
+	assert.False(t, found)
+	c.Add("c", 3, 1)
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), constructed.Load())
+	for _, v := range values {
+		assert.Equal(t, "value", v)
+	}
+}
+
+func TestGetOrAddFunc_KeepsValueAddedMeanwhile(t *testing.T) {
+	c, _ := New(10, 10)
+	value, found, _ := c.GetOrAddFunc("a", func() (interface{}, uint) {
+		c.Add("a", "added", 1)
+		return "constructed", 1
+	})
+	assert.Equal(t, "added", value)
+	assert.True(t, found)
+}
+
+func TestGetOrAddFunc_RetriesAfterPanic(t *testing.T) {
+	c, _ := New(10, 10)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan interface{})
+	go func() {
+		defer func() { done <- recover() }()
+		c.GetOrAddFunc("a", func() (interface{}, uint) {
+			close(started)
+			<-release
+			panic("boom")
+		})
+	}()
+	<-started
+	result := make(chan interface{})
+	go func() {
+		value, _, _ := c.GetOrAddFunc("a", func() (interface{}, uint) {
+			return "retried", 1
+		})
+		result <- value
+	}()
+	close(release)
+	assert.Equal(t, "boom", <-done)
+	assert.Equal(t, "retried", <-result)
+}